@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,14 +11,19 @@ import (
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/go-pkgz/lgr"
 	"github.com/hashicorp/go-multierror"
 	"github.com/jessevdk/go-flags"
+	"github.com/kevinburke/ssh_config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 
 	"github.com/umputun/spot/pkg/config"
@@ -33,11 +39,22 @@ type options struct {
 
 	PlaybookFile string        `short:"p" long:"playbook" env:"SPOT_PLAYBOOK" description:"playbook file" default:"spot.yml"`
 	TaskNames    []string      `short:"n" long:"task" description:"task name"`
+	NoDeps       bool          `long:"no-deps" description:"don't run task dependencies"`
 	Targets      []string      `short:"t" long:"target" description:"target name" default:"default"`
 	Concurrent   int           `short:"c" long:"concurrent" description:"concurrent tasks" default:"1"`
+	Serial       string        `long:"serial" description:"hosts per batch for rolling runs, number or percentage"`
+	MaxFail      int           `long:"max-fail-percentage" description:"stop if percentage of failed hosts exceeds it"`
+	KeepGoing    bool          `long:"keep-going" description:"keep running on healthy hosts if some hosts failed"`
+	GatherFacts  bool          `long:"gather-facts" description:"gather host facts for all tasks"`
+	BecomePass   bool          `short:"K" long:"ask-become-pass" description:"ask for sudo, su or doas password"`
 	SSHTimeout   time.Duration `long:"timeout" env:"SPOT_TIMEOUT" description:"ssh timeout" default:"30s"`
 	SSHAgent     bool          `long:"ssh-agent" env:"SPOT_SSH_AGENT" description:"use ssh-agent"`
+	AskPass      bool          `long:"ask-pass" description:"ask for ssh password, or set it with SPOT_SSH_PASSWORD env"`
 	SSHShell     string        `long:"shell" env:"SPOT_SHELL" description:"shell to use for ssh" default:"/bin/sh"`
+	HostKeyCheck string        `long:"host-key-check" env:"SPOT_HOST_KEY_CHECK" description:"host key check [strict|accept-new|off]"`
+	KnownHosts   string        `long:"known-hosts" env:"SPOT_KNOWN_HOSTS" description:"known_hosts file for host key verification"`
+	ProxyJump    string        `long:"proxy-jump" env:"SPOT_PROXY_JUMP" description:"jump hosts, comma-separated [user@]host[:port]"`
+	SSHConfig    string        `long:"ssh-config" env:"SPOT_SSH_CONFIG" description:"ssh config file, none to disable" default:"~/.ssh/config"`
 
 	// overrides
 	Inventory string            `short:"i" long:"inventory" description:"inventory file or url [$SPOT_INVENTORY]"`
@@ -58,6 +75,10 @@ type options struct {
 	GenTemplate string `long:"gen.template" description:"template file" default:"json"`
 	GenOutput   string `long:"gen.output" description:"output file" default:"stdout"`
 
+	// machine-readable report of the run
+	Report       string `long:"report" description:"write run report [json|junit]" choice:"json" choice:"junit"`
+	ReportOutput string `long:"report.output" description:"report output file, required with --report"`
+
 	Version bool `long:"version" description:"show version"`
 
 	NoColor bool `long:"no-color" env:"SPOT_NO_COLOR" description:"disable color output"`
@@ -118,11 +139,16 @@ func main() {
 	}
 }
 
-func run(opts options) error {
+func run(opts options) (err error) {
 	if opts.Dry {
 		printDryRunWarn(opts.Dbg)
 	}
 
+	if opts.Report != "" && !opts.GenEnable && opts.ReportOutput == "" {
+		// report is not written to stdout, as it would be mixed with the regular output
+		return errors.New("report output file is required, set it with --report.output")
+	}
+
 	st := time.Now()
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -132,32 +158,66 @@ func run(opts options) error {
 		return fmt.Errorf("can't get inentory %q: %w", opts.Inventory, err)
 	}
 
-	pbook, err := makePlaybook(opts, inventoryFile)
+	// ssh config is used by playbook to resolve host aliases and by connector to get their identity files
+	sshConf, err := sshConfig(opts.SSHConfig)
+	if err != nil {
+		return fmt.Errorf("can't load ssh config: %w", err)
+	}
+
+	pbook, err := makePlaybook(opts, inventoryFile, sshConf)
 	if err != nil {
 		return fmt.Errorf("can't get playbook %q: %w", opts.PlaybookFile, err)
 	}
 
+	creds, err := makeCredentials(opts, pbook)
+	if err != nil {
+		return fmt.Errorf("can't get credentials: %w", err)
+	}
+
 	// secrets are known only after playbook is loaded
-	setupLog(opts.Dbg, pbook.AllSecretValues()...) // mask secrets in logs
+	setupLog(opts.Dbg, append(pbook.AllSecretValues(), creds.secrets()...)...) // mask secrets and passwords in logs
 
-	r, err := makeRunner(opts, pbook)
+	r, err := makeRunner(opts, pbook, creds, sshConf)
 	if err != nil {
 		return fmt.Errorf("can't make runner: %w", err)
 	}
+	if closer, ok := r.Connector.(io.Closer); ok {
+		// pooled connections are reused by all tasks and closed at the end of the run
+		defer func() {
+			if e := closer.Close(); e != nil {
+				log.Printf("[WARN] can't close connections: %v", e)
+			}
+		}()
+	}
 
-	if opts.PositionalArgs.AdHocCmd != "" { // run ad-hoc command
-		if r.Playbook, err = setAdHocSSH(opts, pbook); err != nil {
-			return fmt.Errorf("can't setup ad-hoc ssh params: %w", err)
-		}
-		return runAdHoc(ctx, opts.Targets, r)
+	if opts.Report != "" && !opts.GenEnable {
+		// collect results of all tasks and write the report at the end, even if the run failed
+		r.Report = &runner.Report{Secrets: append(pbook.AllSecretValues(), creds.secrets()...)}
+		defer func() {
+			if repErr := writeReport(opts.Report, opts.ReportOutput, r.Report); repErr != nil && err == nil {
+				err = repErr
+			}
+		}()
 	}
 
 	if opts.GenEnable {
 		// generate a list of destination from inventory targets
-		return runGen(opts, r)
+		return runGen(ctx, opts, r)
+	}
+
+	rcp := newRecap()
+	if opts.PositionalArgs.AdHocCmd != "" { // run ad-hoc command
+		if r.Playbook, err = setAdHocSSH(opts, pbook); err != nil {
+			return fmt.Errorf("can't setup ad-hoc ssh params: %w", err)
+		}
+		err = runAdHoc(ctx, opts.Targets, r, rcp)
+		rcp.print(os.Stdout, time.Since(st))
+		return err
 	}
 
-	if err := runTasks(ctx, opts.TaskNames, opts.Targets, r); err != nil {
+	err = runTasks(ctx, opts.TaskNames, opts.Targets, opts.NoDeps, r, rcp)
+	rcp.print(os.Stdout, time.Since(st))
+	if err != nil {
 		return err
 	}
 
@@ -165,36 +225,93 @@ func run(opts options) error {
 	return nil
 }
 
-// runTasks runs all tasks in playbook by default or a single task if specified in command line
-func runTasks(ctx context.Context, taskNames, targets []string, r *runner.Process) error {
-	// run specified tasks if there is any
-	if len(taskNames) > 0 {
-		for _, taskName := range taskNames {
-			for _, targetName := range targetsForTask(targets, taskName, r.Playbook) {
-				if err := runTaskForTarget(ctx, r, taskName, targetName); err != nil {
-					return err
-				}
+// runTasks runs all tasks in playbook by default or a single task if specified in command line.
+// Unless noDeps is set, tasks' dependencies (depends_on) are added and run before the tasks depending on them.
+// In keep-going mode, set by cli or by the task, a failed task doesn't stop the next tasks, errors of all tasks
+// are returned together.
+func runTasks(ctx context.Context, taskNames, targets []string, noDeps bool, r *runner.Process, rcp *recap) error {
+	if len(taskNames) == 0 {
+		// run all tasks in playbook if no task specified
+		for _, task := range r.Playbook.AllTasks() {
+			taskNames = append(taskNames, task.Name)
+		}
+	}
+
+	if !noDeps {
+		var err error
+		if taskNames, err = withDependencies(taskNames, r.Playbook); err != nil {
+			return err
+		}
+	}
+
+	errs := new(multierror.Error)
+	for _, taskName := range taskNames {
+		tsk, err := r.Playbook.Task(taskName)
+		if err != nil {
+			return fmt.Errorf("can't get task %s: %w", taskName, err)
+		}
+		keepGoing := r.KeepGoing || tsk.KeepGoing // keep-going mode is set by cli or by the task
+		for _, targetName := range targetsForTask(targets, taskName, r.Playbook) {
+			err := runTaskForTarget(ctx, r, taskName, targetName, rcp)
+			if err == nil {
+				continue
+			}
+			if !keepGoing || ctx.Err() != nil {
+				return err
 			}
+			// in keep-going mode failed hosts are skipped by the next tasks, healthy hosts continue
+			errs = multierror.Append(errs, err)
 		}
-		return nil
 	}
+	return errs.ErrorOrNil()
+}
+
+// withDependencies returns the list of tasks with all their dependencies, recursively. Dependencies are placed
+// before the tasks depending on them, and each task is included once, even if multiple tasks depend on it.
+func withDependencies(taskNames []string, pbook runner.Playbook) ([]string, error) {
+	res := []string{}
+	added, visiting := map[string]bool{}, map[string]bool{}
 
-	// run all tasks in playbook if no task specified
-	for _, task := range r.Playbook.AllTasks() {
-		for _, targetName := range targetsForTask(targets, task.Name, r.Playbook) {
-			if err := runTaskForTarget(ctx, r, task.Name, targetName); err != nil {
+	var add func(name string) error
+	add = func(name string) error {
+		if added[name] {
+			return nil
+		}
+		if visiting[name] {
+			// this should never happen, cycles are rejected on playbook level
+			return fmt.Errorf("task dependency cycle detected for %q", name)
+		}
+		visiting[name] = true
+		tsk, err := pbook.Task(name)
+		if err != nil {
+			return fmt.Errorf("can't get task %q: %w", name, err)
+		}
+		for _, dep := range tsk.DependsOn {
+			if err := add(dep); err != nil {
 				return err
 			}
 		}
+		added[name] = true
+		res = append(res, name)
+		return nil
+	}
+
+	for _, name := range taskNames {
+		if err := add(name); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	if len(res) > len(taskNames) {
+		log.Printf("[INFO] tasks to run with dependencies: %s", strings.Join(res, ", "))
+	}
+	return res, nil
 }
 
-func runAdHoc(ctx context.Context, targets []string, r *runner.Process) error {
+func runAdHoc(ctx context.Context, targets []string, r *runner.Process, rcp *recap) error {
 	errs := new(multierror.Error)
 	r.Verbose = true // always verbose for ad-hoc
 	for _, targetName := range targets {
-		if err := runTaskForTarget(ctx, r, "ad-hoc", targetName); err != nil {
+		if err := runTaskForTarget(ctx, r, "ad-hoc", targetName, rcp); err != nil {
 			errs = multierror.Append(errs, err)
 		}
 	}
@@ -202,7 +319,7 @@ func runAdHoc(ctx context.Context, targets []string, r *runner.Process) error {
 }
 
 // runGen generates a destination report for the tasks' targets
-func runGen(opts options, r *runner.Process) (err error) {
+func runGen(ctx context.Context, opts options, r *runner.Process) (err error) {
 	var targets []string
 	uniqueTargets := make(map[string]bool)
 	for _, taskName := range opts.TaskNames {
@@ -234,7 +351,7 @@ func runGen(opts options, r *runner.Process) (err error) {
 		defer wr.Close() // nolint this happens after sync
 	}
 
-	err = r.Gen(targets, fh, wr)
+	err = r.Gen(ctx, targets, fh, wr)
 	if err != nil {
 		return fmt.Errorf("can't generate report: %w", err)
 	}
@@ -261,7 +378,7 @@ func inventoryFile(inventory string) (string, error) {
 	return exInventory, nil
 }
 
-func makePlaybook(opts options, inventory string) (*config.PlayBook, error) {
+func makePlaybook(opts options, inventory string, sshConf *ssh_config.Config) (*config.PlayBook, error) {
 	// makeSecretProvider creates secret provider based on options
 	makeSecretProvider := func(sopts SecretsProvider) (config.SecretsProvider, error) {
 		switch sopts.Provider {
@@ -291,6 +408,13 @@ func makePlaybook(opts options, inventory string) (*config.PlayBook, error) {
 		User:         opts.SSHUser,
 		AdHocCommand: opts.PositionalArgs.AdHocCmd,
 		SSHShell:     opts.SSHShell,
+		SSHConfig:    sshConf,
+	}
+
+	if opts.ProxyJump != "" {
+		if overrides.ProxyJump, err = config.ParseProxyJump(opts.ProxyJump); err != nil {
+			return nil, fmt.Errorf("can't parse proxy jump %q: %w", opts.ProxyJump, err)
+		}
 	}
 
 	exPlaybookFile, err := expandPath(opts.PlaybookFile)
@@ -315,49 +439,278 @@ func makePlaybook(opts options, inventory string) (*config.PlayBook, error) {
 	return pbook, nil
 }
 
-func makeRunner(opts options, pbook *config.PlayBook) (*runner.Process, error) {
-	sshKey, err := sshKey(opts.SSHAgent, opts.SSHKey, pbook)
-	if err != nil {
-		return nil, fmt.Errorf("can't get ssh key: %w", err)
-	}
-	logs := executor.MakeLogs(opts.Verbose, opts.NoColor, pbook.AllSecretValues())
-	connector, err := executor.NewConnector(sshKey, opts.SSHTimeout, logs)
+func makeRunner(opts options, pbook *config.PlayBook, creds credentials, sshConf *ssh_config.Config) (*runner.Process, error) {
+	logs := executor.MakeLogs(opts.Verbose, opts.NoColor, append(pbook.AllSecretValues(), creds.secrets()...))
+	connector, err := executor.NewConnector(creds.sshKey, opts.SSHTimeout, logs)
 	if err != nil {
 		return nil, fmt.Errorf("can't create connector: %w", err)
 	}
 	if opts.SSHAgent {
 		connector = connector.WithAgent()
 	}
+	if creds.sshPassword != "" {
+		connector = connector.WithPassword(creds.sshPassword)
+	}
+	if creds.keyPassphrase != "" {
+		connector = connector.WithPassphrase(creds.keyPassphrase)
+	}
+	hostKeyMode, knownHosts, err := hostKeyCheck(opts.HostKeyCheck, opts.KnownHosts, pbook)
+	if err != nil {
+		return nil, fmt.Errorf("can't get host key check: %w", err)
+	}
+	connector = connector.WithHostKeyCheck(hostKeyMode, knownHosts)
+	if sshConf != nil {
+		connector = connector.WithSSHConfig(sshConf)
+	}
 
 	r := runner.Process{
-		Concurrency: opts.Concurrent,
-		Connector:   connector,
-		Playbook:    pbook,
-		Only:        opts.Only,
-		Skip:        opts.Skip,
-		Logs:        logs,
-		Verbose:     opts.Verbose,
-		Dry:         opts.Dry,
-		SSHShell:    opts.SSHShell,
-	}
-	log.Printf("[DEBUG] runner created: concurrency:%d, connector: %s, ssh_shell:%q, verbose:%v, dry:%v, only:%v, skip:%v",
-		r.Concurrency, r.Connector, r.SSHShell, r.Verbose, r.Dry, r.Only, r.Skip)
+		Concurrency:       opts.Concurrent,
+		Connector:         executor.NewPool(connector),
+		Playbook:          pbook,
+		Only:              opts.Only,
+		Skip:              opts.Skip,
+		Logs:              logs,
+		Verbose:           opts.Verbose,
+		Dry:               opts.Dry,
+		SSHShell:          opts.SSHShell,
+		Serial:            opts.Serial,
+		MaxFailPercentage: opts.MaxFail,
+		KeepGoing:         opts.KeepGoing,
+		GatherFacts:       opts.GatherFacts,
+		BecomePassword:    creds.becomePass,
+	}
+	log.Printf("[DEBUG] runner created: concurrency:%d, connector: %s, ssh_shell:%q, verbose:%v, dry:%v, only:%v, skip:%v, "+
+		"serial:%q, max_fail:%d, keep_going:%v", r.Concurrency, r.Connector, r.SSHShell, r.Verbose, r.Dry, r.Only, r.Skip,
+		r.Serial, r.MaxFailPercentage, r.KeepGoing)
 
 	return &r, nil
 }
 
-func runTaskForTarget(ctx context.Context, r *runner.Process, taskName, targetName string) error {
+// credentials holds ssh key and passwords used to connect to hosts and to run commands with sudo, su or doas
+type credentials struct {
+	sshKey        string // private key file, empty for ssh agent only
+	sshPassword   string // password for password and keyboard-interactive authentication
+	keyPassphrase string // passphrase of the encrypted private key
+	becomePass    string // password for sudo, su or doas
+}
+
+// secrets returns all the passwords to be masked in logs
+func (c credentials) secrets() []string {
+	return []string{c.sshPassword, c.keyPassphrase, c.becomePass}
+}
+
+// sshPasswordEnv is the environment variable with ssh password
+const sshPasswordEnv = "SPOT_SSH_PASSWORD"
+
+// makeCredentials collects ssh key and passwords from cli, secrets and interactive prompts.
+// ssh password is asked with --ask-pass, or taken from SPOT_SSH_PASSWORD env or the playbook's ssh_password_secret,
+// in this order. There is no cli flag for it, to keep the password out of the process list and shell history. Passphrase of the encrypted private key is taken from the playbook's
+// ssh_passphrase_secret, otherwise asked interactively.
+func makeCredentials(opts options, pbook *config.PlayBook) (res credentials, err error) {
+	if res.sshKey, err = sshKey(opts.SSHAgent, opts.SSHKey, pbook); err != nil {
+		return res, fmt.Errorf("can't get ssh key: %w", err)
+	}
+
+	secretPassword, secretPassphrase := pbook.SSHSecrets()
+	switch {
+	case opts.AskPass:
+		if res.sshPassword, err = readPassword("ssh password: "); err != nil {
+			return res, fmt.Errorf("can't get ssh password: %w", err)
+		}
+	case os.Getenv(sshPasswordEnv) != "":
+		res.sshPassword = os.Getenv(sshPasswordEnv)
+	default:
+		res.sshPassword = secretPassword
+	}
+
+	if res.sshPassword != "" && opts.SSHKey == "" && pbook.SSHKey == "" {
+		// password is used instead of the default private key, skip the key if it doesn't exist
+		if _, e := os.Stat(res.sshKey); e != nil {
+			log.Printf("[DEBUG] skip default ssh key %s: %v", res.sshKey, e)
+			res.sshKey = ""
+		}
+	}
+
+	res.keyPassphrase = secretPassphrase
+	if res.keyPassphrase == "" && !opts.SSHAgent && isEncryptedKey(res.sshKey) {
+		if res.keyPassphrase, err = readPassword(fmt.Sprintf("passphrase for %s: ", res.sshKey)); err != nil {
+			return res, fmt.Errorf("can't get passphrase for ssh key: %w", err)
+		}
+	}
+
+	if res.becomePass, err = becomePassword(opts.BecomePass); err != nil {
+		return res, fmt.Errorf("can't get become password: %w", err)
+	}
+	return res, nil
+}
+
+// isEncryptedKey checks if the private key file is encrypted with a passphrase
+func isEncryptedKey(keyFile string) bool {
+	if keyFile == "" {
+		return false
+	}
+	key, err := os.ReadFile(keyFile) // nolint
+	if err != nil {
+		return false
+	}
+	_, err = ssh.ParsePrivateKey(key)
+	var passErr *ssh.PassphraseMissingError
+	return errors.As(err, &passErr)
+}
+
+// becomePassword asks for the password used by sudo, su or doas, if requested. Empty if not requested.
+func becomePassword(ask bool) (string, error) {
+	if !ask {
+		return "", nil
+	}
+	pass, err := readPassword("become password: ")
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", fmt.Errorf("empty become password")
+	}
+	return pass, nil
+}
+
+// readPassword prints the prompt to stderr and reads the password from the terminal without echo.
+// It's a var so it can be mocked in tests
+var readPassword = func(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	pass, err := term.ReadPassword(int(os.Stdin.Fd())) //nolint:gosec // fd fits int
+	if err != nil {
+		return "", fmt.Errorf("can't read password: %w", err)
+	}
+	return string(pass), nil
+}
+
+func runTaskForTarget(ctx context.Context, r *runner.Process, taskName, targetName string, rcp *recap) error {
 	st := time.Now()
 	res, err := r.Run(ctx, taskName, targetName)
+	rcp.add(taskName, res.HostReports)
 	if err != nil {
 		return fmt.Errorf("can't run task %q for target %q: %w", taskName, targetName, err)
 	}
-	log.Printf("[INFO] completed: hosts:%d, commands:%d in %v\n",
-		res.Hosts, res.Commands, time.Since(st).Truncate(100*time.Millisecond))
+	if len(res.Batches) > 1 {
+		log.Printf("[INFO] completed: hosts:%d, commands:%d, batches:%d in %v\n",
+			res.Hosts, res.Commands, len(res.Batches), time.Since(st).Truncate(100*time.Millisecond))
+	} else {
+		log.Printf("[INFO] completed: hosts:%d, commands:%d in %v\n",
+			res.Hosts, res.Commands, time.Since(st).Truncate(100*time.Millisecond))
+	}
 	r.Playbook.UpdateTasksTargets(res.Vars) // for dynamic targets
 	return nil
 }
 
+// recap collects per-host results of all the tasks for the summary printed at the end of the run
+type recap struct {
+	hosts map[string]*hostRecap
+	order []string // host addresses in order of the first appearance
+}
+
+// hostRecap holds the number of commands by status for a single host, across all the tasks
+type hostRecap struct {
+	host, name                            string
+	ok, changed, skipped, failed, ignored int
+	failedTask, failedCmd, failedErr      string
+}
+
+func newRecap() *recap {
+	return &recap{hosts: make(map[string]*hostRecap)}
+}
+
+// add adds results of the task on hosts to the recap
+func (r *recap) add(task string, reports []runner.HostReport) {
+	for _, h := range reports {
+		hr, ok := r.hosts[h.Host]
+		if !ok {
+			hr = &hostRecap{host: h.Host, name: h.Name}
+			r.hosts[h.Host] = hr
+			r.order = append(r.order, h.Host)
+		}
+		failedCmd := ""
+		for _, c := range h.Commands {
+			switch {
+			case c.Status == runner.StatusFailed && c.Ignored:
+				hr.ignored++
+			case c.Status == runner.StatusFailed:
+				hr.failed++
+				failedCmd = c.Name
+			case c.Status == runner.StatusChanged:
+				hr.changed++
+			case c.Status == runner.StatusSkipped:
+				hr.skipped++
+			default:
+				hr.ok++
+			}
+		}
+		if h.Error != "" {
+			hr.failedTask, hr.failedCmd, hr.failedErr = task, failedCmd, h.Error
+		}
+	}
+}
+
+// print writes the recap with a line per host, failed hosts listed last with the failed task and command
+func (r *recap) print(w io.Writer, duration time.Duration) {
+	if len(r.order) == 0 {
+		return
+	}
+	hosts := make([]*hostRecap, 0, len(r.order))
+	for _, h := range r.order {
+		hosts = append(hosts, r.hosts[h])
+	}
+	sort.SliceStable(hosts, func(i, j int) bool { return hosts[i].failedTask == "" && hosts[j].failedTask != "" })
+
+	fmt.Fprintln(w, "\nrecap:") // nolint
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, h := range hosts {
+		host := h.host
+		if h.name != "" && !strings.HasPrefix(h.host, h.name+":") {
+			host = fmt.Sprintf("%s (%s)", h.name, h.host)
+		}
+		line := fmt.Sprintf("  %s\tok=%d\tchanged=%d\tskipped=%d\tfailed=%d\tignored=%d", host, h.ok, h.changed, h.skipped,
+			h.failed, h.ignored)
+		switch {
+		case h.failedTask != "" && h.failedCmd != "":
+			line += fmt.Sprintf("\tfailed task %q, command %q", h.failedTask, h.failedCmd)
+		case h.failedTask != "":
+			line += fmt.Sprintf("\tfailed task %q: %s", h.failedTask, strings.SplitN(h.failedErr, "\n", 2)[0])
+		}
+		fmt.Fprintln(tw, line) // nolint
+	}
+	if err := tw.Flush(); err != nil {
+		log.Printf("[WARN] can't write recap: %v", err)
+	}
+	fmt.Fprintf(w, "total time: %v\n", duration.Truncate(100*time.Millisecond)) // nolint
+}
+
+// writeReport writes the run report in the given format (json or junit) to the output file
+func writeReport(format, output string, rep *runner.Report) (err error) {
+	log.Printf("[INFO] writing %s report to %q", format, output)
+	wr, err := os.Create(output) // nolint
+	if err != nil {
+		return fmt.Errorf("can't open report file %q: %w", output, err)
+	}
+	defer wr.Close() // nolint this happens after sync
+
+	switch format {
+	case "json":
+		err = rep.WriteJSON(wr)
+	case "junit":
+		err = rep.WriteJUnit(wr)
+	default:
+		return fmt.Errorf("unknown report format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("can't write report: %w", err)
+	}
+	if err = wr.Sync(); err != nil {
+		return fmt.Errorf("can't sync report: %w", err)
+	}
+	return nil
+}
+
 // get the list of targets for the task. Usually this is just a list of all targets from the command line,
 // however, if the task has targets defined AND cli has the default target, then only those targets will be used.
 func targetsForTask(targets []string, taskName string, pbook runner.Playbook) []string {
@@ -404,6 +757,66 @@ func sshKey(sshAgent bool, sshKey string, pbook *config.PlayBook) (key string, e
 	return sshKey, nil
 }
 
+// get host key verification mode and known_hosts file from cli or playbook.
+// if no mode is provided, use accept-new. if no known_hosts file is provided, use default ~/.ssh/known_hosts
+func hostKeyCheck(mode, knownHosts string, pbook *config.PlayBook) (resMode, resKnownHosts string, err error) {
+	if mode == "" && pbook != nil {
+		mode = pbook.HostKeyCheck // use playbook's host_key_check
+	}
+	if mode == "" {
+		mode = executor.HostKeyAcceptNew
+	}
+	switch mode {
+	case executor.HostKeyStrict, executor.HostKeyAcceptNew, executor.HostKeyOff:
+	default:
+		return "", "", fmt.Errorf("invalid host key check mode %q", mode)
+	}
+
+	if knownHosts == "" && pbook != nil {
+		knownHosts = pbook.KnownHosts // use playbook's known_hosts
+	}
+	if knownHosts, err = expandPath(knownHosts); err != nil {
+		return "", "", fmt.Errorf("can't expand known hosts path: %w", err)
+	}
+	if knownHosts == "" { // no known_hosts provided in cli or playbook
+		u, err := userProvider.Current()
+		if err != nil {
+			return "", "", fmt.Errorf("can't get current user: %w", err)
+		}
+		knownHosts = filepath.Join(u.HomeDir, ".ssh", "known_hosts")
+	}
+
+	log.Printf("[INFO] host key check: %s, known hosts: %s", mode, knownHosts)
+	return mode, knownHosts, nil
+}
+
+// load ssh config from the file. Returns nil if the file is not set, set to "none" or doesn't exist
+func sshConfig(fname string) (*ssh_config.Config, error) {
+	if fname == "" || fname == "none" {
+		return nil, nil
+	}
+	exFname, err := expandPath(fname)
+	if err != nil {
+		return nil, fmt.Errorf("can't expand ssh config path %q: %w", fname, err)
+	}
+	fh, err := os.Open(exFname) // nolint
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("[DEBUG] ssh config %s not found", exFname)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("can't open ssh config %q: %w", exFname, err)
+	}
+	defer fh.Close() // nolint read-only file
+
+	res, err := ssh_config.Decode(fh)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse ssh config %q: %w", exFname, err)
+	}
+	log.Printf("[INFO] ssh config: %s", exFname)
+	return res, nil
+}
+
 // get ssh user from cli or playbook. if no user is provided, use current user from os
 func sshUser(sshUser string, pbook *config.PlayBook) (string, error) {
 	if sshUser == "" && (pbook == nil || pbook.User != "") { // no user provided in cli
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -19,6 +21,7 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 
 	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/runner"
 )
 
 func Test_main(t *testing.T) {
@@ -27,14 +30,16 @@ func Test_main(t *testing.T) {
 
 	t.Run("with system shell set", func(*testing.T) {
 		args := []string{"simplotask", "--dbg", "--playbook=testdata/conf-local.yml", "--user=test",
-			"--key=testdata/test_ssh_key", "--target=" + hostAndPort}
+			"--key=testdata/test_ssh_key", "--target=" + hostAndPort,
+			"--known-hosts=" + filepath.Join(t.TempDir(), "known_hosts")}
 		os.Args = args
 		main()
 	})
 
 	t.Run("with system shell not set", func(t *testing.T) {
 		args := []string{"simplotask", "--dbg", "--playbook=testdata/conf-local.yml", "--user=test",
-			"--key=testdata/test_ssh_key", "--target=" + hostAndPort}
+			"--key=testdata/test_ssh_key", "--target=" + hostAndPort,
+			"--known-hosts=" + filepath.Join(t.TempDir(), "known_hosts")}
 		os.Args = args
 		err := os.Setenv("SHELL", "")
 		require.NoError(t, err)
@@ -50,6 +55,7 @@ func Test_runCompleted(t *testing.T) {
 		opts := options{
 			SSHUser:      "test",
 			SSHKey:       "testdata/test_ssh_key",
+			KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 			PlaybookFile: "testdata/conf.yml",
 			TaskNames:    []string{"task1"},
 			Targets:      []string{hostAndPort},
@@ -74,6 +80,7 @@ func Test_runCompleted(t *testing.T) {
 		opts := options{
 			SSHUser:      "test",
 			SSHKey:       "testdata/test_ssh_key",
+			KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 			PlaybookFile: "testdata/conf.yml",
 			TaskNames:    []string{"task1"},
 			Targets:      []string{hostAndPort},
@@ -99,6 +106,7 @@ func Test_runCompleted(t *testing.T) {
 		opts := options{
 			SSHUser:      "test",
 			SSHKey:       "testdata/test_ssh_key",
+			KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 			PlaybookFile: "testdata/conf.yml",
 			TaskNames:    []string{"task1"},
 			Targets:      []string{hostAndPort},
@@ -125,6 +133,7 @@ func Test_runCompleted(t *testing.T) {
 		opts := options{
 			SSHUser:      "test",
 			SSHKey:       "testdata/test_ssh_key",
+			KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 			PlaybookFile: "testdata/conf-dynamic.yml",
 			SecretsProvider: SecretsProvider{
 				Provider: "spot",
@@ -151,6 +160,7 @@ func Test_runCompletedSimplePlaybook(t *testing.T) {
 	opts := options{
 		SSHUser:      "test",
 		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 		PlaybookFile: "testdata/conf-simple.yml",
 		Targets:      []string{hostAndPort},
 		Only:         []string{"wait"},
@@ -170,10 +180,11 @@ func Test_runAdhoc(t *testing.T) {
 	defer teardown()
 
 	opts := options{
-		SSHUser: "test",
-		SSHKey:  "testdata/test_ssh_key",
-		Targets: []string{hostAndPort},
-		Dbg:     true,
+		SSHUser:    "test",
+		SSHKey:     "testdata/test_ssh_key",
+		KnownHosts: filepath.Join(t.TempDir(), "known_hosts"),
+		Targets:    []string{hostAndPort},
+		Dbg:        true,
 	}
 	opts.PositionalArgs.AdHocCmd = "echo hello"
 	logOut := captureStdout(t, func() {
@@ -190,6 +201,7 @@ func Test_runCompletedSeveralTasks(t *testing.T) {
 	opts := options{
 		SSHUser:      "test",
 		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 		PlaybookFile: "testdata/conf3.yml",
 		TaskNames:    []string{"task1", "task2"},
 		Targets:      []string{hostAndPort},
@@ -215,6 +227,7 @@ func Test_runCompletedAllTasks(t *testing.T) {
 	opts := options{
 		SSHUser:      "test",
 		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 		PlaybookFile: "testdata/conf2.yml",
 		Targets:      []string{hostAndPort},
 		Dbg:          true,
@@ -236,6 +249,81 @@ func Test_runCompletedAllTasks(t *testing.T) {
 
 }
 
+func Test_runWithDependencies(t *testing.T) {
+	opts := options{
+		SSHUser:      "test",
+		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
+		PlaybookFile: "testdata/conf-deps.yml",
+		TaskNames:    []string{"deploy", "migrate"},
+		Targets:      []string{"localhost"},
+		Dbg:          true,
+	}
+
+	t.Run("with dependencies", func(t *testing.T) {
+		logOut := captureStdout(t, func() {
+			err := run(opts)
+			require.NoError(t, err)
+		})
+		t.Log("out: ", logOut)
+		assert.Equal(t, 1, strings.Count(logOut, `run task "build"`))
+		assert.Equal(t, 1, strings.Count(logOut, `run task "migrate"`))
+		assert.Equal(t, 1, strings.Count(logOut, `run task "deploy"`))
+		assert.NotContains(t, logOut, `run task "cleanup"`)
+		assert.Less(t, strings.Index(logOut, `run task "build"`), strings.Index(logOut, `run task "migrate"`))
+		assert.Less(t, strings.Index(logOut, `run task "migrate"`), strings.Index(logOut, `run task "deploy"`))
+	})
+
+	t.Run("no dependencies", func(t *testing.T) {
+		noDepsOpts := opts
+		noDepsOpts.NoDeps = true
+		logOut := captureStdout(t, func() {
+			err := run(noDepsOpts)
+			require.NoError(t, err)
+		})
+		t.Log("out: ", logOut)
+		assert.NotContains(t, logOut, `run task "build"`)
+		assert.Less(t, strings.Index(logOut, `run task "deploy"`), strings.Index(logOut, `run task "migrate"`))
+	})
+}
+
+func Test_withDependencies(t *testing.T) {
+	conf := &config.PlayBook{Tasks: []config.Task{
+		{Name: "build"},
+		{Name: "test", DependsOn: []string{"build"}},
+		{Name: "migrate", DependsOn: []string{"build"}},
+		{Name: "deploy", DependsOn: []string{"test", "migrate"}},
+		{Name: "cleanup"},
+	}}
+
+	tbl := []struct {
+		name     string
+		tasks    []string
+		expected []string
+		err      string
+	}{
+		{"no dependencies", []string{"cleanup"}, []string{"cleanup"}, ""},
+		{"direct dependency", []string{"test"}, []string{"build", "test"}, ""},
+		{"transitive dependencies", []string{"deploy"}, []string{"build", "test", "migrate", "deploy"}, ""},
+		{"shared dependencies added once", []string{"migrate", "test", "cleanup"},
+			[]string{"build", "migrate", "test", "cleanup"}, ""},
+		{"dependency requested explicitly", []string{"deploy", "build"}, []string{"build", "test", "migrate", "deploy"}, ""},
+		{"unknown task", []string{"unknown"}, nil, `can't get task "unknown": task "unknown" not found`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := withDependencies(tt.tasks, conf)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, res)
+		})
+	}
+}
+
 func Test_runCanceled(t *testing.T) {
 	hostAndPort, teardown := startTestContainer(t)
 	defer teardown()
@@ -243,6 +331,7 @@ func Test_runCanceled(t *testing.T) {
 	opts := options{
 		SSHUser:      "test",
 		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 		PlaybookFile: "testdata/conf.yml",
 		TaskNames:    []string{"task1"},
 		Targets:      []string{hostAndPort},
@@ -273,6 +362,7 @@ func Test_runFailed(t *testing.T) {
 	opts := options{
 		SSHUser:      "test",
 		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 		PlaybookFile: "testdata/conf-local-failed.yml",
 		TaskNames:    []string{"default"},
 		Targets:      []string{hostAndPort},
@@ -282,10 +372,194 @@ func Test_runFailed(t *testing.T) {
 	assert.ErrorContains(t, err, `failed command "show content"`)
 }
 
+func Test_runWithReport(t *testing.T) {
+	opts := options{
+		SSHUser:      "test",
+		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
+		PlaybookFile: "testdata/conf-local-failed.yml",
+		TaskNames:    []string{"default"},
+		Targets:      []string{"localhost"},
+	}
+	setupLog(true)
+
+	t.Run("json", func(t *testing.T) {
+		jsonOpts := opts
+		jsonOpts.Report, jsonOpts.ReportOutput = "json", filepath.Join(t.TempDir(), "report.json")
+		err := run(jsonOpts)
+		require.ErrorContains(t, err, `failed command "show content"`)
+
+		data, err := os.ReadFile(jsonOpts.ReportOutput)
+		require.NoError(t, err)
+		t.Log(string(data))
+		var rep runner.Report
+		require.NoError(t, json.Unmarshal(data, &rep))
+		require.Len(t, rep.Tasks, 1)
+		tsk := rep.Tasks[0]
+		assert.Equal(t, "default", tsk.Name)
+		assert.Equal(t, "localhost", tsk.Target)
+		assert.Equal(t, runner.StatusFailed, tsk.Status)
+		assert.Contains(t, tsk.Error, `failed command "show content"`)
+		require.Len(t, tsk.Hosts, 1)
+		require.Len(t, tsk.Hosts[0].Commands, 2)
+		assert.Equal(t, runner.StatusFailed, tsk.Hosts[0].Status)
+
+		cmd1, cmd2 := tsk.Hosts[0].Commands[0], tsk.Hosts[0].Commands[1]
+		assert.Equal(t, "some command", cmd1.Name)
+		assert.Equal(t, runner.StatusChanged, cmd1.Status)
+		assert.Equal(t, 0, cmd1.ExitCode)
+		assert.Equal(t, "something\nall good, 123\n", cmd1.Stdout)
+		assert.Equal(t, "show content", cmd2.Name)
+		assert.Equal(t, runner.StatusFailed, cmd2.Status)
+		assert.NotZero(t, cmd2.ExitCode)
+		assert.Contains(t, cmd2.Stderr, "/tmp/not-found")
+		assert.Contains(t, cmd2.Error, "can't run script on localhost")
+	})
+
+	t.Run("junit", func(t *testing.T) {
+		junitOpts := opts
+		junitOpts.Report, junitOpts.ReportOutput = "junit", filepath.Join(t.TempDir(), "report.xml")
+		err := run(junitOpts)
+		require.Error(t, err)
+
+		data, err := os.ReadFile(junitOpts.ReportOutput)
+		require.NoError(t, err)
+		t.Log(string(data))
+		assert.Contains(t, string(data), `<testsuites name="spot" tests="2" failures="1" skipped="0"`)
+		assert.Contains(t, string(data), `<testsuite name="default [localhost]" tests="2" failures="1" skipped="0"`)
+		assert.Contains(t, string(data), `<testcase name="show content" classname="localhost (localhost:22)"`)
+	})
+
+	t.Run("bad output location", func(t *testing.T) {
+		badOpts := opts
+		badOpts.PlaybookFile = "testdata/conf-deps.yml"
+		badOpts.TaskNames = []string{"build"}
+		badOpts.Report, badOpts.ReportOutput = "json", "/not-found/report.json"
+		err := run(badOpts)
+		require.EqualError(t, err, `can't open report file "/not-found/report.json": open /not-found/report.json: no such file or directory`)
+	})
+
+	t.Run("no output location", func(t *testing.T) {
+		noOutOpts := opts
+		noOutOpts.Report = "json"
+		out := captureStdout(t, func() {
+			err := run(noOutOpts)
+			require.EqualError(t, err, "report output file is required, set it with --report.output")
+		})
+		assert.NotContains(t, out, "some command", "nothing executed")
+	})
+}
+
+func Test_runRecap(t *testing.T) {
+	opts := options{
+		SSHUser:      "test",
+		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
+		PlaybookFile: "testdata/conf-local-failed.yml",
+		TaskNames:    []string{"default"},
+		Targets:      []string{"localhost"},
+	}
+	setupLog(true)
+
+	out := captureStdout(t, func() {
+		err := run(opts)
+		require.ErrorContains(t, err, `failed command "show content"`)
+	})
+	t.Log(out)
+	assert.Regexp(t, `(?m)^recap:\n  localhost:22  ok=0  changed=1  skipped=0  failed=1  ignored=0  `+
+		`failed task "default", command "show content"\ntotal time: `, out)
+}
+
+func Test_runKeepGoing(t *testing.T) {
+	opts := options{
+		SSHUser:      "test",
+		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
+		PlaybookFile: "testdata/conf-keep-going.yml",
+		Targets:      []string{"two"},
+		Concurrent:   2,
+	}
+	setupLog(true)
+
+	t.Run("without keep-going", func(t *testing.T) {
+		out := captureStdout(t, func() {
+			err := run(opts)
+			require.ErrorContains(t, err, `failed command "fail on h1" on host h1:22 (h1)`)
+		})
+		t.Log(out)
+		assert.NotContains(t, out, `run task "second"`)
+	})
+
+	t.Run("with keep-going", func(t *testing.T) {
+		keepOpts := opts
+		keepOpts.KeepGoing = true
+		out := captureStdout(t, func() {
+			err := run(keepOpts)
+			require.ErrorContains(t, err, `failed command "fail on h1" on host h1:22 (h1)`)
+		})
+		t.Log(out)
+		assert.Equal(t, 1, strings.Count(out, `completed command "second command"`), "second task executed on h2 only")
+		assert.Contains(t, out, "h2:22  ok=1  changed=1  skipped=0  failed=0  ignored=0\n")
+		assert.Contains(t, out, `h1:22  ok=0  changed=0  skipped=0  failed=1  ignored=0  failed task "first", command "fail on h1"`)
+	})
+
+	t.Run("with task keep_going", func(t *testing.T) {
+		taskOpts := opts
+		taskOpts.PlaybookFile = "testdata/conf-keep-going-task.yml"
+		out := captureStdout(t, func() {
+			err := run(taskOpts)
+			require.ErrorContains(t, err, `failed command "fail on h1" on host h1:22 (h1)`)
+		})
+		t.Log(out)
+		assert.Equal(t, 1, strings.Count(out, `completed command "second command"`), "second task executed on h2 only")
+		assert.Contains(t, out, "h2:22  ok=1  changed=1  skipped=0  failed=0  ignored=0\n")
+	})
+}
+
+func Test_recap(t *testing.T) {
+	rcp := newRecap()
+	rcp.add("deploy", []runner.HostReport{
+		{Host: "h1.example.com:22", Name: "h1", Status: runner.StatusFailed, Error: "failed command \"restart\"",
+			Commands: []runner.CmdReport{
+				{Name: "check", Status: runner.StatusOk},
+				{Name: "cleanup", Status: runner.StatusFailed, Ignored: true},
+				{Name: "restart", Status: runner.StatusFailed},
+			}},
+		{Host: "h2.example.com:22", Name: "h2", Status: runner.StatusChanged, Commands: []runner.CmdReport{
+			{Name: "check", Status: runner.StatusOk},
+			{Name: "cleanup", Status: runner.StatusChanged},
+			{Name: "restart", Status: runner.StatusChanged},
+		}},
+		{Host: "h3.example.com:22", Status: runner.StatusFailed, Error: "can't connect to h3\ndial tcp: timeout"},
+	})
+	rcp.add("verify", []runner.HostReport{
+		{Host: "h2.example.com:22", Name: "h2", Status: runner.StatusOk, Commands: []runner.CmdReport{
+			{Name: "check", Status: runner.StatusOk},
+			{Name: "optional", Status: runner.StatusSkipped},
+		}},
+	})
+
+	var buf bytes.Buffer
+	rcp.print(&buf, 12345*time.Millisecond)
+	exp := `
+recap:
+  h2 (h2.example.com:22)  ok=2  changed=2  skipped=1  failed=0  ignored=0
+  h1 (h1.example.com:22)  ok=1  changed=0  skipped=0  failed=1  ignored=1  failed task "deploy", command "restart"
+  h3.example.com:22       ok=0  changed=0  skipped=0  failed=0  ignored=0  failed task "deploy": can't connect to h3
+total time: 12.3s
+`
+	assert.Equal(t, exp, buf.String())
+
+	buf.Reset()
+	newRecap().print(&buf, time.Second)
+	assert.Empty(t, buf.String(), "nothing printed without hosts")
+}
+
 func Test_runNoConfig(t *testing.T) {
 	opts := options{
 		SSHUser:      "test",
 		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 		PlaybookFile: "testdata/conf-not-found.yml",
 		TaskNames:    []string{"task1"},
 		Targets:      []string{"localhost"},
@@ -306,6 +580,7 @@ func Test_runGen_goTmplFile(t *testing.T) {
 		opts: options{
 			SSHUser:      "test",
 			SSHKey:       "testdata/test_ssh_key",
+			KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 			PlaybookFile: "testdata/conf.yml",
 			TaskNames:    []string{"task1"},
 			Targets:      []string{"dev"},
@@ -324,6 +599,7 @@ func Test_runGen_goTmplFile(t *testing.T) {
 			opts: options{
 				SSHUser:      "test",
 				SSHKey:       "testdata/test_ssh_key",
+				KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 				PlaybookFile: "testdata/conf.yml",
 				TaskNames:    []string{"task1", "failed_task"},
 				Targets:      []string{"dev"},
@@ -366,6 +642,7 @@ func Test_connectFailed(t *testing.T) {
 	opts := options{
 		SSHUser:      "bad_user",
 		SSHKey:       "testdata/test_ssh_key",
+		KnownHosts:   filepath.Join(t.TempDir(), "known_hosts"),
 		PlaybookFile: "testdata/conf.yml",
 		TaskNames:    []string{"task1"},
 		Targets:      []string{hostAndPort},
@@ -380,6 +657,53 @@ func Test_connectFailed(t *testing.T) {
 	assert.ErrorContains(t, err, `ssh: unable to authenticate`)
 }
 
+func Test_makeCredentials(t *testing.T) {
+	defer func(f func(string) (string, error)) { readPassword = f }(readPassword)
+	var prompts []string
+	readPassword = func(prompt string) (string, error) {
+		prompts = append(prompts, prompt)
+		return "entered", nil
+	}
+
+	tbl := []struct {
+		name     string
+		opts     options
+		env      string // ssh password env
+		expected credentials
+		prompts  []string
+	}{
+		{name: "key only", opts: options{SSHKey: "testdata/test_ssh_key"},
+			expected: credentials{sshKey: "testdata/test_ssh_key"}},
+		{name: "ssh password", opts: options{SSHKey: "testdata/test_ssh_key"}, env: "passwd",
+			expected: credentials{sshKey: "testdata/test_ssh_key", sshPassword: "passwd"}},
+		{name: "ask ssh password", opts: options{SSHKey: "testdata/test_ssh_key", AskPass: true}, env: "passwd",
+			expected: credentials{sshKey: "testdata/test_ssh_key", sshPassword: "entered"}, prompts: []string{"ssh password: "}},
+		{name: "ssh password, no default key", opts: options{}, env: "passwd",
+			expected: credentials{sshPassword: "passwd"}},
+		{name: "encrypted key", opts: options{SSHKey: "testdata/test_ssh_key_encrypted"},
+			expected: credentials{sshKey: "testdata/test_ssh_key_encrypted", keyPassphrase: "entered"},
+			prompts:  []string{"passphrase for testdata/test_ssh_key_encrypted: "}},
+		{name: "encrypted key with agent", opts: options{SSHKey: "testdata/test_ssh_key_encrypted", SSHAgent: true},
+			expected: credentials{sshKey: "testdata/test_ssh_key_encrypted"}},
+		{name: "become password", opts: options{SSHKey: "testdata/test_ssh_key", BecomePass: true},
+			expected: credentials{sshKey: "testdata/test_ssh_key", becomePass: "entered"}, prompts: []string{"become password: "}},
+	}
+
+	userProvider = &mockUserInfoProvider{user: &user.User{HomeDir: t.TempDir()}}
+	defer func() { userProvider = &defaultUserInfoProvider{} }()
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(sshPasswordEnv, tt.env)
+			prompts = nil
+			res, err := makeCredentials(tt.opts, &config.PlayBook{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, res)
+			assert.Equal(t, tt.prompts, prompts)
+		})
+	}
+}
+
 func Test_sshUserAndKey(t *testing.T) {
 
 	osUser, err := user.Current()
@@ -479,6 +803,96 @@ func Test_sshUserAndKey(t *testing.T) {
 	}
 }
 
+func Test_hostKeyCheck(t *testing.T) {
+	mockUser := &user.User{Username: "testuser", HomeDir: "/tmp/test-home"}
+	userProvider = &mockUserInfoProvider{user: mockUser}
+	defer func() { userProvider = &defaultUserInfoProvider{} }()
+
+	testCases := []struct {
+		name               string
+		mode, knownHosts   string
+		conf               *config.PlayBook
+		expectedMode       string
+		expectedKnownHosts string
+		expectedErr        string
+	}{
+		{
+			name:               "defaults",
+			conf:               &config.PlayBook{},
+			expectedMode:       "accept-new",
+			expectedKnownHosts: "/tmp/test-home/.ssh/known_hosts",
+		},
+		{
+			name:               "from playbook",
+			conf:               &config.PlayBook{HostKeyCheck: "strict", KnownHosts: "/etc/spot/known_hosts"},
+			expectedMode:       "strict",
+			expectedKnownHosts: "/etc/spot/known_hosts",
+		},
+		{
+			name:               "command line overrides playbook",
+			mode:               "off",
+			knownHosts:         "~/known_hosts",
+			conf:               &config.PlayBook{HostKeyCheck: "strict", KnownHosts: "/etc/spot/known_hosts"},
+			expectedMode:       "off",
+			expectedKnownHosts: "/tmp/test-home/known_hosts",
+		},
+		{
+			name:        "invalid mode",
+			mode:        "blah",
+			conf:        &config.PlayBook{},
+			expectedErr: `invalid host key check mode "blah"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mode, knownHosts, err := hostKeyCheck(tc.mode, tc.knownHosts, tc.conf)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedMode, mode)
+			assert.Equal(t, tc.expectedKnownHosts, knownHosts)
+		})
+	}
+
+	t.Run("can't expand known hosts path", func(t *testing.T) {
+		userProvider = &mockUserInfoProvider{err: errors.New("user error")}
+		defer func() { userProvider = &mockUserInfoProvider{user: mockUser} }()
+		_, _, err := hostKeyCheck("strict", "~/known_hosts", &config.PlayBook{})
+		require.EqualError(t, err, "can't expand known hosts path: user error")
+	})
+}
+
+func Test_sshConfig(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(fname, []byte("Host web\n  HostName web.example.com\n  Port 2222\n"), 0o600))
+
+	t.Run("disabled", func(t *testing.T) {
+		for _, v := range []string{"", "none"} {
+			conf, err := sshConfig(v)
+			require.NoError(t, err)
+			assert.Nil(t, conf)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		conf, err := sshConfig(filepath.Join(t.TempDir(), "no-such-config"))
+		require.NoError(t, err)
+		assert.Nil(t, conf)
+	})
+
+	t.Run("valid file", func(t *testing.T) {
+		conf, err := sshConfig(fname)
+		require.NoError(t, err)
+		require.NotNil(t, conf)
+		hostName, err := conf.Get("web", "HostName")
+		require.NoError(t, err)
+		assert.Equal(t, "web.example.com", hostName)
+	})
+}
+
 type mockUserInfoProvider struct {
 	user *user.User
 	err  error
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -16,54 +17,138 @@ import (
 
 // Cmd defines a single command. Yaml parsing is custom, because we want to allow "copy" to accept both single and multiple values
 type Cmd struct {
-	Name        string            `yaml:"name" toml:"name"`
-	Copy        CopyInternal      `yaml:"copy" toml:"copy"`
-	MCopy       []CopyInternal    `yaml:"mcopy" toml:"mcopy"` // multiple copy commands, implemented internally
-	Sync        SyncInternal      `yaml:"sync" toml:"sync"`
-	MSync       []SyncInternal    `yaml:"msync" toml:"msync"` // multiple sync commands, implemented internally
-	Delete      DeleteInternal    `yaml:"delete" toml:"delete"`
-	MDelete     []DeleteInternal  `yaml:"mdelete" toml:"mdelete"` // multiple delete commands, implemented internally
-	Wait        WaitInternal      `yaml:"wait" toml:"wait"`
-	Script      string            `yaml:"script" toml:"script,multiline"`
-	Echo        string            `yaml:"echo" toml:"echo"`
-	Environment map[string]string `yaml:"env" toml:"env"`
-	Options     CmdOptions        `yaml:"options" toml:"options,omitempty"`
-	Condition   string            `yaml:"cond" toml:"cond,omitempty"`
-	Register    []string          `yaml:"register" toml:"register"` // register variables from command
-	OnExit      string            `yaml:"on_exit" toml:"on_exit"`   // script to run on exit
+	Name        string             `yaml:"name" toml:"name"`
+	Copy        CopyInternal       `yaml:"copy" toml:"copy"`
+	MCopy       []CopyInternal     `yaml:"mcopy" toml:"mcopy"` // multiple copy commands, implemented internally
+	Sync        SyncInternal       `yaml:"sync" toml:"sync"`
+	MSync       []SyncInternal     `yaml:"msync" toml:"msync"` // multiple sync commands, implemented internally
+	Delete      DeleteInternal     `yaml:"delete" toml:"delete"`
+	MDelete     []DeleteInternal   `yaml:"mdelete" toml:"mdelete"` // multiple delete commands, implemented internally
+	Download    DownloadInternal   `yaml:"download" toml:"download"`
+	MDownload   []DownloadInternal `yaml:"mdownload" toml:"mdownload"` // multiple download commands, implemented internally
+	Template    TemplateInternal   `yaml:"template" toml:"template"`
+	MTemplate   []TemplateInternal `yaml:"mtemplate" toml:"mtemplate"` // multiple template commands, implemented internally
+	Wait        WaitInternal       `yaml:"wait" toml:"wait"`
+	Script      string             `yaml:"script" toml:"script,multiline"`
+	Echo        string             `yaml:"echo" toml:"echo"`
+	Environment map[string]string  `yaml:"env" toml:"env"`
+	Options     CmdOptions         `yaml:"options" toml:"options,omitempty"`
+	Condition   string             `yaml:"cond" toml:"cond,omitempty"`
+	ChangedWhen ChangedWhen        `yaml:"changed_when" toml:"changed_when,omitempty"`
+	Register    []string           `yaml:"register" toml:"register"` // register variables from command
+	Loop        LoopItems          `yaml:"loop" toml:"loop"`         // run command for each item
+	OnExit      string             `yaml:"on_exit" toml:"on_exit"`   // script to run on exit
+	Notify      []string           `yaml:"notify" toml:"notify"`     // handlers to run if command made changes
+
+	RegisterOutput string `yaml:"register_output" toml:"register_output"` // register trimmed stdout of the script
+	RegisterRC     string `yaml:"register_rc" toml:"register_rc"`         // register exit code, non-zero exit is not a failure
+	RegisterJSON   string `yaml:"register_json" toml:"register_json"`     // register json stdout as flattened variables with prefix
 
 	Secrets    map[string]string `yaml:"-" toml:"-"` // loaded secrets, filled by playbook
 	SSHShell   string            `yaml:"-" toml:"-"` // shell to use for ssh commands, filled by playbook
 	LocalShell string            `yaml:"-" toml:"-"` // shell to use for local commands, filled by playbooks
 }
 
+// LoopItems defines items to run command for, each item is available as SPOT_ITEM variable.
+// It can be set as a list of items or, in yaml, as a single item, usually a variable reference like $SERVICES.
+// An item referring to a variable is expanded to the list of values of this variable by the runner.
+type LoopItems []string
+
+// UnmarshalYAML implements yaml.Unmarshaler interface to allow loop set as a single item
+func (l *LoopItems) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = LoopItems{value.Value}
+		return nil
+	}
+	var items []string
+	if err := value.Decode(&items); err != nil {
+		return err
+	}
+	*l = items
+	return nil
+}
+
 // CmdOptions defines options for a command
 type CmdOptions struct {
-	IgnoreErrors bool     `yaml:"ignore_errors" toml:"ignore_errors"` // ignore errors and continue
-	NoAuto       bool     `yaml:"no_auto" toml:"no_auto"`             // don't run command automatically
-	Local        bool     `yaml:"local" toml:"local"`                 // run command on localhost
-	Sudo         bool     `yaml:"sudo" toml:"sudo"`                   // run command with sudo
-	Secrets      []string `yaml:"secrets" toml:"secrets"`             // list of secrets (keys) to load
-	OnlyOn       []string `yaml:"only_on" toml:"only_on"`             // only run on these hosts
+	IgnoreErrors bool         `yaml:"ignore_errors" toml:"ignore_errors"` // ignore errors and continue
+	NoAuto       bool         `yaml:"no_auto" toml:"no_auto"`             // don't run command automatically
+	Local        bool         `yaml:"local" toml:"local"`                 // run command on localhost
+	Sudo         bool         `yaml:"sudo" toml:"sudo"`                   // run command with sudo
+	Secrets      []string     `yaml:"secrets" toml:"secrets"`             // list of secrets (keys) to load
+	OnlyOn       []string     `yaml:"only_on" toml:"only_on"`             // only run on these hosts
+	Retry        RetryOptions `yaml:"retry" toml:"retry,omitempty"`       // retry failed command
+
+	BecomeUser   string `yaml:"become_user" toml:"become_user"`                       // user to run sudo commands as, root by default
+	BecomeMethod string `yaml:"become_method" toml:"become_method"`                   // sudo (default), su or doas
+	BecomeSecret string `yaml:"become_password_secret" toml:"become_password_secret"` // secret key of the become password
+
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"` // max execution time of a single attempt, no limit if 0
+}
+
+// become methods, i.e. the tools used to run commands with elevated privileges if sudo option is set
+const (
+	BecomeSudo = "sudo"
+	BecomeSu   = "su"
+	BecomeDoas = "doas"
+)
+
+// RetryOptions defines how to retry a failed command
+type RetryOptions struct {
+	Attempts int           `yaml:"attempts" toml:"attempts"` // total number of attempts, including the first one
+	Delay    time.Duration `yaml:"delay" toml:"delay"`       // delay before the second attempt
+	Backoff  float64       `yaml:"backoff" toml:"backoff"`   // multiplier of the delay for each next attempt, no backoff if <= 1
+}
+
+// ChangedWhen defines when a script reports changes made on the host. By default, any successful script is changed.
+// If set, the script is changed only if it exited with one of the listed codes or its output matches the pattern.
+// Listed non-zero exit codes are not treated as failures.
+type ChangedWhen struct {
+	ExitCodes []int  `yaml:"rc" toml:"rc"`         // exit codes reporting changes
+	Output    string `yaml:"output" toml:"output"` // regular expression matched against script's stdout
+}
+
+// IsSet returns true if any of changed_when conditions defined
+func (c ChangedWhen) IsSet() bool {
+	return len(c.ExitCodes) > 0 || c.Output != ""
 }
 
 // CopyInternal defines copy command, implemented internally
 type CopyInternal struct {
-	Source  string   `yaml:"src" toml:"src"`         // source must be a file or a glob pattern
-	Dest    string   `yaml:"dst" toml:"dst"`         // destination must be a file or a directory
-	Mkdir   bool     `yaml:"mkdir" toml:"mkdir"`     // create destination directory if it does not exist
-	Force   bool     `yaml:"force" toml:"force"`     // force copy even if source and destination are the same
-	Exclude []string `yaml:"exclude" toml:"exclude"` // exclude files matching these patterns
-	ChmodX  bool     `yaml:"chmod+x" toml:"chmod+x"` // chmod +x on destination file
+	Source   string   `yaml:"src" toml:"src"`           // source must be a file or a glob pattern
+	Dest     string   `yaml:"dst" toml:"dst"`           // destination must be a file or a directory
+	Mkdir    bool     `yaml:"mkdir" toml:"mkdir"`       // create destination directory if it does not exist
+	Force    bool     `yaml:"force" toml:"force"`       // force copy even if source and destination are the same
+	Exclude  []string `yaml:"exclude" toml:"exclude"`   // exclude files matching these patterns
+	ChmodX   bool     `yaml:"chmod+x" toml:"chmod+x"`   // chmod +x on destination file
+	Checksum bool     `yaml:"checksum" toml:"checksum"` // compare content checksums instead of size and modification time
 }
 
 // SyncInternal defines sync command (recursive copy), implemented internally
 type SyncInternal struct {
-	Source  string   `yaml:"src" toml:"src"`         // source must be a directory
-	Dest    string   `yaml:"dst" toml:"dst"`         // destination must be a directory
-	Delete  bool     `yaml:"delete" toml:"delete"`   // delete files in destination that are not in source
+	Source   string   `yaml:"src" toml:"src"`           // source must be a directory
+	Dest     string   `yaml:"dst" toml:"dst"`           // destination must be a directory
+	Delete   bool     `yaml:"delete" toml:"delete"`     // delete files in destination that are not in source
+	Exclude  []string `yaml:"exclude" toml:"exclude"`   // exclude files matching these patterns
+	Force    bool     `yaml:"force" toml:"force"`       // force sync even if source and destination are the same
+	Checksum bool     `yaml:"checksum" toml:"checksum"` // compare content checksums instead of size and modification time
+}
+
+// DownloadInternal defines download command, implemented internally
+type DownloadInternal struct {
+	Source  string   `yaml:"src" toml:"src"`         // remote source must be a file or a glob pattern
+	Dest    string   `yaml:"dst" toml:"dst"`         // local destination must be a file or a directory
+	Mkdir   bool     `yaml:"mkdir" toml:"mkdir"`     // create destination directory if it does not exist
+	Force   bool     `yaml:"force" toml:"force"`     // force download even if source and destination are the same
 	Exclude []string `yaml:"exclude" toml:"exclude"` // exclude files matching these patterns
-	Force   bool     `yaml:"force" toml:"force"`     // force sync even if source and destination are the same
+}
+
+// TemplateInternal defines template command, renders local template and uploads the result, implemented internally
+type TemplateInternal struct {
+	Source string `yaml:"src" toml:"src"`         // local source must be a go text/template file
+	Dest   string `yaml:"dst" toml:"dst"`         // remote destination must be a file
+	Mkdir  bool   `yaml:"mkdir" toml:"mkdir"`     // create destination directory if it does not exist
+	Force  bool   `yaml:"force" toml:"force"`     // force upload even if rendered content and destination are the same
+	ChmodX bool   `yaml:"chmod+x" toml:"chmod+x"` // chmod +x on destination file
 }
 
 // DeleteInternal defines delete command, implemented internally
@@ -274,7 +359,7 @@ func (cmd *Cmd) getSecrets() []string {
 }
 
 // UnmarshalYAML implements yaml.Unmarshaler interface
-// It allows to unmarshal a "copy", "sync" and "delete" from a single field or a slice
+// It allows to unmarshal a "copy", "sync", "delete", "download" and "template" from a single field or a slice
 // All other fields are unmarshalled as usual.
 func (cmd *Cmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var asMap map[string]interface{}
@@ -291,6 +376,8 @@ func (cmd *Cmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		{"copy", &cmd.Copy, &cmd.MCopy},
 		{"sync", &cmd.Sync, &cmd.MSync},
 		{"delete", &cmd.Delete, &cmd.MDelete},
+		{"download", &cmd.Download, &cmd.MDownload},
+		{"template", &cmd.Template, &cmd.MTemplate},
 	}
 
 	// helper function to check if a field is special, matching by filed name (yaml tag)
@@ -344,7 +431,7 @@ func (cmd *Cmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 	}
 
-	// copy, sync and delete are special cases, as they can be either a struct or a list of structs
+	// copy, sync, delete, download and template are special cases, as they can be either a struct or a list of structs
 	for _, sf := range specialFlds {
 		if err := unmarshalField(sf.fld, sf.destSingle); err != nil {
 			if err := unmarshalField(sf.fld, sf.destSlice); err != nil {
@@ -356,8 +443,8 @@ func (cmd *Cmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
-// validate checks if a Cmd has the exactly one command type set (script, copy, mcopy, delete, sync, wait or echo)
-// and returns an error if there are either multiple command types set or none set.
+// validate checks if a Cmd has the exactly one command type set (script, copy, mcopy, delete, sync, download, template,
+// wait or echo) and returns an error if there are either multiple command types set or none set.
 func (cmd *Cmd) validate() error {
 	cmdTypes := []struct {
 		name  string
@@ -370,6 +457,10 @@ func (cmd *Cmd) validate() error {
 		{"mdelete", func() bool { return len(cmd.MDelete) > 0 }},
 		{"sync", func() bool { return cmd.Sync.Source != "" && cmd.Sync.Dest != "" }},
 		{"msync", func() bool { return len(cmd.MSync) > 0 }},
+		{"download", func() bool { return cmd.Download.Source != "" && cmd.Download.Dest != "" }},
+		{"mdownload", func() bool { return len(cmd.MDownload) > 0 }},
+		{"template", func() bool { return cmd.Template.Source != "" && cmd.Template.Dest != "" }},
+		{"mtemplate", func() bool { return len(cmd.MTemplate) > 0 }},
 		{"wait", func() bool { return cmd.Wait.Command != "" }},
 		{"echo", func() bool { return cmd.Echo != "" }},
 	}
@@ -394,6 +485,29 @@ func (cmd *Cmd) validate() error {
 	if cmd.Script == "" && len(cmd.Register) > 0 {
 		return fmt.Errorf("register is only allowed with script command")
 	}
+	if cmd.Script == "" && (cmd.RegisterOutput != "" || cmd.RegisterRC != "" || cmd.RegisterJSON != "") {
+		return fmt.Errorf("register_output, register_rc and register_json are only allowed with script command")
+	}
+
+	switch cmd.Options.BecomeMethod {
+	case "", BecomeSudo, BecomeSu, BecomeDoas:
+	default:
+		return fmt.Errorf("invalid become_method %q, must be one of %s, %s or %s",
+			cmd.Options.BecomeMethod, BecomeSudo, BecomeSu, BecomeDoas)
+	}
+
+	if cmd.Options.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %v, must not be negative", cmd.Options.Timeout)
+	}
+
+	if cmd.ChangedWhen.IsSet() {
+		if cmd.Script == "" {
+			return fmt.Errorf("changed_when is only allowed with script command")
+		}
+		if _, err := regexp.Compile(cmd.ChangedWhen.Output); err != nil {
+			return fmt.Errorf("invalid changed_when output pattern %q: %w", cmd.ChangedWhen.Output, err)
+		}
+	}
 	return nil
 }
 
@@ -461,6 +461,100 @@ copy: {src: source, dst: destination}
 				Copy: CopyInternal{Source: "source", Dest: "destination"},
 			},
 		},
+		{
+			name: "script with changed_when",
+			yamlInput: `
+name: test
+script: ./update.sh
+changed_when: {rc: [2, 3], output: "^updated"}
+`,
+			expectedCmd: Cmd{
+				Name:        "test",
+				Script:      "./update.sh",
+				ChangedWhen: ChangedWhen{ExitCodes: []int{2, 3}, Output: "^updated"},
+			},
+		},
+		{
+			name: "simple download",
+			yamlInput: `
+name: test
+download: {src: /var/log/app.log, dst: logs, mkdir: true}
+`,
+			expectedCmd: Cmd{
+				Name:     "test",
+				Download: DownloadInternal{Source: "/var/log/app.log", Dest: "logs", Mkdir: true},
+			},
+		},
+		{
+			name: "download multiple sets",
+			yamlInput: `
+name: test
+download:
+  - {src: /var/log/app.log, dst: logs}
+  - {src: "/var/log/*.gz", dst: logs, exclude: ["old.gz"]}
+`,
+			expectedCmd: Cmd{
+				Name: "test",
+				MDownload: []DownloadInternal{{Source: "/var/log/app.log", Dest: "logs"},
+					{Source: "/var/log/*.gz", Dest: "logs", Exclude: []string{"old.gz"}}},
+			},
+		},
+		{
+			name: "loop with list",
+			yamlInput: `
+name: test
+script: systemctl restart $SPOT_ITEM
+loop: [nginx, redis]
+`,
+			expectedCmd: Cmd{Name: "test", Script: "systemctl restart $SPOT_ITEM", Loop: LoopItems{"nginx", "redis"}},
+		},
+		{
+			name: "loop with variable",
+			yamlInput: `
+name: test
+script: systemctl restart $SPOT_ITEM
+loop: $SERVICES
+`,
+			expectedCmd: Cmd{Name: "test", Script: "systemctl restart $SPOT_ITEM", Loop: LoopItems{"$SERVICES"}},
+		},
+		{
+			name: "simple template",
+			yamlInput: `
+name: test
+template: {src: nginx.conf.tmpl, dst: /etc/nginx/nginx.conf, mkdir: true}
+`,
+			expectedCmd: Cmd{
+				Name:     "test",
+				Template: TemplateInternal{Source: "nginx.conf.tmpl", Dest: "/etc/nginx/nginx.conf", Mkdir: true},
+			},
+		},
+		{
+			name: "template multiple sets",
+			yamlInput: `
+name: test
+template:
+  - {src: app.conf.tmpl, dst: /etc/app.conf}
+  - {src: run.sh.tmpl, dst: /srv/run.sh, chmod+x: true, force: true}
+`,
+			expectedCmd: Cmd{
+				Name: "test",
+				MTemplate: []TemplateInternal{{Source: "app.conf.tmpl", Dest: "/etc/app.conf"},
+					{Source: "run.sh.tmpl", Dest: "/srv/run.sh", ChmodX: true, Force: true}},
+			},
+		},
+		{
+			name: "copy and sync with checksum",
+			yamlInput: `
+name: test
+copy: {src: source, dst: destination, checksum: true}
+sync: {src: source, dst: destination, checksum: true}
+`,
+			expectedCmd: Cmd{
+				Name: "test",
+				Copy: CopyInternal{Source: "source", Dest: "destination", Checksum: true},
+				Sync: SyncInternal{Source: "source", Dest: "destination", Checksum: true},
+			},
+		},
 		{
 			name: "copy multiple sets",
 			yamlInput: `
@@ -600,12 +694,35 @@ func TestCmd_validate(t *testing.T) {
 		{"only sync", Cmd{Sync: SyncInternal{Source: "source", Dest: "dest"}}, ""},
 		{"only msync", Cmd{MSync: []SyncInternal{{Source: "source", Dest: "dest"}}}, ""},
 		{"only wait", Cmd{Wait: WaitInternal{Command: "command"}}, ""},
+		{"only download", Cmd{Download: DownloadInternal{Source: "source", Dest: "dest"}}, ""},
+		{"only mdownload", Cmd{MDownload: []DownloadInternal{{Source: "source", Dest: "dest"}}}, ""},
+		{"only template", Cmd{Template: TemplateInternal{Source: "source", Dest: "dest"}}, ""},
+		{"only mtemplate", Cmd{MTemplate: []TemplateInternal{{Source: "source", Dest: "dest"}}}, ""},
 		{"multiple fields set", Cmd{Script: "example_script", Copy: CopyInternal{Source: "source", Dest: "dest"}},
 			"only one of [script, copy] is allowed"},
-		{"nothing set", Cmd{}, "one of [script, copy, mcopy, delete, mdelete, sync, msync, wait, echo] must be set"},
+		{"nothing set", Cmd{}, "one of [script, copy, mcopy, delete, mdelete, sync, msync, download, mdownload, template, mtemplate, wait, echo] must be set"},
 		{"script with register", Cmd{Script: "example_script", Register: []string{"a", "b"}}, ""},
 		{"unexpected register", Cmd{Copy: CopyInternal{Source: "source", Dest: "dest"}, Register: []string{"a", "b"}},
 			"register is only allowed with script command"},
+		{"script with register_output and register_rc", Cmd{Script: "example_script", RegisterOutput: "OUT", RegisterRC: "RC"}, ""},
+		{"unexpected register_output", Cmd{Echo: "example", RegisterOutput: "OUT"},
+			"register_output, register_rc and register_json are only allowed with script command"},
+		{"unexpected register_rc", Cmd{Wait: WaitInternal{Command: "true"}, RegisterRC: "RC"},
+			"register_output, register_rc and register_json are only allowed with script command"},
+		{"script with register_json", Cmd{Script: "example_script", RegisterJSON: "RES"}, ""},
+		{"unexpected register_json", Cmd{Echo: "example", RegisterJSON: "RES"},
+			"register_output, register_rc and register_json are only allowed with script command"},
+		{"script with changed_when", Cmd{Script: "example_script", ChangedWhen: ChangedWhen{ExitCodes: []int{2}, Output: "^updated"}}, ""},
+		{"unexpected changed_when", Cmd{Copy: CopyInternal{Source: "source", Dest: "dest"}, ChangedWhen: ChangedWhen{ExitCodes: []int{2}}},
+			"changed_when is only allowed with script command"},
+		{"invalid changed_when pattern", Cmd{Script: "example_script", ChangedWhen: ChangedWhen{Output: "[a-"}},
+			"invalid changed_when output pattern \"[a-\": error parsing regexp: missing closing ]: `[a-`"},
+		{"script with become method", Cmd{Script: "example_script", Options: CmdOptions{Sudo: true, BecomeMethod: "doas"}}, ""},
+		{"invalid become method", Cmd{Script: "example_script", Options: CmdOptions{Sudo: true, BecomeMethod: "pkexec"}},
+			`invalid become_method "pkexec", must be one of sudo, su or doas`},
+		{"script with timeout", Cmd{Script: "example_script", Options: CmdOptions{Timeout: time.Minute}}, ""},
+		{"negative timeout", Cmd{Script: "example_script", Options: CmdOptions{Timeout: -time.Second}},
+			"invalid timeout -1s, must not be negative"},
 	}
 
 	for _, tt := range tbl {
@@ -7,13 +7,17 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-pkgz/stringutils"
 	"github.com/hashicorp/go-multierror"
+	"github.com/kevinburke/ssh_config"
 	"github.com/pelletier/go-toml/v2"
 	"gopkg.in/yaml.v3"
 
@@ -24,13 +28,21 @@ import (
 
 // PlayBook defines the top-level config object
 type PlayBook struct {
-	User       string            `yaml:"user" toml:"user"`               // ssh user
-	SSHKey     string            `yaml:"ssh_key" toml:"ssh_key"`         // ssh key
-	SSHShell   string            `yaml:"ssh_shell" toml:"ssh_shell"`     // ssh shell to use
-	LocalShell string            `yaml:"local_shell" toml:"local_shell"` // local shell to use
-	Inventory  string            `yaml:"inventory" toml:"inventory"`     // inventory file or url
-	Targets    map[string]Target `yaml:"targets" toml:"targets"`         // list of targets/environments
-	Tasks      []Task            `yaml:"tasks" toml:"tasks"`             // list of tasks
+	User         string            `yaml:"user" toml:"user"`                     // ssh user
+	SSHKey       string            `yaml:"ssh_key" toml:"ssh_key"`               // ssh key
+	SSHShell     string            `yaml:"ssh_shell" toml:"ssh_shell"`           // ssh shell to use
+	LocalShell   string            `yaml:"local_shell" toml:"local_shell"`       // local shell to use
+	HostKeyCheck string            `yaml:"host_key_check" toml:"host_key_check"` // host key verification mode
+	KnownHosts   string            `yaml:"known_hosts" toml:"known_hosts"`       // known_hosts file for host key verification
+	ProxyJump    []JumpHost        `yaml:"proxy_jump" toml:"proxy_jump"`         // jump hosts to reach all destinations through
+	Inventory    string            `yaml:"inventory" toml:"inventory"`           // inventory file or url
+	Targets      map[string]Target `yaml:"targets" toml:"targets"`               // list of targets/environments
+	Tasks        []Task            `yaml:"tasks" toml:"tasks"`                   // list of tasks
+	Includes     []Include         `yaml:"includes" toml:"includes"`             // list of playbooks to include tasks from
+
+	// secret keys of ssh credentials, loaded from secrets provider
+	SSHPasswordSecret   string `yaml:"ssh_password_secret" toml:"ssh_password_secret"`
+	SSHPassphraseSecret string `yaml:"ssh_passphrase_secret" toml:"ssh_passphrase_secret"`
 
 	inventory       *InventoryData    // loaded inventory
 	overrides       *Overrides        // overrides passed from cli
@@ -46,43 +58,110 @@ type SecretsProvider interface {
 // SimplePlayBook defines simplified top-level config
 // It is used for unmarshalling only, and result used to make the usual PlayBook
 type SimplePlayBook struct {
-	User       string     `yaml:"user" toml:"user"`                 // ssh user
-	SSHKey     string     `yaml:"ssh_key" toml:"ssh_key"`           // ssh key
-	SSHShell   string     `yaml:"ssh_shell" toml:"ssh_shell"`       // ssh shell to uses
-	LocalShell string     `yaml:"local_shell" toml:"local_shell"`   // local shell to use
-	Inventory  string     `yaml:"inventory" toml:"inventory"`       // inventory file or url
-	Targets    []string   `yaml:"targets" toml:"targets"`           // list of names
-	Target     string     `yaml:"target" toml:"target"`             // a single target to run task on
-	Task       []Cmd      `yaml:"task" toml:"task"`                 // single task is a list of commands
-	Options    CmdOptions `yaml:"options" toml:"options,omitempty"` // options for all commands
+	User         string     `yaml:"user" toml:"user"`                     // ssh user
+	SSHKey       string     `yaml:"ssh_key" toml:"ssh_key"`               // ssh key
+	SSHShell     string     `yaml:"ssh_shell" toml:"ssh_shell"`           // ssh shell to uses
+	LocalShell   string     `yaml:"local_shell" toml:"local_shell"`       // local shell to use
+	HostKeyCheck string     `yaml:"host_key_check" toml:"host_key_check"` // host key verification mode
+	KnownHosts   string     `yaml:"known_hosts" toml:"known_hosts"`       // known_hosts file for host key verification
+	ProxyJump    []JumpHost `yaml:"proxy_jump" toml:"proxy_jump"`         // jump hosts to reach all destinations through
+	Inventory    string     `yaml:"inventory" toml:"inventory"`           // inventory file or url
+	Targets      []string   `yaml:"targets" toml:"targets"`               // list of names
+	Target       string     `yaml:"target" toml:"target"`                 // a single target to run task on
+	Task         []Cmd      `yaml:"task" toml:"task"`                     // single task is a list of commands
+	Options      CmdOptions `yaml:"options" toml:"options,omitempty"`     // options for all commands
+
+	// secret keys of ssh credentials, loaded from secrets provider
+	SSHPasswordSecret   string `yaml:"ssh_password_secret" toml:"ssh_password_secret"`
+	SSHPassphraseSecret string `yaml:"ssh_passphrase_secret" toml:"ssh_passphrase_secret"`
+}
+
+// Include defines a playbook file or url to include tasks, and optionally targets, from.
+// It can be set as a string with the location only or as a struct.
+type Include struct {
+	Path    string `yaml:"path" toml:"path"`       // file or url, relative path is resolved against the including playbook
+	Targets bool   `yaml:"targets" toml:"targets"` // merge targets of the included playbook
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler to allow include set as a string with the location only
+func (inc *Include) UnmarshalText(text []byte) error {
+	inc.Path = string(text)
+	return nil
 }
 
 // Task defines multiple commands runs together
 type Task struct {
-	Name     string     `yaml:"name" toml:"name"` // name of task, mandatory
-	User     string     `yaml:"user" toml:"user"`
-	Commands []Cmd      `yaml:"commands" toml:"commands"`
-	OnError  string     `yaml:"on_error" toml:"on_error"`
-	Targets  []string   `yaml:"targets" toml:"targets"`           // optional list of targets to run task on, names or groups
-	Options  CmdOptions `yaml:"options" toml:"options,omitempty"` // options for all commands
+	Name      string     `yaml:"name" toml:"name"` // name of task, mandatory
+	User      string     `yaml:"user" toml:"user"`
+	Commands  []Cmd      `yaml:"commands" toml:"commands"`
+	OnError   string     `yaml:"on_error" toml:"on_error"`
+	Targets   []string   `yaml:"targets" toml:"targets"`           // optional list of targets to run task on, names or groups
+	Options   CmdOptions `yaml:"options" toml:"options,omitempty"` // options for all commands
+	DependsOn []string   `yaml:"depends_on" toml:"depends_on"`     // optional list of tasks to run before this task
+	Handlers  []Cmd      `yaml:"handlers" toml:"handlers"`         // commands to run at the end of task, if notified
+
+	Serial            string `yaml:"serial" toml:"serial"`                           // hosts per batch, number or percentage
+	MaxFailPercentage int    `yaml:"max_fail_percentage" toml:"max_fail_percentage"` // stop if failed hosts exceed this percentage
+	KeepGoing         bool   `yaml:"keep_going" toml:"keep_going"`                   // don't stop on failed hosts, collect all errors
+	GatherFacts       bool   `yaml:"gather_facts" toml:"gather_facts"`               // gather host facts before running commands
+
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"` // max execution time of the task on each host, no limit if 0
+
+	source string // location of the included playbook the task is from, empty for own tasks
+}
+
+// BatchSize returns the number of hosts in each batch for the given serial setting and the total number of hosts.
+// Serial can be an absolute number of hosts, i.e. "2", or a percentage of all hosts, i.e. "10%".
+// Empty serial means all hosts in a single batch. Percentage rounded up, so each batch has at least one host.
+func BatchSize(serial string, hosts int) (int, error) {
+	serial = strings.TrimSpace(serial)
+	if serial == "" {
+		return hosts, nil
+	}
+
+	if pct, ok := strings.CutSuffix(serial, "%"); ok {
+		val, err := strconv.Atoi(strings.TrimSpace(pct))
+		if err != nil || val <= 0 || val > 100 {
+			return 0, fmt.Errorf("invalid serial %q, percentage must be between 1%% and 100%%", serial)
+		}
+		return max(1, (hosts*val+99)/100), nil
+	}
+
+	val, err := strconv.Atoi(serial)
+	if err != nil || val <= 0 {
+		return 0, fmt.Errorf("invalid serial %q, must be a positive number or percentage", serial)
+	}
+	return min(val, max(hosts, 1)), nil
 }
 
 // Target defines hosts to run commands on
 type Target struct {
-	Name   string        `yaml:"-" toml:"-"`           // name of target, set from the map key
-	Hosts  []Destination `yaml:"hosts" toml:"hosts"`   // direct list of hosts to run commands on, no need to use inventory
-	Groups []string      `yaml:"groups" toml:"groups"` // list of groups to run commands on, matches to inventory
-	Names  []string      `yaml:"names" toml:"names"`   // list of host names to run commands on, matches to inventory
-	Tags   []string      `yaml:"tags" toml:"tags"`     // list of tags to run commands on, matches to inventory
+	Name      string        `yaml:"-" toml:"-"`                   // name of target, set from the map key
+	Hosts     []Destination `yaml:"hosts" toml:"hosts"`           // direct list of hosts to run commands on, no need to use inventory
+	Groups    []string      `yaml:"groups" toml:"groups"`         // list of groups to run commands on, matches to inventory
+	Names     []string      `yaml:"names" toml:"names"`           // list of host names to run commands on, matches to inventory
+	Tags      []string      `yaml:"tags" toml:"tags"`             // list of tags to run commands on, matches to inventory
+	ProxyJump []JumpHost    `yaml:"proxy_jump" toml:"proxy_jump"` // jump hosts to reach target's destinations through
 }
 
 // Destination defines destination info
 type Destination struct {
-	Name string   `yaml:"name" toml:"name"`
-	Host string   `yaml:"host" toml:"host"`
-	Port int      `yaml:"port" toml:"port"`
-	User string   `yaml:"user" toml:"user"`
-	Tags []string `yaml:"tags" toml:"tags"`
+	Name      string     `yaml:"name" toml:"name"`
+	Host      string     `yaml:"host" toml:"host"`
+	Port      int        `yaml:"port" toml:"port"`
+	User      string     `yaml:"user" toml:"user"`
+	Tags      []string   `yaml:"tags" toml:"tags"`
+	ProxyJump []JumpHost `yaml:"proxy_jump" toml:"proxy_jump"` // jump hosts to reach the destination through
+}
+
+// JumpHost defines a jump (bastion) host used to reach destination, similar to ssh's ProxyJump.
+// Multiple jump hosts are chained in the order they are defined.
+type JumpHost struct {
+	Host   string `yaml:"host" toml:"host"`
+	Port   int    `yaml:"port" toml:"port"`       // default is 22
+	User   string `yaml:"user" toml:"user"`       // default is destination's user
+	SSHKey string `yaml:"ssh_key" toml:"ssh_key"` // default is playbook's ssh key
+	Name   string `yaml:"-" toml:"-"`             // ssh config alias the jump host is resolved from, empty if not resolved
 }
 
 // Overrides defines override for task passed from cli
@@ -92,6 +171,8 @@ type Overrides struct {
 	Environment  map[string]string
 	AdHocCommand string
 	SSHShell     string
+	ProxyJump    []JumpHost
+	SSHConfig    *ssh_config.Config // ssh config to resolve host aliases, nil to disable
 }
 
 // InventoryData defines inventory data format
@@ -146,6 +227,10 @@ func New(fname string, overrides *Overrides, secProvider SecretsProvider) (res *
 		return nil, fmt.Errorf("can't unmarshal config: %w", err)
 	}
 
+	if err = res.loadIncludes(fname, res.Includes, map[string]bool{filepath.Clean(fname): true}); err != nil {
+		return nil, fmt.Errorf("can't load includes: %w", err)
+	}
+
 	if err = res.checkConfig(); err != nil {
 		return nil, fmt.Errorf("config %s is invalid: %w", fname, err)
 	}
@@ -154,31 +239,13 @@ func New(fname string, overrides *Overrides, secProvider SecretsProvider) (res *
 
 	for i, tsk := range res.Tasks {
 		for j, c := range tsk.Commands {
-			// set shell (remote and local) for all commands in the task
-			res.Tasks[i].Commands[j].SSHShell = res.remoteShell()
-			res.Tasks[i].Commands[j].LocalShell = res.localShell()
-
-			// append task's secret keys to all the commands
-			res.Tasks[i].Commands[j].Options.Secrets = append(res.Tasks[i].Commands[j].Options.Secrets, tsk.Options.Secrets...)
-			// append task's only_on to all the commands
-			res.Tasks[i].Commands[j].Options.OnlyOn = append(res.Tasks[i].Commands[j].Options.OnlyOn, tsk.Options.OnlyOn...)
-
-			// set bool options for all commands in the task, but only if they are set in the task to true to avoid overriding
-			if tsk.Options.Local {
-				res.Tasks[i].Commands[j].Options.Local = tsk.Options.Local
-			}
-			if tsk.Options.NoAuto {
-				res.Tasks[i].Commands[j].Options.NoAuto = tsk.Options.NoAuto
-			}
-			if tsk.Options.IgnoreErrors {
-				res.Tasks[i].Commands[j].Options.IgnoreErrors = tsk.Options.IgnoreErrors
-			}
-			if tsk.Options.Sudo {
-				res.Tasks[i].Commands[j].Options.Sudo = tsk.Options.Sudo
-			}
-
+			res.applyTaskOptions(tsk, &res.Tasks[i].Commands[j])
 			log.Printf("[DEBUG] load command %q (task: %s)", c.Name, tsk.Name)
 		}
+		for j, c := range tsk.Handlers {
+			res.applyTaskOptions(tsk, &res.Tasks[i].Handlers[j])
+			log.Printf("[DEBUG] load handler %q (task: %s)", c.Name, tsk.Name)
+		}
 	}
 
 	// load secrets from secrets provider
@@ -216,6 +283,56 @@ func New(fname string, overrides *Overrides, secProvider SecretsProvider) (res *
 	return res, nil
 }
 
+// applyTaskOptions sets shells and task's options to the command of the task
+func (p *PlayBook) applyTaskOptions(tsk Task, c *Cmd) {
+	// set shell (remote and local) for all commands in the task
+	c.SSHShell = p.remoteShell()
+	c.LocalShell = p.localShell()
+
+	// append task's secret keys to all the commands
+	c.Options.Secrets = append(c.Options.Secrets, tsk.Options.Secrets...)
+	// append task's only_on to all the commands
+	c.Options.OnlyOn = append(c.Options.OnlyOn, tsk.Options.OnlyOn...)
+
+	// set bool options for all commands in the task, but only if they are set in the task to true to avoid overriding
+	if tsk.Options.Local {
+		c.Options.Local = tsk.Options.Local
+	}
+	if tsk.Options.NoAuto {
+		c.Options.NoAuto = tsk.Options.NoAuto
+	}
+	if tsk.Options.IgnoreErrors {
+		c.Options.IgnoreErrors = tsk.Options.IgnoreErrors
+	}
+	if tsk.Options.Sudo {
+		c.Options.Sudo = tsk.Options.Sudo
+	}
+	// set task's retry for all commands without their own retry
+	if tsk.Options.Retry.Attempts > 0 && c.Options.Retry.Attempts == 0 {
+		c.Options.Retry = tsk.Options.Retry
+	}
+
+	// set task's timeout for all commands without their own
+	if c.Options.Timeout == 0 {
+		c.Options.Timeout = tsk.Options.Timeout
+	}
+
+	// set task's become options for all commands without their own
+	if c.Options.BecomeUser == "" {
+		c.Options.BecomeUser = tsk.Options.BecomeUser
+	}
+	if c.Options.BecomeMethod == "" {
+		c.Options.BecomeMethod = tsk.Options.BecomeMethod
+	}
+	if c.Options.BecomeSecret == "" {
+		c.Options.BecomeSecret = tsk.Options.BecomeSecret
+	}
+	// become password is a secret, load it with the rest of command's secrets
+	if c.Options.BecomeSecret != "" && !stringutils.Contains(c.Options.BecomeSecret, c.Options.Secrets) {
+		c.Options.Secrets = append(c.Options.Secrets, c.Options.BecomeSecret)
+	}
+}
+
 // unmarshalPlaybookFile is trying to parse playbook from the data bytes.
 // It will try to guess format by file extension or use yaml as toml.
 // First it will try to unmarshal to a complete PlayBook struct, if it fails,
@@ -228,14 +345,15 @@ func unmarshalPlaybookFile(fname string, data []byte, overrides *Overrides, res
 			pbookType = "full"
 		}
 		// try to unmarshal yml first and then toml
+		fpath := locationPath(fname)
 		switch {
-		case strings.HasSuffix(fname, ".yml") || strings.HasSuffix(fname, ".yaml") || !strings.Contains(fname, "."):
+		case strings.HasSuffix(fpath, ".yml") || strings.HasSuffix(fpath, ".yaml") || !strings.Contains(filepath.Base(fpath), "."):
 			yamlDecoder := yaml.NewDecoder(bytes.NewReader(data))
 			yamlDecoder.KnownFields(true) // strict mode, fail on unknown fields
 			if err = yamlDecoder.Decode(v); err != nil {
 				return fmt.Errorf("can't unmarshal yaml playbook (%s mode) %s: %w", pbookType, fname, err)
 			}
-		case strings.HasSuffix(fname, ".toml"):
+		case strings.HasSuffix(fpath, ".toml"):
 			if err = toml.Unmarshal(data, v); err != nil {
 				return fmt.Errorf("can't unmarshal toml playbook %s: %w", fname, err)
 			}
@@ -258,7 +376,7 @@ func unmarshalPlaybookFile(fname string, data []byte, overrides *Overrides, res
 	}
 
 	errs := new(multierror.Error)
-	if err = unmarshal(data, res, true); err == nil && len(res.Tasks) > 0 {
+	if err = unmarshal(data, res, true); err == nil && (len(res.Tasks) > 0 || len(res.Includes) > 0) {
 		return nil // success, this is full PlayBook config
 	}
 	errs = multierror.Append(errs, err)
@@ -267,6 +385,11 @@ func unmarshalPlaybookFile(fname string, data []byte, overrides *Overrides, res
 	if err := unmarshal(data, simple, false); err == nil && len(simple.Task) > 0 {
 		// success, this is SimplePlayBook config, convert it to full PlayBook config
 		res.Inventory = simple.Inventory
+		res.HostKeyCheck = simple.HostKeyCheck
+		res.KnownHosts = simple.KnownHosts
+		res.ProxyJump = simple.ProxyJump
+		res.SSHPasswordSecret = simple.SSHPasswordSecret
+		res.SSHPassphraseSecret = simple.SSHPassphraseSecret
 		res.Tasks = []Task{{Commands: simple.Task}} // simple playbook has just a list of commands as the task
 		res.Tasks[0].Name = "default"               // we have only one task, set it as default
 
@@ -290,9 +413,9 @@ func unmarshalPlaybookFile(fname string, data []byte, overrides *Overrides, res
 				log.Printf("[DEBUG] set target name %s", t)
 			}
 
-			if !hasInventory && !strings.Contains(t, ":") { // set as host with :22 in case of just name and no inventory
-				target.Hosts = append(target.Hosts, Destination{Host: t, Port: 22}) // set as hosts in case of ip:port
-				log.Printf("[DEBUG] set target host %s:22", t)
+			if !hasInventory && !strings.Contains(t, ":") { // set as host in case of just name and no inventory
+				target.Hosts = append(target.Hosts, Destination{Host: t}) // port is set by TargetHosts
+				log.Printf("[DEBUG] set target host %s", t)
 			}
 		}
 		res.Targets = map[string]Target{"default": target}
@@ -368,13 +491,20 @@ func (p *PlayBook) Task(name string) (*Task, error) {
 				}
 				res.Commands[cmdIdx].Environment[envKey] = envVal
 			}
+			for hIdx := range res.Handlers {
+				if res.Handlers[hIdx].Environment == nil {
+					res.Handlers[hIdx].Environment = make(map[string]string)
+				}
+				res.Handlers[hIdx].Environment[envKey] = envVal
+			}
 		}
 	}
 
 	return res, nil
 }
 
-// TargetHosts returns target hosts for given target name.
+// TargetHosts returns target hosts for given target name. Host aliases are resolved with ssh config, if set in overrides.
+// Port and user not set for the host explicitly nor by ssh config default to 22 and to the playbook's user.
 func (p *PlayBook) TargetHosts(name string) ([]Destination, error) {
 
 	userOverride := func(u string) string {
@@ -390,23 +520,78 @@ func (p *PlayBook) TargetHosts(name string) ([]Destination, error) {
 		return p.User
 	}
 
-	tgExtractor := newTargetExtractor(p.Targets, p.User, p.inventory)
+	proxyJumpOverride := func(jumps []JumpHost) []JumpHost {
+		// apply overrides of jump hosts
+		if p.overrides != nil && len(p.overrides.ProxyJump) > 0 {
+			return p.overrides.ProxyJump
+		}
+		// no overrides, use jump hosts from destination or target if set
+		if len(jumps) > 0 {
+			return jumps
+		}
+		// no overrides, no jump hosts in destination or target, use default from playbook
+		return p.ProxyJump
+	}
+
+	var sshConf *ssh_config.Config
+	if p.overrides != nil {
+		sshConf = p.overrides.SSHConfig
+	}
+	tgExtractor := newTargetExtractor(p.Targets, p.inventory)
+	if sshConf != nil {
+		tgExtractor = tgExtractor.withSSHConfig(sshConf)
+	}
 	res, err := tgExtractor.Destinations(name)
 	if err != nil {
 		return nil, err
 	}
 
+	// port and user are set only if not set explicitly or by ssh config
 	for i, h := range res {
 		if h.Port == 0 {
 			h.Port = 22 // the default port is 22 if not set
 		}
 		h.User = userOverride(h.User)
+		if h.ProxyJump, err = resolveJumpHosts(sshConf, proxyJumpOverride(h.ProxyJump)); err != nil {
+			return nil, fmt.Errorf("can't resolve jump hosts of %q: %w", h.Host, err)
+		}
 		res[i] = h
 	}
 
 	return res, nil
 }
 
+// ParseProxyJump parses jump hosts from a comma-separated list of [user@]host[:port] entries,
+// the same format as ssh's ProxyJump option. Port is left unset if not in the entry. Empty string returns nil.
+func ParseProxyJump(inp string) ([]JumpHost, error) {
+	if strings.TrimSpace(inp) == "" {
+		return nil, nil
+	}
+	res := []JumpHost{}
+	for _, elem := range strings.Split(inp, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		jh := JumpHost{Host: elem}
+		if i := strings.LastIndex(elem, "@"); i >= 0 {
+			jh.User, jh.Host = elem[:i], elem[i+1:]
+		}
+		if host, portStr, err := net.SplitHostPort(jh.Host); err == nil {
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				return nil, fmt.Errorf("can't parse port of jump host %q: %w", elem, err)
+			}
+			jh.Host, jh.Port = host, port
+		}
+		if jh.Host == "" {
+			return nil, fmt.Errorf("empty host in jump host %q", elem)
+		}
+		res = append(res, jh)
+	}
+	return res, nil
+}
+
 // AllSecretValues returns all secret values from all tasks and all commands.
 // It is used to mask Secrets in logs.
 func (p *PlayBook) AllSecretValues() []string {
@@ -418,6 +603,18 @@ func (p *PlayBook) AllSecretValues() []string {
 	return res
 }
 
+// SSHSecrets returns ssh password and private key passphrase loaded from secrets provider
+// by ssh_password_secret and ssh_passphrase_secret keys. Empty if not set.
+func (p *PlayBook) SSHSecrets() (password, passphrase string) {
+	if p.SSHPasswordSecret != "" {
+		password = p.secrets[p.SSHPasswordSecret]
+	}
+	if p.SSHPassphraseSecret != "" {
+		passphrase = p.secrets[p.SSHPassphraseSecret]
+	}
+	return password, passphrase
+}
+
 // UpdateTasksTargets updates the targets of all tasks in the playbook with the values from the specified map of variables.
 // The method is used to replace variables in the targets of tasks with their actual values and this way provide dynamic targets.
 func (p *PlayBook) UpdateTasksTargets(vars map[string]string) {
@@ -445,40 +642,19 @@ func (p *PlayBook) UpdateTasksTargets(vars map[string]string) {
 // The method also performs some additional processing on the inventory data:
 // - It creates a group "all" that contains all hosts from all groups.
 // - It sorts the hosts in the "all" group by host name for predictable order in tests and processing.
-// - It sets default port and user values for all inventory groups if not already set.
+// - It resolves hosts with ssh config, if set in overrides, and sets default port and user values for all inventory
+// groups if not set by inventory or ssh config.
 // Returns an error if the inventory data cannot be loaded or parsed, or if the "all" group is reserved for all hosts.
 func (p *PlayBook) loadInventory(loc string) (*InventoryData, error) {
 
-	reader := func(loc string) (r io.ReadCloser, err error) {
-		// get reader for inventory file or url
-		switch {
-		case strings.HasPrefix(loc, "http"): // location is a url
-			client := &http.Client{Timeout: 10 * time.Second}
-			resp, err := client.Get(loc)
-			if err != nil {
-				return nil, fmt.Errorf("can't get inventory from http %s: %w", loc, err)
-			}
-			if resp.StatusCode != http.StatusOK {
-				return nil, fmt.Errorf("can't get inventory from http %s, status: %s", loc, resp.Status)
-			}
-			return resp.Body, nil
-		default: // location is a file
-			f, err := os.Open(loc) // nolint
-			if err != nil {
-				return nil, fmt.Errorf("can't open inventory file %s: %w", loc, err)
-			}
-			return f, nil
-		}
-	}
-
-	rdr, err := reader(loc) // inventory ReadCloser, has to be closed
+	rdr, err := openLocation(loc, "inventory") // inventory ReadCloser, has to be closed
 	if err != nil {
 		return nil, err
 	}
 	defer rdr.Close() // nolint
 
 	var data InventoryData
-	if !strings.HasSuffix(loc, ".toml") {
+	if !strings.HasSuffix(locationPath(loc), ".toml") {
 		// we assume it is yaml. Can't do strict check, as we can have urls without any extension
 		if err = yaml.NewDecoder(rdr).Decode(&data); err != nil {
 			return nil, fmt.Errorf("can't parse inventory %s: %w", loc, err)
@@ -518,9 +694,16 @@ func (p *PlayBook) loadInventory(loc string) (*InventoryData, error) {
 		return data.Groups[allHostsGrp][i].Host < data.Groups[allHostsGrp][j].Host
 	})
 
-	// set default port and user if not set for all inventory groups
+	// resolve hosts with ssh config, if set, and set default port and user if not set for all inventory groups
+	var sshConf *ssh_config.Config
+	if p.overrides != nil {
+		sshConf = p.overrides.SSHConfig
+	}
 	for _, gr := range data.Groups {
 		for i := range gr {
+			if gr[i], err = resolveSSHConfig(sshConf, gr[i]); err != nil {
+				return nil, fmt.Errorf("can't resolve inventory host %q: %w", gr[i].Host, err)
+			}
 			if gr[i].Port == 0 {
 				gr[i].Port = 22 // the default port is 22 if not set
 			}
@@ -533,10 +716,134 @@ func (p *PlayBook) loadInventory(loc string) (*InventoryData, error) {
 	return &data, nil
 }
 
+// loadIncludes loads playbooks from includes and merges their tasks, and targets if enabled, into the playbook.
+// Includes of the included playbooks are loaded recursively. Relative locations are resolved against the location
+// of the including playbook, and each location is included once, i.e. repeated and circular includes are skipped.
+// Included tasks are appended after the playbook's tasks. Duplicate task names are rejected by checkConfig,
+// duplicate target names are rejected here.
+func (p *PlayBook) loadIncludes(loc string, includes []Include, seen map[string]bool) error {
+	for _, inc := range includes {
+		if inc.Path == "" {
+			return fmt.Errorf("include in %s has no path", loc)
+		}
+		incLoc := includeLocation(loc, inc.Path)
+		if seen[incLoc] {
+			log.Printf("[DEBUG] playbook %s already included, skip", incLoc)
+			continue
+		}
+		seen[incLoc] = true
+
+		rdr, err := openLocation(incLoc, "playbook")
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(rdr)
+		rdr.Close() // nolint
+		if err != nil {
+			return fmt.Errorf("can't read playbook %s: %w", incLoc, err)
+		}
+
+		included := &PlayBook{}
+		if err = unmarshalPlaybookFile(incLoc, data, p.overrides, included); err != nil {
+			return fmt.Errorf("can't unmarshal included playbook: %w", err)
+		}
+		if err = included.loadIncludes(incLoc, included.Includes, seen); err != nil {
+			return err
+		}
+
+		for _, t := range included.Tasks {
+			if t.source == "" {
+				t.source = incLoc
+			}
+			p.Tasks = append(p.Tasks, t)
+		}
+		log.Printf("[INFO] included %d tasks from %s", len(included.Tasks), incLoc)
+
+		if !inc.Targets {
+			continue
+		}
+		for k, v := range included.Targets {
+			if _, ok := p.Targets[k]; ok {
+				return fmt.Errorf("duplicate target name %q, included from %s", k, incLoc)
+			}
+			if p.Targets == nil {
+				p.Targets = make(map[string]Target)
+			}
+			p.Targets[k] = v
+		}
+		log.Printf("[DEBUG] included %d targets from %s", len(included.Targets), incLoc)
+	}
+	return nil
+}
+
+// includeLocation returns the location of the included playbook. Relative locations are resolved against the location
+// of the including playbook, both for files and urls.
+func includeLocation(base, loc string) string {
+	if isURL(loc) || filepath.IsAbs(loc) {
+		return loc
+	}
+	if isURL(base) {
+		baseURL, err := url.Parse(base)
+		if err != nil {
+			return loc
+		}
+		locURL, err := baseURL.Parse(loc)
+		if err != nil {
+			return loc
+		}
+		return locURL.String()
+	}
+	return filepath.Join(filepath.Dir(base), loc)
+}
+
+// openLocation returns reader for a file or url location, kind is used in error messages only.
+// The returned ReadCloser has to be closed by the caller.
+func openLocation(loc, kind string) (r io.ReadCloser, err error) {
+	switch {
+	case isURL(loc):
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(loc)
+		if err != nil {
+			return nil, fmt.Errorf("can't get %s from http %s: %w", kind, loc, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close() // nolint
+			return nil, fmt.Errorf("can't get %s from http %s, status: %s", kind, loc, resp.Status)
+		}
+		return resp.Body, nil
+	default: // location is a file
+		f, err := os.Open(loc) // nolint
+		if err != nil {
+			return nil, fmt.Errorf("can't open %s file %s: %w", kind, loc, err)
+		}
+		return f, nil
+	}
+}
+
+// isURL checks if the location is a http or https url, not a file
+func isURL(loc string) bool {
+	return strings.HasPrefix(loc, "http://") || strings.HasPrefix(loc, "https://")
+}
+
+// locationPath returns the path of the location, used to detect the format by extension. For urls it is the url's path,
+// without the host, query and fragment.
+func locationPath(loc string) string {
+	if !isURL(loc) {
+		return loc
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	return u.Path
+}
+
 // checkConfig validates the PlayBook configuration by ensuring that:
-// - all tasks have unique names and no empty names
+// - all tasks have unique names and no empty names, including tasks from included playbooks
 // - all commands have a single type set
+// - task dependencies refer to existing tasks and have no cycles
 // - the target set is not called "all"
+// - host key check mode, if set, is one of "strict", "accept-new" or "off"
 // Returns an error if any of these conditions are not met.
 func (p *PlayBook) checkConfig() error {
 
@@ -547,6 +854,9 @@ func (p *PlayBook) checkConfig() error {
 			return fmt.Errorf("task name is required")
 		}
 		if names[t.Name] { // task name must be unique
+			if t.source != "" {
+				return fmt.Errorf("duplicate task name %q, included from %s", t.Name, t.source)
+			}
 			return fmt.Errorf("duplicate task name %q", t.Name)
 		}
 		names[t.Name] = true
@@ -562,6 +872,27 @@ func (p *PlayBook) checkConfig() error {
 				return fmt.Errorf("task %q rejected, invalid command %q: %w", t.Name, c.Name, err)
 			}
 		}
+		if err := t.checkHandlers(); err != nil {
+			return fmt.Errorf("task %q rejected: %w", t.Name, err)
+		}
+	}
+
+	// check what batch settings are valid
+	for _, t := range p.Tasks {
+		if _, err := BatchSize(t.Serial, 1); err != nil {
+			return fmt.Errorf("task %q rejected: %w", t.Name, err)
+		}
+		if t.MaxFailPercentage < 0 || t.MaxFailPercentage > 100 {
+			return fmt.Errorf("task %q rejected, invalid max_fail_percentage %d, must be between 0 and 100", t.Name, t.MaxFailPercentage)
+		}
+		if t.Timeout < 0 {
+			return fmt.Errorf("task %q rejected, invalid timeout %v, must not be negative", t.Name, t.Timeout)
+		}
+	}
+
+	// check what task dependencies are known and make no cycles
+	if err := p.checkDependencies(); err != nil {
+		return err
 	}
 
 	// check what target set is not called "all"
@@ -571,13 +902,97 @@ func (p *PlayBook) checkConfig() error {
 		}
 	}
 
+	// check what host key check mode is valid
+	switch p.HostKeyCheck {
+	case "", "strict", "accept-new", "off":
+	default:
+		return fmt.Errorf("invalid host_key_check %q, must be one of strict, accept-new or off", p.HostKeyCheck)
+	}
+
+	return nil
+}
+
+// checkHandlers checks what handlers are valid commands with unique names, and all notified handlers exist.
+// Handlers can't notify other handlers.
+func (t *Task) checkHandlers() error {
+	handlers := make(map[string]bool, len(t.Handlers))
+	for _, h := range t.Handlers {
+		if h.Name == "" {
+			return fmt.Errorf("handler name is required")
+		}
+		if handlers[h.Name] {
+			return fmt.Errorf("duplicate handler name %q", h.Name)
+		}
+		handlers[h.Name] = true
+		if err := h.validate(); err != nil {
+			return fmt.Errorf("invalid handler %q: %w", h.Name, err)
+		}
+		if len(h.Notify) > 0 {
+			return fmt.Errorf("handler %q can't notify other handlers", h.Name)
+		}
+	}
+	for _, c := range t.Commands {
+		for _, n := range c.Notify {
+			if !handlers[n] {
+				return fmt.Errorf("command %q notifies unknown handler %q", c.Name, n)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDependencies checks what all tasks in depends_on exist, and the dependency graph of tasks is a DAG, i.e. has no cycles.
+// The cycle is detected with depth-first search, reporting the path of tasks making the cycle.
+func (p *PlayBook) checkDependencies() error {
+	tasks := make(map[string]Task, len(p.Tasks))
+	for _, t := range p.Tasks {
+		tasks[t.Name] = t
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(p.Tasks))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("task dependency cycle detected: %s", strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		for _, dep := range tasks[name].DependsOn {
+			if _, ok := tasks[dep]; !ok {
+				return fmt.Errorf("task %q depends on unknown task %q", name, dep)
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	for _, t := range p.Tasks {
+		if err := visit(t.Name, nil); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // loadSecrets loads secrets from secrets provider and stores them in secrets map
 func (p *PlayBook) loadSecrets() error {
 	// check if secrets are defined in playbook
-	secretsCount := 0
+	sshSecrets := []string{}
+	for _, key := range []string{p.SSHPasswordSecret, p.SSHPassphraseSecret} {
+		if key != "" {
+			sshSecrets = append(sshSecrets, key)
+		}
+	}
+	secretsCount := len(sshSecrets)
 	for _, t := range p.Tasks {
 		for _, c := range t.Commands {
 			if c.Options.NoAuto {
@@ -585,6 +1000,9 @@ func (p *PlayBook) loadSecrets() error {
 			}
 			secretsCount += len(c.Options.Secrets)
 		}
+		for _, h := range t.Handlers {
+			secretsCount += len(h.Options.Secrets)
+		}
 	}
 
 	if p.secretsProvider == nil && secretsCount == 0 {
@@ -598,21 +1016,40 @@ func (p *PlayBook) loadSecrets() error {
 		p.secrets = make(map[string]string)
 	}
 
-	// collect Secrets from all command's, retrieve them from provider and store in the secrets map
+	// ssh credentials are used to connect, before any command is executed
+	for _, key := range sshSecrets {
+		val, err := p.secretsProvider.Get(key)
+		if err != nil {
+			return fmt.Errorf("can't get ssh secret %q: %w", key, err)
+		}
+		p.secrets[key] = val
+	}
+
+	// collect Secrets from all command's and handlers, retrieve them from provider and store in the secrets map
+	loadCmdSecrets := func(t Task, c *Cmd) error {
+		for _, key := range c.Options.Secrets {
+			val, err := p.secretsProvider.Get(key)
+			if err != nil {
+				return fmt.Errorf("can't get secret %q defined in task %q, command %q: %w", key, t.Name, c.Name, err)
+			}
+			p.secrets[key] = val // store secret in the secrets map of playbook
+			if c.Secrets == nil {
+				c.Secrets = make(map[string]string)
+			}
+			c.Secrets[key] = val // store secret in the secrets map of command
+		}
+		return nil
+	}
 	for _, t := range p.Tasks {
-		for i, c := range t.Commands {
-			for _, key := range c.Options.Secrets {
-				val, err := p.secretsProvider.Get(key)
-				if err != nil {
-					return fmt.Errorf("can't get secret %q defined in task %q, command %q: %w", key, t.Name, c.Name, err)
-				}
-				p.secrets[key] = val // store secret in the secrets map of playbook
-				if c.Secrets == nil {
-					c.Secrets = make(map[string]string)
-				}
-				c.Secrets[key] = val // store secret in the secrets map of command
+		for i := range t.Commands {
+			if err := loadCmdSecrets(t, &t.Commands[i]); err != nil {
+				return err
+			}
+		}
+		for i := range t.Handlers {
+			if err := loadCmdSecrets(t, &t.Handlers[i]); err != nil {
+				return err
 			}
-			t.Commands[i] = c
 		}
 	}
 	return nil
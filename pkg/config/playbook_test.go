@@ -7,7 +7,9 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/kevinburke/ssh_config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -145,8 +147,13 @@ func TestPlaybook_New(t *testing.T) {
 
 		assert.Equal(t, 1, len(c.Targets))
 		assert.Equal(t, 0, len(c.Targets["default"].Names))
-		assert.Equal(t, []Destination{{Host: "name1", Port: 22}, {Host: "192.168.1.1", Port: 22},
-			{Host: "127.0.0.1", Port: 2222}}, c.Targets["default"].Hosts)
+		assert.Equal(t, []Destination{{Host: "name1"}, {Host: "192.168.1.1"},
+			{Host: "127.0.0.1", Port: 2222}}, c.Targets["default"].Hosts, "port set only if explicit")
+
+		hosts, err := c.TargetHosts("default")
+		require.NoError(t, err)
+		assert.Equal(t, []Destination{{Host: "name1", Port: 22, User: "app"}, {Host: "192.168.1.1", Port: 22, User: "app"},
+			{Host: "127.0.0.1", Port: 2222, User: "app"}}, hosts)
 	})
 
 	t.Run("simple playbook with a single target set", func(t *testing.T) {
@@ -230,14 +237,25 @@ func TestPlaybook_New(t *testing.T) {
 		assert.EqualValues(t, map[string]string{"SEC1": "VAL1", "SEC11": "VAL11", "SEC12": "VAL12", "SEC2": "VAL2"}, tsk.Commands[4].Secrets)
 		assert.Equal(t, []string{"VAL1", "VAL11", "VAL12", "VAL2"}, p.AllSecretValues())
 
-		assert.Equal(t, CmdOptions{IgnoreErrors: true, NoAuto: true, Secrets: []string{"SEC11", "SEC12"}}, p.Tasks[0].Commands[0].Options)
-		assert.Equal(t, CmdOptions{IgnoreErrors: true, NoAuto: true, Secrets: []string{"SEC11", "SEC12"}}, p.Tasks[0].Commands[1].Options)
+		taskRetry := RetryOptions{Attempts: 3, Delay: time.Second, Backoff: 2}
+		assert.Equal(t, CmdOptions{IgnoreErrors: true, NoAuto: true, Secrets: []string{"SEC11", "SEC12"}, Retry: taskRetry},
+			p.Tasks[0].Commands[0].Options)
+		assert.Equal(t, CmdOptions{IgnoreErrors: true, NoAuto: true, Secrets: []string{"SEC11", "SEC12"}, Retry: taskRetry},
+			p.Tasks[0].Commands[1].Options)
 		assert.Equal(t, CmdOptions{IgnoreErrors: true, NoAuto: true, Local: true,
-			Secrets: []string{"SEC11", "SEC12"}}, p.Tasks[0].Commands[2].Options)
+			Secrets: []string{"SEC11", "SEC12"}, Retry: taskRetry}, p.Tasks[0].Commands[2].Options)
 		assert.Equal(t, CmdOptions{IgnoreErrors: true, NoAuto: true, Local: false, Sudo: true,
-			Secrets: []string{"SEC11", "SEC12"}}, p.Tasks[0].Commands[3].Options)
+			Secrets: []string{"SEC11", "SEC12"}, Retry: taskRetry}, p.Tasks[0].Commands[3].Options)
 		assert.Equal(t, CmdOptions{IgnoreErrors: true, NoAuto: true, Local: false, Sudo: false,
-			Secrets: []string{"SEC1", "SEC2", "SEC11", "SEC12"}}, p.Tasks[0].Commands[4].Options)
+			Secrets: []string{"SEC1", "SEC2", "SEC11", "SEC12"}, Retry: RetryOptions{Attempts: 5, Delay: 10 * time.Second}},
+			p.Tasks[0].Commands[4].Options, "command's own retry is not overridden by task's retry")
+
+		assert.Equal(t, []string{"restart remark42"}, p.Tasks[0].Commands[1].Notify)
+		require.Len(t, p.Tasks[0].Handlers, 1)
+		assert.Equal(t, CmdOptions{IgnoreErrors: true, NoAuto: true, Sudo: true, Secrets: []string{"SEC11", "SEC12"},
+			Retry: taskRetry}, p.Tasks[0].Handlers[0].Options, "task's options applied to handler")
+		assert.Equal(t, map[string]string{"SEC11": "VAL11", "SEC12": "VAL12"}, tsk.Handlers[0].Secrets)
+		assert.Equal(t, "/bin/sh", tsk.Handlers[0].SSHShell)
 	})
 
 	t.Run("playbook prohibited all target", func(t *testing.T) {
@@ -272,6 +290,183 @@ func TestPlaybook_New(t *testing.T) {
 	})
 }
 
+func TestPlaybook_NewWithIncludes(t *testing.T) {
+	taskNames := func(tasks []Task) (res []string) {
+		for _, t := range tasks {
+			res = append(res, t.Name)
+		}
+		return res
+	}
+
+	t.Run("yaml with includes", func(t *testing.T) {
+		c, err := New("testdata/includes/main.yml", nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"deploy", "docker-restart", "health-check", "cleanup", "toml-task"}, taskNames(c.Tasks))
+		assert.Equal(t, "/bin/sh", c.Tasks[1].Commands[0].SSHShell, "included task is set up as own one")
+
+		// targets are merged from targets.toml only, tasks.yml included without targets
+		require.Len(t, c.Targets, 2)
+		assert.Equal(t, "prod", c.Targets["prod"].Name)
+		assert.Equal(t, "staging", c.Targets["staging"].Name)
+		assert.Equal(t, []Destination{{Host: "s1.example.com", Port: 2222}}, c.Targets["staging"].Hosts)
+
+		tsk, err := c.Task("health-check")
+		require.NoError(t, err)
+		assert.Equal(t, "umputun", tsk.User, "included task gets playbook's user")
+	})
+
+	t.Run("toml with includes", func(t *testing.T) {
+		c, err := New("testdata/includes/main.toml", nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"deploy", "docker-restart", "health-check", "cleanup"}, taskNames(c.Tasks))
+		assert.Empty(t, c.Targets)
+	})
+
+	t.Run("circular includes", func(t *testing.T) {
+		c, err := New("testdata/includes/cycle-a.yml", nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"task-a", "task-b"}, taskNames(c.Tasks))
+	})
+
+	t.Run("duplicate task", func(t *testing.T) {
+		_, err := New("testdata/includes/dup-task.yml", nil, nil)
+		require.EqualError(t, err, `config testdata/includes/dup-task.yml is invalid: duplicate task name "health-check", `+
+			"included from testdata/includes/common/tasks.yml")
+	})
+
+	t.Run("duplicate target", func(t *testing.T) {
+		_, err := New("testdata/includes/dup-target.yml", nil, nil)
+		require.EqualError(t, err, `can't load includes: duplicate target name "staging", `+
+			"included from testdata/includes/common/targets.toml")
+	})
+
+	t.Run("missing include", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "spot.yml"), []byte("includes: [missing.yml]\n"), 0o600))
+		_, err := New(filepath.Join(dir, "spot.yml"), nil, nil)
+		require.ErrorContains(t, err, "can't open playbook file "+filepath.Join(dir, "missing.yml"))
+	})
+
+	t.Run("includes from url", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/shared/tasks.yml":
+				_, _ = w.Write([]byte("includes: [more.yml]\ntasks:\n  - name: url-task\n    commands:\n" +
+					"      - {name: c1, script: echo 1}\n"))
+			case "/shared/more.yml":
+				_, _ = w.Write([]byte("tasks:\n  - name: url-more-task\n    commands:\n      - {name: c2, script: echo 2}\n"))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer ts.Close()
+
+		dir := t.TempDir()
+		pbook := fmt.Sprintf("includes: [%s/shared/tasks.yml]\ntasks:\n  - name: own\n    commands:\n"+
+			"      - {name: c0, script: echo 0}\n", ts.URL)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "spot.yml"), []byte(pbook), 0o600))
+		c, err := New(filepath.Join(dir, "spot.yml"), nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"own", "url-task", "url-more-task"}, taskNames(c.Tasks))
+	})
+
+	t.Run("toml include from url with query", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/shared/tasks.toml" || r.URL.Query().Get("ref") != "main" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte("[[tasks]]\nname = \"toml-task\"\n[[tasks.commands]]\nname = \"c1\"\nscript = \"echo 1\"\n"))
+		}))
+		defer ts.Close()
+
+		dir := t.TempDir()
+		pbook := fmt.Sprintf("includes: [\"%s/shared/tasks.toml?ref=main\"]\ntasks:\n  - name: own\n    commands:\n"+
+			"      - {name: c0, script: echo 0}\n", ts.URL)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "spot.yml"), []byte(pbook), 0o600))
+		c, err := New(filepath.Join(dir, "spot.yml"), nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"own", "toml-task"}, taskNames(c.Tasks))
+	})
+}
+
+func Test_locationPath(t *testing.T) {
+	tbl := []struct {
+		loc, expected string
+	}{
+		{"playbooks/spot.yml", "playbooks/spot.yml"},
+		{"http-checks.yml", "http-checks.yml"},
+		{"https://example.com/pb/spot.toml", "/pb/spot.toml"},
+		{"https://example.com/pb/spot.toml?ref=main#top", "/pb/spot.toml"},
+		{"http://example.com", ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.loc, func(t *testing.T) {
+			assert.Equal(t, tt.expected, locationPath(tt.loc))
+		})
+	}
+}
+
+func Test_includeLocation(t *testing.T) {
+	tbl := []struct {
+		base, loc, expected string
+	}{
+		{"spot.yml", "common.yml", "common.yml"},
+		{"playbooks/spot.yml", "common/tasks.yml", "playbooks/common/tasks.yml"},
+		{"playbooks/spot.yml", "../common.yml", "common.yml"},
+		{"playbooks/spot.yml", "/etc/spot/common.yml", "/etc/spot/common.yml"},
+		{"playbooks/spot.yml", "https://example.com/common.yml", "https://example.com/common.yml"},
+		{"https://example.com/pb/spot.yml", "common.yml", "https://example.com/pb/common.yml"},
+		{"https://example.com/pb/spot.yml", "../shared/common.yml", "https://example.com/shared/common.yml"},
+		{"playbooks/spot.yml", "http-checks.yml", "playbooks/http-checks.yml"},
+		{"https://example.com/pb/spot.yml", "http-checks.yml", "https://example.com/pb/http-checks.yml"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.base+"+"+tt.loc, func(t *testing.T) {
+			assert.Equal(t, tt.expected, includeLocation(tt.base, tt.loc))
+		})
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	tbl := []struct {
+		serial   string
+		hosts    int
+		expected int
+		err      string
+	}{
+		{"", 10, 10, ""},
+		{"3", 10, 3, ""},
+		{" 3 ", 10, 3, ""},
+		{"20", 10, 10, ""},
+		{"1", 0, 1, ""},
+		{"10%", 10, 1, ""},
+		{"25%", 10, 3, ""},
+		{"50%", 5, 3, ""},
+		{"100%", 7, 7, ""},
+		{"1%", 3, 1, ""},
+		{"0", 10, 0, `invalid serial "0", must be a positive number or percentage`},
+		{"-2", 10, 0, `invalid serial "-2", must be a positive number or percentage`},
+		{"abc", 10, 0, `invalid serial "abc", must be a positive number or percentage`},
+		{"0%", 10, 0, `invalid serial "0%", percentage must be between 1% and 100%`},
+		{"120%", 10, 0, `invalid serial "120%", percentage must be between 1% and 100%`},
+		{"x%", 10, 0, `invalid serial "x%", percentage must be between 1% and 100%`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.serial, func(t *testing.T) {
+			res, err := BatchSize(tt.serial, tt.hosts)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, res)
+		})
+	}
+}
+
 func TestPlayBook_Task(t *testing.T) {
 
 	t.Run("not-found", func(t *testing.T) {
@@ -472,6 +667,160 @@ func TestTargetHosts(t *testing.T) {
 	}
 }
 
+func TestTargetHosts_proxyJump(t *testing.T) {
+	bastion := []JumpHost{{Host: "bastion.example.com", Port: 22, User: "jump"}}
+	p := &PlayBook{
+		User:      "defaultuser",
+		ProxyJump: []JumpHost{{Host: "default-bastion.example.com", Port: 2222}},
+		Targets: map[string]Target{
+			"target1": {Name: "target1", Hosts: []Destination{{Host: "host1.example.com", Port: 22}}},
+			"target2": {Name: "target2", Hosts: []Destination{{Host: "host2.example.com", Port: 22}}, ProxyJump: bastion},
+			"target3": {Name: "target3", ProxyJump: bastion, Hosts: []Destination{
+				{Host: "host3.example.com", Port: 22, ProxyJump: []JumpHost{{Host: "own-bastion.example.com", Port: 22}}},
+			}},
+		},
+		inventory: &InventoryData{Groups: map[string][]Destination{"all": {}}},
+	}
+
+	testCases := []struct {
+		name       string
+		targetName string
+		overrides  *Overrides
+		expected   []JumpHost
+	}{
+		{"playbook jump hosts", "target1", nil, []JumpHost{{Host: "default-bastion.example.com", Port: 2222}}},
+		{"target jump hosts", "target2", nil, bastion},
+		{"destination jump hosts", "target3", nil, []JumpHost{{Host: "own-bastion.example.com", Port: 22}}},
+		{"overridden jump hosts", "target3", &Overrides{ProxyJump: []JumpHost{{Host: "cli.example.com", Port: 22}}},
+			[]JumpHost{{Host: "cli.example.com", Port: 22}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p.overrides = tc.overrides
+			res, err := p.TargetHosts(tc.targetName)
+			require.NoError(t, err)
+			require.Len(t, res, 1)
+			assert.Equal(t, tc.expected, res[0].ProxyJump)
+		})
+	}
+}
+
+func TestTargetHosts_sshConfig(t *testing.T) {
+	sshConf, err := ssh_config.DecodeBytes([]byte(`
+Host web
+  HostName web.example.com
+  Port 2222
+  User deployer
+
+Host api
+  HostName api.example.com
+
+Host internal
+  HostName 10.0.1.1
+  ProxyJump bastion
+
+Host bastion
+  HostName bastion.example.com
+  Port 2200
+  User jump
+`))
+	require.NoError(t, err)
+
+	inventory := filepath.Join(t.TempDir(), "inventory.yml")
+	err = os.WriteFile(inventory, []byte(`hosts:
+  - {host: web}
+  - {host: web, name: web-custom, port: 2233, user: admin}
+  - {host: 10.0.0.1, name: web}
+`), 0o600)
+	require.NoError(t, err)
+
+	p := &PlayBook{User: "defaultuser", overrides: &Overrides{SSHConfig: sshConf},
+		Targets: map[string]Target{
+			"target1": {Name: "target1", Hosts: []Destination{{Host: "web"}, {Host: "web", Port: 22, User: "user1"}}},
+		}}
+	p.inventory, err = p.loadInventory(inventory)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		targetName string
+		expected   []Destination
+	}{
+		{"playbook hosts", "target1", []Destination{
+			{Host: "web.example.com", Port: 2222, User: "deployer"},
+			{Host: "web.example.com", Port: 22, User: "user1"},
+		}},
+		{"bare alias", "api", []Destination{{Host: "api.example.com", Name: "api", Port: 22, User: "defaultuser"}}},
+		{"alias with explicit port and user", "user2@web:22", []Destination{
+			{Host: "web.example.com", Name: "web", Port: 22, User: "user2"}}},
+		{"aliased bastion", "internal", []Destination{{Host: "10.0.1.1", Name: "internal", Port: 22, User: "defaultuser",
+			ProxyJump: []JumpHost{{Host: "bastion.example.com", Port: 2200, User: "jump", Name: "bastion"}}}}},
+		{"inventory hosts", "all", []Destination{
+			{Host: "10.0.0.1", Name: "web", Port: 2222, User: "deployer"},
+			{Host: "web.example.com", Port: 2222, User: "deployer"},
+			{Host: "web", Name: "web-custom", Port: 2233, User: "admin"},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := p.TargetHosts(tc.targetName)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+
+	t.Run("aliased jump hosts from overrides", func(t *testing.T) {
+		p.overrides.ProxyJump = []JumpHost{{Host: "bastion", User: "admin"}, {Host: "other.example.com"}}
+		defer func() { p.overrides.ProxyJump = nil }()
+		res, err := p.TargetHosts("api")
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		assert.Equal(t, []JumpHost{{Host: "bastion.example.com", Port: 2200, User: "admin", Name: "bastion"},
+			{Host: "other.example.com", Name: "other.example.com"}}, res[0].ProxyJump)
+	})
+
+	t.Run("user override wins", func(t *testing.T) {
+		p.overrides.User = "cli-user"
+		defer func() { p.overrides.User = "" }()
+		res, err := p.TargetHosts("target1")
+		require.NoError(t, err)
+		assert.Equal(t, []Destination{{Host: "web.example.com", Port: 2222, User: "cli-user"},
+			{Host: "web.example.com", Port: 22, User: "cli-user"}}, res)
+	})
+}
+
+func TestParseProxyJump(t *testing.T) {
+	testCases := []struct {
+		name     string
+		inp      string
+		expected []JumpHost
+		err      string
+	}{
+		{"empty", "", nil, ""},
+		{"host only", "bastion.example.com", []JumpHost{{Host: "bastion.example.com"}}, ""},
+		{"user, host and port", "user1@bastion.example.com:2222",
+			[]JumpHost{{Host: "bastion.example.com", Port: 2222, User: "user1"}}, ""},
+		{"multiple hops", "user1@bastion1:2222, bastion2",
+			[]JumpHost{{Host: "bastion1", Port: 2222, User: "user1"}, {Host: "bastion2"}}, ""},
+		{"invalid port", "bastion:abc", nil, `can't parse port of jump host "bastion:abc"`},
+		{"empty host", "user1@", nil, `empty host in jump host "user1@"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := ParseProxyJump(tc.inp)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+}
+
 func TestPlayBook_UpdateTasksTargets(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -734,6 +1083,125 @@ func TestPlayBook_checkConfig(t *testing.T) {
 			},
 			expectedErr: `task "task1" has no commands`,
 		},
+		{
+			name: "invalid host key check",
+			playbook: PlayBook{
+				HostKeyCheck: "maybe",
+				Tasks:        []Task{{Name: "task1", Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `invalid host_key_check "maybe", must be one of strict, accept-new or off`,
+		},
+		{
+			name: "valid dependencies",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "deploy", DependsOn: []string{"build", "migrate"}, Commands: []Cmd{{Script: "example_script"}}},
+					{Name: "migrate", DependsOn: []string{"build"}, Commands: []Cmd{{Script: "example_script"}}},
+					{Name: "build", Commands: []Cmd{{Script: "example_script"}}},
+				},
+			},
+			expectedErr: "",
+		},
+		{
+			name: "unknown dependency",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", DependsOn: []string{"build"}, Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `task "deploy" depends on unknown task "build"`,
+		},
+		{
+			name: "dependency cycle",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "deploy", DependsOn: []string{"migrate"}, Commands: []Cmd{{Script: "example_script"}}},
+					{Name: "migrate", DependsOn: []string{"build"}, Commands: []Cmd{{Script: "example_script"}}},
+					{Name: "build", DependsOn: []string{"deploy"}, Commands: []Cmd{{Script: "example_script"}}},
+				},
+			},
+			expectedErr: "task dependency cycle detected: deploy -> migrate -> build -> deploy",
+		},
+		{
+			name: "self dependency",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", DependsOn: []string{"deploy"}, Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: "task dependency cycle detected: deploy -> deploy",
+		},
+		{
+			name: "valid batch settings",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Serial: "25%", MaxFailPercentage: 10, Commands: []Cmd{{Script: "example_script"}}}},
+			},
+		},
+		{
+			name: "invalid serial",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Serial: "abc", Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `task "deploy" rejected: invalid serial "abc", must be a positive number or percentage`,
+		},
+		{
+			name: "invalid max fail percentage",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", MaxFailPercentage: 101, Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `task "deploy" rejected, invalid max_fail_percentage 101, must be between 0 and 100`,
+		},
+		{
+			name: "negative task timeout",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Timeout: -time.Minute, Commands: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `task "deploy" rejected, invalid timeout -1m0s, must not be negative`,
+		},
+		{
+			name: "valid handlers",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Commands: []Cmd{{Name: "c1", Script: "example_script", Notify: []string{"h1"}}},
+					Handlers: []Cmd{{Name: "h1", Script: "example_script"}, {Name: "h2", Script: "example_script"}}}},
+			},
+		},
+		{
+			name: "unknown handler",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Commands: []Cmd{{Name: "c1", Script: "example_script", Notify: []string{"h2"}}},
+					Handlers: []Cmd{{Name: "h1", Script: "example_script"}}}},
+			},
+			expectedErr: `task "deploy" rejected: command "c1" notifies unknown handler "h2"`,
+		},
+		{
+			name: "duplicate handler",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Commands: []Cmd{{Name: "c1", Script: "example_script"}},
+					Handlers: []Cmd{{Name: "h1", Script: "example_script"}, {Name: "h1", Script: "example_script"}}}},
+			},
+			expectedErr: `task "deploy" rejected: duplicate handler name "h1"`,
+		},
+		{
+			name: "handler without name",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Commands: []Cmd{{Name: "c1", Script: "example_script"}},
+					Handlers: []Cmd{{Script: "example_script"}}}},
+			},
+			expectedErr: `task "deploy" rejected: handler name is required`,
+		},
+		{
+			name: "invalid handler",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Commands: []Cmd{{Name: "c1", Script: "example_script"}},
+					Handlers: []Cmd{{Name: "h1"}}}},
+			},
+			expectedErr: `task "deploy" rejected: invalid handler "h1": one of [script, copy, mcopy, delete, mdelete, sync, msync, ` +
+				`download, mdownload, template, mtemplate, wait, echo] must be set`,
+		},
+		{
+			name: "handler notifies handler",
+			playbook: PlayBook{
+				Tasks: []Task{{Name: "deploy", Commands: []Cmd{{Name: "c1", Script: "example_script"}},
+					Handlers: []Cmd{{Name: "h1", Script: "example_script", Notify: []string{"h2"}}, {Name: "h2", Script: "example_script"}}}},
+			},
+			expectedErr: `task "deploy" rejected: handler "h1" can't notify other handlers`,
+		},
 	}
 
 	for _, tt := range tbl {
@@ -771,6 +1239,23 @@ func TestPlayBook_loadSecrets(t *testing.T) {
 		assert.Equal(t, map[string]string{"secret1": "value1", "secret2": "value2"}, p.secrets)
 	})
 
+	t.Run("ssh secrets", func(t *testing.T) {
+		p := PlayBook{secretsProvider: &secProvider, SSHPasswordSecret: "secret1", SSHPassphraseSecret: "secret2"}
+		err := p.loadSecrets()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"secret1": "value1", "secret2": "value2"}, p.secrets)
+		password, passphrase := p.SSHSecrets()
+		assert.Equal(t, "value1", password)
+		assert.Equal(t, "value2", passphrase)
+		assert.Equal(t, []string{"value1", "value2"}, p.AllSecretValues())
+	})
+
+	t.Run("ssh secret retrieval failure", func(t *testing.T) {
+		p := PlayBook{secretsProvider: &secProvider, SSHPasswordSecret: "unknown"}
+		err := p.loadSecrets()
+		assert.EqualError(t, err, `can't get ssh secret "unknown": unknown secret key "unknown"`)
+	})
+
 	t.Run("provider not set", func(t *testing.T) {
 		p := PlayBook{Tasks: []Task{{Commands: []Cmd{{Options: CmdOptions{Secrets: []string{"secret1"}}}}}}}
 		err := p.loadSecrets()
@@ -786,6 +1271,43 @@ func TestPlayBook_loadSecrets(t *testing.T) {
 	})
 }
 
+func TestPlayBook_applyTaskOptionsBecome(t *testing.T) {
+	p := PlayBook{}
+	tsk := Task{Options: CmdOptions{BecomeUser: "admin", BecomeMethod: BecomeSu, BecomeSecret: "root_pass"}}
+
+	t.Run("inherited from task", func(t *testing.T) {
+		c := Cmd{Name: "cmd1", Options: CmdOptions{Secrets: []string{"secret1"}}}
+		p.applyTaskOptions(tsk, &c)
+		assert.Equal(t, "admin", c.Options.BecomeUser)
+		assert.Equal(t, BecomeSu, c.Options.BecomeMethod)
+		assert.Equal(t, "root_pass", c.Options.BecomeSecret)
+		assert.Equal(t, []string{"secret1", "root_pass"}, c.Options.Secrets, "become secret added to secrets")
+	})
+
+	t.Run("command's own options", func(t *testing.T) {
+		c := Cmd{Name: "cmd1", Options: CmdOptions{BecomeUser: "app", BecomeMethod: BecomeDoas, BecomeSecret: "app_pass",
+			Secrets: []string{"app_pass"}}}
+		p.applyTaskOptions(tsk, &c)
+		assert.Equal(t, "app", c.Options.BecomeUser)
+		assert.Equal(t, BecomeDoas, c.Options.BecomeMethod)
+		assert.Equal(t, "app_pass", c.Options.BecomeSecret)
+		assert.Equal(t, []string{"app_pass"}, c.Options.Secrets, "become secret not duplicated")
+	})
+}
+
+func TestPlayBook_applyTaskOptionsTimeout(t *testing.T) {
+	p := PlayBook{}
+	tsk := Task{Options: CmdOptions{Timeout: time.Minute}}
+
+	c := Cmd{Name: "cmd1"}
+	p.applyTaskOptions(tsk, &c)
+	assert.Equal(t, time.Minute, c.Options.Timeout, "inherited from task")
+
+	c = Cmd{Name: "cmd2", Options: CmdOptions{Timeout: time.Second}}
+	p.applyTaskOptions(tsk, &c)
+	assert.Equal(t, time.Second, c.Options.Timeout, "command's own timeout")
+}
+
 func TestPlayBook_AllTasks(t *testing.T) {
 	p := PlayBook{Tasks: []Task{
 		{Name: "task1", Targets: []string{"target1"}},
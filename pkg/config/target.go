@@ -5,6 +5,8 @@ import (
 	"log"
 	"strconv"
 	"strings"
+
+	"github.com/kevinburke/ssh_config"
 )
 
 // targetExtractor is a helper struct used to extract destinations from a given target.
@@ -12,17 +14,25 @@ import (
 // Additionally, it is responsible for deduplicating the resulting destinations.
 type targetExtractor struct {
 	data      map[string]Target
-	user      string
 	inventory *InventoryData
+	sshConfig *ssh_config.Config // optional, used to resolve host aliases
+}
+
+func newTargetExtractor(targets map[string]Target, inventory *InventoryData) *targetExtractor {
+	return &targetExtractor{data: targets, inventory: inventory}
 }
 
-func newTargetExtractor(targets map[string]Target, user string, inventory *InventoryData) *targetExtractor {
-	return &targetExtractor{data: targets, user: user, inventory: inventory}
+// withSSHConfig sets ssh config used to resolve host aliases of all the destinations.
+func (tg *targetExtractor) withSSHConfig(conf *ssh_config.Config) *targetExtractor {
+	tg.sshConfig = conf
+	return tg
 }
 
 // Destinations returns list of destinations for target name
 // It first checks if the target exists in the playbook; if not, it looks into the inventory.
-// After collecting the destinations, it deduplicates them before returning.
+// After collecting the destinations, it deduplicates them before returning. Hosts set in the playbook and the target name
+// used as a host are resolved with ssh config, if set; their port and user are left empty if not set explicitly or by
+// ssh config. Inventory hosts are resolved on loading.
 func (tg *targetExtractor) Destinations(name string) (res []Destination, err error) {
 	dedup := func(in []Destination) (res []Destination) {
 		seen := make(map[string]struct{})
@@ -59,7 +69,10 @@ func (tg *targetExtractor) destinationsFromPlaybook(name string, t Target) ([]De
 	}
 	log.Printf("[DEBUG] target %q found in playbook", t.Name)
 
-	res := appendHostsFromTarget(t)
+	res, err := tg.appendHostsFromTarget(t)
+	if err != nil {
+		return nil, err
+	}
 	res = append(res, tg.matchNamesInventory(name, t.Names)...)
 	res = append(res, tg.matchGroupsInventory(name, t.Groups)...)
 	res = append(res, tg.matchTagsInventory(name, t.Tags)...)
@@ -67,17 +80,34 @@ func (tg *targetExtractor) destinationsFromPlaybook(name string, t Target) ([]De
 	if len(res) == 0 {
 		return nil, fmt.Errorf("hosts for target %q not found", t.Name)
 	}
+
+	// set target's jump hosts for all destinations without their own jump hosts
+	if len(t.ProxyJump) > 0 {
+		for i := range res {
+			if len(res[i].ProxyJump) == 0 {
+				res[i].ProxyJump = t.ProxyJump
+			}
+		}
+	}
+
 	log.Printf("[DEBUG] target %q has %d total hosts: %+v", t.Name, len(res), res)
 	return res, nil
 }
 
-func appendHostsFromTarget(t Target) []Destination {
+// appendHostsFromTarget returns the hosts set in the target, resolved with ssh config
+func (tg *targetExtractor) appendHostsFromTarget(t Target) ([]Destination, error) {
 	res := []Destination{}
+	for _, h := range t.Hosts {
+		d, err := resolveSSHConfig(tg.sshConfig, h)
+		if err != nil {
+			return nil, fmt.Errorf("can't resolve host %q of target %q: %w", h.Host, t.Name, err)
+		}
+		res = append(res, d)
+	}
 	if len(t.Hosts) > 0 {
-		res = append(res, t.Hosts...)
-		log.Printf("[DEBUG] target %q has %d hosts: %+v", t.Name, len(t.Hosts), t.Hosts)
+		log.Printf("[DEBUG] target %q has %d hosts: %+v", t.Name, len(res), res)
 	}
-	return res
+	return res, nil
 }
 
 // matchNamesInventory matches names in the target with names in the inventory and returns the matching destinations.
@@ -140,7 +170,7 @@ func (tg *targetExtractor) matchTagsInventory(name string, tags []string) []Dest
 // If still not found, it checks if the target name matches a host in the inventory.
 // If the target name contains an '@', it splits the user from the host and uses it for the destination.
 // If the target name contains a ':', it splits the host from the port and uses them for the destination.
-// If none of the above conditions match, it defaults to using the target name as the host and assumes port 22.
+// If none of the above conditions match, it uses the target name as the host.
 func (tg *targetExtractor) destinationsFromInventory(name string) ([]Destination, error) {
 	hosts, ok := tg.inventory.Groups[name]
 	if ok {
@@ -171,7 +201,7 @@ func (tg *targetExtractor) destinationsFromInventory(name string) ([]Destination
 		}
 	}
 
-	user := tg.user // default user from playbook
+	user := ""
 	if strings.Contains(name, "@") {
 		// user is specified in target host
 		elems := strings.Split(name, "@")
@@ -189,10 +219,79 @@ func (tg *targetExtractor) destinationsFromInventory(name string) ([]Destination
 			return nil, fmt.Errorf("can't parse port %s: %w", elems[1], err)
 		}
 		log.Printf("[DEBUG] target %q used as host:port %s:%d", name, elems[0], port)
-		return []Destination{{Host: elems[0], Name: elems[0], Port: port, User: user}}, nil
+		d, err := resolveSSHConfig(tg.sshConfig, Destination{Host: elems[0], Name: elems[0], Port: port, User: user})
+		if err != nil {
+			return nil, err
+		}
+		return []Destination{d}, nil
 	}
 
-	// we have no idea what this is, use it as host:22
-	log.Printf("[DEBUG] target %q used as host:22 %s", name, name)
-	return []Destination{{Host: name, Name: name, Port: 22, User: user}}, nil
+	// we have no idea what this is, use it as host, resolved with ssh config if it is an alias
+	log.Printf("[DEBUG] target %q used as host %s", name, name)
+	d, err := resolveSSHConfig(tg.sshConfig, Destination{Host: name, Name: name, User: user})
+	if err != nil {
+		return nil, err
+	}
+	return []Destination{d}, nil
+}
+
+// resolveSSHConfig applies ssh config settings of the host alias to the destination. The alias is the destination's
+// name if set, otherwise its host. HostName is used only if the host is the alias itself, Port, User and ProxyJump
+// only if not set for the destination. Jump hosts from ProxyJump are resolved later, with resolveJumpHosts.
+// Returns the destination as is if ssh config is not set.
+func resolveSSHConfig(conf *ssh_config.Config, d Destination) (res Destination, err error) {
+	if conf == nil {
+		return d, nil
+	}
+	alias := d.Name
+	if alias == "" {
+		alias = d.Host
+	}
+
+	get := func(key string) string {
+		v, e := conf.Get(alias, key)
+		if e != nil {
+			log.Printf("[WARN] can't get %s for %q from ssh config: %v", key, alias, e)
+			return ""
+		}
+		return strings.TrimSpace(v)
+	}
+
+	res = d
+	if v := get("HostName"); v != "" && d.Host == alias {
+		res.Host = strings.ReplaceAll(v, "%h", alias)
+	}
+	if v := get("Port"); v != "" && d.Port == 0 {
+		if res.Port, err = strconv.Atoi(v); err != nil {
+			return Destination{}, fmt.Errorf("can't parse port %q of %q from ssh config: %w", v, alias, err)
+		}
+	}
+	if v := get("User"); v != "" && d.User == "" {
+		res.User = v
+	}
+	if v := get("ProxyJump"); v != "" && !strings.EqualFold(v, "none") && len(d.ProxyJump) == 0 {
+		if res.ProxyJump, err = ParseProxyJump(v); err != nil {
+			return Destination{}, fmt.Errorf("can't parse proxy jump of %q from ssh config: %w", alias, err)
+		}
+	}
+	log.Printf("[DEBUG] host %q resolved with ssh config: %+v", alias, res)
+	return res, nil
+}
+
+// resolveJumpHosts applies ssh config settings of the jump host aliases to the jump hosts, the same way as
+// for destinations. Each resolved jump host keeps its alias in Name, to get its identity files from ssh config
+// on connect. Returns the jump hosts as is if ssh config is not set.
+func resolveJumpHosts(conf *ssh_config.Config, jumps []JumpHost) ([]JumpHost, error) {
+	if conf == nil || len(jumps) == 0 {
+		return jumps, nil
+	}
+	res := make([]JumpHost, 0, len(jumps))
+	for _, jh := range jumps {
+		d, err := resolveSSHConfig(conf, Destination{Host: jh.Host, Name: jh.Host, Port: jh.Port, User: jh.User})
+		if err != nil {
+			return nil, fmt.Errorf("can't resolve jump host %q: %w", jh.Host, err)
+		}
+		res = append(res, JumpHost{Host: d.Host, Port: d.Port, User: d.User, SSHKey: jh.SSHKey, Name: jh.Host})
+	}
+	return res, nil
 }
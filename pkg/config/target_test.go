@@ -3,14 +3,15 @@ package config
 import (
 	"testing"
 
+	"github.com/kevinburke/ssh_config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDestinations(t *testing.T) {
 	testCases := []struct {
 		name      string
 		targets   map[string]Target
-		user      string
 		inventory *InventoryData
 		expected  []Destination
 		err       bool
@@ -20,7 +21,6 @@ func TestDestinations(t *testing.T) {
 			targets: map[string]Target{
 				"test": {},
 			},
-			user:      "user",
 			inventory: nil,
 			expected:  nil,
 			err:       true,
@@ -31,7 +31,6 @@ func TestDestinations(t *testing.T) {
 			targets: map[string]Target{
 				"test": {Tags: []string{"no-match"}},
 			},
-			user: "user",
 			inventory: &InventoryData{
 				Groups: map[string][]Destination{
 					"all": {
@@ -49,7 +48,6 @@ func TestDestinations(t *testing.T) {
 			targets: map[string]Target{
 				"test": {Tags: []string{"web"}},
 			},
-			user: "user",
 			inventory: &InventoryData{
 				Groups: map[string][]Destination{
 					allHostsGrp: {
@@ -69,7 +67,6 @@ func TestDestinations(t *testing.T) {
 			targets: map[string]Target{
 				"test": {Groups: []string{"no-match"}},
 			},
-			user: "user",
 			inventory: &InventoryData{
 				Groups: map[string][]Destination{
 					allHostsGrp: {
@@ -93,7 +90,6 @@ func TestDestinations(t *testing.T) {
 			targets: map[string]Target{
 				"test": {Groups: []string{"web"}},
 			},
-			user: "user",
 			inventory: &InventoryData{
 				Groups: map[string][]Destination{
 					allHostsGrp: {
@@ -119,7 +115,6 @@ func TestDestinations(t *testing.T) {
 			targets: map[string]Target{
 				"test": {Names: []string{"server1"}},
 			},
-			user: "user",
 			inventory: &InventoryData{
 				Groups: map[string][]Destination{
 					allHostsGrp: {
@@ -143,7 +138,6 @@ func TestDestinations(t *testing.T) {
 					Tags:   []string{"db"},
 				},
 			},
-			user: "user",
 			inventory: &InventoryData{
 				Groups: map[string][]Destination{
 					allHostsGrp: {
@@ -175,7 +169,6 @@ func TestDestinations(t *testing.T) {
 					Names:  []string{"server1"},
 				},
 			},
-			user: "user",
 			inventory: &InventoryData{
 				Groups: map[string][]Destination{
 					allHostsGrp: {
@@ -200,7 +193,7 @@ func TestDestinations(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			tge := newTargetExtractor(tc.targets, tc.user, tc.inventory)
+			tge := newTargetExtractor(tc.targets, tc.inventory)
 			res, err := tge.Destinations("test")
 
 			if tc.err {
@@ -217,42 +210,36 @@ func TestHostAddressParsing(t *testing.T) {
 	testCases := []struct {
 		name     string
 		input    string
-		user     string
 		expected Destination
 		err      bool
 	}{
 		{
-			name:     "address only, default port",
+			name:     "address only, port and user not set",
 			input:    "192.168.1.1",
-			user:     "user",
-			expected: Destination{Host: "192.168.1.1", Name: "192.168.1.1", Port: 22, User: "user"},
+			expected: Destination{Host: "192.168.1.1", Name: "192.168.1.1"},
 			err:      false,
 		},
 		{
-			name:     "user and address only, default port",
+			name:     "user and address only, port not set",
 			input:    "john@192.168.1.1",
-			user:     "user",
-			expected: Destination{Host: "192.168.1.1", Name: "192.168.1.1", Port: 22, User: "john"},
+			expected: Destination{Host: "192.168.1.1", Name: "192.168.1.1", User: "john"},
 			err:      false,
 		},
 		{
 			name:     "port specified",
 			input:    "192.168.1.1:2222",
-			user:     "user",
-			expected: Destination{Host: "192.168.1.1", Name: "192.168.1.1", Port: 2222, User: "user"},
+			expected: Destination{Host: "192.168.1.1", Name: "192.168.1.1", Port: 2222},
 			err:      false,
 		},
 		{
 			name:     "user and port specified",
 			input:    "john@192.168.1.1:2222",
-			user:     "user",
 			expected: Destination{Host: "192.168.1.1", Name: "192.168.1.1", Port: 2222, User: "john"},
 			err:      false,
 		},
 		{
 			name:     "invalid port",
 			input:    "192.168.1.1:invalid",
-			user:     "user",
 			expected: Destination{},
 			err:      true,
 		},
@@ -260,7 +247,7 @@ func TestHostAddressParsing(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			tge := newTargetExtractor(nil, tc.user, &InventoryData{})
+			tge := newTargetExtractor(nil, &InventoryData{})
 			res, err := tge.Destinations(tc.input)
 
 			if tc.err {
@@ -273,3 +260,79 @@ func TestHostAddressParsing(t *testing.T) {
 		})
 	}
 }
+
+func TestHostAddressParsing_withSSHConfig(t *testing.T) {
+	sshConf, err := ssh_config.DecodeBytes([]byte(`
+Host web
+  HostName web.example.com
+  Port 2222
+  User deployer
+  ProxyJump jump@bastion.example.com:2200
+
+Host db
+  HostName 10.0.0.5
+
+Host bad-port
+  Port abc
+
+Host *.internal
+  User internal
+`))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected Destination
+		err      bool
+	}{
+		{
+			name:  "alias with all settings",
+			input: "web",
+			expected: Destination{Host: "web.example.com", Name: "web", Port: 2222, User: "deployer",
+				ProxyJump: []JumpHost{{Host: "bastion.example.com", Port: 2200, User: "jump"}}},
+		},
+		{
+			name:     "alias with host name only",
+			input:    "db",
+			expected: Destination{Host: "10.0.0.5", Name: "db"},
+		},
+		{
+			name:  "explicit user overrides ssh config",
+			input: "john@web",
+			expected: Destination{Host: "web.example.com", Name: "web", Port: 2222, User: "john",
+				ProxyJump: []JumpHost{{Host: "bastion.example.com", Port: 2200, User: "jump"}}},
+		},
+		{
+			name:     "wildcard match",
+			input:    "h1.internal",
+			expected: Destination{Host: "h1.internal", Name: "h1.internal", User: "internal"},
+		},
+		{
+			name:     "not in ssh config",
+			input:    "other.example.com",
+			expected: Destination{Host: "other.example.com", Name: "other.example.com"},
+		},
+		{
+			name:  "explicit port overrides ssh config",
+			input: "web:2233",
+			expected: Destination{Host: "web.example.com", Name: "web", Port: 2233, User: "deployer",
+				ProxyJump: []JumpHost{{Host: "bastion.example.com", Port: 2200, User: "jump"}}},
+		},
+		{name: "invalid port in ssh config", input: "bad-port", err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tge := newTargetExtractor(nil, &InventoryData{}).withSSHConfig(sshConf)
+			res, err := tge.Destinations(tc.input)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 1, len(res))
+			assert.Equal(t, tc.expected, res[0])
+		})
+	}
+}
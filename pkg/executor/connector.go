@@ -2,23 +2,53 @@ package executor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/kevinburke/ssh_config"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+// host key verification modes
+const (
+	HostKeyStrict    = "strict"     // reject hosts not listed in known_hosts or with mismatched keys
+	HostKeyAcceptNew = "accept-new" // trust unknown hosts on first use and add them to known_hosts, reject mismatched keys
+	HostKeyOff       = "off"        // don't verify host keys at all
+)
+
+// JumpHost defines a jump (bastion) host used to reach the destination, similar to ssh's ProxyJump.
+type JumpHost struct {
+	Addr string // host:port of the jump host, port 22 is used if not set
+	Name string // ssh config alias of the jump host to get its identity files, host part of Addr is used if not set
+	User string // ssh user for the jump host, destination's user is used if not set
+	Key  string // private key for the jump host, connector's private key is used if not set
+}
+
 // Connector provides factory methods to create Remote executor. Each executor is connected to a single SSH hostAddr.
 type Connector struct {
 	privateKey  string
 	timeout     time.Duration
 	enableAgent bool
 	logs        Logs
+
+	hostKeyMode string     // host key verification mode, one of HostKeyStrict, HostKeyAcceptNew or HostKeyOff
+	knownHosts  string     // known_hosts file used for host key verification
+	knownLock   sync.Mutex // protects known_hosts file updates in accept-new mode
+
+	sshConf *ssh_config.Config // optional ssh config to get identity files of host aliases
+
+	password   string // optional password for password and keyboard-interactive authentication
+	passphrase string // optional passphrase of encrypted private keys
 }
 
 // NewConnector creates a new Connector for a given user and private key.
@@ -43,53 +73,188 @@ func (c *Connector) WithAgent() *Connector {
 	return c
 }
 
+// WithHostKeyCheck sets host key verification mode and known_hosts file to check host keys against.
+// Empty mode is the same as HostKeyOff.
+func (c *Connector) WithHostKeyCheck(mode, knownHosts string) *Connector {
+	log.Printf("[DEBUG] host key check %q, known hosts %q", mode, knownHosts)
+	c.hostKeyMode = mode
+	c.knownHosts = knownHosts
+	return c
+}
+
+// WithSSHConfig sets ssh config used to get identity files of the host aliases on connect.
+func (c *Connector) WithSSHConfig(conf *ssh_config.Config) *Connector {
+	log.Printf("[DEBUG] use ssh config")
+	c.sshConf = conf
+	return c
+}
+
+// WithPassword enables password and keyboard-interactive authentication with the given password.
+// They are tried after the public key authentication.
+func (c *Connector) WithPassword(password string) *Connector {
+	log.Printf("[DEBUG] use password authentication")
+	c.password = password
+	return c
+}
+
+// WithPassphrase sets passphrase used to decrypt encrypted private keys.
+func (c *Connector) WithPassphrase(passphrase string) *Connector {
+	log.Printf("[DEBUG] use private key passphrase")
+	c.passphrase = passphrase
+	return c
+}
+
 // Connect connects to a remote hostAddr and returns a remote executer, caller must close.
-func (c *Connector) Connect(ctx context.Context, hostAddr, hostName, user string) (*Remote, error) {
-	log.Printf("[DEBUG] connect to %q (%s), user %q", hostAddr, hostName, user)
-	client, err := c.sshClient(ctx, hostAddr, user)
+// If jump hosts are provided, the connection is tunneled through them in the given order.
+func (c *Connector) Connect(ctx context.Context, hostAddr, hostName, user string, jumps ...JumpHost) (*Remote, error) {
+	log.Printf("[DEBUG] connect to %q (%s), user %q, jumps %+v", hostAddr, hostName, user, jumps)
+	clients, err := c.sshClient(ctx, hostAddr, hostName, user, jumps)
 	if err != nil {
 		return nil, err
 	}
-	return &Remote{client: client, hostAddr: hostAddr, hostName: hostName, logs: c.logs.WithHost(hostAddr, hostName)}, nil
+	return &Remote{client: clients[len(clients)-1], jumpClients: clients[:len(clients)-1], hostAddr: hostAddr,
+		hostName: hostName, logs: c.logs.WithHost(hostAddr, hostName)}, nil
 }
 
-// sshClient creates ssh client connected to remote server. Caller must close session.
-func (c *Connector) sshClient(ctx context.Context, host, user string) (session *ssh.Client, err error) {
-	log.Printf("[DEBUG] create ssh session to %s, user %s", host, user)
-	if !strings.Contains(host, ":") {
-		host += ":22"
+// identityFiles returns identity files set in ssh config for the host alias, they are used in addition to the connector's
+// private key. The alias is hostName if set, otherwise the host part of hostAddr. Host name, port and user of the alias
+// are resolved by config, as only it knows which of them are set explicitly.
+func (c *Connector) identityFiles(hostAddr, hostName string) []string {
+	if c.sshConf == nil {
+		return nil
 	}
 
-	dialer := net.Dialer{Timeout: c.timeout}
-	conn, err := dialer.DialContext(ctx, "tcp", host)
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial: %w", err)
+	host := hostAddr
+	if h, _, err := net.SplitHostPort(hostAddr); err == nil {
+		host = h
+	}
+	alias := hostName
+	if alias == "" {
+		alias = host
 	}
 
-	conf, err := c.sshConfig(user, c.privateKey)
+	files, err := c.sshConf.GetAll(alias, "IdentityFile")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create ssh config: %w", err)
+		log.Printf("[WARN] can't get identity files for %q from ssh config: %v", alias, err)
 	}
-	ncc, chans, reqs, err := ssh.NewClientConn(conn, host, conf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create client connection to %s: %v", host, err)
+	res := []string{}
+	for _, f := range files {
+		f = strings.ReplaceAll(strings.TrimSpace(f), "%h", host)
+		if strings.HasPrefix(f, "~") {
+			if home, e := os.UserHomeDir(); e == nil {
+				f = filepath.Join(home, f[1:])
+			}
+		}
+		res = append(res, f)
 	}
-	client := ssh.NewClient(ncc, chans, reqs)
-	log.Printf("[DEBUG] ssh session created to %s", host)
-	return client, nil
+	return res
 }
 
-func (c *Connector) sshConfig(user, privateKeyPath string) (*ssh.ClientConfig, error) {
+// sshClient creates ssh client connected to remote server, through the jump hosts if any. Returns all the clients
+// created for the connection, the last one is connected to the remote server and the rest to the jump hosts.
+// Identity files from ssh config are used in addition to the private key for each of them, looked up by the jump host's
+// alias and by hostName for the remote server. Caller must close all the clients.
+func (c *Connector) sshClient(ctx context.Context, host, hostName, user string,
+	jumps []JumpHost) (clients []*ssh.Client, err error) {
+	log.Printf("[DEBUG] create ssh session to %s, user %s", host, user)
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// close all the clients created so far in reverse order, from the closest to the remote server
+		for i := len(clients) - 1; i >= 0; i-- {
+			_ = clients[i].Close()
+		}
+	}()
+
+	hops := c.hops(host, user, jumps)
+	for i, hop := range hops {
+		addr, hopUser, hopKey := hop.Addr, hop.User, hop.Key
+
+		conn, e := c.dial(ctx, clients, addr)
+		if e != nil {
+			if i < len(jumps) {
+				return clients, fmt.Errorf("failed to dial jump host %s: %w", addr, e)
+			}
+			return clients, fmt.Errorf("failed to dial: %w", e)
+		}
+
+		alias := hop.Name
+		if i == len(jumps) {
+			alias = hostName // the remote server is looked up in ssh config by its name
+		}
+		conf, e := c.sshConfig(hopUser, hopKey, c.identityFiles(addr, alias)...)
+		if e != nil {
+			_ = conn.Close()
+			return clients, fmt.Errorf("failed to create ssh config: %w", e)
+		}
+		conf.HostKeyAlgorithms = c.hostKeyAlgorithms(addr)
+		ncc, chans, reqs, e := ssh.NewClientConn(conn, addr, conf)
+		if e != nil {
+			_ = conn.Close()
+			return clients, fmt.Errorf("failed to create client connection to %s: %v", addr, e)
+		}
+		clients = append(clients, ssh.NewClient(ncc, chans, reqs))
+		if i < len(jumps) {
+			log.Printf("[DEBUG] ssh session created to jump host %s", addr)
+		}
+	}
+
+	log.Printf("[DEBUG] ssh session created to %s", hops[len(hops)-1].Addr)
+	return clients, nil
+}
+
+// hops returns the jump hosts followed by the remote server, with the address, user and key used to connect to each
+// of them. Port 22 is used for addresses without port, the remote server's user and the connector's private key
+// for jump hosts without their own.
+func (c *Connector) hops(host, user string, jumps []JumpHost) []JumpHost {
+	res := make([]JumpHost, 0, len(jumps)+1)
+	res = append(res, jumps...)
+	res = append(res, JumpHost{Addr: host, User: user, Key: c.privateKey})
+	for i, hop := range res {
+		if _, _, err := net.SplitHostPort(hop.Addr); err != nil {
+			res[i].Addr = net.JoinHostPort(hop.Addr, "22")
+		}
+		if hop.User == "" {
+			res[i].User = user
+		}
+		if hop.Key == "" {
+			res[i].Key = c.privateKey
+		}
+	}
+	return res
+}
+
+// dial makes a tcp connection to addr. If there are clients already connected, i.e. we are going through the jump hosts,
+// it dials from the last one, otherwise it dials directly.
+func (c *Connector) dial(ctx context.Context, clients []*ssh.Client, addr string) (net.Conn, error) {
+	if len(clients) == 0 {
+		dialer := net.Dialer{Timeout: c.timeout}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return clients[len(clients)-1].DialContext(dialCtx, "tcp", addr)
+}
+
+// sshConfig makes ssh client config for the user and private key. Optional identity files are added
+// as extra keys, unreadable or invalid ones are skipped, the same way ssh does for IdentityFile.
+func (c *Connector) sshConfig(user, privateKeyPath string, identityFiles ...string) (*ssh.ClientConfig, error) {
 
 	// getAuth returns a list of ssh.AuthMethod to be used for authentication.
 	// if ssh agent is enabled, it will be used, otherwise private key will be used.
+	// with password set, missing ssh agent is not an error, password authentication is used instead.
 	getAuth := func() (auth []ssh.AuthMethod, err error) {
 		if privateKeyPath == "" || c.enableAgent {
 			if aconn, e := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); e == nil {
 				auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(aconn).Signers))
 				log.Printf("[DEBUG] ssh agent found at %s", os.Getenv("SSH_AUTH_SOCK"))
 			} else {
-				return nil, fmt.Errorf("unable to connect to ssh agent: %w", e)
+				if c.password == "" {
+					return nil, fmt.Errorf("unable to connect to ssh agent: %w", e)
+				}
+				log.Printf("[DEBUG] skip ssh agent: %v", e)
 			}
 			return auth, nil
 		}
@@ -98,7 +263,7 @@ func (c *Connector) sshConfig(user, privateKeyPath string) (*ssh.ClientConfig, e
 		if err != nil {
 			return nil, fmt.Errorf("unable to read private key: %vw", err)
 		}
-		signer, err := ssh.ParsePrivateKey(key)
+		signer, err := c.parsePrivateKey(key)
 		if err != nil {
 			return nil, fmt.Errorf("unable to parse private key: %w", err)
 		}
@@ -111,15 +276,212 @@ func (c *Connector) sshConfig(user, privateKeyPath string) (*ssh.ClientConfig, e
 		return nil, fmt.Errorf("failed to get ssh auth: %w", err)
 	}
 
+	signers := []ssh.Signer{}
+	for _, f := range identityFiles {
+		if f == privateKeyPath {
+			continue // already used
+		}
+		key, e := os.ReadFile(f) // nolint
+		if e != nil {
+			log.Printf("[DEBUG] skip identity file %s: %v", f, e)
+			continue
+		}
+		signer, e := c.parsePrivateKey(key)
+		if e != nil {
+			log.Printf("[DEBUG] skip identity file %s: %v", f, e)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if c.password != "" {
+		// keyboard-interactive is used by servers asking for the password with a prompt, i.e. with PAM
+		auth = append(auth, ssh.Password(c.password), ssh.KeyboardInteractive(c.keyboardInteractive))
+	}
+
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		return nil, fmt.Errorf("failed to make host key callback: %w", err)
+	}
+
 	sshConfig := &ssh.ClientConfig{
 		User:            user,
 		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // nolint
+		HostKeyCallback: hostKeyCallback,
 	}
 
 	return sshConfig, nil
 }
 
+// keyboardInteractive answers keyboard-interactive questions with the password. Only password questions, asked with
+// echo off and mentioning a password, are answered. Any other question, i.e. OTP or 2FA code, fails the authentication,
+// as the password is not the answer to it.
+func (c *Connector) keyboardInteractive(_, _ string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		echo := i < len(echos) && echos[i]
+		if echo || !strings.Contains(strings.ToLower(q), "password") {
+			return nil, fmt.Errorf("can't answer keyboard-interactive question %q with password", q)
+		}
+		answers[i] = c.password
+	}
+	return answers, nil
+}
+
+// parsePrivateKey parses private key, decrypting it with the connector's passphrase if the key is encrypted
+func (c *Connector) parsePrivateKey(key []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(key)
+	if err == nil {
+		return signer, nil
+	}
+	var passErr *ssh.PassphraseMissingError
+	if !errors.As(err, &passErr) {
+		return nil, err
+	}
+	if c.passphrase == "" {
+		return nil, fmt.Errorf("private key is encrypted, passphrase is not set: %w", err)
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(c.passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt private key: %w", err)
+	}
+	return signer, nil
+}
+
+// hostKeyCallback returns ssh.HostKeyCallback for the connector's host key verification mode.
+// In strict mode the host key must be present in known_hosts file. In accept-new mode unknown hosts are added
+// to known_hosts file on the first connection. Mismatched keys are rejected in both modes.
+func (c *Connector) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	switch c.hostKeyMode {
+	case "", HostKeyOff:
+		return ssh.InsecureIgnoreHostKey(), nil // nolint
+	case HostKeyStrict, HostKeyAcceptNew:
+	default:
+		return nil, fmt.Errorf("unknown host key check mode %q", c.hostKeyMode)
+	}
+
+	if c.knownHosts == "" {
+		return nil, fmt.Errorf("known_hosts file is not set")
+	}
+
+	// checkKnownHosts checks host key against known_hosts file. Missing file is not an error, all hosts are unknown in this case.
+	// Returns unknown=true if the host is not in known_hosts file, and error if the key is mismatched or can't be checked.
+	checkKnownHosts := func(hostname string, remote net.Addr, key ssh.PublicKey) (unknown bool, err error) {
+		if _, err = os.Stat(c.knownHosts); errors.Is(err, os.ErrNotExist) {
+			return true, nil
+		}
+		check, err := knownhosts.New(c.knownHosts)
+		if err != nil {
+			return false, fmt.Errorf("failed to load known hosts %s: %w", c.knownHosts, err)
+		}
+		err = check(hostname, remote, key)
+		if err == nil {
+			return false, nil
+		}
+		keyErr := &knownhosts.KeyError{}
+		if !errors.As(err, &keyErr) {
+			return false, fmt.Errorf("host key verification failed for %s (%s): %w", hostname, ssh.FingerprintSHA256(key), err)
+		}
+		if len(keyErr.Want) > 0 {
+			return false, fmt.Errorf("host key mismatch for %s, fingerprint %s doesn't match %s",
+				hostname, ssh.FingerprintSHA256(key), c.knownHosts)
+		}
+		return true, nil
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		unknown, err := checkKnownHosts(hostname, remote, key)
+		if err != nil || !unknown {
+			return err
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		if c.hostKeyMode != HostKeyAcceptNew {
+			return fmt.Errorf("unknown host %s, fingerprint %s not found in %s", hostname, fingerprint, c.knownHosts)
+		}
+
+		// accept-new mode, add the unknown host to known_hosts file
+		c.knownLock.Lock()
+		defer c.knownLock.Unlock()
+
+		// the host could be added by another connection while we were waiting for the lock, check it again
+		if unknown, err = checkKnownHosts(hostname, remote, key); err != nil || !unknown {
+			return err
+		}
+
+		if err = os.MkdirAll(filepath.Dir(c.knownHosts), 0o700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", c.knownHosts, err)
+		}
+		fh, err := os.OpenFile(c.knownHosts, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600) // nolint
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", c.knownHosts, err)
+		}
+		defer fh.Close() // nolint
+		if _, err = fh.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"); err != nil {
+			return fmt.Errorf("failed to add %s to %s: %w", hostname, c.knownHosts, err)
+		}
+		// report the added host key to the info log, it is shown without debug mode, as ssh does for new hosts
+		c.logs.WithHost(hostname, "").Info.Printf("permanently added host key %s to known hosts %s", fingerprint, c.knownHosts)
+		return nil
+	}, nil
+}
+
+// hostKeyAlgorithms returns host key algorithms for the types of the host's keys in known_hosts file, so the server
+// presents the key we know instead of its preferred one of another type, the same way as ssh does.
+// Returns nil, i.e. the default algorithms, if host key check is off, or the host is not in known_hosts file.
+func (c *Connector) hostKeyAlgorithms(addr string) []string {
+	if c.hostKeyMode == "" || c.hostKeyMode == HostKeyOff || c.knownHosts == "" {
+		return nil
+	}
+	if _, err := os.Stat(c.knownHosts); err != nil {
+		return nil
+	}
+	check, err := knownhosts.New(c.knownHosts)
+	if err != nil {
+		log.Printf("[WARN] failed to load known hosts %s: %v", c.knownHosts, err)
+		return nil
+	}
+
+	// check with a key which is never in known_hosts fails, and the error has all the known keys of the host
+	keyErr := &knownhosts.KeyError{}
+	if err = check(addr, &net.TCPAddr{}, unknownKey{}); !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil
+	}
+	types := make([]string, 0, len(keyErr.Want))
+	for _, k := range keyErr.Want {
+		types = append(types, k.Key.Type())
+	}
+	sort.Strings(types)
+
+	res := []string{}
+	for _, t := range types {
+		if t == ssh.KeyAlgoRSA {
+			// rsa key can be presented with any of rsa signature algorithms, sha2 ones are preferred
+			res = append(res, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+			continue
+		}
+		res = append(res, t)
+	}
+	log.Printf("[DEBUG] host key algorithms for %s: %v", addr, res)
+	return res
+}
+
+// unknownKey is a placeholder public key which is never found in known_hosts file
+type unknownKey struct{}
+
+func (unknownKey) Type() string    { return "unknown" }
+func (unknownKey) Marshal() []byte { return []byte("unknown") }
+func (unknownKey) Verify(_ []byte, _ *ssh.Signature) error {
+	return errors.New("unknown key can't verify")
+}
+
 func (c *Connector) String() string {
-	return fmt.Sprintf("ssh connector with private key %s.., timeout %v, agent %v", c.privateKey[:8], c.timeout, c.enableAgent)
+	key := c.privateKey
+	if len(key) > 8 {
+		key = key[:8]
+	}
+	return fmt.Sprintf("ssh connector with private key %s.., timeout %v, agent %v, host key check %q, password %v",
+		key, c.timeout, c.enableAgent, c.hostKeyMode, c.password != "")
 }
@@ -1,11 +1,23 @@
 package executor
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/kevinburke/ssh_config"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func TestConnector_Connect(t *testing.T) {
@@ -28,6 +40,31 @@ func TestConnector_Connect(t *testing.T) {
 		require.ErrorContains(t, err, "ssh: unable to authenticate")
 	})
 
+	t.Run("encrypted key with passphrase", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key_encrypted", time.Second*10, MakeLogs(true, false, nil))
+		require.NoError(t, err)
+		sess, err := c.WithPassphrase("spot-test").Connect(ctx, hostAndPort, "h1", "test")
+		require.NoError(t, err)
+		defer sess.Close()
+	})
+
+	t.Run("password", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", "")
+		c, err := NewConnector("", time.Second*10, MakeLogs(true, false, nil))
+		require.NoError(t, err)
+		sess, err := c.WithPassword("test-password").Connect(ctx, hostAndPort, "h1", "test")
+		require.NoError(t, err)
+		defer sess.Close()
+	})
+
+	t.Run("bad password", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", "")
+		c, err := NewConnector("", time.Second*10, MakeLogs(true, false, nil))
+		require.NoError(t, err)
+		_, err = c.WithPassword("bad-password").Connect(ctx, hostAndPort, "h1", "test")
+		require.ErrorContains(t, err, "ssh: unable to authenticate")
+	})
+
 	t.Run("bad key", func(t *testing.T) {
 		_, err := NewConnector("testdata/test_ssh_key33", time.Second*10, MakeLogs(true, false, nil))
 		require.ErrorContains(t, err, "private key file \"testdata/test_ssh_key33\" does not exist", "test")
@@ -54,3 +91,257 @@ func TestConnector_Connect(t *testing.T) {
 		require.ErrorContains(t, err, "failed to dial: dial tcp 10.255.255.1:22: i/o timeout")
 	})
 }
+
+func TestConnector_parsePrivateKey(t *testing.T) {
+	plain, err := os.ReadFile("testdata/test_ssh_key")
+	require.NoError(t, err)
+	encrypted, err := os.ReadFile("testdata/test_ssh_key_encrypted")
+	require.NoError(t, err)
+
+	tbl := []struct {
+		name       string
+		key        []byte
+		passphrase string
+		expErr     string
+	}{
+		{name: "plain key", key: plain},
+		{name: "plain key, passphrase ignored", key: plain, passphrase: "spot-test"},
+		{name: "encrypted key", key: encrypted, passphrase: "spot-test"},
+		{name: "encrypted key, no passphrase", key: encrypted,
+			expErr: "private key is encrypted, passphrase is not set: ssh: this private key is passphrase protected"},
+		{name: "encrypted key, wrong passphrase", key: encrypted, passphrase: "bad",
+			expErr: "can't decrypt private key: x509: decryption password incorrect"},
+		{name: "invalid key", key: []byte("bad key"), expErr: "ssh: no key found"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Connector{passphrase: tt.passphrase}
+			signer, err := c.parsePrivateKey(tt.key)
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "ssh-rsa", signer.PublicKey().Type())
+		})
+	}
+}
+
+func TestConnector_sshConfigPassword(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/no-such-agent.sock")
+
+	t.Run("no agent, no password", func(t *testing.T) {
+		c := &Connector{enableAgent: true}
+		_, err := c.sshConfig("user", "")
+		require.ErrorContains(t, err, "unable to connect to ssh agent")
+	})
+
+	t.Run("no agent, with password", func(t *testing.T) {
+		c := (&Connector{enableAgent: true}).WithPassword("passwd")
+		conf, err := c.sshConfig("user", "")
+		require.NoError(t, err)
+		assert.Len(t, conf.Auth, 2, "password and keyboard-interactive")
+	})
+
+	t.Run("key and password", func(t *testing.T) {
+		c := (&Connector{}).WithPassword("passwd").WithPassphrase("spot-test")
+		conf, err := c.sshConfig("user", "testdata/test_ssh_key_encrypted")
+		require.NoError(t, err)
+		assert.Len(t, conf.Auth, 3, "public key, password and keyboard-interactive")
+	})
+}
+
+func TestConnector_keyboardInteractive(t *testing.T) {
+	c := (&Connector{}).WithPassword("passwd")
+	testCases := []struct {
+		name      string
+		questions []string
+		echos     []bool
+		expected  []string
+		err       string
+	}{
+		{"no questions", nil, nil, []string{}, ""},
+		{"password", []string{"Password: "}, []bool{false}, []string{"passwd"}, ""},
+		{"password for user", []string{"user@host's password:"}, []bool{false}, []string{"passwd"}, ""},
+		{"otp code", []string{"Password: ", "Verification code: "}, []bool{false, false}, nil,
+			`can't answer keyboard-interactive question "Verification code: " with password`},
+		{"password with echo", []string{"Password: "}, []bool{true}, nil,
+			`can't answer keyboard-interactive question "Password: " with password`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := c.keyboardInteractive("user", "", tc.questions, tc.echos)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+}
+
+func TestConnector_hostKeyCallback(t *testing.T) {
+	makeKey := func(t *testing.T) ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		key, err := ssh.NewPublicKey(pub)
+		require.NoError(t, err)
+		return key
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+	key1, key2 := makeKey(t), makeKey(t)
+
+	t.Run("off", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second, MakeLogs(true, false, nil))
+		require.NoError(t, err)
+		cb, err := c.WithHostKeyCheck(HostKeyOff, "").hostKeyCallback()
+		require.NoError(t, err)
+		assert.NoError(t, cb("h1:2222", remote, key1))
+	})
+
+	t.Run("unknown mode", func(t *testing.T) {
+		c, err := NewConnector("testdata/test_ssh_key", time.Second, MakeLogs(true, false, nil))
+		require.NoError(t, err)
+		_, err = c.WithHostKeyCheck("blah", "").hostKeyCallback()
+		assert.EqualError(t, err, `unknown host key check mode "blah"`)
+	})
+
+	t.Run("strict, unknown host", func(t *testing.T) {
+		knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+		c, err := NewConnector("testdata/test_ssh_key", time.Second, MakeLogs(true, false, nil))
+		require.NoError(t, err)
+		cb, err := c.WithHostKeyCheck(HostKeyStrict, knownHosts).hostKeyCallback()
+		require.NoError(t, err)
+		err = cb("h1:2222", remote, key1)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unknown host h1:2222, fingerprint "+ssh.FingerprintSHA256(key1))
+		_, err = os.Stat(knownHosts)
+		assert.True(t, os.IsNotExist(err), "strict mode should not create known_hosts")
+	})
+
+	t.Run("strict, known host", func(t *testing.T) {
+		knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+		line := knownhosts.Line([]string{knownhosts.Normalize("h1:2222")}, key1)
+		require.NoError(t, os.WriteFile(knownHosts, []byte(line+"\n"), 0o600))
+		c, err := NewConnector("testdata/test_ssh_key", time.Second, MakeLogs(true, false, nil))
+		require.NoError(t, err)
+		cb, err := c.WithHostKeyCheck(HostKeyStrict, knownHosts).hostKeyCallback()
+		require.NoError(t, err)
+		assert.NoError(t, cb("h1:2222", remote, key1))
+
+		err = cb("h1:2222", remote, key2)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "host key mismatch for h1:2222, fingerprint "+ssh.FingerprintSHA256(key2))
+	})
+
+	t.Run("accept-new", func(t *testing.T) {
+		knownHosts := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+		logs, infoBuf := MakeLogs(true, true, nil), &bytes.Buffer{}
+		logs.Info = logs.Info.WithWriter(infoBuf)
+		c, err := NewConnector("testdata/test_ssh_key", time.Second, logs)
+		require.NoError(t, err)
+		cb, err := c.WithHostKeyCheck(HostKeyAcceptNew, knownHosts).hostKeyCallback()
+		require.NoError(t, err)
+
+		// first connection adds the host to known_hosts
+		require.NoError(t, cb("h1:2222", remote, key1))
+		data, err := os.ReadFile(knownHosts)
+		require.NoError(t, err)
+		assert.Equal(t, knownhosts.Line([]string{"[h1]:2222"}, key1)+"\n", string(data))
+		assert.Equal(t, fmt.Sprintf("[h1:2222] permanently added host key %s to known hosts %s\n",
+			ssh.FingerprintSHA256(key1), knownHosts), infoBuf.String())
+
+		// the same key accepted again without duplication
+		require.NoError(t, cb("h1:2222", remote, key1))
+		data, err = os.ReadFile(knownHosts)
+		require.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(string(data), "\n"))
+		assert.Equal(t, 1, strings.Count(infoBuf.String(), "permanently added"), "known host is not reported again")
+
+		// changed key rejected
+		err = cb("h1:2222", remote, key2)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "host key mismatch for h1:2222")
+	})
+}
+
+func TestConnector_hostKeyAlgorithms(t *testing.T) {
+	pubData, err := os.ReadFile("testdata/test_ssh_key.pub")
+	require.NoError(t, err)
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	require.NoError(t, err)
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKey, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	lines := []string{
+		knownhosts.Line([]string{knownhosts.Normalize("h1:2222")}, rsaKey),
+		knownhosts.Line([]string{knownhosts.Normalize("h2")}, edKey),
+		knownhosts.Line([]string{knownhosts.Normalize("h2")}, rsaKey),
+	}
+	require.NoError(t, os.WriteFile(knownHosts, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second, MakeLogs(true, false, nil))
+	require.NoError(t, err)
+	c = c.WithHostKeyCheck(HostKeyStrict, knownHosts)
+
+	testCases := []struct {
+		name, addr string
+		expected   []string
+	}{
+		{"rsa key only", "h1:2222", []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}},
+		{"rsa and ed25519 keys", "h2:22", []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+			ssh.KeyAlgoRSA}},
+		{"different port", "h1:22", nil},
+		{"unknown host", "h3:22", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, c.hostKeyAlgorithms(tc.addr))
+		})
+	}
+
+	t.Run("host key check off", func(t *testing.T) {
+		assert.Nil(t, c.WithHostKeyCheck(HostKeyOff, knownHosts).hostKeyAlgorithms("h1:2222"))
+	})
+
+	t.Run("no known hosts file", func(t *testing.T) {
+		assert.Nil(t, c.WithHostKeyCheck(HostKeyAcceptNew, filepath.Join(t.TempDir(), "known_hosts")).hostKeyAlgorithms("h1:2222"))
+	})
+}
+
+func TestConnector_identityFiles(t *testing.T) {
+	sshConf, err := ssh_config.DecodeBytes([]byte(`
+Host web
+  HostName web.example.com
+  Port 2222
+  User deployer
+  IdentityFile /keys/web_key
+  IdentityFile /keys/%h_key
+`))
+	require.NoError(t, err)
+
+	c := &Connector{}
+	assert.Empty(t, c.identityFiles("web", ""), "no ssh config")
+
+	c = c.WithSSHConfig(sshConf)
+	testCases := []struct {
+		name, hostAddr, hostName string
+		expIdentities            []string
+	}{
+		{"resolved host, alias as name", "web.example.com:2222", "web", []string{"/keys/web_key", "/keys/web.example.com_key"}},
+		{"alias as host", "web:22", "", []string{"/keys/web_key", "/keys/web_key"}},
+		{"ip with alias name", "10.0.0.1:22", "web", []string{"/keys/web_key", "/keys/10.0.0.1_key"}},
+		{"unknown host", "other:22", "other", []string{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expIdentities, c.identityFiles(tc.hostAddr, tc.hostName))
+		})
+	}
+}
@@ -37,15 +37,16 @@ func (ex *Dry) Run(_ context.Context, cmd string, _ *RunOpts) (out []string, err
 
 // Upload doesn't actually upload, just prints the command
 func (ex *Dry) Upload(_ context.Context, local, remote string, opts *UpDownOpts) (err error) {
-	var mkdir bool
+	var mkdir, checksum bool
 	var exclude []string
 
 	if opts != nil {
 		mkdir = opts.Mkdir
+		checksum = opts.Checksum
 		exclude = opts.Exclude
 	}
 
-	log.Printf("[DEBUG] upload %s to %s, mkdir: %v, exclude: %v", local, remote, mkdir, exclude)
+	log.Printf("[DEBUG] upload %s to %s, mkdir: %v, checksum: %v, exclude: %v", local, remote, mkdir, checksum, exclude)
 	if strings.Contains(remote, "spot-script") {
 		// this is a temp script created by spot to perform script execution on remote host
 		ex.logs.Err.Write([]byte("command script " + remote)) // nolint
@@ -69,26 +70,28 @@ func (ex *Dry) Upload(_ context.Context, local, remote string, opts *UpDownOpts)
 
 // Download file from remote server with scp
 func (ex *Dry) Download(_ context.Context, remote, local string, opts *UpDownOpts) (err error) {
-	var mkdir bool
+	var mkdir, checksum bool
 	var exclude []string
 
 	if opts != nil {
 		mkdir = opts.Mkdir
+		checksum = opts.Checksum
 		exclude = opts.Exclude
 	}
 
-	log.Printf("[DEBUG] download %s to %s, mkdir: %v, exclude: %v", local, remote, mkdir, exclude)
+	log.Printf("[DEBUG] download %s to %s, mkdir: %v, checksum: %v, exclude: %v", local, remote, mkdir, checksum, exclude)
 	return nil
 }
 
 // Sync doesn't sync anything, just prints the command
 func (ex *Dry) Sync(_ context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
 	del := opts != nil && opts.Delete
+	checksum := opts != nil && opts.Checksum
 	exclude := []string{}
 	if opts != nil {
 		exclude = opts.Exclude
 	}
-	log.Printf("[DEBUG] sync %s to %s, delete: %v, exlcude: %v", localDir, remoteDir, del, exclude) // nolint
+	log.Printf("[DEBUG] sync %s to %s, delete: %v, checksum: %v, exlcude: %v", localDir, remoteDir, del, checksum, exclude) // nolint
 	return nil, nil
 }
 
@@ -4,9 +4,18 @@ package executor
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // Interface is an interface for the executor.
@@ -22,7 +31,62 @@ type Interface interface {
 
 // RunOpts is a struct for run options.
 type RunOpts struct {
-	Verbose bool // print more info to primary stdout
+	Verbose bool      // print more info to primary stdout
+	Stdout  io.Writer // optional writer to capture command's stdout, in addition to logs
+	Stderr  io.Writer // optional writer to capture command's stderr, in addition to logs
+	Stdin   io.Reader // optional command's input, i.e. password for sudo
+	PTY     bool      // request pseudo-terminal for the command, remote only. stderr is merged into stdout with pty
+}
+
+// stdin returns command's input from opts, nil if not set
+func (o *RunOpts) stdin() io.Reader {
+	if o == nil {
+		return nil
+	}
+	return o.Stdin
+}
+
+// outWriters returns writers for command's stdout and stderr, adding capture writers from opts if set
+func (o *RunOpts) outWriters(stdout, stderr io.Writer) (outWr, errWr io.Writer) {
+	outWr, errWr = stdout, stderr
+	if o == nil {
+		return outWr, errWr
+	}
+	if o.Stdout != nil {
+		outWr = io.MultiWriter(outWr, o.Stdout)
+	}
+	if o.Stderr != nil {
+		errWr = io.MultiWriter(errWr, o.Stderr)
+	}
+	return outWr, errWr
+}
+
+// ExitCode returns the exit code of the failed command from the error returned by Run.
+// Returns 0 for nil error and -1 if the error is not caused by the command's exit status.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus()
+	}
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) {
+		return execErr.ExitCode()
+	}
+	return -1
+}
+
+// stopTimeout is the time given to the stopped command to exit after each signal, before the next, harder, way to stop it
+const stopTimeout = 2 * time.Second
+
+// stopError makes the error for the command stopped by the context, it says if the command was stopped on timeout
+func stopError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timeout: %w", ctx.Err())
+	}
+	return fmt.Errorf("canceled: %w", ctx.Err())
 }
 
 // UpDownOpts is a struct for upload and download options.
@@ -31,6 +95,17 @@ type UpDownOpts struct {
 	Checksum bool     // compare checksums of local and remote files, default is size and modtime
 	Force    bool     // overwrite existing files on remote
 	Exclude  []string // exclude files matching the given patterns
+
+	// OnTransfer is an optional callback, called for each file actually transferred.
+	// Files skipped as up-to-date are not reported.
+	OnTransfer func(src, dst string)
+}
+
+// transferred calls OnTransfer callback if set
+func (o *UpDownOpts) transferred(src, dst string) {
+	if o != nil && o.OnTransfer != nil {
+		o.OnTransfer(src, dst)
+	}
 }
 
 // SyncOpts is a struct for sync options.
@@ -47,6 +122,69 @@ type DeleteOpts struct {
 	Exclude   []string // exclude files matching the given patterns
 }
 
+// UploadFile is a local file to upload and its destination
+type UploadFile struct {
+	Local  string
+	Remote string
+}
+
+// UploadFiles returns local files matching src and their destinations, the way Upload copies them.
+// The source can be a glob pattern, with multiple files matched the destination is a directory.
+// Files matching exclude patterns are skipped. Returns error if nothing matched the source.
+func UploadFiles(src, dst string, exclude []string) ([]UploadFile, error) {
+	matches, err := filepath.Glob(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand glob pattern %s: %w", src, err)
+	}
+	if len(matches) == 0 { // no match
+		return nil, fmt.Errorf("source file %q not found", src)
+	}
+
+	res := make([]UploadFile, 0, len(matches))
+	for _, match := range matches {
+		relPath, err := filepath.Rel(filepath.Dir(src), match)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build relative path for %s: %w", match, err)
+		}
+		if isExcluded(relPath, exclude) {
+			continue
+		}
+		remoteFile := dst
+		if len(matches) > 1 { // if there are multiple files, treat destination as a directory
+			remoteFile = filepath.Join(dst, filepath.Base(match))
+		}
+		res = append(res, UploadFile{Local: match, Remote: remoteFile})
+	}
+	return res, nil
+}
+
+// RemoteFile is a file in the remote directory, with the properties used to compare it with the local file
+type RemoteFile struct {
+	Size int64
+	Time time.Time
+}
+
+// SyncFiles returns files to update and files to delete to sync the remote directory with the local one, the same
+// way as Sync does. Remote files are given by their paths relative to the remote directory. Files are matched by size
+// and modification time, or by sameContent func, if set, for files of the same size. Excluded files are neither
+// updated nor deleted.
+func SyncFiles(localDir string, remote map[string]RemoteFile, excl []string,
+	sameContent func(path string) bool) (updated, deleted []string, err error) {
+	localFiles, err := getLocalFilesProperties(localDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
+	}
+	remoteFiles := make(map[string]fileProperties, len(remote))
+	for path, rf := range remote {
+		if isExcluded(path, excl) {
+			continue
+		}
+		remoteFiles[path] = fileProperties{Size: rf.Size, Time: rf.Time, FileName: path}
+	}
+	updated, deleted = findUnmatchedFiles(localFiles, remoteFiles, excl, sameContent)
+	return updated, deleted, nil
+}
+
 func isExcluded(path string, excl []string) bool {
 	pathSegments := strings.Split(path, string(filepath.Separator))
 	for i := range pathSegments {
@@ -89,3 +227,27 @@ func isWithinOneSecond(t1, t2 time.Time) bool {
 	}
 	return diff <= time.Second
 }
+
+// checksum returns hex-encoded sha256 checksum of the content read from r
+func checksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("failed to calculate checksum: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// shellQuote quotes the string to be used as a single word in posix shell, with no expansions
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// localChecksum returns hex-encoded sha256 checksum of the local file
+func localChecksum(path string) (string, error) {
+	fh, err := os.Open(path) // nolint
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer fh.Close() // nolint ro file
+	return checksum(fh)
+}
@@ -2,8 +2,12 @@ package executor
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -107,3 +111,84 @@ func captureStdOut(t *testing.T, f func()) string {
 	io.Copy(&buf, r)
 	return buf.String()
 }
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, -1, ExitCode(errors.New("some error")))
+
+	err := exec.Command("sh", "-c", "exit 5").Run()
+	require.Error(t, err)
+	assert.Equal(t, 5, ExitCode(err))
+	assert.Equal(t, 5, ExitCode(fmt.Errorf("can't run: %w", err)))
+}
+
+func TestUploadFiles(t *testing.T) {
+	tbl := []struct {
+		name     string
+		src, dst string
+		exclude  []string
+		expected []UploadFile
+		expErr   string
+	}{
+		{name: "single file", src: "testdata/data1.txt", dst: "/tmp/dst.txt",
+			expected: []UploadFile{{Local: "testdata/data1.txt", Remote: "/tmp/dst.txt"}}},
+		{name: "glob", src: "testdata/data*.txt", dst: "/tmp/dst",
+			expected: []UploadFile{{Local: "testdata/data1.txt", Remote: "/tmp/dst/data1.txt"},
+				{Local: "testdata/data2.txt", Remote: "/tmp/dst/data2.txt"}, {Local: "testdata/data3.txt", Remote: "/tmp/dst/data3.txt"}}},
+		{name: "glob with exclude", src: "testdata/data*.txt", dst: "/tmp/dst", exclude: []string{"data2.*"},
+			expected: []UploadFile{{Local: "testdata/data1.txt", Remote: "/tmp/dst/data1.txt"},
+				{Local: "testdata/data3.txt", Remote: "/tmp/dst/data3.txt"}}},
+		{name: "not found", src: "testdata/not-found.txt", dst: "/tmp/dst", expErr: `source file "testdata/not-found.txt" not found`},
+		{name: "bad pattern", src: "testdata/[", dst: "/tmp/dst",
+			expErr: "failed to expand glob pattern testdata/[: syntax error in pattern"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := UploadFiles(tt.src, tt.dst, tt.exclude)
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, res)
+		})
+	}
+}
+
+func TestSyncFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "same.txt"), []byte("same"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "new.txt"), []byte("new"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "size.txt"), []byte("size"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "skip.txt"), []byte("skip"), 0o600))
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, f := range []string{"same.txt", "new.txt", filepath.Join("sub", "size.txt"), "skip.txt"} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, f), mtime, mtime))
+	}
+
+	remote := map[string]RemoteFile{
+		"same.txt":                       {Size: 4, Time: mtime},
+		filepath.Join("sub", "size.txt"): {Size: 5, Time: mtime},
+		"extra.txt":                      {Size: 1, Time: mtime},
+		"keep.me":                        {Size: 1, Time: mtime},
+	}
+
+	t.Run("by size and time", func(t *testing.T) {
+		updated, deleted, err := SyncFiles(dir, remote, []string{"skip.txt", "keep.me"}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"new.txt", filepath.Join("sub", "size.txt")}, updated)
+		assert.Equal(t, []string{"extra.txt"}, deleted)
+	})
+
+	t.Run("by content", func(t *testing.T) {
+		updated, _, err := SyncFiles(dir, remote, []string{"skip.txt", "keep.me"}, func(path string) bool { return false })
+		require.NoError(t, err)
+		assert.Equal(t, []string{"new.txt", "same.txt", filepath.Join("sub", "size.txt")}, updated)
+	})
+
+	t.Run("missing local dir", func(t *testing.T) {
+		_, _, err := SyncFiles(filepath.Join(dir, "not-found"), remote, nil, nil)
+		require.Error(t, err)
+	})
+}
@@ -12,6 +12,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-pkgz/fileutils"
 )
@@ -27,7 +29,7 @@ func NewLocal(logs Logs) *Local {
 }
 
 // Run executes command on local hostAddr, inside the shell
-func (l *Local) Run(ctx context.Context, cmd string, _ *RunOpts) (out []string, err error) {
+func (l *Local) Run(ctx context.Context, cmd string, opts *RunOpts) (out []string, err error) {
 	shell := func() string {
 		if strings.HasPrefix(cmd, "sh -c") {
 			return "sh" // command has sh -c prefix, so use sh
@@ -46,6 +48,13 @@ func (l *Local) Run(ctx context.Context, cmd string, _ *RunOpts) (out []string,
 		cmd = strings.TrimSuffix(cmd, "'")
 	}
 	command := exec.CommandContext(ctx, shell(), "-c", cmd) // nolint
+	// on canceled context interrupt the command first, then terminate it and kill as the last resort
+	setProcessGroup(command)
+	command.Cancel = func() error {
+		time.AfterFunc(stopTimeout, func() { _ = signalCommand(command, syscall.SIGTERM) })
+		return signalCommand(command, syscall.SIGINT)
+	}
+	command.WaitDelay = 2 * stopTimeout
 
 	outLog := l.logs.Out.WithHost("localhost", "")
 	errLog := l.logs.Err.WithHost("localhost", "")
@@ -53,9 +62,24 @@ func (l *Local) Run(ctx context.Context, cmd string, _ *RunOpts) (out []string,
 
 	var stdoutBuf bytes.Buffer
 	mwr := io.MultiWriter(outLog, &stdoutBuf)
-	command.Stdout, command.Stderr = mwr, errLog
+	command.Stdout, command.Stderr = opts.outWriters(mwr, errLog)
+	if in := opts.stdin(); in != nil {
+		// copy the input in our own goroutine, Wait doesn't wait for it. Otherwise, the command which never reads
+		// the input, i.e. sudo with cached credentials, hangs until the input is closed by the caller
+		stdinPipe, e := command.StdinPipe()
+		if e != nil {
+			return nil, fmt.Errorf("can't get stdin pipe: %w", e)
+		}
+		go func() {
+			_, _ = io.Copy(stdinPipe, in)
+			_ = stdinPipe.Close()
+		}()
+	}
 	err = command.Run()
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, stopError(ctx)
+		}
 		return nil, err
 	}
 
@@ -69,16 +93,6 @@ func (l *Local) Run(ctx context.Context, cmd string, _ *RunOpts) (out []string,
 // Upload just copy file from one place to another
 func (l *Local) Upload(_ context.Context, src, dst string, opts *UpDownOpts) (err error) {
 
-	// check if the local parameter contains a glob pattern
-	matches, err := filepath.Glob(src)
-	if err != nil {
-		return fmt.Errorf("failed to expand glob pattern %s: %w", src, err)
-	}
-
-	if len(matches) == 0 { // no match
-		return fmt.Errorf("source file %q not found", src)
-	}
-
 	var mkdir bool
 	var exclude []string
 
@@ -87,24 +101,17 @@ func (l *Local) Upload(_ context.Context, src, dst string, opts *UpDownOpts) (er
 		exclude = opts.Exclude
 	}
 
-	if mkdir {
-		if err = os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
-			return fmt.Errorf("can't create local dir %s: %w", filepath.Dir(dst), err)
-		}
+	files, err := UploadFiles(src, dst, exclude)
+	if err != nil {
+		return err
 	}
 
-	for _, match := range matches {
-		relPath, e := filepath.Rel(filepath.Dir(src), match)
-		if e != nil {
-			return fmt.Errorf("failed to build relative path for %s: %w", match, err)
-		}
-		if isExcluded(relPath, exclude) {
-			continue
-		}
-
-		destination := dst
-		if len(matches) > 1 {
-			destination = filepath.Join(dst, filepath.Base(match))
+	for _, f := range files {
+		match, destination := f.Local, f.Remote
+		if mkdir {
+			if err = os.MkdirAll(filepath.Dir(destination), 0o750); err != nil {
+				return fmt.Errorf("can't create local dir %s: %w", filepath.Dir(destination), err)
+			}
 		}
 
 		// check source file info
@@ -119,20 +126,28 @@ func (l *Local) Upload(_ context.Context, src, dst string, opts *UpDownOpts) (er
 			return fmt.Errorf("failed to stat destination file %s: %w", destination, err)
 		}
 
-		// if destination file exists, and source and destination have the same size and modification time, skip copying
+		// if destination file exists, and source and destination have the same size and modification time, skip copying.
+		// with checksum option, the content is compared instead of modification time.
 		forced := opts != nil && opts.Force
+		checksum := opts != nil && opts.Checksum
 		isSame := func() bool {
-			return srcInfo.Size() == dstInfo.Size() && srcInfo.ModTime().Equal(dstInfo.ModTime()) &&
-				srcInfo.Mode() == dstInfo.Mode()
+			if srcInfo.Size() != dstInfo.Size() || srcInfo.Mode() != dstInfo.Mode() {
+				return false
+			}
+			if checksum {
+				return l.sameContent(match, destination)
+			}
+			return srcInfo.ModTime().Equal(dstInfo.ModTime())
 		}
 		if err == nil && !forced && isSame() {
-			log.Printf("[DEBUG] skip copying %s to %s, same size and modification time", match, destination)
+			log.Printf("[DEBUG] skip copying %s to %s, same size and modification time or content", match, destination)
 			continue
 		}
 
 		if err = l.copyFile(match, destination); err != nil {
 			return fmt.Errorf("can't copy local file from %s to %s: %w", match, dst, err)
 		}
+		opts.transferred(match, destination)
 	}
 	return nil
 }
@@ -145,10 +160,12 @@ func (l *Local) Download(_ context.Context, src, dst string, opts *UpDownOpts) (
 // Sync directories from src to dst
 func (l *Local) Sync(ctx context.Context, src, dst string, opts *SyncOpts) ([]string, error) {
 	excl := []string{}
+	checksum := false
 	if opts != nil {
 		excl = opts.Exclude
+		checksum = opts.Checksum
 	}
-	copiedFiles, err := l.syncSrcToDst(ctx, src, dst, excl)
+	copiedFiles, err := l.syncSrcToDst(ctx, src, dst, excl, checksum)
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +197,8 @@ func (l *Local) Delete(ctx context.Context, remoteFile string, opts *DeleteOpts)
 // Close does nothing for local
 func (l *Local) Close() error { return nil }
 
-func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string) ([]string, error) {
+// syncSrcToDst copies all files from src to dst. With checksum, files with the same content are skipped.
+func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string, checksum bool) ([]string, error) {
 	var copiedFiles []string
 
 	err := filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
@@ -211,6 +229,13 @@ func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string
 			return nil
 		}
 
+		if checksum {
+			if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.Size() == info.Size() && l.sameContent(srcPath, dstPath) {
+				log.Printf("[DEBUG] skip copying %s to %s, same content", srcPath, dstPath)
+				return nil
+			}
+		}
+
 		if err := fileutils.CopyFile(srcPath, dstPath); err != nil {
 			return err
 		}
@@ -268,6 +293,22 @@ func (l *Local) removeExtraDstFiles(ctx context.Context, src, dst string) error
 	return nil
 }
 
+// sameContent checks if src and dst files have the same content, comparing their checksums.
+// Any error is reported as a mismatch, i.e. the file will be copied.
+func (l *Local) sameContent(src, dst string) bool {
+	srcSum, err := localChecksum(src)
+	if err != nil {
+		log.Printf("[WARN] can't get checksum of %s: %v", src, err)
+		return false
+	}
+	dstSum, err := localChecksum(dst)
+	if err != nil {
+		log.Printf("[WARN] can't get checksum of %s: %v", dst, err)
+		return false
+	}
+	return srcSum == dstSum
+}
+
 // nolint
 func (l *Local) copyFile(src, dst string) error {
 	srcFile, err := os.Open(src)
@@ -297,6 +338,10 @@ func (l *Local) copyFile(src, dst string) error {
 	if err := os.Chmod(dst, fi.Mode()); err != nil {
 		return err
 	}
+	// keep modification time, so the next upload of the same file is skipped, same as remote upload does
+	if err := os.Chtimes(dst, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
 
 	return nil
 }
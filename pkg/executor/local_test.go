@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -42,6 +44,61 @@ func TestRun(t *testing.T) {
 		require.Error(t, e)
 	})
 
+	t.Run("capture stdout and stderr with exit code", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		out, e := l.Run(ctx, "echo out1; echo err1 >&2; echo out2; exit 3", &RunOpts{Stdout: &stdout, Stderr: &stderr})
+		require.Error(t, e)
+		assert.Nil(t, out)
+		assert.Equal(t, "out1\nout2\n", stdout.String())
+		assert.Equal(t, "err1\n", stderr.String())
+		assert.Equal(t, 3, ExitCode(e))
+		assert.Equal(t, 3, ExitCode(fmt.Errorf("wrapped: %w", e)))
+	})
+
+	t.Run("input never closed", func(t *testing.T) {
+		inpRdr, inpWr := io.Pipe()
+		defer inpWr.Close()
+		tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		st := time.Now()
+		out, e := l.Run(tctx, "echo done", &RunOpts{Stdin: inpRdr})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"done"}, out)
+		assert.Less(t, time.Since(st), time.Second, "doesn't wait for the input")
+	})
+
+	t.Run("input", func(t *testing.T) {
+		out, e := l.Run(ctx, `read v; echo "got $v"`, &RunOpts{Stdin: strings.NewReader("value\n")})
+		require.NoError(t, e)
+		assert.Equal(t, []string{"got value"}, out)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		st := time.Now()
+		_, e := l.Run(tctx, "sleep 5", nil)
+		require.EqualError(t, e, "timeout: context deadline exceeded")
+		assert.Less(t, time.Since(st), stopTimeout, "stopped by interrupt")
+	})
+
+	t.Run("timeout with ignored interrupt", func(t *testing.T) {
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		st := time.Now()
+		_, e := l.Run(tctx, `trap "" INT; while true; do sleep 0.1; done`, nil)
+		require.EqualError(t, e, "timeout: context deadline exceeded")
+		assert.GreaterOrEqual(t, time.Since(st), stopTimeout, "interrupt ignored")
+		assert.Less(t, time.Since(st), 2*stopTimeout, "stopped by terminate")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, e := l.Run(cctx, "echo hello", nil)
+		require.EqualError(t, e, "canceled: context canceled")
+	})
+
 	t.Run("multi line out success", func(t *testing.T) {
 		// Prepare the test environment
 		_, err := l.Run(ctx, "mkdir -p /tmp/st", &RunOpts{Verbose: true})
@@ -227,6 +284,51 @@ func TestUploadAndDownload(t *testing.T) {
 	}
 }
 
+func TestLocal_UploadWithChecksum(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	tmpDir := t.TempDir()
+	src, dst := filepath.Join(tmpDir, "src.txt"), filepath.Join(tmpDir, "dst.txt")
+	require.NoError(t, os.WriteFile(src, []byte("content1"), 0o600))
+	require.NoError(t, os.WriteFile(dst, []byte("content1"), 0o600))
+	require.NoError(t, os.Chtimes(dst, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+
+	l := &Local{}
+	err := l.Upload(context.Background(), src, dst, &UpDownOpts{Checksum: true})
+	require.NoError(t, err)
+	assert.Contains(t, logBuf.String(), "[DEBUG] skip copying", "same content with different mod time should be skipped")
+	logBuf.Reset()
+
+	require.NoError(t, os.WriteFile(src, []byte("content2"), 0o600))
+	err = l.Upload(context.Background(), src, dst, &UpDownOpts{Checksum: true})
+	require.NoError(t, err)
+	assert.NotContains(t, logBuf.String(), "[DEBUG] skip copying", "different content of the same size should be copied")
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "content2", string(data))
+}
+
+func TestLocal_UploadOnTransfer(t *testing.T) {
+	tmpDir := t.TempDir()
+	src, dst := filepath.Join(tmpDir, "src.txt"), filepath.Join(tmpDir, "dst.txt")
+	require.NoError(t, os.WriteFile(src, []byte("content1"), 0o600))
+
+	transferred := []string{}
+	opts := &UpDownOpts{OnTransfer: func(src, dst string) { transferred = append(transferred, src+" -> "+dst) }}
+	l := &Local{}
+	require.NoError(t, l.Upload(context.Background(), src, dst, opts))
+	assert.Equal(t, []string{src + " -> " + dst}, transferred)
+
+	require.NoError(t, l.Upload(context.Background(), src, dst, opts))
+	assert.Len(t, transferred, 1, "up-to-date file is not transferred")
+
+	opts.Force = true
+	require.NoError(t, l.Upload(context.Background(), src, dst, opts))
+	assert.Len(t, transferred, 2, "forced upload is transferred")
+}
+
 func TestUploadDownloadWithGlob(t *testing.T) {
 	// create some temporary test files with content
 	tmpDir, err := os.MkdirTemp("", "test")
@@ -409,6 +511,7 @@ func TestLocal_Sync(t *testing.T) {
 		dstStructure map[string]string
 		del          bool
 		exclude      []string
+		checksum     bool
 		expected     []string
 	}{
 		{
@@ -563,6 +666,23 @@ func TestLocal_Sync(t *testing.T) {
 				"dir1/file2.txt",
 			},
 		},
+		{
+			name: "sync with checksum, skip files with the same content",
+			srcStructure: map[string]string{
+				"file1.txt":      "content1",
+				"file2.txt":      "content2",
+				"dir1/file3.txt": "content3",
+			},
+			dstStructure: map[string]string{
+				"file1.txt":      "content1",
+				"file2.txt":      "contentX",
+				"dir1/file3.txt": "content3",
+			},
+			checksum: true,
+			expected: []string{
+				"file2.txt",
+			},
+		},
 	}
 
 	svc := Local{}
@@ -598,7 +718,7 @@ func TestLocal_Sync(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
 
-			copiedFiles, err := svc.Sync(ctx, srcDir, dstDir, &SyncOpts{Delete: tc.del, Exclude: tc.exclude})
+			copiedFiles, err := svc.Sync(ctx, srcDir, dstDir, &SyncOpts{Delete: tc.del, Exclude: tc.exclude, Checksum: tc.checksum})
 			require.NoError(t, err)
 			assert.ElementsMatch(t, tc.expected, copiedFiles)
 
@@ -846,7 +966,7 @@ func TestLocal_syncSrcToDst_InvalidSrcPath(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(dst)
 
-	_, err = l.syncSrcToDst(context.Background(), src, dst, nil)
+	_, err = l.syncSrcToDst(context.Background(), src, dst, nil, false)
 	assert.Error(t, err, "expected an error")
 }
 
@@ -993,7 +1113,7 @@ func TestSyncSrcToDst_UnhappyPath(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 		cancel()
 
-		_, err = l.syncSrcToDst(ctx, tmpSrcDir, tmpDstDir, nil)
+		_, err = l.syncSrcToDst(ctx, tmpSrcDir, tmpDstDir, nil, false)
 		assert.Error(t, err, "syncSrcToDst should return an error when the context is canceled")
 	})
 
@@ -1003,7 +1123,7 @@ func TestSyncSrcToDst_UnhappyPath(t *testing.T) {
 		assert.NoError(t, err, "creating a temporary destination directory should not return an error")
 		defer os.RemoveAll(tmpDstDir)
 
-		_, err = l.syncSrcToDst(context.Background(), invalidSrcPath, tmpDstDir, nil)
+		_, err = l.syncSrcToDst(context.Background(), invalidSrcPath, tmpDstDir, nil, false)
 		assert.Error(t, err, "syncSrcToDst should return an error when there's an error while walking the source directory")
 	})
 }
@@ -0,0 +1,16 @@
+//go:build windows
+
+package executor
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup does nothing on windows, process groups are not used
+func setProcessGroup(_ *exec.Cmd) {}
+
+// signalCommand sends the signal to the command's process. Windows supports kill only, other signals fail
+func signalCommand(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Signal(sig)
+}
@@ -77,7 +77,7 @@ func (s *colorizedWriter) WithWriter(wr io.Writer) LogWriter {
 // Printf writes the given text to io.Writer with the colorized hostAddr prefix.
 func (s *colorizedWriter) Printf(format string, v ...any) {
 	msg := fmt.Sprintf(format, v...)
-	msg = maskSecrets(msg, s.secrets)
+	msg = MaskSecrets(msg, s.secrets)
 	_, _ = fmt.Fprint(s, msg)
 }
 
@@ -92,7 +92,7 @@ func (s *colorizedWriter) Write(p []byte) (n int, err error) {
 			hostID = s.hostName + " " + s.hostAddr
 		}
 		formattedOutput := fmt.Sprintf("[%s] %s %s", hostID, s.prefix, line)
-		formattedOutput = maskSecrets(formattedOutput, s.secrets)
+		formattedOutput = MaskSecrets(formattedOutput, s.secrets)
 
 		if s.prefix == "" {
 			formattedOutput = fmt.Sprintf("[%s] %s", hostID, line)
@@ -142,7 +142,8 @@ func MakeLogs(verbose, bw bool, secrets []string) Logs {
 	return Logs{Info: infoLog, Out: outLog, Err: errLog, verbose: verbose, secrets: secrets, monochrome: bw}
 }
 
-func maskSecrets(s string, secrets []string) string {
+// MaskSecrets replaces all the secrets appearing in the string as a whole word with "****"
+func MaskSecrets(s string, secrets []string) string {
 	for _, secret := range secrets {
 		if secret == " " || secret == "" {
 			continue
@@ -166,7 +167,7 @@ func (w *stdOutLogWriter) Write(p []byte) (n int, err error) {
 		if line == "" {
 			continue
 		}
-		line = maskSecrets(line, w.secrets)
+		line = MaskSecrets(line, w.secrets)
 		log.Printf("[%s] %s %s", w.level, w.prefix, line)
 	}
 	return len(p), nil
@@ -316,7 +316,7 @@ func TestMaskSecrets(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		output := maskSecrets(tt.input, tt.secrets)
+		output := MaskSecrets(tt.input, tt.secrets)
 		assert.Equal(t, tt.expected, output)
 	}
 }
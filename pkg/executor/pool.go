@@ -0,0 +1,133 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pool keeps ssh connections made by Connector open for reuse, keyed by host address, port and user.
+// Connecting to the same host again returns the pooled connection, if it is still alive, otherwise
+// the host is reconnected. Connections are kept until Pool.Close. Thread safe.
+type Pool struct {
+	connector *Connector
+	lock      sync.Mutex
+	conns     map[string]*pooledConn
+}
+
+// pooledConn holds the connection to a single host, with the lock to prevent parallel connects to the same host
+type pooledConn struct {
+	lock   sync.Mutex
+	remote *Remote
+}
+
+// NewPool makes a connection pool for the connector.
+func NewPool(connector *Connector) *Pool {
+	return &Pool{connector: connector, conns: map[string]*pooledConn{}}
+}
+
+// Connect returns remote executor for the host, reusing the pooled connection if any. Close of the returned executor
+// doesn't close the connection, it is closed by Pool.Close. Jump hosts are part of the connection's key as well,
+// i.e. the same host reached through different jump hosts gets a separate connection.
+func (p *Pool) Connect(ctx context.Context, hostAddr, hostName, user string, jumps ...JumpHost) (*Remote, error) {
+	key := p.key(hostAddr, user, jumps)
+
+	p.lock.Lock()
+	pc, ok := p.conns[key]
+	if !ok {
+		pc = &pooledConn{}
+		p.conns[key] = pc
+	}
+	p.lock.Unlock()
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.remote != nil {
+		if pc.remote.alive(p.connector.timeout) {
+			log.Printf("[DEBUG] reuse connection to %s", key)
+			return pc.remote.pooledCopy(hostName, p.connector.logs), nil
+		}
+		log.Printf("[INFO] connection to %s is dead, reconnect", key)
+		_ = pc.remote.closeConn()
+		pc.remote = nil
+	}
+
+	remote, err := p.connector.Connect(ctx, hostAddr, hostName, user, jumps...)
+	if err != nil {
+		return nil, err
+	}
+	remote.sftp = &sftpSession{}
+	pc.remote = remote
+	return remote.pooledCopy(hostName, p.connector.logs), nil
+}
+
+// Close closes all pooled connections.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var err error
+	for key, pc := range p.conns {
+		pc.lock.Lock()
+		if pc.remote != nil {
+			if e := pc.remote.closeConn(); e != nil && err == nil {
+				err = fmt.Errorf("failed to close connection to %s: %w", key, e)
+			}
+		}
+		pc.lock.Unlock()
+	}
+	p.conns = map[string]*pooledConn{}
+	return err
+}
+
+func (p *Pool) String() string {
+	return fmt.Sprintf("pool of %s", p.connector)
+}
+
+// key makes the pool key from the address and user of the remote server and each jump host, the same as used
+// to connect to them, i.e. with the default port and user applied
+func (p *Pool) key(hostAddr, user string, jumps []JumpHost) string {
+	hops := p.connector.hops(hostAddr, user, jumps)
+	dest := hops[len(hops)-1]
+	res := dest.User + "@" + dest.Addr
+	if len(hops) > 1 {
+		via := make([]string, 0, len(hops)-1)
+		for _, h := range hops[:len(hops)-1] {
+			via = append(via, h.User+"@"+h.Addr)
+		}
+		res += " via " + strings.Join(via, ",")
+	}
+	return res
+}
+
+// alive checks if the connection is still alive by sending keepalive request. The connection is considered dead
+// if the request failed or not answered in time.
+func (ex *Remote) alive(timeout time.Duration) bool {
+	if ex.client == nil {
+		return false
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := ex.client.SendRequest("keepalive@openssh.com", true, nil)
+		errCh <- err
+	}()
+	if timeout <= 0 {
+		return <-errCh == nil
+	}
+	select {
+	case err := <-errCh:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// pooledCopy returns a copy of the remote executor sharing the connection and sftp client, with logs for the host name.
+// Close of the copy doesn't close the connection.
+func (ex *Remote) pooledCopy(hostName string, logs Logs) *Remote {
+	return &Remote{client: ex.client, jumpClients: ex.jumpClients, hostAddr: ex.hostAddr, hostName: hostName,
+		logs: logs.WithHost(ex.hostAddr, hostName), sftp: ex.sftp, pooled: true}
+}
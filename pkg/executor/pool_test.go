@@ -0,0 +1,101 @@
+package executor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Connect(t *testing.T) {
+	ctx := context.Background()
+	hostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10, MakeLogs(true, false, nil))
+	require.NoError(t, err)
+	pool := NewPool(c)
+
+	r1, err := pool.Connect(ctx, hostAndPort, "h1", "test")
+	require.NoError(t, err)
+	require.NoError(t, r1.Close(), "close of pooled executor does nothing")
+
+	r2, err := pool.Connect(ctx, hostAndPort, "h2", "test")
+	require.NoError(t, err)
+	assert.Same(t, r1.client, r2.client, "connection reused")
+	assert.Equal(t, "h2", r2.hostName)
+	out, err := r2.Run(ctx, "echo hello", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello"}, out)
+
+	t.Run("sftp client reused", func(t *testing.T) {
+		require.NoError(t, r2.Upload(ctx, "testdata/data1.txt", "/tmp/pool/data1.txt", &UpDownOpts{Mkdir: true}))
+		sftpClient := r2.sftp.client
+		require.NotNil(t, sftpClient)
+		require.NoError(t, r2.Upload(ctx, "testdata/data2.txt", "/tmp/pool/data2.txt", &UpDownOpts{Mkdir: true}))
+		assert.Same(t, sftpClient, r2.sftp.client)
+		out, err = r2.Run(ctx, "ls /tmp/pool", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"data1.txt", "data2.txt"}, out)
+	})
+
+	t.Run("reconnect dead connection", func(t *testing.T) {
+		require.NoError(t, r2.client.Close()) // simulate broken connection
+		r3, err := pool.Connect(ctx, hostAndPort, "h1", "test")
+		require.NoError(t, err)
+		assert.NotSame(t, r2.client, r3.client, "new connection")
+		out, err := r3.Run(ctx, "echo hello", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"hello"}, out)
+	})
+
+	t.Run("different user", func(t *testing.T) {
+		_, err := pool.Connect(ctx, hostAndPort, "h1", "test33")
+		require.ErrorContains(t, err, "ssh: unable to authenticate")
+	})
+
+	require.NoError(t, pool.Close())
+	r4, err := pool.Connect(ctx, hostAndPort, "h1", "test")
+	require.NoError(t, err)
+	assert.NotSame(t, r2.client, r4.client, "new connection after pool closed")
+	require.NoError(t, pool.Close())
+	_, err = r4.Run(ctx, "echo hello", nil)
+	require.Error(t, err, "connection closed by pool")
+}
+
+func TestPool_key(t *testing.T) {
+	c, err := NewConnector("testdata/test_ssh_key", time.Second, MakeLogs(false, false, nil))
+	require.NoError(t, err)
+
+	tbl := []struct {
+		name     string
+		hostAddr string
+		user     string
+		jumps    []JumpHost
+		expected string
+	}{
+		{name: "host with port", hostAddr: "h1.example.com:2222", user: "test", expected: "test@h1.example.com:2222"},
+		{name: "host without port", hostAddr: "h1.example.com", user: "test", expected: "test@h1.example.com:22"},
+		{name: "with jumps", hostAddr: "10.0.0.1:22", user: "test",
+			jumps:    []JumpHost{{Addr: "bastion:22", User: "jump"}, {Addr: "bastion2:2222"}},
+			expected: "test@10.0.0.1:22 via jump@bastion:22,test@bastion2:2222"},
+		{name: "jumps without port and user", hostAddr: "10.0.0.1", user: "test",
+			jumps:    []JumpHost{{Addr: "bastion"}},
+			expected: "test@10.0.0.1:22 via test@bastion:22"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewPool(c)
+			assert.Equal(t, tt.expected, pool.key(tt.hostAddr, tt.user, tt.jumps))
+		})
+	}
+
+	t.Run("same dial parameters make the same key", func(t *testing.T) {
+		pool := NewPool(c)
+		assert.Equal(t, pool.key("h1:22", "test", []JumpHost{{Addr: "bastion:22", User: "test"}}),
+			pool.key("h1", "test", []JumpHost{{Addr: "bastion"}}))
+		assert.NotEqual(t, pool.key("h1", "test", nil), pool.key("h1", "test2", nil))
+	})
+}
@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -20,28 +21,62 @@ import (
 
 // Remote executes commands on remote server, via ssh. Not thread-safe.
 type Remote struct {
-	client   *ssh.Client
-	hostAddr string
-	hostName string
-	logs     Logs
+	client      *ssh.Client
+	jumpClients []*ssh.Client // clients connected to jump hosts, in order of the hops
+	hostAddr    string
+	hostName    string
+	logs        Logs
+
+	sftp   *sftpSession // kept alive sftp client, reused by all transfers. nil for a new client per transfer
+	pooled bool         // connection is owned by Pool and closed by it, Close does nothing
 }
 
-// Close connection to remote server.
+// sftpSession keeps sftp client open for reuse. The client is created on the first use
+// and recreated if the sftp subsystem terminated. Thread safe.
+type sftpSession struct {
+	lock   sync.Mutex
+	client *sftp.Client
+}
+
+// Close connection to remote server and to the jump hosts, if any.
+// Pooled connections are not closed, Pool.Close closes them.
 func (ex *Remote) Close() error {
+	if ex.pooled {
+		return nil
+	}
+	return ex.closeConn()
+}
+
+// closeConn closes sftp client, if kept alive, connection to remote server and to the jump hosts
+func (ex *Remote) closeConn() error {
+	var err error
+	if ex.sftp != nil {
+		ex.sftp.lock.Lock()
+		if ex.sftp.client != nil {
+			_ = ex.sftp.client.Close()
+			ex.sftp.client = nil
+		}
+		ex.sftp.lock.Unlock()
+	}
 	if ex.client != nil {
-		return ex.client.Close()
+		err = ex.client.Close()
 	}
-	return nil
+	for i := len(ex.jumpClients) - 1; i >= 0; i-- {
+		if e := ex.jumpClients[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 // Run command on remote server.
-func (ex *Remote) Run(ctx context.Context, cmd string, _ *RunOpts) (out []string, err error) {
+func (ex *Remote) Run(ctx context.Context, cmd string, opts *RunOpts) (out []string, err error) {
 	if ex.client == nil {
 		return nil, fmt.Errorf("client is not connected")
 	}
 	log.Printf("[DEBUG] run %s", cmd)
 
-	return ex.sshRun(ctx, ex.client, cmd)
+	return ex.sshRun(ctx, ex.client, cmd, opts)
 }
 
 // Upload file to remote server with scp
@@ -56,43 +91,26 @@ func (ex *Remote) Upload(ctx context.Context, local, remote string, opts *UpDown
 		return fmt.Errorf("failed to split hostAddr and port: %w", err)
 	}
 
-	// check if the local parameter contains a glob pattern
-	matches, err := filepath.Glob(local)
-	if err != nil {
-		return fmt.Errorf("failed to expand glob pattern %s: %w", local, err)
-	}
-
-	if len(matches) == 0 { // no match
-		return fmt.Errorf("source file %q not found", local)
-	}
-
 	var exclude []string
 	if opts != nil {
 		exclude = opts.Exclude
 	}
+	files, err := UploadFiles(local, remote, exclude)
+	if err != nil {
+		return err
+	}
 
 	// upload each file matching the glob pattern. If no glob pattern is found, the file is matched as is
-	for _, match := range matches {
-		relPath, e := filepath.Rel(filepath.Dir(local), match)
-		if e != nil {
-			return fmt.Errorf("failed to build relative path for %s: %w", match, err)
-		}
-		if isExcluded(relPath, exclude) {
-			continue
-		}
-
-		remoteFile := remote
-		if len(matches) > 1 { // if there are multiple files, treat remote as a directory
-			remoteFile = filepath.Join(remote, filepath.Base(match))
-		}
+	for _, f := range files {
 		req := sftpReq{
-			client:     ex.client,
-			localFile:  match,
-			remoteFile: remoteFile,
+			localFile:  f.Local,
+			remoteFile: f.Remote,
 			mkdir:      opts != nil && opts.Mkdir,
 			force:      opts != nil && opts.Force,
+			checksum:   opts != nil && opts.Checksum,
 			remoteHost: host,
 			remotePort: port,
+			onTransfer: opts.transferred,
 		}
 		if err := ex.sftpUpload(ctx, req); err != nil {
 			return err
@@ -113,11 +131,13 @@ func (ex *Remote) Download(ctx context.Context, remote, local string, opts *UpDo
 		return fmt.Errorf("failed to split hostAddr and port: %w", err)
 	}
 
-	var mkdir bool
+	var mkdir, force, checksum bool
 	var exclude []string
 
 	if opts != nil {
 		mkdir = opts.Mkdir
+		force = opts.Force
+		checksum = opts.Checksum
 		exclude = opts.Exclude
 	}
 
@@ -136,12 +156,14 @@ func (ex *Remote) Download(ctx context.Context, remote, local string, opts *UpDo
 		}
 
 		req := sftpReq{
-			client:     ex.client,
 			localFile:  localFile,
 			remoteFile: remoteFile,
 			mkdir:      mkdir,
+			force:      force,
+			checksum:   checksum,
 			remoteHost: host,
 			remotePort: port,
+			onTransfer: opts.transferred,
 		}
 		err = ex.sftpDownload(ctx, req)
 		if err != nil {
@@ -154,7 +176,7 @@ func (ex *Remote) Download(ctx context.Context, remote, local string, opts *UpDo
 
 // Sync compares local and remote files and uploads unmatched files, recursively.
 func (ex *Remote) Sync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
-	localFiles, err := ex.getLocalFilesProperties(localDir)
+	localFiles, err := getLocalFilesProperties(localDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
 	}
@@ -168,11 +190,31 @@ func (ex *Remote) Sync(ctx context.Context, localDir, remoteDir string, opts *Sy
 		return nil, fmt.Errorf("failed to get remote files properties for %s: %w", remoteDir, err)
 	}
 
-	unmatchedFiles, deletedFiles := ex.findUnmatchedFiles(localFiles, remoteFiles, excl)
+	var sameContent func(path string) bool
+	checksum := opts != nil && opts.Checksum
+	if checksum {
+		// checksums are calculated on the remote host in one call, only for the files with the same size
+		candidates := []string{}
+		for path, lp := range localFiles {
+			if rp, ok := remoteFiles[path]; ok && !lp.IsDir && !rp.IsDir && lp.Size == rp.Size {
+				candidates = append(candidates, filepath.Join(remoteDir, path))
+			}
+		}
+		sums, e := ex.remoteChecksums(ctx, candidates)
+		if e != nil {
+			log.Printf("[WARN] can't get checksums of remote files in %s: %v", remoteDir, e)
+		}
+		sameContent = func(path string) bool {
+			return sameChecksum(filepath.Join(localDir, path), sums[filepath.Join(remoteDir, path)])
+		}
+	}
+
+	unmatchedFiles, deletedFiles := findUnmatchedFiles(localFiles, remoteFiles, excl, sameContent)
 	for _, file := range unmatchedFiles {
 		localPath := filepath.Join(localDir, file)
 		remotePath := filepath.Join(remoteDir, file)
-		if err = ex.Upload(ctx, localPath, remotePath, &UpDownOpts{Mkdir: true}); err != nil {
+		// with checksum files are already compared by content, force upload to skip another comparison
+		if err = ex.Upload(ctx, localPath, remotePath, &UpDownOpts{Mkdir: true, Force: checksum}); err != nil {
 			return nil, fmt.Errorf("failed to upload %s to %s: %w", localPath, remotePath, err)
 		}
 		log.Printf("[INFO] synced %s to %s", localPath, remotePath)
@@ -200,11 +242,11 @@ func (ex *Remote) Delete(ctx context.Context, remoteFile string, opts *DeleteOpt
 		return fmt.Errorf("client is not connected")
 	}
 
-	sftpClient, err := sftp.NewClient(ex.client)
+	sftpClient, release, err := ex.sftpClient()
 	if err != nil {
 		return fmt.Errorf("failed to create sftp client: %v", err)
 	}
-	defer sftpClient.Close()
+	defer release()
 
 	fileInfo, err := sftpClient.Stat(remoteFile)
 	if err != nil {
@@ -306,7 +348,7 @@ func (ex *Remote) Delete(ctx context.Context, remoteFile string, opts *DeleteOpt
 }
 
 // sshRun executes command on remote server. context close sends interrupt signal to the remote process.
-func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string) (out []string, err error) {
+func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string, opts *RunOpts) (out []string, err error) {
 	log.Printf("[DEBUG] run ssh command %q on %s", command, client.RemoteAddr().String())
 	session, err := client.NewSession()
 	if err != nil {
@@ -318,9 +360,28 @@ func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string
 
 	var stdoutBuf bytes.Buffer
 	mwr := io.MultiWriter(ex.logs.Out, &stdoutBuf)
-	session.Stdout, session.Stderr = mwr, ex.logs.Err
+	session.Stdout, session.Stderr = opts.outWriters(mwr, ex.logs.Err)
+	if in := opts.stdin(); in != nil {
+		// copy the input in our own goroutine, session doesn't wait for it. Otherwise, the command which never reads
+		// the input, i.e. sudo with cached credentials, hangs until the input is closed by the caller
+		stdinPipe, e := session.StdinPipe()
+		if e != nil {
+			return nil, fmt.Errorf("failed to get stdin pipe: %w", e)
+		}
+		go func() {
+			_, _ = io.Copy(stdinPipe, in)
+			_ = stdinPipe.Close()
+		}()
+	}
+	if opts != nil && opts.PTY {
+		// no echo, so the input (i.e. password) is not printed back to the output
+		modes := ssh.TerminalModes{ssh.ECHO: 0, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+		if err = session.RequestPty("xterm", 40, 200, modes); err != nil {
+			return nil, fmt.Errorf("failed to request pty: %w", err)
+		}
+	}
 
-	done := make(chan error)
+	done := make(chan error, 1)
 	go func() {
 		done <- session.Run(command)
 	}()
@@ -331,10 +392,8 @@ func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string
 			return nil, fmt.Errorf("failed to run command on remote server: %w", err)
 		}
 	case <-ctx.Done():
-		if err = session.Signal(ssh.SIGINT); err != nil {
-			return nil, fmt.Errorf("failed to send interrupt signal to remote process: %w", err)
-		}
-		return nil, fmt.Errorf("canceled: %w", ctx.Err())
+		stopSession(session, done)
+		return nil, stopError(ctx)
 	}
 
 	for _, line := range strings.Split(stdoutBuf.String(), "\n") {
@@ -345,6 +404,57 @@ func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string
 	return out, nil
 }
 
+// stopSession stops the remote process of the session, escalating from SIGINT to SIGTERM, and closing the session
+// if the process is still running. Not all ssh servers support signals, the session close is the last resort.
+func stopSession(session *ssh.Session, done <-chan error) {
+	for _, sig := range []ssh.Signal{ssh.SIGINT, ssh.SIGTERM} {
+		if err := session.Signal(sig); err != nil {
+			log.Printf("[DEBUG] can't send %s signal to remote process: %v", sig, err)
+			continue
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(stopTimeout):
+		}
+	}
+	log.Printf("[DEBUG] remote process is still running, close session")
+	if err := session.Close(); err != nil {
+		log.Printf("[DEBUG] can't close session: %v", err)
+	}
+}
+
+// sftpClient returns sftp client for file transfers, the release function should be called when the client is not
+// needed anymore. With kept alive sftp session the client is shared, otherwise a new client is created and closed on release.
+func (ex *Remote) sftpClient() (client *sftp.Client, release func(), err error) {
+	if ex.sftp == nil {
+		if client, err = sftp.NewClient(ex.client, sftp.UseConcurrentWrites(true)); err != nil {
+			return nil, nil, err
+		}
+		return client, func() { _ = client.Close() }, nil
+	}
+
+	ex.sftp.lock.Lock()
+	defer ex.sftp.lock.Unlock()
+	if ex.sftp.client == nil {
+		if client, err = sftp.NewClient(ex.client, sftp.UseConcurrentWrites(true)); err != nil {
+			return nil, nil, err
+		}
+		ex.sftp.client = client
+		go func() {
+			// reset the client once the sftp subsystem terminated, the next call will create a new one
+			e := client.Wait()
+			log.Printf("[DEBUG] sftp client for %s terminated: %v", ex.hostAddr, e)
+			ex.sftp.lock.Lock()
+			if ex.sftp.client == client {
+				ex.sftp.client = nil
+			}
+			ex.sftp.lock.Unlock()
+		}()
+	}
+	return ex.sftp.client, func() {}, nil
+}
+
 type sftpReq struct {
 	localFile  string
 	remoteHost string
@@ -352,7 +462,8 @@ type sftpReq struct {
 	remoteFile string
 	mkdir      bool
 	force      bool
-	client     *ssh.Client
+	checksum   bool
+	onTransfer func(src, dst string) // called after the file transferred, not called for skipped files
 }
 
 func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
@@ -361,11 +472,11 @@ func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
 		log.Printf("[INFO] uploaded %s to %s:%s in %s", req.localFile, req.remoteHost, req.remoteFile, time.Since(st))
 	}(time.Now())
 
-	sftpClient, err := sftp.NewClient(req.client, sftp.UseConcurrentWrites(true))
+	sftpClient, release, err := ex.sftpClient()
 	if err != nil {
 		return fmt.Errorf("failed to create sftp client: %v", err)
 	}
-	defer sftpClient.Close()
+	defer release()
 
 	inpFh, err := os.Open(req.localFile)
 	if err != nil {
@@ -382,8 +493,14 @@ func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
 	remoteFi, err := sftpClient.Stat(req.remoteFile)
 	if err == nil {
 		// if remote file exists, and has the same size, mod time and mode, skip upload. Force flag overrides this.
-		isSame := !req.force && remoteFi.Size() == inpFi.Size() &&
-			isWithinOneSecond(remoteFi.ModTime(), inpFi.ModTime()) && remoteFi.Mode() == inpFi.Mode()
+		// with checksum option, the content is compared instead of mod time.
+		isSame := !req.force && remoteFi.Size() == inpFi.Size() && remoteFi.Mode() == inpFi.Mode()
+		if isSame && req.checksum {
+			isSame = sameChecksum(req.localFile, ex.remoteChecksum(ctx, req.remoteFile))
+		}
+		if isSame && !req.checksum {
+			isSame = isWithinOneSecond(remoteFi.ModTime(), inpFi.ModTime())
+		}
 		if isSame {
 			log.Printf("[INFO] remote file %s identical to local file %s, skipping upload", req.remoteFile, req.localFile)
 			return nil
@@ -425,6 +542,9 @@ func (ex *Remote) sftpUpload(ctx context.Context, req sftpReq) error {
 		return fmt.Errorf("failed to set modification time of remote file %s: %v", req.remoteFile, err)
 	}
 
+	if req.onTransfer != nil {
+		req.onTransfer(req.localFile, req.remoteFile)
+	}
 	return nil
 }
 
@@ -432,11 +552,11 @@ func (ex *Remote) sftpDownload(ctx context.Context, req sftpReq) error {
 	log.Printf("[INFO] download %s from %s:%s", req.localFile, req.remoteHost, req.remoteFile)
 	defer func(st time.Time) { log.Printf("[DEBUG] download done for %q in %s", req.localFile, time.Since(st)) }(time.Now())
 
-	sftpClient, err := sftp.NewClient(req.client)
+	sftpClient, release, err := ex.sftpClient()
 	if err != nil {
 		return fmt.Errorf("failed to create sftp client: %v", err)
 	}
-	defer sftpClient.Close()
+	defer release()
 
 	remoteFh, err := sftpClient.Open(req.remoteFile)
 	if err != nil {
@@ -449,6 +569,12 @@ func (ex *Remote) sftpDownload(ctx context.Context, req sftpReq) error {
 		return fmt.Errorf("failed to stat remote file: %v", err)
 	}
 
+	if req.mkdir {
+		if e := os.MkdirAll(filepath.Dir(req.localFile), 0o750); e != nil {
+			return fmt.Errorf("failed to create local directory: %v", e)
+		}
+	}
+
 	// Check if local file exists, if not create it.
 	if _, stErr := os.Stat(req.localFile); stErr != nil {
 		if !os.IsNotExist(stErr) {
@@ -473,7 +599,15 @@ func (ex *Remote) sftpDownload(ctx context.Context, req sftpReq) error {
 	}
 
 	// if the local file size and mod time are the same as the remote file, don't download. Force flag overrides this.
-	if !req.force && localFi.Size() == remoteFi.Size() && isWithinOneSecond(localFi.ModTime(), remoteFi.ModTime()) {
+	// with checksum option, the content is compared instead of mod time.
+	isSame := !req.force && localFi.Size() == remoteFi.Size()
+	if isSame && req.checksum {
+		isSame = sameChecksum(req.localFile, ex.remoteChecksum(ctx, req.remoteFile))
+	}
+	if isSame && !req.checksum {
+		isSame = isWithinOneSecond(localFi.ModTime(), remoteFi.ModTime())
+	}
+	if isSame {
 		log.Printf("[INFO] local file %s is up-to-date.", req.localFile)
 		return nil
 	}
@@ -493,7 +627,13 @@ func (ex *Remote) sftpDownload(ctx context.Context, req sftpReq) error {
 		}
 	}
 
-	return localFh.Sync() // nolint
+	if err = localFh.Sync(); err != nil {
+		return fmt.Errorf("failed to sync local file: %v", err)
+	}
+	if req.onTransfer != nil {
+		req.onTransfer(req.remoteFile, req.localFile)
+	}
+	return nil
 }
 
 type fileProperties struct {
@@ -504,7 +644,7 @@ type fileProperties struct {
 }
 
 // getLocalFilesProperties returns map of file properties for all files in the local directory.
-func (ex *Remote) getLocalFilesProperties(dir string) (map[string]fileProperties, error) {
+func getLocalFilesProperties(dir string) (map[string]fileProperties, error) {
 	fileProps := make(map[string]fileProperties)
 
 	// walk local directory and get file properties
@@ -535,11 +675,11 @@ func (ex *Remote) getLocalFilesProperties(dir string) (map[string]fileProperties
 // doesn't support excluding files/directories, and we can speed up the process by excluding files/directories that
 // are not needed.
 func (ex *Remote) getRemoteFilesProperties(ctx context.Context, dir string, excl []string) (map[string]fileProperties, error) {
-	sftpClient, e := sftp.NewClient(ex.client)
+	sftpClient, release, e := ex.sftpClient()
 	if e != nil {
 		return nil, fmt.Errorf("failed to create sftp client: %v", e)
 	}
-	defer sftpClient.Close()
+	defer release()
 
 	fileProps := make(map[string]fileProperties)
 
@@ -594,7 +734,10 @@ func (ex *Remote) getRemoteFilesProperties(ctx context.Context, dir string, excl
 	return fileProps, nil
 }
 
-func (ex *Remote) findUnmatchedFiles(local, remote map[string]fileProperties, excl []string) (updatedFiles, deletedFiles []string) {
+// findUnmatchedFiles returns files to upload and files to delete on remote. Files are matched by size and mod time,
+// unless sameContent func is set. In this case files with the same size are matched by sameContent result.
+func findUnmatchedFiles(local, remote map[string]fileProperties, excl []string,
+	sameContent func(path string) bool) (updatedFiles, deletedFiles []string) {
 	updatedFiles = []string{}
 	deletedFiles = []string{}
 
@@ -606,7 +749,17 @@ func (ex *Remote) findUnmatchedFiles(local, remote map[string]fileProperties, ex
 			continue // don't put excluded files to unmatched files, no need to upload them
 		}
 		remoteProps, exists := remote[localPath]
-		if !exists || localProps.Size != remoteProps.Size || !isWithinOneSecond(localProps.Time, remoteProps.Time) {
+		if !exists || localProps.Size != remoteProps.Size {
+			updatedFiles = append(updatedFiles, localPath)
+			continue
+		}
+		if sameContent != nil {
+			if !sameContent(localPath) {
+				updatedFiles = append(updatedFiles, localPath)
+			}
+			continue
+		}
+		if !isWithinOneSecond(localProps.Time, remoteProps.Time) {
 			updatedFiles = append(updatedFiles, localPath)
 		}
 	}
@@ -624,12 +777,61 @@ func (ex *Remote) findUnmatchedFiles(local, remote map[string]fileProperties, ex
 	return updatedFiles, deletedFiles
 }
 
+// remoteChecksum returns hex-encoded sha256 checksum of the remote file, calculated on the remote host.
+// Any error is logged and reported as empty checksum, i.e. a mismatch.
+func (ex *Remote) remoteChecksum(ctx context.Context, remoteFile string) string {
+	sums, err := ex.remoteChecksums(ctx, []string{remoteFile})
+	if err != nil {
+		log.Printf("[WARN] can't get checksum of remote file %s: %v", remoteFile, err)
+	}
+	return sums[remoteFile]
+}
+
+// remoteChecksums returns hex-encoded sha256 checksums of the remote files by their names. Checksums are calculated
+// on the remote host with sha256sum, so only the digests are transferred, not the content of the files.
+func (ex *Remote) remoteChecksums(ctx context.Context, files []string) (map[string]string, error) {
+	res := map[string]string{}
+	if len(files) == 0 {
+		return res, nil
+	}
+	quoted := make([]string, 0, len(files))
+	for _, f := range files {
+		quoted = append(quoted, shellQuote(f))
+	}
+	out, err := ex.Run(ctx, "sha256sum -- "+strings.Join(quoted, " "), nil)
+	if err != nil {
+		return res, err
+	}
+	for _, line := range out {
+		// sha256sum prints "<checksum>  <file>" lines
+		if sum, name, ok := strings.Cut(line, "  "); ok {
+			res[name] = sum
+		}
+	}
+	return res, nil
+}
+
+// sameChecksum compares checksum of the local file with the remote checksum. Any error or empty remote checksum
+// is reported as a mismatch, i.e. the file will be transferred.
+func sameChecksum(localFile, remoteSum string) bool {
+	if remoteSum == "" {
+		return false
+	}
+	localSum, err := localChecksum(localFile)
+	if err != nil {
+		log.Printf("[WARN] can't get checksum of local file %s: %v", localFile, err)
+		return false
+	}
+	log.Printf("[DEBUG] checksum of %s: %s, checksum of remote: %s", localFile, localSum, remoteSum)
+	return localSum == remoteSum
+}
+
 func (ex *Remote) findMatchedFiles(remote string, excl []string) ([]string, error) {
-	sftpClient, err := sftp.NewClient(ex.client)
+	sftpClient, release, err := ex.sftpClient()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create sftp client: %v", err)
 	}
-	defer sftpClient.Close()
+	defer release()
 
 	matches, err := sftpClient.Glob(remote)
 	if err != nil {
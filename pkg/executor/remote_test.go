@@ -221,6 +221,81 @@ func TestUpload_UploadOverwriteWithAndWithoutForce(t *testing.T) {
 	assert.NotContains(t, wr.String(), "skipping upload")
 }
 
+func TestUpload_UploadOverwriteWithChecksum(t *testing.T) {
+	ctx := context.Background()
+	hostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10, MakeLogs(true, false, nil))
+	require.NoError(t, err)
+
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	require.NoError(t, err)
+	defer sess.Close()
+
+	wr := &bytes.Buffer{}
+	log.SetOutput(io.MultiWriter(wr, os.Stdout))
+
+	tmpFile := filepath.Join(t.TempDir(), "data.txt")
+	require.NoError(t, os.WriteFile(tmpFile, []byte("some content"), 0o644)) // nolint
+
+	err = sess.Upload(ctx, tmpFile, "/tmp/checksum/data.txt", &UpDownOpts{Mkdir: true, Checksum: true})
+	require.NoError(t, err)
+	assert.NotContains(t, wr.String(), " skipping upload")
+	wr.Reset()
+
+	// same content with a new modification time, should be skipped
+	require.NoError(t, os.Chtimes(tmpFile, time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+	err = sess.Upload(ctx, tmpFile, "/tmp/checksum/data.txt", &UpDownOpts{Mkdir: true, Checksum: true})
+	require.NoError(t, err)
+	assert.Contains(t, wr.String(), "skipping upload")
+	wr.Reset()
+
+	// different content of the same size, should be uploaded
+	require.NoError(t, os.WriteFile(tmpFile, []byte("some Content"), 0o644)) // nolint
+	err = sess.Upload(ctx, tmpFile, "/tmp/checksum/data.txt", &UpDownOpts{Mkdir: true, Checksum: true})
+	require.NoError(t, err)
+	assert.NotContains(t, wr.String(), "skipping upload")
+}
+
+func TestExecuter_remoteChecksums(t *testing.T) {
+	ctx := context.Background()
+	hostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10, MakeLogs(true, false, nil))
+	require.NoError(t, err)
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	require.NoError(t, err)
+	defer sess.Close()
+
+	tmpFile := filepath.Join(t.TempDir(), "data.txt")
+	require.NoError(t, os.WriteFile(tmpFile, []byte("some content"), 0o644)) // nolint
+	err = sess.Upload(ctx, tmpFile, "/tmp/checksums/it's data.txt", &UpDownOpts{Mkdir: true})
+	require.NoError(t, err)
+	localSum, err := localChecksum(tmpFile)
+	require.NoError(t, err)
+
+	sums, err := sess.remoteChecksums(ctx, []string{"/tmp/checksums/it's data.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/tmp/checksums/it's data.txt": localSum}, sums)
+
+	assert.Equal(t, localSum, sess.remoteChecksum(ctx, "/tmp/checksums/it's data.txt"))
+	assert.Empty(t, sess.remoteChecksum(ctx, "/tmp/checksums/no-such-file.txt"))
+}
+
+func Test_sameChecksum(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "data.txt")
+	require.NoError(t, os.WriteFile(tmpFile, []byte("some content"), 0o600))
+	sum, err := localChecksum(tmpFile)
+	require.NoError(t, err)
+
+	assert.True(t, sameChecksum(tmpFile, sum))
+	assert.False(t, sameChecksum(tmpFile, "0123456789abcdef"), "different checksum")
+	assert.False(t, sameChecksum(tmpFile, ""), "no remote checksum")
+	assert.False(t, sameChecksum(filepath.Join(t.TempDir(), "no-such-file"), sum), "no local file")
+}
+
 func TestExecuter_ConnectCanceled(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
 	defer cancel()
@@ -313,6 +388,14 @@ func TestExecuter_Run(t *testing.T) {
 		assert.ErrorContains(t, err, "context canceled")
 	})
 
+	t.Run("timeout", func(t *testing.T) {
+		ctxTimeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		st := time.Now()
+		_, err := sess.Run(ctxTimeout, `trap "" INT TERM; sleep 10`, nil)
+		require.EqualError(t, err, "timeout: context deadline exceeded")
+		assert.Less(t, time.Since(st), 3*stopTimeout, "stopped by session close")
+	})
 }
 
 func TestExecuter_Sync(t *testing.T) {
@@ -595,14 +678,38 @@ func TestExecuter_findUnmatchedFiles(t *testing.T) {
 
 	for _, tc := range tbl {
 		t.Run(tc.name, func(t *testing.T) {
-			ex := &Remote{}
-			updated, deleted := ex.findUnmatchedFiles(tc.local, tc.remote, tc.exclude)
+			updated, deleted := findUnmatchedFiles(tc.local, tc.remote, tc.exclude, nil)
 			assert.Equal(t, tc.updated, updated)
 			assert.Equal(t, tc.deleted, deleted)
 		})
 	}
 }
 
+func TestExecuter_findUnmatchedFilesWithChecksum(t *testing.T) {
+	local := map[string]fileProperties{
+		"file1": {Size: 100, Time: time.Unix(0, 0)},
+		"file2": {Size: 200, Time: time.Unix(0, 0)},
+		"file3": {Size: 300, Time: time.Unix(0, 0)},
+		"file4": {Size: 400, Time: time.Unix(0, 0)},
+	}
+	remote := map[string]fileProperties{
+		"file1": {Size: 100, Time: time.Unix(100, 0)}, // same content, different time
+		"file2": {Size: 200, Time: time.Unix(0, 0)},   // different content, same time
+		"file3": {Size: 301, Time: time.Unix(0, 0)},   // different size
+	}
+	checked := []string{}
+	sameContent := func(path string) bool {
+		checked = append(checked, path)
+		return path == "file1"
+	}
+
+	updated, deleted := findUnmatchedFiles(local, remote, nil, sameContent)
+	assert.Equal(t, []string{"file2", "file3", "file4"}, updated)
+	assert.Equal(t, []string{}, deleted)
+	sort.Strings(checked)
+	assert.Equal(t, []string{"file1", "file2"}, checked, "only files with the same size are compared by content")
+}
+
 func Test_getRemoteFilesProperties(t *testing.T) {
 	ctx := context.Background()
 	hostAndPort, teardown := startTestContainer(t)
@@ -666,9 +773,11 @@ func startTestContainer(t *testing.T) (hostAndPort string, teardown func()) {
 			{HostFilePath: "testdata/test_ssh_key.pub", ContainerFilePath: "/authorized_key"},
 		},
 		Env: map[string]string{
-			"PUBLIC_KEY": string(pubKey),
-			"USER_NAME":  "test",
-			"TZ":         "Etc/UTC",
+			"PUBLIC_KEY":      string(pubKey),
+			"USER_NAME":       "test",
+			"TZ":              "Etc/UTC",
+			"PASSWORD_ACCESS": "true",
+			"USER_PASSWORD":   "test-password",
 		},
 	}
 	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
@@ -0,0 +1,155 @@
+package runner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/executor"
+)
+
+// sudoPrompt is the password prompt set for sudo, used only if the become password is provided.
+// It has a random token, so the command's own output can't be taken for the prompt.
+var sudoPrompt = fmt.Sprintf("[spot-%s] sudo password:", promptToken())
+
+// sudoPromptRe matches the sudo password prompt in the stderr of the command
+var sudoPromptRe = regexp.MustCompile(regexp.QuoteMeta(sudoPrompt))
+
+// ptyPromptRe matches a password prompt of su or doas. The prompt can't be set for them, and with pty it is printed
+// to stdout, so it is matched only if it is the whole output so far, i.e. before the command itself printed anything.
+var ptyPromptRe = regexp.MustCompile(`(?i)\A[^\n]*password[^\n]*:\s*\z`)
+
+// sudo wraps the command to run it with elevated privileges, by the become method (sudo by default, su or doas)
+// and as the become user (root by default). For sudo with the become password, the password is read from stdin.
+func (ec *execCmd) sudo(c string) string {
+	user := ec.cmd.Options.BecomeUser
+	switch ec.cmd.Options.BecomeMethod {
+	case config.BecomeSu:
+		if user == "" {
+			user = "root"
+		}
+		return fmt.Sprintf("su %s -c %q", user, c)
+	case config.BecomeDoas:
+		if user != "" {
+			return fmt.Sprintf("doas -u %s %s", user, c)
+		}
+		return fmt.Sprintf("doas %s", c)
+	default:
+		res := "sudo"
+		if ec.becomePassword() != "" {
+			res += fmt.Sprintf(" -S -p %q", sudoPrompt)
+		}
+		if user != "" {
+			res += " -u " + user
+		}
+		return fmt.Sprintf("%s %s", res, c)
+	}
+}
+
+// runSudo runs the command with elevated privileges, feeding the become password if needed
+func (ec *execCmd) runSudo(ctx context.Context, c string, opts *executor.RunOpts) ([]string, error) {
+	opts, done := ec.becomeOpts(opts)
+	defer done()
+	return ec.exec.Run(ctx, ec.sudo(c), opts)
+}
+
+// becomePassword returns the password for the become method. The password from the secret set by become_password_secret
+// takes precedence over the one provided by user, i.e. entered with --ask-become-pass. Empty if not set.
+func (ec *execCmd) becomePassword() string {
+	if key := ec.cmd.Options.BecomeSecret; key != "" && ec.cmd.Secrets[key] != "" {
+		return ec.cmd.Secrets[key]
+	}
+	return ec.sudoPass
+}
+
+// becomeOpts returns run options for the command with elevated privileges. If the become password is set, the command's
+// output is watched for the password prompt, and the password is sent to the command's stdin once the prompt is found.
+// For sudo the prompt is set by spot and watched in stderr. su and doas read the password from the terminal only,
+// so pty is requested for them, and their prompt is watched at the beginning of the output. The returned done function
+// should be called after the command completed. Without password, the options are returned as is.
+func (ec *execCmd) becomeOpts(opts *executor.RunOpts) (res *executor.RunOpts, done func()) {
+	pass := ec.becomePassword()
+	if !ec.cmd.Options.Sudo || pass == "" {
+		return opts, func() {}
+	}
+
+	res = &executor.RunOpts{}
+	if opts != nil {
+		*res = *opts
+	}
+	res.PTY = ec.cmd.Options.BecomeMethod == config.BecomeSu || ec.cmd.Options.BecomeMethod == config.BecomeDoas
+
+	inpRdr, inpWr := io.Pipe()
+	var once sync.Once
+	send := func() {
+		once.Do(func() {
+			go func() {
+				if _, err := io.WriteString(inpWr, pass+"\n"); err != nil {
+					log.Printf("[WARN] can't send become password on %s: %v", ec.hostAddr, err)
+				}
+				if !res.PTY {
+					// sudo reads the password from stdin, close it to prevent the command itself from waiting for input.
+					// with pty the input is kept open until the command completed
+					_ = inpWr.Close()
+				}
+			}()
+		})
+	}
+	res.Stdin = inpRdr
+	if res.PTY {
+		res.Stdout = watchPrompt(res.Stdout, &promptWriter{prompt: ptyPromptRe, headOnly: true, onPrompt: send})
+	} else {
+		res.Stderr = watchPrompt(res.Stderr, &promptWriter{prompt: sudoPromptRe, onPrompt: send})
+	}
+	return res, func() { _ = inpWr.Close() }
+}
+
+// watchPrompt returns a writer passing all the writes to the prompt writer and to the original writer, if not nil
+func watchPrompt(w io.Writer, pw *promptWriter) io.Writer {
+	if w == nil {
+		return pw
+	}
+	return io.MultiWriter(w, pw)
+}
+
+// promptWriter is a writer detecting the password prompt in the output. It keeps the tail of the output only,
+// as the prompt is expected at the end of the output written so far. With headOnly, the beginning of the output
+// is kept instead, and nothing is matched once it is longer than the limit.
+type promptWriter struct {
+	prompt   *regexp.Regexp
+	headOnly bool
+	onPrompt func()
+	buf      []byte
+}
+
+func (w *promptWriter) Write(p []byte) (int, error) {
+	const maxLen = 256
+	if w.headOnly && len(w.buf) > maxLen {
+		return len(p), nil
+	}
+	w.buf = append(w.buf, p...)
+	if !w.headOnly && len(w.buf) > maxLen {
+		w.buf = w.buf[len(w.buf)-maxLen:]
+	}
+	if w.prompt.Match(w.buf) {
+		w.onPrompt()
+	}
+	return len(p), nil
+}
+
+// promptToken returns a random token for the password prompt
+func promptToken() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36) // fallback, shouldn't happen
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,147 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/executor"
+)
+
+func Test_execCmdSudo(t *testing.T) {
+	tbl := []struct {
+		name     string
+		opts     config.CmdOptions
+		pass     string
+		expected string
+	}{
+		{name: "default", expected: "sudo ls -la"},
+		{name: "sudo with user", opts: config.CmdOptions{BecomeUser: "app"}, expected: "sudo -u app ls -la"},
+		{name: "sudo with password", pass: "passwd", expected: fmt.Sprintf("sudo -S -p %q ls -la", sudoPrompt)},
+		{name: "sudo with password from secret", opts: config.CmdOptions{BecomeSecret: "pass_key", BecomeUser: "app"},
+			expected: fmt.Sprintf("sudo -S -p %q -u app ls -la", sudoPrompt)},
+		{name: "su", opts: config.CmdOptions{BecomeMethod: config.BecomeSu}, pass: "passwd", expected: `su root -c "ls -la"`},
+		{name: "su with user", opts: config.CmdOptions{BecomeMethod: config.BecomeSu, BecomeUser: "app"},
+			expected: `su app -c "ls -la"`},
+		{name: "doas", opts: config.CmdOptions{BecomeMethod: config.BecomeDoas}, expected: "doas ls -la"},
+		{name: "doas with user", opts: config.CmdOptions{BecomeMethod: config.BecomeDoas, BecomeUser: "app"},
+			expected: "doas -u app ls -la"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			ec := execCmd{cmd: config.Cmd{Options: tt.opts, Secrets: map[string]string{"pass_key": "secret"}}, sudoPass: tt.pass}
+			assert.Equal(t, tt.expected, ec.sudo("ls -la"))
+		})
+	}
+}
+
+func Test_promptWriter(t *testing.T) {
+	tbl := []struct {
+		name     string
+		prompt   *regexp.Regexp
+		headOnly bool
+		writes   []string
+		expected bool
+	}{
+		{name: "sudo prompt", prompt: sudoPromptRe, writes: []string{"some warning\n", sudoPrompt}, expected: true},
+		{name: "sudo prompt in parts", prompt: sudoPromptRe, writes: []string{sudoPrompt[:5], sudoPrompt[5:]}, expected: true},
+		{name: "not sudo prompt", prompt: sudoPromptRe, writes: []string{"[sudo] password for user:"}},
+		{name: "su prompt", prompt: ptyPromptRe, headOnly: true, writes: []string{"Password: "}, expected: true},
+		{name: "doas prompt", prompt: ptyPromptRe, headOnly: true, writes: []string{"doas (user@host) password: "}, expected: true},
+		{name: "password in output", prompt: ptyPromptRe, headOnly: true, writes: []string{"started\n", "enter password: "}},
+		{name: "long output", prompt: ptyPromptRe, headOnly: true, writes: []string{strings.Repeat("a", 300), "password: "}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			prompted := false
+			pw := &promptWriter{prompt: tt.prompt, headOnly: tt.headOnly, onPrompt: func() { prompted = true }}
+			for _, w := range tt.writes {
+				n, err := pw.Write([]byte(w))
+				require.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			assert.Equal(t, tt.expected, prompted)
+		})
+	}
+}
+
+func Test_execCmdBecomePassword(t *testing.T) {
+	ec := execCmd{cmd: config.Cmd{Options: config.CmdOptions{BecomeSecret: "pass_key"}}, sudoPass: "entered"}
+	assert.Equal(t, "entered", ec.becomePassword(), "secret not loaded")
+
+	ec.cmd.Secrets = map[string]string{"pass_key": "from_secret"}
+	assert.Equal(t, "from_secret", ec.becomePassword(), "secret takes precedence")
+}
+
+func Test_execCmdBecomeOpts(t *testing.T) {
+	ctx := context.Background()
+	lcl := executor.NewLocal(executor.MakeLogs(false, false, nil))
+
+	t.Run("password sent on prompt", func(t *testing.T) {
+		ec := execCmd{exec: lcl, hostAddr: "localhost", sudoPass: "passwd", cmd: config.Cmd{Options: config.CmdOptions{Sudo: true}}}
+		stdout := bytes.NewBuffer(nil)
+		opts, done := ec.becomeOpts(&executor.RunOpts{Stdout: stdout})
+		defer done()
+		require.NotNil(t, opts.Stdin)
+		assert.False(t, opts.PTY)
+
+		out, err := lcl.Run(ctx, fmt.Sprintf(`printf '%%s' %s >&2; read p; echo "got $p"`, shellQuote(sudoPrompt)), opts)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"got passwd"}, out)
+		assert.Equal(t, "got passwd\n", stdout.String(), "original stdout writer gets the output")
+	})
+
+	t.Run("password not sent on command's own prompt", func(t *testing.T) {
+		ec := execCmd{exec: lcl, hostAddr: "localhost", sudoPass: "passwd", cmd: config.Cmd{Options: config.CmdOptions{Sudo: true}}}
+		opts, done := ec.becomeOpts(nil)
+		defer done()
+		out, err := lcl.Run(ctx, `echo "password:"; printf 'Password: ' >&2; read -t 1 p; echo "got [$p]"`, opts)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"password:", "got []"}, out)
+	})
+
+	t.Run("no prompt", func(t *testing.T) {
+		fakeSudo(t) // runs the command without asking for the password, like sudo with cached credentials
+		ec := execCmd{exec: lcl, hostAddr: "localhost", sudoPass: "passwd", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Script: "echo done", Options: config.CmdOptions{Sudo: true}}}
+		tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		st := time.Now()
+		resp, err := ec.Script(tctx)
+		require.NoError(t, err)
+		assert.Equal(t, "done\n", resp.stdout)
+		assert.Less(t, time.Since(st), time.Second, "doesn't wait for the password to be sent")
+	})
+
+	t.Run("pty for su and doas", func(t *testing.T) {
+		ec := execCmd{sudoPass: "passwd", cmd: config.Cmd{Options: config.CmdOptions{Sudo: true, BecomeMethod: config.BecomeSu}}}
+		opts, done := ec.becomeOpts(nil)
+		defer done()
+		assert.True(t, opts.PTY)
+		assert.NotNil(t, opts.Stdin)
+	})
+
+	t.Run("no password", func(t *testing.T) {
+		ec := execCmd{cmd: config.Cmd{Options: config.CmdOptions{Sudo: true}}}
+		inp := &executor.RunOpts{Verbose: true}
+		opts, done := ec.becomeOpts(inp)
+		defer done()
+		assert.Same(t, inp, opts)
+	})
+
+	t.Run("no sudo", func(t *testing.T) {
+		ec := execCmd{sudoPass: "passwd"}
+		opts, done := ec.becomeOpts(nil)
+		defer done()
+		assert.Nil(t, opts)
+	})
+}
@@ -4,15 +4,23 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	mr "math/rand"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/umputun/spot/pkg/config"
@@ -25,18 +33,26 @@ type execCmd struct {
 	cmd      config.Cmd
 	hostAddr string
 	hostName string
+	hostTags []string
+	item     string // loop item, empty if command has no loop
 	tsk      *config.Task
 	exec     executor.Interface
 	verbose  bool
 	sshShell string
 	onExit   string
+	sudoPass string // become password for sudo, su or doas, provided by user
 }
 
 type execCmdResp struct {
-	details string
-	verbose string
-	vars    map[string]string
-	onExit  execCmd
+	details  string
+	verbose  string
+	vars     map[string]string
+	onExit   execCmd
+	changed  bool   // command made changes on the host
+	skipped  bool   // command skipped by condition
+	stdout   string // captured stdout of the script
+	stderr   string // captured stderr of the script
+	exitCode int    // exit code of the script
 }
 
 type execCmdErr struct {
@@ -59,6 +75,7 @@ func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 	}
 	if !cond {
 		resp.details = fmt.Sprintf(" {skip: %s}", ec.cmd.Name)
+		resp.skipped = true
 		return resp, nil
 	}
 
@@ -81,16 +98,22 @@ func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 	resp.details = fmt.Sprintf(" {script: %s}", c)
 	if ec.cmd.Options.Sudo {
 		resp.details = fmt.Sprintf(" {script: %s, sudo: true}", c)
-		if strings.HasPrefix(c, ec.shell()+" ") { // single line script already has sh -c
-			c = fmt.Sprintf("sudo %s", c)
-		} else {
-			c = fmt.Sprintf("sudo %s -c %q", ec.shell(), c)
+		if !strings.HasPrefix(c, ec.shell()+" ") { // single line script already has sh -c
+			c = fmt.Sprintf("%s -c %q", ec.shell(), c)
 		}
+		c = ec.sudo(c)
 	}
 	resp.verbose = scr
 
-	out, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose})
-	if err != nil {
+	var stdout, stderr bytes.Buffer
+	runOpts, done := ec.becomeOpts(&executor.RunOpts{Verbose: ec.verbose, Stdout: &stdout, Stderr: &stderr})
+	out, err := ec.exec.Run(ctx, c, runOpts)
+	done()
+	resp.stdout, resp.stderr, resp.exitCode = stripSetvar(stdout.String()), stderr.String(), executor.ExitCode(err)
+	resp.changed = ec.scriptChanged(resp.exitCode, resp.stdout)
+	// exit code listed in changed_when is not a failure, as well as any exit code registered with register_rc
+	rcRegistered := ec.cmd.RegisterRC != "" && resp.exitCode > 0
+	if err != nil && !(resp.changed && resp.exitCode > 0) && !rcRegistered {
 		return resp, ec.errorFmt("can't run script on %s: %w", ec.hostAddr, err)
 	}
 
@@ -108,10 +131,97 @@ func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 		}
 		resp.vars[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 	}
+	if ec.cmd.RegisterOutput != "" {
+		resp.vars[ec.cmd.RegisterOutput] = strings.TrimSpace(resp.stdout)
+	}
+	if ec.cmd.RegisterRC != "" {
+		resp.vars[ec.cmd.RegisterRC] = strconv.Itoa(resp.exitCode)
+	}
+	if ec.cmd.RegisterJSON != "" {
+		if err := flattenJSON(ec.cmd.RegisterJSON, resp.stdout, resp.vars); err != nil {
+			return resp, ec.errorFmt("can't register json output of script on %s: %w", ec.hostAddr, err)
+		}
+	}
 
 	return resp, nil
 }
 
+// flattenJSON parses json and sets its values to vars, named by the path to the value joined with "_", starting
+// with the prefix, i.e. {"items": [{"name": "a"}]} makes prefix_items_0_name=a. Characters not allowed in variable
+// names are replaced with "_". Null is set as empty string, a scalar json value is set to the prefix itself.
+func flattenJSON(prefix, data string, vars map[string]string) error {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber() // keep numbers as is, i.e. no 1e+06 for big ones
+	var val any
+	if err := dec.Decode(&val); err != nil {
+		return fmt.Errorf("invalid json: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("invalid json: unexpected data after the top-level value")
+	}
+
+	var flatten func(name string, v any)
+	flatten = func(name string, v any) {
+		switch vv := v.(type) {
+		case map[string]any:
+			for k, elem := range vv {
+				flatten(name+"_"+jsonVarRe.ReplaceAllString(k, "_"), elem)
+			}
+		case []any:
+			for i, elem := range vv {
+				flatten(name+"_"+strconv.Itoa(i), elem)
+			}
+		case nil:
+			vars[name] = ""
+		default: // string, json.Number or bool
+			vars[name] = fmt.Sprintf("%v", vv)
+		}
+	}
+	flatten(prefix, val)
+	return nil
+}
+
+// jsonVarRe matches characters not allowed in variable names made from json keys
+var jsonVarRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// scriptChanged checks if the script made changes on the host. Without changed_when any successful script is changed,
+// otherwise it is changed if exited with one of the listed codes or if the output matches the pattern.
+func (ec *execCmd) scriptChanged(exitCode int, stdout string) bool {
+	cw := ec.cmd.ChangedWhen
+	if !cw.IsSet() {
+		return exitCode == 0
+	}
+	for _, code := range cw.ExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	if cw.Output == "" || exitCode != 0 {
+		return false
+	}
+	re, err := regexp.Compile(cw.Output)
+	if err != nil {
+		log.Printf("[WARN] invalid changed_when output pattern %q: %v", cw.Output, err)
+		return false
+	}
+	return re.MatchString(stdout)
+}
+
+// stripSetvar removes "setvar" lines, added by the script itself to pass variables, from the script's output
+func stripSetvar(out string) string {
+	if !strings.Contains(out, "setvar ") {
+		return out
+	}
+	lines := strings.SplitAfter(out, "\n")
+	res := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "setvar ") {
+			res = append(res, line)
+		}
+	}
+	return strings.Join(res, "")
+}
+
 // Copy uploads a single file or multiple files (if wildcard is used) to a target host.
 // if sudo option is set, it will make a temporary directory and upload the files there,
 // then move it to the final destination with sudo script execution.
@@ -124,12 +234,13 @@ func (ec *execCmd) Copy(ctx context.Context) (resp execCmdResp, err error) {
 	if !ec.cmd.Options.Sudo {
 		// if sudo is not set, we can use the original destination and upload the file directly
 		resp.details = fmt.Sprintf(" {copy: %s -> %s}", src, dst)
-		opts := &executor.UpDownOpts{Mkdir: ec.cmd.Copy.Mkdir, Force: ec.cmd.Copy.Force, Exclude: ec.cmd.Copy.Exclude}
+		opts := &executor.UpDownOpts{Mkdir: ec.cmd.Copy.Mkdir, Force: ec.cmd.Copy.Force, Exclude: ec.cmd.Copy.Exclude,
+			Checksum: ec.cmd.Copy.Checksum, OnTransfer: func(_, _ string) { resp.changed = true }}
 		if err := ec.exec.Upload(ctx, src, dst, opts); err != nil {
 			return resp, ec.errorFmt("can't copy file to %s: %w", ec.hostAddr, err)
 		}
 		if ec.cmd.Copy.ChmodX {
-			if _, err := ec.exec.Run(ctx, fmt.Sprintf("chmod +x %s", dst), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+			if _, err := ec.exec.Run(ctx, "chmod +x "+shellQuote(dst), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
 				return resp, ec.errorFmt("can't chmod +x file on %s: %w", ec.hostAddr, err)
 			}
 			resp.details = fmt.Sprintf(" {copy: %s -> %s, chmod: +x}", src, dst)
@@ -139,48 +250,178 @@ func (ec *execCmd) Copy(ctx context.Context) (resp execCmdResp, err error) {
 
 	if ec.cmd.Options.Sudo {
 		// if sudo is set, we need to upload the file to a temporary directory and move it to the final destination
-		tmpRemoteDir := ec.uniqueTmp(tmpRemoteDirPrefix)
 		resp.details = fmt.Sprintf(" {copy: %s -> %s, sudo: true}", src, dst)
-		// not using filepath.Join because we want to keep the linux slash, see https://github.com/umputun/spot/issues/144
-		tmpDest := tmpRemoteDir + "/" + filepath.Base(dst)
-
-		// upload to a temporary directory with mkdir
-		err := ec.exec.Upload(ctx, src, tmpDest, &executor.UpDownOpts{Mkdir: true, Force: true, Exclude: ec.cmd.Copy.Exclude})
+		changed, err := ec.copySudo(ctx, src, dst)
 		if err != nil {
-			return resp, ec.errorFmt("can't copy file to %s: %w", ec.hostAddr, err)
+			return resp, ec.error(err)
 		}
-		defer func() {
-			// remove temporary directory we created under /tmp/.spot-<rand>
-			if e := ec.exec.Delete(ctx, tmpRemoteDir, &executor.DeleteOpts{Recursive: true}); e != nil {
-				log.Printf("[WARN] can't remove temporary directory %q on %s: %v", tmpRemoteDir, ec.hostAddr, e)
+		resp.changed = changed
+		if ec.cmd.Copy.ChmodX {
+			if _, err := ec.runSudo(ctx, "chmod +x "+shellQuote(dst), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+				return resp, ec.errorFmt("can't chmod +x file on %s: %w", ec.hostAddr, err)
 			}
-		}()
+			resp.details = fmt.Sprintf(" {copy: %s -> %s, sudo: true, chmod: +x}", src, dst)
+		}
+	}
+
+	return resp, nil
+}
 
-		mvCmd := fmt.Sprintf("mv -f %s %s", tmpDest, dst) // move a single file
-		if strings.Contains(src, "*") && !strings.HasSuffix(tmpDest, "/") {
-			mvCmd = fmt.Sprintf("mkdir -p %s\nmv -f %s/* %s", dst, tmpDest, dst) // move multiple files, if wildcard is used
+// copySudo uploads files to a temporary directory and moves them to the destination with sudo.
+// Files are compared with the destination first, and nothing is copied if all of them are the same, unless forced.
+// Returns true if files were copied.
+func (ec *execCmd) copySudo(ctx context.Context, src, dst string) (bool, error) {
+	files, err := executor.UploadFiles(src, dst, ec.cmd.Copy.Exclude)
+	if err != nil {
+		return false, fmt.Errorf("can't copy file to %s: %w", ec.hostAddr, err)
+	}
+	if !ec.cmd.Copy.Force && ec.sameRemoteFiles(ctx, files, ec.cmd.Copy.Checksum) {
+		log.Printf("[DEBUG] remote files %s on %s are the same as local, skip copying", dst, ec.hostAddr)
+		return false, nil
+	}
+
+	tmpRemoteDir := ec.uniqueTmp(tmpRemoteDirPrefix)
+	// not using filepath.Join because we want to keep the linux slash, see https://github.com/umputun/spot/issues/144
+	tmpDest := tmpRemoteDir + "/" + filepath.Base(dst)
+
+	// upload to a temporary directory with mkdir
+	err = ec.exec.Upload(ctx, src, tmpDest, &executor.UpDownOpts{Mkdir: true, Force: true, Exclude: ec.cmd.Copy.Exclude})
+	if err != nil {
+		return false, fmt.Errorf("can't copy file to %s: %w", ec.hostAddr, err)
+	}
+	defer func() {
+		// remove temporary directory we created under /tmp/.spot-<rand>
+		if e := ec.exec.Delete(ctx, tmpRemoteDir, &executor.DeleteOpts{Recursive: true}); e != nil {
+			log.Printf("[WARN] can't remove temporary directory %q on %s: %v", tmpRemoteDir, ec.hostAddr, e)
 		}
-		c, _, _, err := ec.prepScript(ctx, mvCmd, nil)
-		if err != nil {
-			return resp, ec.errorFmt("can't prepare sudo moving command on %s: %w", ec.hostAddr, err)
+	}()
+
+	mvCmd := fmt.Sprintf("mv -f %s %s", shellQuote(tmpDest), shellQuote(dst)) // move a single file
+	if strings.Contains(src, "*") && !strings.HasSuffix(tmpDest, "/") {
+		// move multiple files, if wildcard is used
+		mvCmd = fmt.Sprintf("mkdir -p %s\nmv -f %s/* %s", shellQuote(dst), shellQuote(tmpDest), shellQuote(dst))
+	}
+	c, _, _, err := ec.prepScript(ctx, mvCmd, nil)
+	if err != nil {
+		return false, fmt.Errorf("can't prepare sudo moving command on %s: %w", ec.hostAddr, err)
+	}
+
+	// run move command with sudo
+	for _, line := range strings.Split(c, "\n") {
+		if _, err := ec.runSudo(ctx, line, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+			return false, fmt.Errorf("can't move file to %s: %w", ec.hostAddr, err)
 		}
+	}
+	return true, nil
+}
 
-		// run move command with sudo
-		for _, line := range strings.Split(c, "\n") {
-			sudoMove := fmt.Sprintf("sudo %s", line)
-			if _, err := ec.exec.Run(ctx, sudoMove, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
-				return resp, ec.errorFmt("can't move file to %s: %w", ec.hostAddr, err)
-			}
+// sameRemoteFiles checks if all the remote files are the same as the local ones, by size and modification time,
+// or by sha256 checksum if checksum is set. Remote files are checked with sudo, as they may be not readable by the user.
+// Returns false if any remote file doesn't exist or can't be checked.
+func (ec *execCmd) sameRemoteFiles(ctx context.Context, files []executor.UploadFile, checksum bool) bool {
+	remotePaths := make([]string, 0, len(files))
+	for _, f := range files {
+		remotePaths = append(remotePaths, f.Remote)
+	}
+
+	if checksum {
+		sums, err := ec.remoteChecksums(ctx, remotePaths)
+		if err != nil {
+			log.Printf("[DEBUG] can't check remote files on %s: %v", ec.hostAddr, err)
+			return false
 		}
-		if ec.cmd.Copy.ChmodX {
-			if _, err := ec.exec.Run(ctx, fmt.Sprintf("sudo chmod +x %s", dst), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
-				return resp, ec.errorFmt("can't chmod +x file on %s: %w", ec.hostAddr, err)
+		for _, f := range files {
+			localSum, err := fileChecksum(f.Local)
+			if err != nil || sums[f.Remote] != localSum {
+				return false
 			}
-			resp.details = fmt.Sprintf(" {copy: %s -> %s, sudo: true, chmod: +x}", src, dst)
 		}
+		return true
 	}
 
-	return resp, nil
+	quoted := make([]string, 0, len(remotePaths))
+	for _, p := range remotePaths {
+		quoted = append(quoted, shellQuote(p))
+	}
+	remoteProps, err := ec.remoteFilesProps(ctx, "stat -c '%s %Y %n' -- "+strings.Join(quoted, " "))
+	if err != nil {
+		log.Printf("[DEBUG] can't check remote files on %s: %v", ec.hostAddr, err)
+		return false
+	}
+	for _, f := range files {
+		rp, ok := remoteProps[f.Remote]
+		if !ok {
+			return false
+		}
+		fi, err := os.Stat(f.Local)
+		if err != nil || fi.Size() != rp.Size {
+			return false
+		}
+		if diff := fi.ModTime().Unix() - rp.Time.Unix(); diff > 1 || diff < -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteFilesProps runs the command printing "<size> <mtime> <file>" lines with sudo, and returns properties
+// of the listed files by their names
+func (ec *execCmd) remoteFilesProps(ctx context.Context, cmd string) (map[string]executor.RemoteFile, error) {
+	out, err := ec.runSudo(ctx, cmd, &executor.RunOpts{Verbose: ec.verbose})
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]executor.RemoteFile, len(out))
+	for _, line := range out {
+		elems := strings.SplitN(line, " ", 3)
+		if len(elems) != 3 {
+			continue
+		}
+		size, sizeErr := strconv.ParseInt(elems[0], 10, 64)
+		mtime, mtimeErr := strconv.ParseInt(elems[1], 10, 64)
+		if sizeErr != nil || mtimeErr != nil {
+			continue
+		}
+		res[elems[2]] = executor.RemoteFile{Size: size, Time: time.Unix(mtime, 0)}
+	}
+	return res, nil
+}
+
+// remoteChecksums returns sha256 checksums of the remote files by their names, calculated with sudo
+func (ec *execCmd) remoteChecksums(ctx context.Context, files []string) (map[string]string, error) {
+	res := map[string]string{}
+	if len(files) == 0 {
+		return res, nil
+	}
+	quoted := make([]string, 0, len(files))
+	for _, f := range files {
+		quoted = append(quoted, shellQuote(f))
+	}
+	out, err := ec.runSudo(ctx, "sha256sum -- "+strings.Join(quoted, " "), &executor.RunOpts{Verbose: ec.verbose})
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range out {
+		// sha256sum prints "<checksum>  <file>" lines
+		if sum, name, ok := strings.Cut(line, "  "); ok {
+			res[name] = sum
+		}
+	}
+	return res, nil
+}
+
+// fileChecksum returns hex-encoded sha256 checksum of the local file
+func fileChecksum(path string) (string, error) {
+	fh, err := os.Open(path) // nolint gosec // path is the file to copy
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close() // nolint ro file
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // Mcopy uploads multiple files to a target host. It calls copy function for each file.
@@ -193,28 +434,141 @@ func (ec *execCmd) Mcopy(ctx context.Context) (resp execCmdResp, err error) {
 		msgs = append(msgs, fmt.Sprintf("%s -> %s", src, dst))
 		ecSingle := ec
 		ecSingle.cmd.Copy = config.CopyInternal{Source: src, Dest: dst, Mkdir: c.Mkdir, Force: c.Force,
-			ChmodX: c.ChmodX, Exclude: c.Exclude}
-		if _, err := ecSingle.Copy(ctx); err != nil {
+			ChmodX: c.ChmodX, Exclude: c.Exclude, Checksum: c.Checksum}
+		r, err := ecSingle.Copy(ctx)
+		if err != nil {
 			return resp, ec.errorFmt("can't copy file to %s: %w", ec.hostAddr, err)
 		}
+		resp.changed = resp.changed || r.changed
 	}
 	resp.details = fmt.Sprintf(" {copy: %s}", strings.Join(msgs, ", "))
 	return resp, nil
 }
 
 // Sync synchronizes files from a source to a destination on a target host.
+// If sudo option is set, it compares and installs the files with sudo, see syncSudo.
 func (ec *execCmd) Sync(ctx context.Context) (resp execCmdResp, err error) {
 	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
 	src := tmpl.apply(ec.cmd.Sync.Source)
 	dst := tmpl.apply(ec.cmd.Sync.Dest)
 	resp.details = fmt.Sprintf(" {sync: %s -> %s}", src, dst)
-	opts := &executor.SyncOpts{Delete: ec.cmd.Sync.Delete, Exclude: ec.cmd.Sync.Exclude, Force: ec.cmd.Sync.Force}
-	if _, err := ec.exec.Sync(ctx, src, dst, opts); err != nil {
+	opts := &executor.SyncOpts{Delete: ec.cmd.Sync.Delete, Exclude: ec.cmd.Sync.Exclude, Force: ec.cmd.Sync.Force,
+		Checksum: ec.cmd.Sync.Checksum}
+
+	if ec.cmd.Options.Sudo {
+		resp.details = fmt.Sprintf(" {sync: %s -> %s, sudo: true}", src, dst)
+		changed, err := ec.syncSudo(ctx, src, dst, opts)
+		if err != nil {
+			return resp, ec.errorFmt("can't sync files on %s: %w", ec.hostAddr, err)
+		}
+		resp.changed = changed
+		return resp, nil
+	}
+
+	updated, err := ec.exec.Sync(ctx, src, dst, opts)
+	if err != nil {
 		return resp, ec.errorFmt("can't sync files on %s: %w", ec.hostAddr, err)
 	}
+	resp.changed = len(updated) > 0
 	return resp, nil
 }
 
+// syncSudo syncs a local directory to a remote directory not writable by the user. Properties of the destination files
+// are collected with sudo and compared with the local files the same way as the regular sync does, so exclude, delete
+// and checksum work the same way. Only the updated files are uploaded to a temporary directory and installed to the
+// destination with sudo. Existing files are overwritten in place, keeping their ownership. Returns true if anything
+// was changed.
+func (ec *execCmd) syncSudo(ctx context.Context, src, dst string, opts *executor.SyncOpts) (bool, error) {
+	dstDir := strings.TrimSuffix(dst, "/")
+	findCmd := fmt.Sprintf("if [ -d %s ]; then find %s -type f -exec stat -c '%%s %%Y %%n' {} +; fi",
+		shellQuote(dstDir), shellQuote(dstDir))
+	props, err := ec.remoteFilesProps(ctx, "sh -c "+shellQuote(findCmd))
+	if err != nil {
+		return false, fmt.Errorf("can't get properties of files in %s: %w", dst, err)
+	}
+	remote := make(map[string]executor.RemoteFile, len(props))
+	for name, rf := range props {
+		if rel, ok := strings.CutPrefix(name, dstDir+"/"); ok {
+			remote[filepath.FromSlash(rel)] = rf
+		}
+	}
+
+	var sameContent func(path string) bool
+	if opts.Checksum {
+		// checksums are needed only for files of the same size, others are different anyway
+		candidates := []string{}
+		for rel, rf := range remote {
+			if fi, err := os.Stat(filepath.Join(src, rel)); err == nil && fi.Mode().IsRegular() && fi.Size() == rf.Size {
+				candidates = append(candidates, dstDir+"/"+filepath.ToSlash(rel))
+			}
+		}
+		sums, err := ec.remoteChecksums(ctx, candidates)
+		if err != nil {
+			return false, fmt.Errorf("can't get checksums of files in %s: %w", dst, err)
+		}
+		sameContent = func(path string) bool {
+			localSum, err := fileChecksum(filepath.Join(src, path))
+			return err == nil && sums[dstDir+"/"+filepath.ToSlash(path)] == localSum
+		}
+	}
+
+	updated, deleted, err := executor.SyncFiles(src, remote, opts.Exclude, sameContent)
+	if err != nil {
+		return false, err
+	}
+	if !opts.Delete {
+		deleted = nil
+	}
+	if len(updated) == 0 && len(deleted) == 0 {
+		return false, nil
+	}
+
+	tmpRemoteDir := ec.uniqueTmp(tmpRemoteDirPrefix)
+	defer func() {
+		// remove temporary directory we created under /tmp/.spot-<rand>
+		if e := ec.exec.Delete(ctx, tmpRemoteDir, &executor.DeleteOpts{Recursive: true}); e != nil {
+			log.Printf("[WARN] can't remove temporary directory %q on %s: %v", tmpRemoteDir, ec.hostAddr, e)
+		}
+	}()
+
+	// not using filepath.Join because we want to keep the linux slash, see https://github.com/umputun/spot/issues/144
+	applyCmds := []string{"set -e", "mkdir -p " + shellQuote(dstDir)}
+	for _, f := range deleted {
+		applyCmds = append(applyCmds, "rm -f "+shellQuote(dstDir+"/"+filepath.ToSlash(f)))
+	}
+	for _, f := range updated {
+		localPath := filepath.Join(src, f)
+		fi, err := os.Stat(localPath)
+		if err != nil {
+			return false, fmt.Errorf("can't stat %s: %w", localPath, err)
+		}
+		tmpPath, dstPath := tmpRemoteDir+"/"+filepath.ToSlash(f), dstDir+"/"+filepath.ToSlash(f)
+		// upload keeps the mode and modification time of the local file
+		if err := ec.exec.Upload(ctx, localPath, tmpPath, &executor.UpDownOpts{Mkdir: true, Force: true}); err != nil {
+			return false, fmt.Errorf("can't upload %s to temporary directory: %w", localPath, err)
+		}
+		// cp without -p overwrites the existing file in place, so its owner is kept, and new files are owned by
+		// the sudo user. mode and modification time are set explicitly, the latter is used to compare files on the next sync
+		applyCmds = append(applyCmds, "mkdir -p "+shellQuote(path.Dir(dstPath)),
+			fmt.Sprintf("cp %s %s", shellQuote(tmpPath), shellQuote(dstPath)),
+			fmt.Sprintf("chmod %o %s", fi.Mode().Perm(), shellQuote(dstPath)),
+			fmt.Sprintf("touch -r %s %s", shellQuote(tmpPath), shellQuote(dstPath)))
+	}
+	c, _, teardown, err := ec.prepScript(ctx, "", strings.NewReader(strings.Join(applyCmds, "\n")+"\n"))
+	if err != nil {
+		return false, fmt.Errorf("can't prepare sudo sync script: %w", err)
+	}
+	defer func() {
+		if e := teardown(); e != nil {
+			log.Printf("[WARN] can't teardown sudo sync script on %s: %v", ec.hostAddr, e)
+		}
+	}()
+	if _, err := ec.runSudo(ctx, c, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		return false, fmt.Errorf("can't apply changes to %s: %w", dst, err)
+	}
+	return true, nil
+}
+
 // Msync synchronizes multiple locations from a source to a destination on a target host.
 func (ec *execCmd) Msync(ctx context.Context) (resp execCmdResp, err error) {
 	msgs := []string{}
@@ -224,43 +578,79 @@ func (ec *execCmd) Msync(ctx context.Context) (resp execCmdResp, err error) {
 		dst := tmpl.apply(c.Dest)
 		msgs = append(msgs, fmt.Sprintf("%s -> %s", src, dst))
 		ecSingle := ec
-		ecSingle.cmd.Sync = config.SyncInternal{Source: src, Dest: dst, Exclude: c.Exclude, Delete: c.Delete, Force: c.Force}
-		if _, err := ecSingle.Sync(ctx); err != nil {
+		ecSingle.cmd.Sync = config.SyncInternal{Source: src, Dest: dst, Exclude: c.Exclude, Delete: c.Delete, Force: c.Force,
+			Checksum: c.Checksum}
+		r, err := ecSingle.Sync(ctx)
+		if err != nil {
 			return resp, ec.errorFmt("can't sync %s to %s %s: %w", src, ec.hostAddr, dst, err)
 		}
+		resp.changed = resp.changed || r.changed
 	}
 	resp.details = fmt.Sprintf(" {sync: %s}", strings.Join(msgs, ", "))
 	return resp, nil
 }
 
 // Delete deletes files on a target host. If sudo option is set, it will execute a sudo rm commands.
+// The command is changed only if the location existed before the delete, i.e. something was actually removed.
 func (ec *execCmd) Delete(ctx context.Context) (resp execCmdResp, err error) {
 	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
 	loc := tmpl.apply(ec.cmd.Delete.Location)
 
+	existed, err := ec.locationExists(ctx, loc)
+	if err != nil {
+		return resp, ec.errorFmt("can't check %s on %s: %w", loc, ec.hostAddr, err)
+	}
+
 	if !ec.cmd.Options.Sudo {
 		// if sudo is not set, we can delete the file directly
 		if err := ec.exec.Delete(ctx, loc, &executor.DeleteOpts{Recursive: ec.cmd.Delete.Recursive}); err != nil {
 			return resp, ec.errorFmt("can't delete files on %s: %w", ec.hostAddr, err)
 		}
 		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v}", loc, ec.cmd.Delete.Recursive)
+		resp.changed = existed
 	}
 
 	if ec.cmd.Options.Sudo {
 		// if sudo is set, we need to delete the file using sudo by ssh-ing into the host and running the command
-		cmd := fmt.Sprintf("sudo rm -f %s", loc)
+		cmd := "rm -f " + shellQuoteGlob(loc)
 		if ec.cmd.Delete.Recursive {
-			cmd = fmt.Sprintf("sudo rm -rf %s", loc)
+			cmd = "rm -rf " + shellQuoteGlob(loc)
 		}
-		if _, err := ec.exec.Run(ctx, cmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		if _, err := ec.runSudo(ctx, cmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
 			return resp, ec.errorFmt("can't delete file(s) on %s: %w", ec.hostAddr, err)
 		}
 		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v, sudo: true}", loc, ec.cmd.Delete.Recursive)
+		resp.changed = existed
 	}
 
 	return resp, nil
 }
 
+// locationExists checks if the location to delete exists on the host, with sudo if set. With sudo glob patterns are
+// expanded by the shell, the same way as by rm, and the location exists if any file matches.
+func (ec *execCmd) locationExists(ctx context.Context, loc string) (bool, error) {
+	const found = "spot-location-exists"
+	checkCmd := func(quoted string) string {
+		return fmt.Sprintf(`for f in %s; do if [ -e "$f" ] || [ -L "$f" ]; then echo %s; break; fi; done`, quoted, found)
+	}
+	var out []string
+	var err error
+	if ec.cmd.Options.Sudo {
+		out, err = ec.runSudo(ctx, "sh -c "+shellQuote(checkCmd(shellQuoteGlob(loc))), &executor.RunOpts{Verbose: ec.verbose})
+	} else {
+		out, err = ec.exec.Run(ctx, checkCmd(shellQuote(loc)), &executor.RunOpts{Verbose: ec.verbose})
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, line := range out {
+		if strings.TrimSpace(line) == found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // MDelete deletes multiple locations on a target host.
 func (ec *execCmd) MDelete(ctx context.Context) (resp execCmdResp, err error) {
 	msgs := []string{}
@@ -269,15 +659,264 @@ func (ec *execCmd) MDelete(ctx context.Context) (resp execCmdResp, err error) {
 		loc := tmpl.apply(c.Location)
 		ecSingle := ec
 		ecSingle.cmd.Delete = config.DeleteInternal{Location: loc, Recursive: c.Recursive}
-		if _, err := ecSingle.Delete(ctx); err != nil {
+		r, err := ecSingle.Delete(ctx)
+		if err != nil {
 			return resp, ec.errorFmt("can't delete %s on %s: %w", loc, ec.hostAddr, err)
 		}
 		msgs = append(msgs, loc)
+		resp.changed = resp.changed || r.changed // changed only if any of the locations was actually removed
 	}
 	resp.details = fmt.Sprintf(" {delete: %s}", strings.Join(msgs, ", "))
 	return resp, nil
 }
 
+// Download fetches a single file or multiple files (if wildcard is used) from a target host to the local destination.
+// By default, files of each host are stored in a subdirectory named after the host (SPOT_REMOTE_NAME), so downloads
+// from multiple hosts don't overwrite each other. This is skipped if the destination refers to SPOT_REMOTE_NAME or
+// SPOT_REMOTE_HOST already. If sudo option is set, it will copy the files to a temporary directory with sudo,
+// make them readable for the user and download from there.
+func (ec *execCmd) Download(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+
+	src := tmpl.apply(ec.cmd.Download.Source)
+	dst := tmpl.apply(ec.cmd.Download.Dest)
+	mkdir := ec.cmd.Download.Mkdir
+	if !strings.Contains(ec.cmd.Download.Dest, "SPOT_REMOTE_NAME") && !strings.Contains(ec.cmd.Download.Dest, "SPOT_REMOTE_HOST") {
+		dst = ec.hostDownloadDest(src, dst)
+		mkdir = true // per-host subdirectory is made by spot, create it if not exists
+	}
+	opts := &executor.UpDownOpts{Mkdir: mkdir, Force: ec.cmd.Download.Force, Exclude: ec.cmd.Download.Exclude,
+		OnTransfer: func(_, _ string) { resp.changed = true }}
+
+	if !ec.cmd.Options.Sudo {
+		resp.details = fmt.Sprintf(" {download: %s -> %s}", src, dst)
+		if err := ec.exec.Download(ctx, src, dst, opts); err != nil {
+			return resp, ec.errorFmt("can't download file from %s: %w", ec.hostAddr, err)
+		}
+		return resp, nil
+	}
+
+	// if sudo is set, we need to copy the files to a temporary directory with sudo and download them from there
+	tmpRemoteDir := ec.uniqueTmp(tmpRemoteDirPrefix)
+	resp.details = fmt.Sprintf(" {download: %s -> %s, sudo: true}", src, dst)
+	defer func() {
+		// remove temporary directory we created under /tmp/.spot-<rand>
+		if e := ec.exec.Delete(ctx, tmpRemoteDir, &executor.DeleteOpts{Recursive: true}); e != nil {
+			log.Printf("[WARN] can't remove temporary directory %q on %s: %v", tmpRemoteDir, ec.hostAddr, e)
+		}
+	}()
+
+	if _, err := ec.exec.Run(ctx, fmt.Sprintf("mkdir -p %s", tmpRemoteDir), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		return resp, ec.errorFmt("can't prepare files for download on %s: %w", ec.hostAddr, err)
+	}
+	sudoCmds := []string{
+		// run cp in a shell with sudo to expand wildcards in directories not readable by the user
+		"sh -c " + shellQuote(fmt.Sprintf("cp -p %s %s/", shellQuoteGlob(src), shellQuote(tmpRemoteDir))),
+		"chown -R $(id -u):$(id -g) " + shellQuote(tmpRemoteDir),
+	}
+	for _, c := range sudoCmds {
+		if _, err := ec.runSudo(ctx, c, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+			return resp, ec.errorFmt("can't prepare files for download on %s: %w", ec.hostAddr, err)
+		}
+	}
+
+	// not using filepath.Join because we want to keep the linux slash, see https://github.com/umputun/spot/issues/144
+	tmpSrc := tmpRemoteDir + "/" + filepath.Base(src)
+	if err := ec.exec.Download(ctx, tmpSrc, dst, opts); err != nil {
+		return resp, ec.errorFmt("can't download file from %s: %w", ec.hostAddr, err)
+	}
+	return resp, nil
+}
+
+// MDownload fetches multiple files from a target host. It calls download function for each file.
+func (ec *execCmd) MDownload(ctx context.Context) (resp execCmdResp, err error) {
+	msgs := []string{}
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	for _, c := range ec.cmd.MDownload {
+		msgs = append(msgs, fmt.Sprintf("%s -> %s", tmpl.apply(c.Source), tmpl.apply(c.Dest)))
+		ecSingle := ec
+		ecSingle.cmd.Download = c // not templated here, Download applies templates and checks for the host placeholders
+		r, err := ecSingle.Download(ctx)
+		if err != nil {
+			return resp, ec.errorFmt("can't download file from %s: %w", ec.hostAddr, err)
+		}
+		resp.changed = resp.changed || r.changed
+	}
+	resp.details = fmt.Sprintf(" {download: %s}", strings.Join(msgs, ", "))
+	return resp, nil
+}
+
+// hostDownloadDest returns local destination inside the host's subdirectory. The subdirectory is the host name,
+// or the host address if the name is not set. If the source is a glob pattern, the destination ends with a slash or it is
+// an existing directory, the destination is a directory, otherwise it is a file.
+func (ec *execCmd) hostDownloadDest(src, dst string) string {
+	hostDir := ec.hostName
+	if hostDir == "" {
+		hostDir = ec.hostAddr
+		if h, _, err := net.SplitHostPort(ec.hostAddr); err == nil {
+			hostDir = h
+		}
+	}
+	if strings.ContainsAny(src, "*?[") {
+		return filepath.Join(dst, hostDir)
+	}
+	if fi, err := os.Stat(dst); strings.HasSuffix(dst, "/") || (err == nil && fi.IsDir()) {
+		return filepath.Join(dst, hostDir, filepath.Base(src))
+	}
+	return filepath.Join(filepath.Dir(dst), hostDir, filepath.Base(dst))
+}
+
+// Template renders a local go text/template file and uploads the result to a target host. Template data includes
+// command's environment (with registered variables), loaded secrets and host fields, see templateData.
+// Upload is done the same way as for copy command, with mkdir, chmod+x and sudo support. If the rendered content is
+// the same as the content of the remote file, the upload is skipped, unless force option is set.
+func (ec *execCmd) Template(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+
+	src := tmpl.apply(ec.cmd.Template.Source)
+	dst := tmpl.apply(ec.cmd.Template.Dest)
+	resp.details = fmt.Sprintf(" {template: %s -> %s}", src, dst)
+
+	content, err := ec.renderTemplate(src)
+	if err != nil {
+		return resp, ec.errorFmt("can't render template %s for %s: %w", src, ec.hostAddr, err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "spot-template")
+	if err != nil {
+		return resp, ec.errorFmt("can't create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	if !ec.cmd.Template.Force && ec.sameRemoteContent(ctx, content, dst, tmpDir) {
+		resp.details = fmt.Sprintf(" {template: %s -> %s, no changes}", src, dst)
+		return resp, nil
+	}
+
+	// write rendered content with the mode of the template file, upload keeps the mode of the local file
+	mode := os.FileMode(0o644)
+	if fi, e := os.Stat(src); e == nil {
+		mode = fi.Mode().Perm()
+	}
+	rendered := filepath.Join(tmpDir, filepath.Base(dst))
+	if err = os.WriteFile(rendered, content, mode); err != nil {
+		return resp, ec.errorFmt("can't write rendered template %s: %w", rendered, err)
+	}
+	if err = os.Chmod(rendered, mode); err != nil { // WriteFile mode is affected by umask
+		return resp, ec.errorFmt("can't set mode of rendered template %s: %w", rendered, err)
+	}
+
+	// upload rendered file with copy command, force is set as the content is already compared
+	ecCopy := *ec
+	ecCopy.cmd.Copy = config.CopyInternal{Source: rendered, Dest: dst, Mkdir: ec.cmd.Template.Mkdir, Force: true,
+		ChmodX: ec.cmd.Template.ChmodX}
+	if _, err = ecCopy.Copy(ctx); err != nil {
+		return resp, ec.errorFmt("can't upload rendered template to %s: %w", ec.hostAddr, err)
+	}
+	resp.changed = true
+
+	opts := []string{}
+	if ec.cmd.Options.Sudo {
+		opts = append(opts, "sudo: true")
+	}
+	if ec.cmd.Template.ChmodX {
+		opts = append(opts, "chmod: +x")
+	}
+	if len(opts) > 0 {
+		resp.details = fmt.Sprintf(" {template: %s -> %s, %s}", src, dst, strings.Join(opts, ", "))
+	}
+	return resp, nil
+}
+
+// MTemplate renders and uploads multiple templates to a target host. It calls template function for each file.
+func (ec *execCmd) MTemplate(ctx context.Context) (resp execCmdResp, err error) {
+	msgs := []string{}
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	for _, c := range ec.cmd.MTemplate {
+		ecSingle := *ec
+		ecSingle.cmd.Template = c
+		r, err := ecSingle.Template(ctx)
+		if err != nil {
+			return resp, ec.errorFmt("can't upload template to %s: %w", ec.hostAddr, err)
+		}
+		msg := fmt.Sprintf("%s -> %s", tmpl.apply(c.Source), tmpl.apply(c.Dest))
+		if strings.HasSuffix(r.details, ", no changes}") {
+			msg += " (no changes)"
+		}
+		msgs = append(msgs, msg)
+		resp.changed = resp.changed || r.changed
+	}
+	resp.details = fmt.Sprintf(" {template: %s}", strings.Join(msgs, ", "))
+	return resp, nil
+}
+
+// renderTemplate renders local template file with templateData. Missing keys are reported as errors
+// to catch typos in variable names.
+func (ec *execCmd) renderTemplate(src string) ([]byte, error) {
+	data, err := os.ReadFile(src) // nolint gosec // template location is defined by playbook
+	if err != nil {
+		return nil, fmt.Errorf("can't read template: %w", err)
+	}
+	t, err := template.New(filepath.Base(src)).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, ec.templateData()); err != nil {
+		return nil, fmt.Errorf("can't execute template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// templateData makes data for template command. It includes command's environment variables (task env, registered
+// variables and overrides), secrets, and host fields: SPOT_REMOTE_HOST, SPOT_REMOTE_NAME, SPOT_REMOTE_USER, SPOT_TASK,
+// SPOT_COMMAND and SPOT_REMOTE_TAGS (list of inventory tags). Secrets override env, host fields override both.
+func (ec *execCmd) templateData() map[string]any {
+	res := make(map[string]any, len(ec.cmd.Environment)+len(ec.cmd.Secrets)+6)
+	for k, v := range ec.cmd.Environment {
+		res[k] = v
+	}
+	for k, v := range ec.cmd.Secrets {
+		res[k] = v
+	}
+	res["SPOT_REMOTE_HOST"] = ec.hostAddr
+	res["SPOT_REMOTE_NAME"] = ec.hostName
+	res["SPOT_COMMAND"] = ec.cmd.Name
+	res["SPOT_REMOTE_TAGS"] = append([]string{}, ec.hostTags...)
+	if ec.tsk != nil {
+		res["SPOT_REMOTE_USER"] = ec.tsk.User
+		res["SPOT_TASK"] = ec.tsk.Name
+	}
+	return res
+}
+
+// sameRemoteContent checks if the remote file has the given content. Without sudo the remote file is downloaded
+// to tmpDir and compared, with sudo the sha256 checksum is calculated on the remote host by sha256sum.
+// Returns false if the remote file doesn't exist or can't be read.
+func (ec *execCmd) sameRemoteContent(ctx context.Context, content []byte, dst, tmpDir string) bool {
+	if ec.cmd.Options.Sudo {
+		out, err := ec.runSudo(ctx, "sha256sum "+shellQuote(dst), &executor.RunOpts{Verbose: ec.verbose})
+		if err != nil || len(out) == 0 {
+			log.Printf("[DEBUG] can't get checksum of %s on %s: %v", dst, ec.hostAddr, err)
+			return false
+		}
+		sum := sha256.Sum256(content)
+		fields := strings.Fields(out[len(out)-1]) // the last line, output may start with the password prompt
+		return len(fields) > 0 && fields[0] == hex.EncodeToString(sum[:])
+	}
+
+	remoteCopy := filepath.Join(tmpDir, "remote-"+filepath.Base(dst))
+	if err := ec.exec.Download(ctx, dst, remoteCopy, &executor.UpDownOpts{Force: true}); err != nil {
+		log.Printf("[DEBUG] can't download %s from %s: %v", dst, ec.hostAddr, err)
+		return false
+	}
+	remoteContent, err := os.ReadFile(remoteCopy) // nolint gosec // file is in our temp dir
+	if err != nil {
+		return false // nothing downloaded, i.e. remote file doesn't exist
+	}
+	return bytes.Equal(remoteContent, content)
+}
+
 // Wait waits for a command to complete on a target hostAddr. It runs the command in a loop with a check duration
 // until the command succeeds or the timeout is exceeded.
 func (ec *execCmd) Wait(ctx context.Context) (resp execCmdResp, err error) {
@@ -307,10 +946,11 @@ func (ec *execCmd) Wait(ctx context.Context) (resp execCmdResp, err error) {
 		c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond))
 
 	waitCmd := fmt.Sprintf("%s -c %q", ec.shell(), c) // run wait command in a shell
+	run := ec.exec.Run
 	if ec.cmd.Options.Sudo {
 		resp.details = fmt.Sprintf(" {wait: %s, timeout: %v, duration: %v, sudo: true}",
 			c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond))
-		waitCmd = fmt.Sprintf("sudo %s -c %q", ec.shell(), c) // add sudo if needed
+		run = ec.runSudo // add sudo if needed
 	}
 	resp.verbose = script
 
@@ -326,7 +966,7 @@ func (ec *execCmd) Wait(ctx context.Context) (resp execCmdResp, err error) {
 		case <-timeoutTk.C:
 			return resp, ec.errorFmt("timeout exceeded")
 		case <-checkTk.C:
-			if _, err := ec.exec.Run(ctx, waitCmd, nil); err == nil {
+			if _, err := run(ctx, waitCmd, nil); err == nil {
 				return resp, nil // command succeeded
 			}
 		}
@@ -341,10 +981,11 @@ func (ec *execCmd) Echo(ctx context.Context) (resp execCmdResp, err error) {
 	if !strings.HasPrefix(echoCmd, "echo ") {
 		echoCmd = fmt.Sprintf("echo %q", echoCmd)
 	}
+	run := ec.exec.Run
 	if ec.cmd.Options.Sudo {
-		echoCmd = fmt.Sprintf("sudo %q", echoCmd)
+		run = ec.runSudo
 	}
-	out, err := ec.exec.Run(ctx, echoCmd, nil)
+	out, err := run(ctx, echoCmd, nil)
 	if err != nil {
 		return resp, ec.errorFmt("can't run echo command on %s: %w", ec.hostAddr, err)
 	}
@@ -371,12 +1012,14 @@ func (ec *execCmd) checkCondition(ctx context.Context) (bool, error) {
 		}
 	}()
 
+	run := ec.exec.Run
 	if ec.cmd.Options.Sudo { // command's sudo also applies to condition script
-		c = fmt.Sprintf("sudo %s -c %q", ec.shell(), c)
+		c = fmt.Sprintf("%s -c %q", ec.shell(), c)
+		run = ec.runSudo
 	}
 
 	// run the condition command
-	if _, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+	if _, err := run(ctx, c, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
 		log.Printf("[DEBUG] condition not passed on %s: %v", ec.hostAddr, err)
 		if inverted {
 			return true, nil // inverted condition failed, so we return true
@@ -396,7 +1039,7 @@ func (ec *execCmd) checkCondition(ctx context.Context) (bool, error) {
 // a temporary file with the script chmod as +x and uploads to remote host to /tmp.
 // it also  returns a teardown function to remove the temporary file after the command execution.
 func (ec *execCmd) prepScript(ctx context.Context, s string, r io.Reader) (cmd, scr string, teardown func() error, err error) {
-	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name}
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, item: ec.item}
 
 	if s != "" { // single command, nothing to do just apply templates
 		return tmpl.apply(s), "", nil, nil
@@ -465,6 +1108,7 @@ func (ec *execCmd) prepScript(ctx context.Context, s string, r io.Reader) (cmd,
 type templater struct {
 	hostAddr string
 	hostName string
+	item     string
 	command  string
 	env      map[string]string
 	task     *config.Task
@@ -488,6 +1132,9 @@ func (tm *templater) apply(inp string) string {
 	res = apply(res, "SPOT_COMMAND", tm.command)
 	res = apply(res, "SPOT_REMOTE_USER", tm.task.User)
 	res = apply(res, "SPOT_TASK", tm.task.Name)
+	if tm.item != "" {
+		res = apply(res, "SPOT_ITEM", tm.item)
+	}
 
 	if tm.err != nil {
 		res = apply(res, "SPOT_ERROR", tm.err.Error())
@@ -517,6 +1164,33 @@ func (ec *execCmd) uniqueTmp(prefix string) string {
 	return fmt.Sprintf("%s%d", prefix, rndInt())
 }
 
+// shellQuote quotes the string to be used as a single word in posix shell, with no expansions
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellQuoteGlob quotes the string for posix shell like shellQuote, but keeps glob characters (*, ? and [])
+// unquoted, to be expanded by the shell.
+func shellQuoteGlob(s string) string {
+	var res, word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			res.WriteString(shellQuote(word.String()))
+			word.Reset()
+		}
+	}
+	for _, r := range s {
+		if strings.ContainsRune("*?[]", r) {
+			flush()
+			res.WriteRune(r)
+			continue
+		}
+		word.WriteRune(r)
+	}
+	flush()
+	return res.String()
+}
+
 func (ec *execCmd) error(err error) *execCmdErr {
 	return &execCmdErr{err: err, exec: *ec}
 }
@@ -7,8 +7,10 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -122,6 +124,25 @@ func Test_templaterApply(t *testing.T) {
 			},
 			expected: "example.com:user:ls ",
 		},
+		{
+			name: "with loop item",
+			inp:  "$SPOT_COMMAND {SPOT_ITEM} ${SPOT_ITEM} $SPOT_ITEM",
+			tmpl: templater{
+				command: "ls",
+				task:    &config.Task{Name: "task1", User: "user"},
+				item:    "nginx",
+			},
+			expected: "ls nginx nginx nginx",
+		},
+		{
+			name: "without loop item",
+			inp:  "$SPOT_COMMAND {SPOT_ITEM}",
+			tmpl: templater{
+				command: "ls",
+				task:    &config.Task{Name: "task1", User: "user"},
+			},
+			expected: "ls {SPOT_ITEM}",
+		},
 	}
 
 	for _, tt := range tests {
@@ -150,6 +171,20 @@ func Test_execCmd(t *testing.T) {
 		assert.Equal(t, " {copy: testdata/inventory.yml -> /tmp/inventory.txt}", resp.details)
 	})
 
+	t.Run("script with register_output and register_rc", func(t *testing.T) {
+		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Script: `echo " hello "`,
+			RegisterOutput: "OUT", RegisterRC: "RC"}}
+		resp, err := ec.Script(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"OUT": "hello", "RC": "0"}, resp.vars)
+
+		ec.cmd.Script = "echo first\necho second\nexit 5"
+		resp, err = ec.Script(ctx)
+		require.NoError(t, err, "non-zero exit is not a failure")
+		assert.Equal(t, map[string]string{"OUT": "first\nsecond", "RC": "5"}, resp.vars)
+		assert.False(t, resp.changed)
+	})
+
 	t.Run("wait done", func(t *testing.T) {
 		time.AfterFunc(time.Second, func() {
 			_, _ = sess.Run(ctx, "touch /tmp/wait.done", nil)
@@ -204,8 +239,13 @@ func Test_execCmd(t *testing.T) {
 		require.NoError(t, err)
 		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Delete: config.DeleteInternal{
 			Location: "/tmp/delete.me"}}}
-		_, err = ec.Delete(ctx)
+		resp, err := ec.Delete(ctx)
 		require.NoError(t, err)
+		assert.True(t, resp.changed)
+
+		resp, err = ec.Delete(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "already deleted")
 	})
 
 	t.Run("delete a multi-files", func(t *testing.T) {
@@ -360,6 +400,88 @@ func Test_execCmd(t *testing.T) {
 		assert.Contains(t, resp.details, "conf2.yml")
 	})
 
+	t.Run("download a single file", func(t *testing.T) {
+		dstDir := t.TempDir()
+		ec := execCmd{exec: sess, hostAddr: testingHostAndPort, hostName: "my-host", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Download: config.DownloadInternal{Source: "/etc/passwd", Dest: dstDir + "/passwd.txt"}}}
+		resp, err := ec.Download(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {download: /etc/passwd -> %s/my-host/passwd.txt}", dstDir), resp.details)
+		data, err := os.ReadFile(dstDir + "/my-host/passwd.txt")
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "root:")
+	})
+
+	t.Run("download multiple files with explicit host dir", func(t *testing.T) {
+		dstDir := t.TempDir()
+		ec := execCmd{exec: sess, hostAddr: testingHostAndPort, hostName: "my-host", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{MDownload: []config.DownloadInternal{
+				{Source: "/etc/passwd", Dest: dstDir + "/{SPOT_REMOTE_NAME}-passwd", Mkdir: true},
+				{Source: "/etc/host*", Dest: dstDir + "/glob"},
+			}}}
+		resp, err := ec.MDownload(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {download: /etc/passwd -> %s/my-host-passwd, /etc/host* -> %s/glob}", dstDir, dstDir),
+			resp.details)
+		assert.FileExists(t, dstDir+"/my-host-passwd")
+		assert.FileExists(t, dstDir+"/glob/my-host/hostname")
+		assert.FileExists(t, dstDir+"/glob/my-host/hosts")
+	})
+
+	t.Run("download a single file with sudo", func(t *testing.T) {
+		dstDir := t.TempDir()
+		ec := execCmd{exec: sess, hostAddr: testingHostAndPort, hostName: "my-host", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Download: config.DownloadInternal{Source: "/etc/shadow", Dest: dstDir + "/"},
+				Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Download(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {download: /etc/shadow -> %s/my-host/shadow, sudo: true}", dstDir), resp.details)
+		data, err := os.ReadFile(dstDir + "/my-host/shadow")
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "root:")
+	})
+
+	t.Run("template with sudo", func(t *testing.T) {
+		ec := execCmd{exec: sess, hostAddr: testingHostAndPort, hostName: "my-host", hostTags: []string{"t1"},
+			tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+				Template:    config.TemplateInternal{Source: "testdata/app.conf.tmpl", Dest: "/srv/app/app.conf", Mkdir: true},
+				Environment: map[string]string{"APP_PORT": "8080"}, Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {template: testdata/app.conf.tmpl -> /srv/app/app.conf, sudo: true}", resp.details)
+
+		out, err := sess.Run(ctx, "cat /srv/app/app.conf", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"host=" + testingHostAndPort, "name=my-host", "port=8080", "tags=t1"}, out)
+
+		// render again, same content, should be skipped
+		resp, err = ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {template: testdata/app.conf.tmpl -> /srv/app/app.conf, no changes}", resp.details)
+	})
+
+	t.Run("template without sudo", func(t *testing.T) {
+		ec := execCmd{exec: sess, hostAddr: testingHostAndPort, hostName: "my-host", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Template: config.TemplateInternal{Source: "testdata/app.conf.tmpl", Dest: "/tmp/app.conf"},
+				Environment: map[string]string{"APP_PORT": "8080"}}}
+		resp, err := ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {template: testdata/app.conf.tmpl -> /tmp/app.conf}", resp.details)
+
+		resp, err = ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {template: testdata/app.conf.tmpl -> /tmp/app.conf, no changes}", resp.details)
+
+		// different content, should be uploaded
+		ec.cmd.Environment["APP_PORT"] = "9090"
+		resp, err = ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {template: testdata/app.conf.tmpl -> /tmp/app.conf}", resp.details)
+		out, err := sess.Run(ctx, "cat /tmp/app.conf", nil)
+		require.NoError(t, err)
+		assert.Contains(t, out, "port=9090")
+	})
+
 	t.Run("dbl-copy non-forced", func(t *testing.T) {
 		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
 			Copy: config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory.txt"}}}
@@ -394,6 +516,557 @@ func Test_execCmd(t *testing.T) {
 
 }
 
+func Test_execCmdDownloadLocalAndDry(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(srcDir+"/file1.txt", []byte("content1"), 0o600))
+
+	t.Run("local", func(t *testing.T) {
+		ec := execCmd{exec: executor.NewLocal(executor.MakeLogs(false, false, nil)), hostAddr: "h1.example.com:22",
+			tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Download: config.DownloadInternal{
+				Source: srcDir + "/file1.txt", Dest: dstDir + "/file1.txt"}}}
+		resp, err := ec.Download(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {download: %s/file1.txt -> %s/h1.example.com/file1.txt}", srcDir, dstDir), resp.details)
+		data, err := os.ReadFile(dstDir + "/h1.example.com/file1.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "content1", string(data))
+	})
+
+	t.Run("local with sudo, special characters in names", func(t *testing.T) {
+		fakeSudo(t)
+		dir := filepath.Join(srcDir, "it's a $(touch injected) dir")
+		require.NoError(t, os.MkdirAll(dir, 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "app 1.log"), []byte("log1"), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "app 2.log"), []byte("log2"), 0o600))
+
+		ec := execCmd{exec: executor.NewLocal(executor.MakeLogs(false, false, nil)), hostAddr: "h1.example.com:22",
+			tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Download: config.DownloadInternal{
+				Source: dir + "/app *.log", Dest: dstDir + "/sudo/"}, Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Download(context.Background())
+		require.NoError(t, err)
+		assert.True(t, resp.changed)
+		data, err := os.ReadFile(dstDir + "/sudo/h1.example.com/app 2.log")
+		require.NoError(t, err)
+		assert.Equal(t, "log2", string(data))
+		assert.FileExists(t, dstDir+"/sudo/h1.example.com/app 1.log")
+		assert.NoFileExists(t, "injected")
+	})
+
+	t.Run("dry", func(t *testing.T) {
+		ec := execCmd{exec: executor.NewDry(executor.MakeLogs(false, false, nil)), hostAddr: "h1.example.com:22", hostName: "h1",
+			tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Download: config.DownloadInternal{
+				Source: "/var/log/app.log", Dest: dstDir + "/dry/app.log"}, Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Download(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {download: /var/log/app.log -> %s/dry/h1/app.log, sudo: true}", dstDir), resp.details)
+		assert.NoDirExists(t, dstDir+"/dry")
+	})
+}
+
+func Test_execCmdTemplateLocalAndDry(t *testing.T) {
+	dstDir := t.TempDir()
+
+	t.Run("local", func(t *testing.T) {
+		ec := execCmd{exec: executor.NewLocal(executor.MakeLogs(false, false, nil)), hostAddr: "h1.example.com:22",
+			hostName: "h1", hostTags: []string{"t1", "t2"}, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+				Template:    config.TemplateInternal{Source: "testdata/app.conf.tmpl", Dest: dstDir + "/conf/app.conf", Mkdir: true},
+				Environment: map[string]string{"APP_PORT": "8080"}}}
+		resp, err := ec.Template(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {template: testdata/app.conf.tmpl -> %s/conf/app.conf}", dstDir), resp.details)
+		data, err := os.ReadFile(dstDir + "/conf/app.conf")
+		require.NoError(t, err)
+		assert.Equal(t, "host=h1.example.com:22\nname=h1\nport=8080\ntags=t1,t2\n", string(data))
+
+		resp, err = ec.Template(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {template: testdata/app.conf.tmpl -> %s/conf/app.conf, no changes}", dstDir), resp.details)
+
+		ec.cmd.Template.Force = true
+		resp, err = ec.Template(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {template: testdata/app.conf.tmpl -> %s/conf/app.conf}", dstDir), resp.details)
+	})
+
+	t.Run("local multiple with chmod+x", func(t *testing.T) {
+		ec := execCmd{exec: executor.NewLocal(executor.MakeLogs(false, false, nil)), hostAddr: "h1.example.com:22",
+			tsk: &config.Task{Name: "test"}, cmd: config.Cmd{MTemplate: []config.TemplateInternal{
+				{Source: "testdata/app.conf.tmpl", Dest: dstDir + "/m1.conf"},
+				{Source: "testdata/app.conf.tmpl", Dest: dstDir + "/m2.sh", ChmodX: true},
+			}, Environment: map[string]string{"APP_PORT": "8080"}}}
+		resp, err := ec.MTemplate(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {template: testdata/app.conf.tmpl -> %s/m1.conf, testdata/app.conf.tmpl -> %s/m2.sh}",
+			dstDir, dstDir), resp.details)
+		fi, err := os.Stat(dstDir + "/m2.sh")
+		require.NoError(t, err)
+		assert.NotZero(t, fi.Mode().Perm()&0o100, "should be executable")
+
+		resp, err = ec.MTemplate(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {template: testdata/app.conf.tmpl -> %s/m1.conf (no changes), "+
+			"testdata/app.conf.tmpl -> %s/m2.sh (no changes)}", dstDir, dstDir), resp.details)
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		ec := execCmd{exec: executor.NewLocal(executor.MakeLogs(false, false, nil)), hostAddr: "h1.example.com:22",
+			tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+				Template: config.TemplateInternal{Source: "testdata/app.conf.tmpl", Dest: dstDir + "/missing.conf"}}}
+		_, err := ec.Template(context.Background())
+		require.ErrorContains(t, err, "can't render template testdata/app.conf.tmpl")
+		require.ErrorContains(t, err, `map has no entry for key "APP_PORT"`)
+		assert.NoFileExists(t, dstDir+"/missing.conf")
+	})
+
+	t.Run("dry", func(t *testing.T) {
+		ec := execCmd{exec: executor.NewDry(executor.MakeLogs(false, false, nil)), hostAddr: "h1.example.com:22",
+			tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+				Template:    config.TemplateInternal{Source: "testdata/app.conf.tmpl", Dest: dstDir + "/dry/app.conf"},
+				Environment: map[string]string{"APP_PORT": "8080"}, Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Template(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {template: testdata/app.conf.tmpl -> %s/dry/app.conf, sudo: true}", dstDir), resp.details)
+		assert.NoDirExists(t, dstDir+"/dry")
+	})
+}
+
+func Test_execCmdChangedLocal(t *testing.T) {
+	ctx := context.Background()
+	lcl := executor.NewLocal(executor.MakeLogs(false, false, nil))
+
+	t.Run("script", func(t *testing.T) {
+		tbl := []struct {
+			name        string
+			script      string
+			changedWhen config.ChangedWhen
+			changed     bool
+			expErr      string
+		}{
+			{name: "no changed_when", script: "echo hello", changed: true},
+			{name: "no changed_when, failed", script: "exit 1", expErr: "can't run script on localhost: exit status 1"},
+			{name: "rc matched", script: "exit 2", changedWhen: config.ChangedWhen{ExitCodes: []int{2}}, changed: true},
+			{name: "rc not matched", script: "exit 0", changedWhen: config.ChangedWhen{ExitCodes: []int{2}}},
+			{name: "rc not matched, failed", script: "exit 1", changedWhen: config.ChangedWhen{ExitCodes: []int{2}},
+				expErr: "can't run script on localhost: exit status 1"},
+			{name: "output matched", script: "echo updated 3 files", changedWhen: config.ChangedWhen{Output: `^updated \d+`},
+				changed: true},
+			{name: "output not matched", script: "echo nothing to do", changedWhen: config.ChangedWhen{Output: `^updated \d+`}},
+		}
+		for _, tt := range tbl {
+			t.Run(tt.name, func(t *testing.T) {
+				ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"},
+					cmd: config.Cmd{Script: tt.script, ChangedWhen: tt.changedWhen}}
+				resp, err := ec.Script(ctx)
+				if tt.expErr != "" {
+					require.EqualError(t, err, tt.expErr)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tt.changed, resp.changed)
+			})
+		}
+	})
+
+	t.Run("register output and rc", func(t *testing.T) {
+		tbl := []struct {
+			name    string
+			cmd     config.Cmd
+			vars    map[string]string
+			changed bool
+			expErr  string
+		}{
+			{name: "output", cmd: config.Cmd{Script: `echo "  hello  "`, RegisterOutput: "OUT"},
+				vars: map[string]string{"OUT": "hello"}, changed: true},
+			{name: "output, multiline", cmd: config.Cmd{Script: "echo first\necho second", RegisterOutput: "OUT"},
+				vars: map[string]string{"OUT": "first\nsecond"}, changed: true},
+			{name: "output, failed", cmd: config.Cmd{Script: "echo hello; exit 1", RegisterOutput: "OUT"},
+				expErr: "can't run script on localhost: exit status 1"},
+			{name: "rc, success", cmd: config.Cmd{Script: "echo hello", RegisterRC: "RC"},
+				vars: map[string]string{"RC": "0"}, changed: true},
+			{name: "rc, failed", cmd: config.Cmd{Script: "exit 3", RegisterRC: "RC"}, vars: map[string]string{"RC": "3"}},
+			{name: "rc and output, multiline failed", cmd: config.Cmd{Script: "echo hello\nexit 2", RegisterOutput: "OUT",
+				RegisterRC: "RC"}, vars: map[string]string{"OUT": "hello", "RC": "2"}},
+			{name: "with register", cmd: config.Cmd{Script: "export FOO=bar\necho hello", Register: []string{"FOO"},
+				RegisterOutput: "OUT"}, vars: map[string]string{"FOO": "bar", "OUT": "hello"}, changed: true},
+			{name: "json", cmd: config.Cmd{Script: `echo "{\"status\": \"ok\", \"items\": [{\"name\": \"a\"}]}"`, RegisterJSON: "RES"},
+				vars: map[string]string{"RES_status": "ok", "RES_items_0_name": "a"}, changed: true},
+			{name: "json, multiline", cmd: config.Cmd{Script: "echo '{'\necho '  \"status\": \"ok\"'\necho '}'", RegisterJSON: "RES"},
+				vars: map[string]string{"RES_status": "ok"}, changed: true},
+			{name: "json, invalid", cmd: config.Cmd{Script: "echo not json", RegisterJSON: "RES"},
+				expErr: "can't register json output of script on localhost: " +
+					"invalid json: invalid character 'o' in literal null (expecting 'u')"},
+		}
+		for _, tt := range tbl {
+			t.Run(tt.name, func(t *testing.T) {
+				ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"}, cmd: tt.cmd}
+				resp, err := ec.Script(ctx)
+				if tt.expErr != "" {
+					require.EqualError(t, err, tt.expErr)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tt.vars, resp.vars)
+				assert.Equal(t, tt.changed, resp.changed)
+			})
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "inventory.yml")
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Copy: config.CopyInternal{Source: "testdata/inventory.yml", Dest: dst}}}
+		resp, err := ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "file uploaded")
+
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "file is up-to-date")
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		dst := t.TempDir()
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Sync: config.SyncInternal{Source: "testdata", Dest: dst, Checksum: true}}}
+		resp, err := ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "files synced")
+
+		resp, err = ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "files are up-to-date")
+	})
+}
+
+func Test_execCmdDeleteChangedLocal(t *testing.T) {
+	fakeSudo(t)
+	ctx := context.Background()
+	lcl := executor.NewLocal(executor.MakeLogs(false, false, nil))
+	dir := t.TempDir()
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "it's.txt"), []byte("data"), 0o600))
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Delete: config.DeleteInternal{Location: filepath.Join(dir, "it's.txt")}}}
+		resp, err := ec.Delete(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "file deleted")
+		assert.NoFileExists(t, filepath.Join(dir, "it's.txt"))
+	})
+
+	t.Run("delete recursive with sudo", func(t *testing.T) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("data"), 0o600))
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Delete: config.DeleteInternal{Location: filepath.Join(dir, "sub"), Recursive: true},
+				Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Delete(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "directory deleted")
+		assert.NoDirExists(t, filepath.Join(dir, "sub"))
+
+		resp, err = ec.Delete(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "nothing to delete")
+	})
+
+	t.Run("delete glob with sudo", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "f1.log"), []byte("data"), 0o600))
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{Delete: config.DeleteInternal{Location: filepath.Join(dir, "*.log")},
+				Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Delete(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "matched file deleted")
+		assert.NoFileExists(t, filepath.Join(dir, "f1.log"))
+
+		resp, err = ec.Delete(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "no files matched")
+	})
+
+	t.Run("mdelete with sudo", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "m1.txt"), []byte("data"), 0o600))
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"},
+			cmd: config.Cmd{MDelete: []config.DeleteInternal{{Location: filepath.Join(dir, "m1.txt")},
+				{Location: filepath.Join(dir, "m2.txt")}}, Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.MDelete(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "one of the files deleted")
+		assert.NoFileExists(t, filepath.Join(dir, "m1.txt"))
+
+		resp, err = ec.MDelete(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "nothing to delete")
+	})
+}
+
+func Test_execCmdCopySudoLocal(t *testing.T) {
+	fakeSudo(t)
+	ctx := context.Background()
+	lcl := executor.NewLocal(executor.MakeLogs(false, false, nil))
+	src, dst := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file1.txt"), []byte("content1"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file2.txt"), []byte("content2"), 0o600))
+
+	t.Run("single file", func(t *testing.T) {
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+			Copy:    config.CopyInternal{Source: filepath.Join(src, "file1.txt"), Dest: filepath.Join(dst, "my file.txt")},
+			Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed)
+		data, err := os.ReadFile(filepath.Join(dst, "my file.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "content1", string(data))
+
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "same file, nothing copied")
+
+		ec.cmd.Copy.Force = true
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "forced copy")
+		ec.cmd.Copy.Force = false
+
+		require.NoError(t, os.WriteFile(filepath.Join(src, "file1.txt"), []byte("updated content1"), 0o600))
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "local file updated")
+		data, err = os.ReadFile(filepath.Join(dst, "my file.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "updated content1", string(data))
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+			Copy: config.CopyInternal{Source: filepath.Join(src, "file2.txt"), Dest: filepath.Join(dst, "checksum.txt"),
+				Checksum: true},
+			Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed)
+
+		// same content with different modification time is the same file
+		oldTime := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dst, "checksum.txt"), oldTime, oldTime))
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "same content")
+
+		// different content with the same size and modification time is copied
+		fi, err := os.Stat(filepath.Join(src, "file2.txt"))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dst, "checksum.txt"), []byte("CONTENT2"), 0o600))
+		require.NoError(t, os.Chtimes(filepath.Join(dst, "checksum.txt"), fi.ModTime(), fi.ModTime()))
+		ec.cmd.Copy.Checksum = false
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "without checksum only size and modification time are compared")
+		ec.cmd.Copy.Checksum = true
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "different content")
+		data, err := os.ReadFile(filepath.Join(dst, "checksum.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "content2", string(data))
+	})
+
+	t.Run("multiple files", func(t *testing.T) {
+		ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+			Copy:    config.CopyInternal{Source: filepath.Join(src, "*.txt"), Dest: filepath.Join(dst, "multi")},
+			Options: config.CmdOptions{Sudo: true}}}
+		resp, err := ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed)
+		assert.FileExists(t, filepath.Join(dst, "multi", "file1.txt"))
+		assert.FileExists(t, filepath.Join(dst, "multi", "file2.txt"))
+
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "same files, nothing copied")
+
+		require.NoError(t, os.Remove(filepath.Join(dst, "multi", "file2.txt")))
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed, "remote file missing")
+		assert.FileExists(t, filepath.Join(dst, "multi", "file2.txt"))
+	})
+}
+
+func Test_execCmdSyncSudoLocal(t *testing.T) {
+	fakeSudo(t)
+
+	ctx := context.Background()
+	lcl := executor.NewLocal(executor.MakeLogs(false, false, nil))
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "dst")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file1.txt"), []byte("content1"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "sub", "file2.txt"), []byte("content2"), 0o600))
+
+	ec := execCmd{exec: lcl, hostAddr: "localhost", tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+		Sync:    config.SyncInternal{Source: src, Dest: dst, Checksum: true, Delete: true},
+		Options: config.CmdOptions{Sudo: true}}}
+
+	t.Run("initial sync", func(t *testing.T) {
+		resp, err := ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed)
+		assert.Equal(t, fmt.Sprintf(" {sync: %s -> %s, sudo: true}", src, dst), resp.details)
+		data, err := os.ReadFile(filepath.Join(dst, "sub", "file2.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "content2", string(data))
+	})
+
+	t.Run("no changes", func(t *testing.T) {
+		resp, err := ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed)
+	})
+
+	t.Run("update and delete", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(src, "file1.txt"), []byte("updated"), 0o600))
+		require.NoError(t, os.RemoveAll(filepath.Join(src, "sub")))
+		require.NoError(t, os.WriteFile(filepath.Join(dst, "extra.txt"), []byte("extra"), 0o600))
+
+		resp, err := ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed)
+		data, err := os.ReadFile(filepath.Join(dst, "file1.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "updated", string(data))
+		assert.NoFileExists(t, filepath.Join(dst, "sub", "file2.txt"))
+		assert.NoFileExists(t, filepath.Join(dst, "extra.txt"))
+
+		resp, err = ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed)
+	})
+
+	t.Run("owner of updated file kept", func(t *testing.T) {
+		if os.Getuid() != 0 {
+			t.Skip("changing file owner requires root")
+		}
+		require.NoError(t, os.Chown(filepath.Join(dst, "file1.txt"), 65534, 65534))
+		require.NoError(t, os.WriteFile(filepath.Join(src, "file1.txt"), []byte("updated again"), 0o600))
+		require.NoError(t, os.Chmod(filepath.Join(src, "file1.txt"), 0o640))
+
+		resp, err := ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.True(t, resp.changed)
+		fi, err := os.Stat(filepath.Join(dst, "file1.txt"))
+		require.NoError(t, err)
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		require.True(t, ok)
+		assert.Equal(t, uint32(65534), st.Uid)
+		assert.Equal(t, os.FileMode(0o640), fi.Mode().Perm())
+		data, err := os.ReadFile(filepath.Join(dst, "file1.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "updated again", string(data))
+	})
+}
+
+func Test_shellQuote(t *testing.T) {
+	tbl := []struct {
+		inp, quoted, quotedGlob string
+	}{
+		{inp: "/tmp/file.txt", quoted: "'/tmp/file.txt'", quotedGlob: "'/tmp/file.txt'"},
+		{inp: "/tmp/my file.txt", quoted: "'/tmp/my file.txt'", quotedGlob: "'/tmp/my file.txt'"},
+		{inp: "/tmp/it's.txt", quoted: `'/tmp/it'\''s.txt'`, quotedGlob: `'/tmp/it'\''s.txt'`},
+		{inp: "/tmp/$(id);rm", quoted: "'/tmp/$(id);rm'", quotedGlob: "'/tmp/$(id);rm'"},
+		{inp: "/var/log/app *.log", quoted: "'/var/log/app *.log'", quotedGlob: "'/var/log/app '*'.log'"},
+		{inp: "/var/log/app-?.[0-9]", quoted: "'/var/log/app-?.[0-9]'", quotedGlob: "'/var/log/app-'?'.'['0-9']"},
+		{inp: "*", quoted: "'*'", quotedGlob: "*"},
+		{inp: "", quoted: "''", quotedGlob: ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.inp, func(t *testing.T) {
+			assert.Equal(t, tt.quoted, shellQuote(tt.inp))
+			assert.Equal(t, tt.quotedGlob, shellQuoteGlob(tt.inp))
+		})
+	}
+}
+
+// fakeSudo sets sudo running the command as is, to check commands made with sudo without real privileges.
+// Options are skipped, and the password is never asked.
+func fakeSudo(t *testing.T) {
+	binDir := t.TempDir()
+	script := "#!/bin/sh\nwhile [ $# -gt 0 ]; do case \"$1\" in -p|-u) shift 2;; -*) shift;; *) break;; esac; done\nexec \"$@\"\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "sudo"), []byte(script), 0o700)) // nolint
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+}
+
+func Test_flattenJSON(t *testing.T) {
+	tbl := []struct {
+		name     string
+		data     string
+		expected map[string]string
+		expErr   string
+	}{
+		{name: "object", data: `{"status": "ok", "code": 200, "healthy": true, "error": null}`,
+			expected: map[string]string{"RES_status": "ok", "RES_code": "200", "RES_healthy": "true", "RES_error": ""}},
+		{name: "nested", data: `{"items": [{"name": "a", "tags": ["x", "y"]}, {"name": "b"}], "meta": {"total": 2}}`,
+			expected: map[string]string{"RES_items_0_name": "a", "RES_items_0_tags_0": "x", "RES_items_0_tags_1": "y",
+				"RES_items_1_name": "b", "RES_meta_total": "2"}},
+		{name: "top-level array", data: `[{"Id": "abc"}]`, expected: map[string]string{"RES_0_Id": "abc"}},
+		{name: "scalar", data: `"v1.2.3"`, expected: map[string]string{"RES": "v1.2.3"}},
+		{name: "big and float numbers", data: `{"size": 12345678901234, "ratio": 0.25}`,
+			expected: map[string]string{"RES_size": "12345678901234", "RES_ratio": "0.25"}},
+		{name: "keys with special characters", data: `{"com.docker.compose/project": "app", "a-b c": "d"}`,
+			expected: map[string]string{"RES_com_docker_compose_project": "app", "RES_a_b_c": "d"}},
+		{name: "empty object", data: `{}`, expected: map[string]string{}},
+		{name: "with whitespace", data: "\n  {\"a\": 1}\n", expected: map[string]string{"RES_a": "1"}},
+		{name: "not json", data: "hello", expErr: "invalid json: invalid character 'h' looking for beginning of value"},
+		{name: "empty", data: "", expErr: "invalid json: EOF"},
+		{name: "trailing data", data: `{"a": 1} {"b": 2}`, expErr: "invalid json: unexpected data after the top-level value"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := map[string]string{}
+			err := flattenJSON("RES", tt.data, vars)
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, vars)
+		})
+	}
+}
+
+func Test_templateData(t *testing.T) {
+	ec := execCmd{hostAddr: "h1.example.com:22", hostName: "h1", hostTags: []string{"t1"},
+		tsk: &config.Task{Name: "task1", User: "user1"}, cmd: config.Cmd{Name: "cmd1",
+			Environment: map[string]string{"FOO": "foo", "SECRET1": "env", "SPOT_REMOTE_HOST": "bad"},
+			Secrets:     map[string]string{"SECRET1": "secret"}}}
+	assert.Equal(t, map[string]any{
+		"FOO": "foo", "SECRET1": "secret",
+		"SPOT_REMOTE_HOST": "h1.example.com:22", "SPOT_REMOTE_NAME": "h1", "SPOT_REMOTE_USER": "user1",
+		"SPOT_TASK": "task1", "SPOT_COMMAND": "cmd1", "SPOT_REMOTE_TAGS": []string{"t1"},
+	}, ec.templateData())
+}
+
+func Test_hostDownloadDest(t *testing.T) {
+	existingDir := t.TempDir()
+	tbl := []struct {
+		name, hostAddr, hostName, src, dst, expected string
+	}{
+		{"file", "h1.example.com:22", "h1", "/var/log/app.log", "logs/app.log", "logs/h1/app.log"},
+		{"file without host name", "h1.example.com:22", "", "/var/log/app.log", "logs/app.log", "logs/h1.example.com/app.log"},
+		{"directory with slash", "h1.example.com:22", "h1", "/var/log/app.log", "logs/", "logs/h1/app.log"},
+		{"existing directory", "h1.example.com:22", "h1", "/var/log/app.log", existingDir, existingDir + "/h1/app.log"},
+		{"glob", "h1.example.com:22", "h1", "/var/log/*.log", "logs", "logs/h1"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			ec := execCmd{hostAddr: tt.hostAddr, hostName: tt.hostName}
+			assert.Equal(t, tt.expected, ec.hostDownloadDest(tt.src, tt.dst))
+		})
+	}
+}
+
 func Test_execCmdWithTmp(t *testing.T) {
 	testingHostAndPort, teardown := startTestContainer(t)
 	defer teardown()
@@ -456,10 +1129,10 @@ func Test_execCmdWithTmp(t *testing.T) {
 
 		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
 			Options: config.CmdOptions{Sudo: true},
-			Copy:    config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory.txt"}}}
+			Copy:    config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory-sudo.txt"}}}
 		resp, err := ec.Copy(ctx)
 		require.NoError(t, err)
-		assert.Equal(t, " {copy: testdata/inventory.yml -> /tmp/inventory.txt, sudo: true}", resp.details)
+		assert.Equal(t, " {copy: testdata/inventory.yml -> /tmp/inventory-sudo.txt, sudo: true}", resp.details)
 		tmpPath := extractTmpPath(wr.String())
 		assert.NotEmpty(t, tmpPath)
 		t.Logf("tmpPath: %s", tmpPath)
@@ -467,11 +1140,11 @@ func Test_execCmdWithTmp(t *testing.T) {
 		// check if dest contains file
 		wr.Reset()
 		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
-			Script: "ls -la /tmp/inventory.txt"},
+			Script: "ls -la /tmp/inventory-sudo.txt"},
 		}
 		resp, err = ec.Script(ctx)
 		require.NoError(t, err)
-		assert.Contains(t, wr.String(), "/tmp/inventory.txt")
+		assert.Contains(t, wr.String(), "/tmp/inventory-sudo.txt")
 		assert.Contains(t, wr.String(), "> -rw-r--r-- ")
 
 		// check if tmp dir removed
@@ -483,6 +1156,14 @@ func Test_execCmdWithTmp(t *testing.T) {
 		resp, err = ec.Script(ctx)
 		require.Error(t, err)
 		assert.Contains(t, wr.String(), fmt.Sprintf("cannot access '%s'", tmpPath))
+
+		// copy the same file again, nothing changed
+		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+			Options: config.CmdOptions{Sudo: true},
+			Copy:    config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory-sudo.txt"}}}
+		resp, err = ec.Copy(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed)
 	})
 
 	t.Run("copy a single file with sudo and chmod+x", func(t *testing.T) {
@@ -491,10 +1172,10 @@ func Test_execCmdWithTmp(t *testing.T) {
 
 		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
 			Options: config.CmdOptions{Sudo: true},
-			Copy:    config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory.txt", ChmodX: true}}}
+			Copy:    config.CopyInternal{Source: "testdata/inventory.yml", Dest: "/tmp/inventory-sudo-x.txt", ChmodX: true}}}
 		resp, err := ec.Copy(ctx)
 		require.NoError(t, err)
-		assert.Equal(t, " {copy: testdata/inventory.yml -> /tmp/inventory.txt, sudo: true, chmod: +x}", resp.details)
+		assert.Equal(t, " {copy: testdata/inventory.yml -> /tmp/inventory-sudo-x.txt, sudo: true, chmod: +x}", resp.details)
 		tmpPath := extractTmpPath(wr.String())
 		assert.NotEmpty(t, tmpPath)
 		t.Logf("tmpPath: %s", tmpPath)
@@ -502,11 +1183,11 @@ func Test_execCmdWithTmp(t *testing.T) {
 		// check if dest contains file
 		wr.Reset()
 		ec = execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
-			Script: "ls -la /tmp/inventory.txt"},
+			Script: "ls -la /tmp/inventory-sudo-x.txt"},
 		}
 		resp, err = ec.Script(ctx)
 		require.NoError(t, err)
-		assert.Contains(t, wr.String(), "/tmp/inventory.txt")
+		assert.Contains(t, wr.String(), "/tmp/inventory-sudo-x.txt")
 		assert.Contains(t, wr.String(), "> -rwxr-xr-x ", "file should be executable")
 
 		// check if tmp dir removed
@@ -558,4 +1239,36 @@ func Test_execCmdWithTmp(t *testing.T) {
 		require.Error(t, err)
 		assert.Contains(t, wr.String(), fmt.Sprintf("cannot access '%s'", tmpPath))
 	})
+
+	t.Run("sync with sudo", func(t *testing.T) {
+		_, err := sess.Run(ctx, "sudo mkdir -p /srv/sync/old && sudo touch /srv/sync/old/f1 /srv/sync/keep.me /srv/sync/extra"+
+			" /srv/sync/inventory.yml && sudo chown nobody /srv/sync/inventory.yml", &executor.RunOpts{Verbose: true})
+		require.NoError(t, err)
+
+		ec := execCmd{exec: sess, tsk: &config.Task{Name: "test"}, cmd: config.Cmd{
+			Sync: config.SyncInternal{Source: "testdata", Dest: "/srv/sync", Delete: true, Exclude: []string{"keep.me"}}}}
+		_, err = ec.Sync(ctx)
+		require.Error(t, err, "should fail because of missing sudo")
+
+		ec.cmd.Options.Sudo = true
+		resp, err := ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {sync: testdata -> /srv/sync, sudo: true}", resp.details)
+		assert.True(t, resp.changed)
+
+		out, err := sess.Run(ctx, "find /srv/sync -type f", nil)
+		require.NoError(t, err)
+		assert.Contains(t, out, "/srv/sync/inventory.yml")
+		assert.Contains(t, out, "/srv/sync/keep.me", "excluded file is kept")
+		assert.NotContains(t, out, "/srv/sync/old/f1")
+		assert.NotContains(t, out, "/srv/sync/extra")
+
+		out, err = sess.Run(ctx, "stat -c %U /srv/sync/inventory.yml /srv/sync/conf.yml", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"nobody", "root"}, out, "owner of updated file is kept, new file is owned by root")
+
+		resp, err = ec.Sync(ctx)
+		require.NoError(t, err)
+		assert.False(t, resp.changed, "files are up-to-date")
+	})
 }
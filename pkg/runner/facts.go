@@ -0,0 +1,140 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-pkgz/syncs"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/executor"
+)
+
+// factsScript collects host facts in a single run. Each line of the output is key=value, /etc/os-release is printed as is.
+// It is posix sh compatible for linux and macOS, and has no single quotes as it is passed to sh -c '...'
+var factsScript = strings.Join([]string{
+	"echo os=$(uname -s)",
+	"echo arch=$(uname -m)",
+	"echo hostname=$(hostname 2>/dev/null || uname -n)",
+	"if [ -r /etc/os-release ]; then cat /etc/os-release; fi",
+	"if command -v sw_vers >/dev/null 2>&1; then echo ID=macos; echo VERSION_ID=$(sw_vers -productVersion); fi",
+	"echo cpus=$(nproc 2>/dev/null || getconf _NPROCESSORS_ONLN 2>/dev/null || sysctl -n hw.ncpu 2>/dev/null)",
+	"if [ -r /proc/meminfo ]; then grep MemTotal /proc/meminfo; else echo memsize=$(sysctl -n hw.memsize 2>/dev/null); fi",
+	"echo route=$(ip route get 1.1.1.1 2>/dev/null)",
+	"echo ips=$(hostname -I 2>/dev/null || ipconfig getifaddr en0 2>/dev/null)",
+}, "; ")
+
+// genHost is a target host in Gen output, with facts if gathered
+type genHost struct {
+	config.Destination
+	Facts map[string]string `json:",omitempty"`
+}
+
+// genFacts gathers facts of all the hosts for Gen output, connecting to the hosts in parallel
+func (p *Process) genFacts(ctx context.Context, hosts []genHost) error {
+	wg := syncs.NewErrSizedGroup(max(p.Concurrency, 1), syncs.Context(ctx), syncs.Preemptive)
+	for i := range hosts {
+		i := i
+		wg.Go(func() error {
+			h := hosts[i].Destination
+			hostAddr := fmt.Sprintf("%s:%d", h.Host, h.Port)
+			remote, err := p.Connector.Connect(ctx, hostAddr, h.Name, h.User, p.jumpHosts(h)...)
+			if err != nil {
+				return fmt.Errorf("can't connect to %s: %w", hostAddr, err)
+			}
+			defer remote.Close()
+			facts, err := p.hostFacts(ctx, remote, hostAddr)
+			if err != nil {
+				return fmt.Errorf("host %s: %w", hostAddr, err)
+			}
+			hosts[i].Facts = facts
+			return nil
+		})
+	}
+	return wg.Wait()
+}
+
+// hostFacts returns facts of the host, gathered once per run and cached by host address
+func (p *Process) hostFacts(ctx context.Context, ex executor.Interface, hostAddr string) (map[string]string, error) {
+	p.factsLock.Lock()
+	facts, ok := p.facts[hostAddr]
+	p.factsLock.Unlock()
+	if ok {
+		return facts, nil
+	}
+
+	out, err := ex.Run(ctx, fmt.Sprintf("sh -c '%s'", factsScript), nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't gather facts: %w", err)
+	}
+	facts = parseFacts(out)
+	log.Printf("[DEBUG] facts for %s: %v", hostAddr, facts)
+
+	p.factsLock.Lock()
+	if p.facts == nil {
+		p.facts = map[string]map[string]string{}
+	}
+	p.facts[hostAddr] = facts
+	p.factsLock.Unlock()
+	return facts, nil
+}
+
+// setFacts sets facts as environment variables of all commands and handlers of the task.
+// Variables already set for a command are not overridden.
+func (p *Process) setFacts(facts map[string]string, tsk *config.Task) {
+	p.updateVars(facts, config.Cmd{Name: "facts"}, tsk)
+}
+
+// parseFacts makes SPOT_FACT_* variables from the output of factsScript. All the facts are set,
+// the ones not detected are empty. OS is lowercase, i.e. linux or darwin, memory is in megabytes.
+func parseFacts(out []string) map[string]string {
+	raw := map[string]string{}
+	for _, line := range out {
+		if strings.HasPrefix(line, "MemTotal:") { // from /proc/meminfo, i.e. "MemTotal:  16318508 kB"
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				raw["memtotal"] = fields[1]
+			}
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		raw[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"'`)
+	}
+
+	memory := ""
+	if kb, err := strconv.ParseInt(raw["memtotal"], 10, 64); err == nil {
+		memory = strconv.FormatInt(kb/1024, 10)
+	} else if b, err := strconv.ParseInt(raw["memsize"], 10, 64); err == nil {
+		memory = strconv.FormatInt(b/1024/1024, 10)
+	}
+
+	// default ip is the source address of the default route, i.e. "1.1.1.1 via 10.0.0.1 dev eth0 src 10.0.0.5 uid 0",
+	// or the first address of the host if there is no route info
+	ip := ""
+	routeFields := strings.Fields(raw["route"])
+	for i := 0; i < len(routeFields)-1; i++ {
+		if routeFields[i] == "src" {
+			ip = routeFields[i+1]
+			break
+		}
+	}
+	if ips := strings.Fields(raw["ips"]); ip == "" && len(ips) > 0 {
+		ip = ips[0]
+	}
+
+	return map[string]string{
+		"SPOT_FACT_OS":       strings.ToLower(raw["os"]),
+		"SPOT_FACT_DISTRO":   raw["ID"],
+		"SPOT_FACT_VERSION":  raw["VERSION_ID"],
+		"SPOT_FACT_ARCH":     raw["arch"],
+		"SPOT_FACT_HOSTNAME": raw["hostname"],
+		"SPOT_FACT_CPUS":     raw["cpus"],
+		"SPOT_FACT_MEMORY":   memory,
+		"SPOT_FACT_IP":       ip,
+	}
+}
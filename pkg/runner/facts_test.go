@@ -0,0 +1,148 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/executor"
+	"github.com/umputun/spot/pkg/runner/mocks"
+)
+
+func Test_parseFacts(t *testing.T) {
+	tbl := []struct {
+		name     string
+		out      []string
+		expected map[string]string
+	}{
+		{
+			name: "linux",
+			out: []string{"os=Linux", "arch=x86_64", "hostname=web1", `PRETTY_NAME="Ubuntu 22.04.3 LTS"`, "NAME=\"Ubuntu\"",
+				`VERSION_ID="22.04"`, "ID=ubuntu", "ID_LIKE=debian", "cpus=4", "MemTotal:       16318508 kB",
+				"route=1.1.1.1 via 10.0.0.1 dev eth0 src 10.0.0.5 uid 1000", "ips=10.0.0.5 172.17.0.1"},
+			expected: map[string]string{"SPOT_FACT_OS": "linux", "SPOT_FACT_DISTRO": "ubuntu", "SPOT_FACT_VERSION": "22.04",
+				"SPOT_FACT_ARCH": "x86_64", "SPOT_FACT_HOSTNAME": "web1", "SPOT_FACT_CPUS": "4", "SPOT_FACT_MEMORY": "15936",
+				"SPOT_FACT_IP": "10.0.0.5"},
+		},
+		{
+			name: "macos",
+			out: []string{"os=Darwin", "arch=arm64", "hostname=mbp.local", "ID=macos", "VERSION_ID=14.2.1", "cpus=10",
+				"memsize=34359738368", "route=", "ips=192.168.1.20"},
+			expected: map[string]string{"SPOT_FACT_OS": "darwin", "SPOT_FACT_DISTRO": "macos", "SPOT_FACT_VERSION": "14.2.1",
+				"SPOT_FACT_ARCH": "arm64", "SPOT_FACT_HOSTNAME": "mbp.local", "SPOT_FACT_CPUS": "10", "SPOT_FACT_MEMORY": "32768",
+				"SPOT_FACT_IP": "192.168.1.20"},
+		},
+		{
+			name: "nothing detected",
+			out:  []string{"some garbage"},
+			expected: map[string]string{"SPOT_FACT_OS": "", "SPOT_FACT_DISTRO": "", "SPOT_FACT_VERSION": "", "SPOT_FACT_ARCH": "",
+				"SPOT_FACT_HOSTNAME": "", "SPOT_FACT_CPUS": "", "SPOT_FACT_MEMORY": "", "SPOT_FACT_IP": ""},
+		},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseFacts(tt.out))
+		})
+	}
+}
+
+func TestProcess_hostFacts(t *testing.T) {
+	ctx := context.Background()
+	p := Process{}
+	lcl := executor.NewLocal(executor.MakeLogs(false, false, nil))
+
+	facts, err := p.hostFacts(ctx, lcl, "localhost:22")
+	require.NoError(t, err)
+	assert.Len(t, facts, 8)
+	assert.NotEmpty(t, facts["SPOT_FACT_OS"])
+	assert.NotEmpty(t, facts["SPOT_FACT_ARCH"])
+	assert.NotEmpty(t, facts["SPOT_FACT_HOSTNAME"])
+	assert.NotEmpty(t, facts["SPOT_FACT_CPUS"])
+
+	cached, err := p.hostFacts(ctx, nil, "localhost:22") // no executor needed for cached facts
+	require.NoError(t, err)
+	assert.Equal(t, facts, cached)
+}
+
+func TestProcess_RunWithFacts(t *testing.T) {
+	ctx := context.Background()
+	conf, err := config.New("testdata/conf-facts.yml", nil, nil)
+	require.NoError(t, err)
+
+	// facts are cached already, so the connection is not used
+	connector := &mocks.ConnectorMock{
+		ConnectFunc: func(context.Context, string, string, string, ...executor.JumpHost) (*executor.Remote, error) {
+			return &executor.Remote{}, nil
+		},
+	}
+	stdout := captureStdOut(t, func() {
+		p := Process{Concurrency: 1, Playbook: conf, Connector: connector, Logs: executor.MakeLogs(true, true, nil),
+			facts: map[string]map[string]string{"localhost:22": {"SPOT_FACT_OS": "linux", "SPOT_FACT_ARCH": "arm64",
+				"SPOT_FACT_DISTRO": "debian", "SPOT_FACT_VERSION": "12", "SPOT_FACT_IP": "10.0.0.5"}}}
+		_, err := p.Run(ctx, "default", "localhost:22")
+		require.NoError(t, err)
+	})
+	t.Log(stdout)
+	assert.Contains(t, stdout, "os=linux arch=arm64 ip=10.0.0.5")
+	assert.Contains(t, stdout, `completed command "linux only" {echo: running on debian 12}`)
+	assert.Contains(t, stdout, `completed command "darwin only" {skip: darwin only}`)
+	assert.Len(t, connector.ConnectCalls(), 1, "connected to gather facts")
+
+	t.Run("dry run", func(t *testing.T) {
+		dryConnector := &mocks.ConnectorMock{}
+		p := Process{Concurrency: 1, Playbook: conf, Connector: dryConnector, Logs: executor.MakeLogs(false, true, nil), Dry: true}
+		_, err := p.Run(ctx, "default", "localhost:22")
+		require.NoError(t, err)
+		assert.Empty(t, dryConnector.ConnectCalls(), "facts not gathered in dry mode")
+	})
+}
+
+func TestProcess_GenWithFacts(t *testing.T) {
+	pbook := &mocks.PlaybookMock{
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Name: "h1", Host: "host1", Port: 22, User: "user1"}}, nil
+		},
+	}
+	connector := &mocks.ConnectorMock{
+		ConnectFunc: func(context.Context, string, string, string, ...executor.JumpHost) (*executor.Remote, error) {
+			return &executor.Remote{}, nil
+		},
+	}
+	p := Process{Playbook: pbook, Connector: connector, GatherFacts: true,
+		facts: map[string]map[string]string{"host1:22": {"SPOT_FACT_OS": "linux", "SPOT_FACT_ARCH": "x86_64"}}}
+
+	t.Run("json", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		require.NoError(t, p.Gen(context.Background(), []string{"test"}, nil, buf))
+		res := []struct {
+			Name  string
+			Facts map[string]string
+		}{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &res))
+		require.Len(t, res, 1)
+		assert.Equal(t, "h1", res[0].Name)
+		assert.Equal(t, map[string]string{"SPOT_FACT_OS": "linux", "SPOT_FACT_ARCH": "x86_64"}, res[0].Facts)
+	})
+
+	t.Run("template", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		tmpl := bytes.NewBufferString(`{{range .}}{{.Name}} {{.Facts.SPOT_FACT_OS}}/{{.Facts.SPOT_FACT_ARCH}}{{end}}`)
+		require.NoError(t, p.Gen(context.Background(), []string{"test"}, tmpl, buf))
+		assert.Equal(t, "h1 linux/x86_64", buf.String())
+	})
+
+	t.Run("connect error", func(t *testing.T) {
+		p := Process{Playbook: pbook, GatherFacts: true, Connector: &mocks.ConnectorMock{
+			ConnectFunc: func(context.Context, string, string, string, ...executor.JumpHost) (*executor.Remote, error) {
+				return nil, assert.AnError
+			}}}
+		err := p.Gen(context.Background(), []string{"test"}, nil, &bytes.Buffer{})
+		require.ErrorContains(t, err, "can't connect to host1:22")
+	})
+}
@@ -16,7 +16,7 @@ import (
 //
 //		// make and configure a mocked runner.Connector
 //		mockedConnector := &ConnectorMock{
-//			ConnectFunc: func(ctx context.Context, hostAddr string, hostName string, user string) (*executor.Remote, error) {
+//			ConnectFunc: func(ctx context.Context, hostAddr string, hostName string, user string, jumps ...executor.JumpHost) (*executor.Remote, error) {
 //				panic("mock out the Connect method")
 //			},
 //		}
@@ -27,7 +27,7 @@ import (
 //	}
 type ConnectorMock struct {
 	// ConnectFunc mocks the Connect method.
-	ConnectFunc func(ctx context.Context, hostAddr string, hostName string, user string) (*executor.Remote, error)
+	ConnectFunc func(ctx context.Context, hostAddr string, hostName string, user string, jumps ...executor.JumpHost) (*executor.Remote, error)
 
 	// calls tracks calls to the methods.
 	calls struct {
@@ -41,13 +41,15 @@ type ConnectorMock struct {
 			HostName string
 			// User is the user argument value.
 			User string
+			// Jumps is the jumps argument value.
+			Jumps []executor.JumpHost
 		}
 	}
 	lockConnect sync.RWMutex
 }
 
 // Connect calls ConnectFunc.
-func (mock *ConnectorMock) Connect(ctx context.Context, hostAddr string, hostName string, user string) (*executor.Remote, error) {
+func (mock *ConnectorMock) Connect(ctx context.Context, hostAddr string, hostName string, user string, jumps ...executor.JumpHost) (*executor.Remote, error) {
 	if mock.ConnectFunc == nil {
 		panic("ConnectorMock.ConnectFunc: method is nil but Connector.Connect was just called")
 	}
@@ -56,16 +58,18 @@ func (mock *ConnectorMock) Connect(ctx context.Context, hostAddr string, hostNam
 		HostAddr string
 		HostName string
 		User     string
+		Jumps    []executor.JumpHost
 	}{
 		Ctx:      ctx,
 		HostAddr: hostAddr,
 		HostName: hostName,
 		User:     user,
+		Jumps:    jumps,
 	}
 	mock.lockConnect.Lock()
 	mock.calls.Connect = append(mock.calls.Connect, callInfo)
 	mock.lockConnect.Unlock()
-	return mock.ConnectFunc(ctx, hostAddr, hostName, user)
+	return mock.ConnectFunc(ctx, hostAddr, hostName, user, jumps...)
 }
 
 // ConnectCalls gets all the calls that were made to Connect.
@@ -77,12 +81,14 @@ func (mock *ConnectorMock) ConnectCalls() []struct {
 	HostAddr string
 	HostName string
 	User     string
+	Jumps    []executor.JumpHost
 } {
 	var calls []struct {
 		Ctx      context.Context
 		HostAddr string
 		HostName string
 		User     string
+		Jumps    []executor.JumpHost
 	}
 	mock.lockConnect.RLock()
 	calls = mock.calls.Connect
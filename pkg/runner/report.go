@@ -0,0 +1,278 @@
+package runner
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/umputun/spot/pkg/executor"
+)
+
+// Status is a status of executed command, host or task in the report
+type Status string
+
+// enum of all statuses
+const (
+	StatusOk      Status = "ok"      // executed, no changes made
+	StatusChanged Status = "changed" // executed and made changes on the host
+	StatusSkipped Status = "skipped" // not executed, filtered out or condition not met
+	StatusFailed  Status = "failed"  // failed, including ignored failures of commands with ignore_errors
+)
+
+// Report collects results of all tasks executed by Process, for machine-readable output. Thread safe.
+// Secrets are masked in all the strings of the written report, the same way as in logs.
+type Report struct {
+	Tasks   []TaskReport `json:"tasks"`
+	Secrets []string     `json:"-"` // values to mask in the written report
+	lock    sync.Mutex
+}
+
+// TaskReport holds the results of a task executed for a target
+type TaskReport struct {
+	Name     string       `json:"name"`
+	Target   string       `json:"target"`
+	Status   Status       `json:"status"`
+	Duration float64      `json:"duration"` // in seconds
+	Error    string       `json:"error,omitempty"`
+	Hosts    []HostReport `json:"hosts"`
+}
+
+// HostReport holds the results of a task executed on a single host
+type HostReport struct {
+	Host     string            `json:"host"` // host address with port
+	Name     string            `json:"name,omitempty"`
+	Status   Status            `json:"status"`
+	Duration float64           `json:"duration"` // in seconds
+	Error    string            `json:"error,omitempty"`
+	Commands []CmdReport       `json:"commands"`
+	Vars     map[string]string `json:"vars,omitempty"` // all variables registered on the host
+}
+
+// CmdReport holds the result of a single command executed on a host
+type CmdReport struct {
+	Name     string            `json:"name"`
+	Status   Status            `json:"status"`
+	Duration float64           `json:"duration"` // in seconds
+	ExitCode int               `json:"exit_code"`
+	Stdout   string            `json:"stdout,omitempty"`
+	Stderr   string            `json:"stderr,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Ignored  bool              `json:"ignored,omitempty"` // failed, but the error ignored, i.e. with ignore_errors
+	Vars     map[string]string `json:"vars,omitempty"`    // variables registered by the command
+}
+
+// add adds task report, called by Process.Run for each task and target
+func (r *Report) add(tr TaskReport) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Tasks = append(r.Tasks, tr)
+}
+
+// WriteJSON writes the report as indented json
+func (r *Report) WriteJSON(w io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&Report{Tasks: r.masked()}); err != nil {
+		return fmt.Errorf("can't encode json report: %w", err)
+	}
+	return nil
+}
+
+// WriteJUnit writes the report in junit xml format. Each task and target pair is a test suite,
+// each command on each host is a test case with the host as the class name.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	type junitResult struct {
+		Message string `xml:"message,attr,omitempty"`
+		Body    string `xml:",chardata"`
+	}
+	type junitCase struct {
+		Name      string       `xml:"name,attr"`
+		ClassName string       `xml:"classname,attr"`
+		Time      string       `xml:"time,attr"`
+		Failure   *junitResult `xml:"failure,omitempty"`
+		Skipped   *junitResult `xml:"skipped,omitempty"`
+		SystemOut string       `xml:"system-out,omitempty"`
+		SystemErr string       `xml:"system-err,omitempty"`
+	}
+	type junitSuite struct {
+		Name     string      `xml:"name,attr"`
+		Tests    int         `xml:"tests,attr"`
+		Failures int         `xml:"failures,attr"`
+		Skipped  int         `xml:"skipped,attr"`
+		Time     string      `xml:"time,attr"`
+		Cases    []junitCase `xml:"testcase"`
+	}
+	type junitSuites struct {
+		XMLName  xml.Name     `xml:"testsuites"`
+		Name     string       `xml:"name,attr"`
+		Tests    int          `xml:"tests,attr"`
+		Failures int          `xml:"failures,attr"`
+		Skipped  int          `xml:"skipped,attr"`
+		Time     string       `xml:"time,attr"`
+		Suites   []junitSuite `xml:"testsuite"`
+	}
+
+	secs := func(d float64) string { return fmt.Sprintf("%.3f", d) }
+	res := junitSuites{Name: "spot"}
+	var total float64
+	for _, t := range r.masked() {
+		suite := junitSuite{Name: fmt.Sprintf("%s [%s]", t.Name, t.Target), Time: secs(t.Duration)}
+		for _, h := range t.Hosts {
+			className := h.Host
+			if h.Name != "" {
+				className = fmt.Sprintf("%s (%s)", h.Name, h.Host)
+			}
+			cmdFailed := false
+			for _, c := range h.Commands {
+				tc := junitCase{Name: c.Name, ClassName: className, Time: secs(c.Duration), SystemOut: c.Stdout, SystemErr: c.Stderr}
+				switch c.Status {
+				case StatusFailed:
+					tc.Failure = &junitResult{Message: c.Error, Body: c.Stderr}
+					suite.Failures++
+					cmdFailed = true
+				case StatusSkipped:
+					tc.Skipped = &junitResult{}
+					suite.Skipped++
+				}
+				suite.Cases = append(suite.Cases, tc)
+			}
+			if h.Error != "" && !cmdFailed {
+				// host failed not by a command, i.e. can't connect. report it as a failed case of the task itself
+				suite.Cases = append(suite.Cases, junitCase{Name: t.Name, ClassName: className, Time: secs(h.Duration),
+					Failure: &junitResult{Message: h.Error}})
+				suite.Failures++
+			}
+		}
+		suite.Tests = len(suite.Cases)
+		res.Tests += suite.Tests
+		res.Failures += suite.Failures
+		res.Skipped += suite.Skipped
+		total += t.Duration
+		res.Suites = append(res.Suites, suite)
+	}
+	res.Time = secs(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return fmt.Errorf("can't write junit report: %w", err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		return fmt.Errorf("can't encode junit report: %w", err)
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return fmt.Errorf("can't write junit report: %w", err)
+	}
+	return nil
+}
+
+// masked returns a copy of the task reports with secrets masked in all the strings, including captured output,
+// errors and registered variables. Caller must hold the lock.
+func (r *Report) masked() []TaskReport {
+	mask := func(s string) string { return executor.MaskSecrets(s, r.Secrets) }
+	maskVars := func(vv map[string]string) map[string]string {
+		if vv == nil {
+			return nil
+		}
+		res := make(map[string]string, len(vv))
+		for k, v := range vv {
+			res[k] = mask(v)
+		}
+		return res
+	}
+
+	// slices are copied with [:0:0] to keep nil ones nil, so the json output is the same as for the original report
+	res := append(r.Tasks[:0:0], r.Tasks...)
+	for i, t := range res {
+		t.Name, t.Target, t.Error = mask(t.Name), mask(t.Target), mask(t.Error)
+		t.Hosts = append(t.Hosts[:0:0], t.Hosts...)
+		for j, h := range t.Hosts {
+			h.Host, h.Name, h.Error, h.Vars = mask(h.Host), mask(h.Name), mask(h.Error), maskVars(h.Vars)
+			h.Commands = append(h.Commands[:0:0], h.Commands...)
+			for k, c := range h.Commands {
+				c.Name, c.Stdout, c.Stderr, c.Error = mask(c.Name), mask(c.Stdout), mask(c.Stderr), mask(c.Error)
+				c.Vars = maskVars(c.Vars)
+				h.Commands[k] = c
+			}
+			t.Hosts[j] = h
+		}
+		res[i] = t
+	}
+	return res
+}
+
+// cmdReport makes a report for the executed command from its response and error
+func (r execCmdResp) cmdReport(name string, duration time.Duration, err error) CmdReport {
+	res := CmdReport{Name: name, Status: StatusOk, Duration: duration.Seconds(), ExitCode: r.exitCode,
+		Stdout: r.stdout, Stderr: r.stderr}
+	if len(r.vars) > 0 {
+		res.Vars = r.vars
+	}
+	switch {
+	case err != nil:
+		res.Status, res.Error = StatusFailed, err.Error()
+	case r.skipped:
+		res.Status = StatusSkipped
+	case r.changed:
+		res.Status = StatusChanged
+	}
+	return res
+}
+
+// finish sets the final status, duration, error and vars of the host report
+func (r *HostReport) finish(duration time.Duration, vv map[string]string, err error) {
+	r.Duration = duration.Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if len(vv) > 0 {
+		r.Vars = vv
+	}
+	r.Status = r.hostStatus()
+}
+
+// hostStatus returns the status of the host based on the results of its commands
+func (r *HostReport) hostStatus() Status {
+	if r.Error != "" {
+		return StatusFailed
+	}
+	res := StatusSkipped
+	for _, c := range r.Commands {
+		switch c.Status {
+		case StatusChanged:
+			return StatusChanged
+		case StatusOk, StatusFailed: // failed here is an ignored failure, the host itself is fine
+			res = StatusOk
+		}
+	}
+	return res
+}
+
+// taskReport makes a report for the task executed for a target. The task failed if err is set, i.e. the run
+// returned an error or some hosts failed within max fail percentage.
+func taskReport(task, target string, duration time.Duration, hosts []HostReport, err error) TaskReport {
+	res := TaskReport{Name: task, Target: target, Status: StatusSkipped, Duration: duration.Seconds(), Hosts: hosts}
+	if err != nil {
+		res.Status, res.Error = StatusFailed, err.Error()
+		return res
+	}
+	for _, h := range hosts {
+		switch h.Status {
+		case StatusChanged:
+			res.Status = StatusChanged
+		case StatusOk, StatusFailed:
+			if res.Status == StatusSkipped {
+				res.Status = StatusOk
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport_WriteJSON(t *testing.T) {
+	rep := &Report{}
+	rep.add(TaskReport{Name: "deploy", Target: "prod", Status: StatusChanged, Duration: 1.5, Hosts: []HostReport{
+		{Host: "h1:22", Name: "h1", Status: StatusChanged, Duration: 1.2, Vars: map[string]string{"FOO": "bar"},
+			Commands: []CmdReport{
+				{Name: "cmd1", Status: StatusChanged, Duration: 0.5, Stdout: "out\n", Vars: map[string]string{"FOO": "bar"}},
+				{Name: "cmd2", Status: StatusSkipped},
+			}},
+	}})
+
+	var buf bytes.Buffer
+	require.NoError(t, rep.WriteJSON(&buf))
+	t.Log(buf.String())
+
+	var res Report
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &res))
+	assert.Equal(t, rep.Tasks, res.Tasks)
+	assert.Contains(t, buf.String(), `"exit_code": 0`)
+	assert.NotContains(t, buf.String(), `"stderr"`, "empty fields omitted")
+}
+
+func TestReport_WriteJUnit(t *testing.T) {
+	rep := &Report{}
+	rep.add(TaskReport{Name: "deploy", Target: "prod", Status: StatusFailed, Duration: 2, Hosts: []HostReport{
+		{Host: "h1:22", Name: "h1", Status: StatusFailed, Duration: 1.2, Error: "failed command cmd2", Commands: []CmdReport{
+			{Name: "cmd1", Status: StatusOk, Duration: 0.5, Stdout: "out"},
+			{Name: "cmd2", Status: StatusFailed, Duration: 0.25, ExitCode: 1, Stderr: "bad <thing>", Error: "exit status 1"},
+			{Name: "cmd3", Status: StatusSkipped},
+		}},
+		{Host: "h2:22", Status: StatusFailed, Duration: 0.1, Error: "can't connect"},
+	}})
+	rep.add(TaskReport{Name: "check", Target: "prod", Status: StatusOk, Duration: 1, Hosts: []HostReport{
+		{Host: "h1:22", Name: "h1", Status: StatusOk, Commands: []CmdReport{{Name: "cmd1", Status: StatusOk, Duration: 1}}},
+	}})
+
+	var buf bytes.Buffer
+	require.NoError(t, rep.WriteJUnit(&buf))
+	t.Log(buf.String())
+
+	exp := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="spot" tests="5" failures="2" skipped="1" time="3.000">
+  <testsuite name="deploy [prod]" tests="4" failures="2" skipped="1" time="2.000">
+    <testcase name="cmd1" classname="h1 (h1:22)" time="0.500">
+      <system-out>out</system-out>
+    </testcase>
+    <testcase name="cmd2" classname="h1 (h1:22)" time="0.250">
+      <failure message="exit status 1">bad &lt;thing&gt;</failure>
+      <system-err>bad &lt;thing&gt;</system-err>
+    </testcase>
+    <testcase name="cmd3" classname="h1 (h1:22)" time="0.000">
+      <skipped></skipped>
+    </testcase>
+    <testcase name="deploy" classname="h2:22" time="0.100">
+      <failure message="can&#39;t connect"></failure>
+    </testcase>
+  </testsuite>
+  <testsuite name="check [prod]" tests="1" failures="0" skipped="0" time="1.000">
+    <testcase name="cmd1" classname="h1 (h1:22)" time="1.000"></testcase>
+  </testsuite>
+</testsuites>
+`
+	assert.Equal(t, exp, buf.String())
+}
+
+func TestReport_secretsMasked(t *testing.T) {
+	rep := &Report{Secrets: []string{"s3cret", "passw0rd"}}
+	rep.add(TaskReport{Name: "deploy", Target: "prod", Status: StatusFailed, Error: "failed with s3cret", Hosts: []HostReport{
+		{Host: "h1:22", Name: "h1", Status: StatusFailed, Error: "s3cret failed", Vars: map[string]string{"TOKEN": "s3cret"},
+			Commands: []CmdReport{
+				{Name: "cmd1", Status: StatusOk, Stdout: "token s3cret\n", Vars: map[string]string{"TOKEN": "s3cret"}},
+				{Name: "cmd2", Status: StatusFailed, Stderr: "bad passw0rd", Error: "exit with passw0rd"},
+			}},
+	}})
+
+	var jsonBuf bytes.Buffer
+	require.NoError(t, rep.WriteJSON(&jsonBuf))
+	var res Report
+	require.NoError(t, json.Unmarshal(jsonBuf.Bytes(), &res))
+	require.Len(t, res.Tasks, 1)
+	assert.Equal(t, "failed with ****", res.Tasks[0].Error)
+	host := res.Tasks[0].Hosts[0]
+	assert.Equal(t, "**** failed", host.Error)
+	assert.Equal(t, map[string]string{"TOKEN": "****"}, host.Vars)
+	assert.Equal(t, "token ****\n", host.Commands[0].Stdout)
+	assert.Equal(t, map[string]string{"TOKEN": "****"}, host.Commands[0].Vars)
+	assert.Equal(t, "bad ****", host.Commands[1].Stderr)
+	assert.Equal(t, "exit with ****", host.Commands[1].Error)
+	assert.NotContains(t, jsonBuf.String(), "Secrets", "secrets not written")
+
+	var junitBuf bytes.Buffer
+	require.NoError(t, rep.WriteJUnit(&junitBuf))
+	t.Log(junitBuf.String())
+	assert.Contains(t, junitBuf.String(), "<system-out>token ****&#xA;</system-out>")
+	assert.Contains(t, junitBuf.String(), `<failure message="exit with ****">bad ****</failure>`)
+
+	for _, buf := range []bytes.Buffer{jsonBuf, junitBuf} {
+		assert.NotContains(t, buf.String(), "s3cret")
+		assert.NotContains(t, buf.String(), "passw0rd")
+	}
+	assert.Equal(t, "token s3cret\n", rep.Tasks[0].Hosts[0].Commands[0].Stdout, "collected report not changed")
+}
+
+func TestReport_statuses(t *testing.T) {
+	t.Run("command", func(t *testing.T) {
+		assert.Equal(t, StatusOk, execCmdResp{}.cmdReport("c", time.Second, nil).Status)
+		assert.Equal(t, StatusChanged, execCmdResp{changed: true}.cmdReport("c", time.Second, nil).Status)
+		assert.Equal(t, StatusSkipped, execCmdResp{skipped: true}.cmdReport("c", time.Second, nil).Status)
+		r := execCmdResp{changed: true, exitCode: 2, stderr: "err"}.cmdReport("c", time.Second, errors.New("failed"))
+		assert.Equal(t, CmdReport{Name: "c", Status: StatusFailed, Duration: 1, ExitCode: 2, Stderr: "err", Error: "failed"}, r)
+	})
+
+	t.Run("host", func(t *testing.T) {
+		tbl := []struct {
+			cmds     []Status
+			err      error
+			expected Status
+		}{
+			{nil, nil, StatusSkipped},
+			{[]Status{StatusSkipped}, nil, StatusSkipped},
+			{[]Status{StatusSkipped, StatusOk}, nil, StatusOk},
+			{[]Status{StatusFailed, StatusOk}, nil, StatusOk},
+			{[]Status{StatusOk, StatusChanged, StatusSkipped}, nil, StatusChanged},
+			{[]Status{StatusOk, StatusFailed}, errors.New("failed"), StatusFailed},
+		}
+		for _, tt := range tbl {
+			hr := HostReport{}
+			for _, s := range tt.cmds {
+				hr.Commands = append(hr.Commands, CmdReport{Status: s})
+			}
+			hr.finish(time.Second, nil, tt.err)
+			assert.Equal(t, tt.expected, hr.Status, "%v", tt.cmds)
+		}
+	})
+
+	t.Run("task", func(t *testing.T) {
+		hosts := []HostReport{{Status: StatusOk}, {Status: StatusFailed}}
+		assert.Equal(t, StatusOk, taskReport("t", "tg", time.Second, hosts, nil).Status, "failed host tolerated")
+		hosts = append(hosts, HostReport{Status: StatusChanged})
+		assert.Equal(t, StatusChanged, taskReport("t", "tg", time.Second, hosts, nil).Status)
+		assert.Equal(t, StatusSkipped, taskReport("t", "tg", time.Second, []HostReport{{Status: StatusSkipped}}, nil).Status)
+		tr := taskReport("t", "tg", time.Second, hosts, errors.New("failed"))
+		assert.Equal(t, StatusFailed, tr.Status)
+		assert.Equal(t, "failed", tr.Error)
+	})
+}
@@ -13,9 +13,11 @@ import (
 	"sync/atomic"
 	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/go-pkgz/stringutils"
 	"github.com/go-pkgz/syncs"
+	"github.com/hashicorp/go-multierror"
 
 	"github.com/umputun/spot/pkg/config"
 	"github.com/umputun/spot/pkg/config/deepcopy"
@@ -36,13 +38,34 @@ type Process struct {
 	Dry         bool
 	SSHShell    string
 
+	Serial            string // hosts per batch, number or percentage, overrides task's serial if set
+	MaxFailPercentage int    // max percentage of failed hosts, overrides task's max_fail_percentage if set
+
+	Report *Report // optional, collects results of all executed tasks if set
+
+	KeepGoing bool // keep running on healthy hosts if some hosts failed, failed hosts are skipped by the next tasks
+
+	BecomePassword string // password for sudo, su or doas, used by commands without become_password_secret
+
+	GatherFacts bool // gather host facts for all tasks, in addition to tasks with gather_facts set
+
+	facts     map[string]map[string]string // gathered facts, by host address
+	factsLock sync.Mutex
+
+	failedHosts     map[string]bool // hosts failed in keep-going mode, by host address
+	failedHostsLock sync.Mutex
+
+	registered     map[string]vars // vars registered by the completed tasks, by host address
+	registeredAll  vars            // vars registered by the completed tasks on all hosts, with the host prefix
+	registeredLock sync.Mutex
+
 	Skip []string
 	Only []string
 }
 
 // Connector is an interface for connecting to a host, and returning remote executer.
 type Connector interface {
-	Connect(ctx context.Context, hostAddr, hostName, user string) (*executor.Remote, error)
+	Connect(ctx context.Context, hostAddr, hostName, user string, jumps ...executor.JumpHost) (*executor.Remote, error)
 }
 
 // Playbook is an interface for getting task and target information from playbook.
@@ -56,16 +79,31 @@ type Playbook interface {
 
 // ProcResp holds the information about processed commands and hosts.
 type ProcResp struct {
-	Vars     map[string]string
-	Commands int
-	Hosts    int
+	Vars        map[string]string
+	Commands    int
+	Hosts       int
+	Batches     []BatchResp  // batches of hosts processed, in order
+	HostReports []HostReport // results of the task on each processed host, in the order of target hosts
+}
+
+// BatchResp holds the information about hosts processed in a single batch.
+type BatchResp struct {
+	Hosts  []config.Destination // all hosts of the batch
+	Failed []config.Destination // hosts failed in the batch
+
+	errs []error // errors of failed hosts, in the order of hosts
 }
 
 type vars map[string]string
 
-// Run runs a task for a set of target hosts. Runs in parallel with limited concurrency,
-// each host is processed in separate goroutine. Returns ProcResp with the information about processed commands and hosts
-// plus vars from all thr commands.
+// Run runs a task for a set of target hosts. Hosts split into batches by serial setting, each batch completed before
+// the next one started. Inside a batch hosts run in parallel with limited concurrency, each host is processed
+// in separate goroutine. The run stopped after a batch if the percentage of failed hosts exceeds max fail percentage,
+// hosts failed within max fail percentage are skipped by the next tasks.
+// In keep-going mode (set by Process or by the task), failed hosts don't stop the run, unless max fail percentage set
+// and exceeded. Errors of all failed hosts are collected into multierror and on-error command called for each of them.
+// Returns ProcResp with the information about processed commands, hosts and batches plus vars from all the commands
+// and per-host results. ProcResp is returned on task failure as well, with the results of the processed hosts.
 func (p *Process) Run(ctx context.Context, task, target string) (s ProcResp, err error) {
 	tsk, err := p.Playbook.Task(task)
 	if err != nil {
@@ -73,29 +111,142 @@ func (p *Process) Run(ctx context.Context, task, target string) (s ProcResp, err
 	}
 	log.Printf("[DEBUG] task %q has %d commands", task, len(tsk.Commands))
 
-	allVars := make(map[string]string)
 	targetHosts, err := p.Playbook.TargetHosts(target)
 	if err != nil {
 		return ProcResp{}, fmt.Errorf("can't get target %s: %w", target, err)
 	}
 	log.Printf("[DEBUG] target hosts (%d) %+v", len(targetHosts), targetHosts)
 
+	keepGoing := p.KeepGoing || tsk.KeepGoing
+	// skip hosts failed by the previous tasks, hosts are marked as failed only by the tasks continued after the failure,
+	// i.e. running in keep-going mode or with the failures within max fail percentage
+	if targetHosts = p.healthyHosts(targetHosts); len(targetHosts) == 0 {
+		log.Printf("[WARN] skip task %q for target %q, all hosts failed", task, target)
+		return ProcResp{Vars: map[string]string{}}, nil
+	}
+
+	serial, maxFail := tsk.Serial, tsk.MaxFailPercentage
+	if p.Serial != "" {
+		serial = p.Serial
+	}
+	if p.MaxFailPercentage > 0 {
+		maxFail = p.MaxFailPercentage
+	}
+	batchSize, err := config.BatchSize(serial, len(targetHosts))
+	if err != nil {
+		return ProcResp{}, fmt.Errorf("can't make batches for task %s: %w", task, err)
+	}
+
+	stTask := time.Now()
+	res := ProcResp{Vars: make(map[string]string)}
 	var commands int32
-	lock := sync.Mutex{}
+	failed := 0
+	hostReports := []HostReport{}
+	hostErrs := new(multierror.Error)
+	for i := 0; i < len(targetHosts); i += batchSize {
+		batch := targetHosts[i:min(i+batchSize, len(targetHosts))]
+		if batchSize < len(targetHosts) {
+			log.Printf("[INFO] run task %q, batch %d of %d, hosts: %d", task, i/batchSize+1,
+				(len(targetHosts)+batchSize-1)/batchSize, len(batch))
+		}
+		br, reports, e := p.runBatch(ctx, tsk, batch, i == 0, &commands, res.Vars)
+		hostReports = append(hostReports, reports...)
+		res.Batches = append(res.Batches, br)
+		res.Hosts += len(br.Hosts)
+		failed += len(br.Failed)
+		if e == nil {
+			continue
+		}
+		hostErrs = multierror.Append(hostErrs, br.errs...)
+		if keepGoing {
+			p.addFailedHosts(br.Failed)
+		}
+		if ctx.Err() != nil {
+			err = e // canceled, don't run the next batches regardless of max fail percentage
+			break
+		}
+		if keepGoing && maxFail == 0 {
+			log.Printf("[WARN] task %q failed on %d of %d hosts, keep going", task, failed, res.Hosts)
+			continue
+		}
+		if failed*100 <= maxFail*res.Hosts {
+			// tolerated failures don't fail the task, but the failed hosts are skipped by the next tasks, as in ansible
+			p.addFailedHosts(br.Failed)
+			log.Printf("[WARN] task %q failed on %d of %d hosts, within max fail percentage %d%%", task, failed, res.Hosts, maxFail)
+			continue
+		}
+		err = e
+		if keepGoing {
+			err = hostErrs
+		}
+		if maxFail > 0 {
+			err = fmt.Errorf("failed %d of %d hosts, max fail percentage %d%% exceeded: %w", failed, res.Hosts, maxFail, err)
+		}
+		if res.Hosts < len(targetHosts) {
+			log.Printf("[WARN] task %q stopped after batch %d, %d hosts not processed", task, len(res.Batches),
+				len(targetHosts)-res.Hosts)
+		}
+		break
+	}
+	if keepGoing && err == nil {
+		err = hostErrs.ErrorOrNil() // in keep-going mode the task failed if any host failed
+	}
+
+	// execute on-error command if any error occurred during task execution and on-error command is defined.
+	// in keep-going mode it is executed for each failed host
+	if err != nil && tsk.OnError != "" {
+		if keepGoing && ctx.Err() == nil {
+			for _, e := range hostErrs.Errors {
+				p.onError(ctx, e)
+			}
+		} else {
+			p.onError(ctx, err)
+		}
+	}
 
+	if p.Report != nil {
+		repErr := err
+		if repErr == nil && failed > 0 {
+			// failures tolerated by max fail percentage don't fail the run, but the task is reported as failed
+			repErr = fmt.Errorf("failed %d of %d hosts, within max fail percentage %d%%: %w", failed, res.Hosts, maxFail, hostErrs)
+		}
+		p.Report.add(taskReport(task, target, time.Since(stTask), hostReports, repErr))
+	}
+
+	p.registerVars(hostReports)
+
+	res.HostReports = hostReports
+	res.Commands = int(atomic.LoadInt32(&commands))
+	return res, err
+}
+
+// runBatch runs a task for a batch of hosts in parallel with limited concurrency and waits for all of them to complete.
+// Vars from all the hosts collected into allVars. The number of commands counted for the first host of the first batch.
+// Returns reports for all the hosts of the batch, in the same order as hosts.
+func (p *Process) runBatch(ctx context.Context, tsk *config.Task, hosts []config.Destination, first bool,
+	commands *int32, allVars map[string]string) (BatchResp, []HostReport, error) {
+
+	res := BatchResp{Hosts: hosts}
+	reports := make([]HostReport, len(hosts))
+	hostErrs := make([]error, len(hosts))
+	lock := sync.Mutex{}
 	wg := syncs.NewErrSizedGroup(p.Concurrency, syncs.Context(ctx), syncs.Preemptive)
-	for i, host := range targetHosts {
+	for i, host := range hosts {
 		i, host := i, host
 		wg.Go(func() error {
-			count, vv, e := p.runTaskOnHost(ctx, tsk, fmt.Sprintf("%s:%d", host.Host, host.Port), host.Name, host.User)
-			if i == 0 {
-				atomic.AddInt32(&commands, int32(count))
+			st := time.Now()
+			count, vv, e := p.runTaskOnHost(ctx, tsk, host, &reports[i])
+			reports[i].finish(time.Since(st), vv, e)
+			if i == 0 && first {
+				atomic.AddInt32(commands, int32(count))
 			}
 
 			lock.Lock()
 			if e != nil {
 				errLog := p.Logs.WithHost(host.Host, host.Name).Err
 				errLog.Write([]byte(e.Error())) // nolint
+				res.Failed = append(res.Failed, host)
+				hostErrs[i] = e
 			}
 			for k, v := range vv {
 				allVars[k] = v
@@ -105,18 +256,45 @@ func (p *Process) Run(ctx context.Context, task, target string) (s ProcResp, err
 			return e
 		})
 	}
-	err = wg.Wait()
+	err := wg.Wait()
+	for _, e := range hostErrs {
+		if e != nil {
+			res.errs = append(res.errs, e)
+		}
+	}
+	return res, reports, err
+}
 
-	// execute on-error command if any error occurred during task execution and on-error command is defined
-	if err != nil && tsk.OnError != "" {
-		p.onError(ctx, err)
+// healthyHosts returns hosts not failed by the previous tasks in keep-going mode or within max fail percentage
+func (p *Process) healthyHosts(hosts []config.Destination) []config.Destination {
+	p.failedHostsLock.Lock()
+	defer p.failedHostsLock.Unlock()
+	res := make([]config.Destination, 0, len(hosts))
+	for _, h := range hosts {
+		addr := fmt.Sprintf("%s:%d", h.Host, h.Port)
+		if p.failedHosts[addr] {
+			log.Printf("[INFO] skip host %s, failed by the previous task", addr)
+			continue
+		}
+		res = append(res, h)
 	}
+	return res
+}
 
-	return ProcResp{Hosts: len(targetHosts), Commands: int(atomic.LoadInt32(&commands)), Vars: allVars}, err
+// addFailedHosts marks hosts failed in keep-going mode or within max fail percentage, to skip them by the next tasks
+func (p *Process) addFailedHosts(hosts []config.Destination) {
+	p.failedHostsLock.Lock()
+	defer p.failedHostsLock.Unlock()
+	if p.failedHosts == nil {
+		p.failedHosts = make(map[string]bool)
+	}
+	for _, h := range hosts {
+		p.failedHosts[fmt.Sprintf("%s:%d", h.Host, h.Port)] = true
+	}
 }
 
 // Gen generates the list target hosts for a given target, applying templates.
-func (p *Process) Gen(targets []string, tmplRdr io.Reader, respWr io.Writer) error {
+func (p *Process) Gen(ctx context.Context, targets []string, tmplRdr io.Reader, respWr io.Writer) error {
 
 	targetHosts := []config.Destination{}
 	for _, target := range targets {
@@ -128,9 +306,19 @@ func (p *Process) Gen(targets []string, tmplRdr io.Reader, respWr io.Writer) err
 	}
 	log.Printf("[DEBUG] target hosts (%d) %+v", len(targetHosts), targetHosts)
 
+	hosts := make([]genHost, len(targetHosts))
+	for i, h := range targetHosts {
+		hosts[i] = genHost{Destination: h}
+	}
+	if p.GatherFacts {
+		if err := p.genFacts(ctx, hosts); err != nil {
+			return fmt.Errorf("can't gather facts: %w", err)
+		}
+	}
+
 	// if no reader provided, just encode target hosts as json
 	if tmplRdr == nil {
-		return json.NewEncoder(respWr).Encode(targetHosts)
+		return json.NewEncoder(respWr).Encode(hosts)
 	}
 
 	templateBytes, err := io.ReadAll(tmplRdr)
@@ -142,28 +330,32 @@ func (p *Process) Gen(targets []string, tmplRdr io.Reader, respWr io.Writer) err
 	if err != nil {
 		return fmt.Errorf("can't parse template: %w", err)
 	}
-	if err = tmpl.Execute(respWr, targetHosts); err != nil {
+	if err = tmpl.Execute(respWr, hosts); err != nil {
 		return fmt.Errorf("can't execute template: %w", err)
 	}
 
 	return nil
 }
 
-// runTaskOnHost executes all commands of a task on a target host. hostAddr can be a remote host or localhost with port.
+// runTaskOnHost executes all commands of a task on a target host. host can be a remote host or localhost with port.
 // returns number of executed commands, vars from all commands and error if any.
-func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr, hostName, user string) (int, vars, error) {
+func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, host config.Destination, rep *HostReport) (int, vars, error) {
 	report := func(hostAddr, hostName, f string, vals ...any) {
 		p.Logs.WithHost(hostAddr, hostName).Info.Printf(f, vals...)
 	}
 	since := func(st time.Time) time.Duration { return time.Since(st).Truncate(time.Millisecond) }
 
 	stTask := time.Now()
+	hostAddr, hostName := fmt.Sprintf("%s:%d", host.Host, host.Port), host.Name
+	rep.Host, rep.Name = hostAddr, hostName
+
+	gatherFacts := (p.GatherFacts || tsk.GatherFacts) && !p.Dry // facts are not gathered in dry mode
 
 	var remote executor.Interface
-	if p.anyRemoteCommand(tsk) {
-		// make remote executor only if there is a remote command in the taks
+	if p.anyRemoteCommand(tsk) || gatherFacts {
+		// make remote executor only if there is a remote command in the taks or facts should be gathered
 		var err error
-		remote, err = p.Connector.Connect(ctx, hostAddr, hostName, user)
+		remote, err = p.Connector.Connect(ctx, hostAddr, hostName, host.User, p.jumpHosts(host)...)
 		if err != nil {
 			if hostName != "" {
 				return 0, nil, fmt.Errorf("can't connect to %s: %w", hostName, err)
@@ -182,71 +374,146 @@ func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr,
 	// copy task to prevent one task on hostA modifying task on hostB as it does updateVars
 	activeTask := deepcopy.Copy(*tsk).(config.Task)
 
+	// task's timeout limits all the commands and handlers of the task on the host, on-exit commands are not limited
+	tskCtx := ctx
+	if tsk.Timeout > 0 {
+		var cancel context.CancelFunc
+		tskCtx, cancel = context.WithTimeout(ctx, tsk.Timeout)
+		defer cancel()
+	}
+	tskError := func(err error) error {
+		if tskCtx.Err() != nil && ctx.Err() == nil { // stopped by the task's timeout, not by the caller
+			return fmt.Errorf("task %q timeout %v exceeded: %w", tsk.Name, tsk.Timeout, err)
+		}
+		return err
+	}
+
+	if gatherFacts {
+		facts, err := p.hostFacts(tskCtx, remote, hostAddr)
+		if err != nil {
+			rep.Commands = append(rep.Commands, CmdReport{Name: "gather facts", Status: StatusFailed, Error: err.Error()})
+			return 0, nil, tskError(fmt.Errorf("failed to gather facts on host %s (%s): %w", hostAddr, hostName, err))
+		}
+		p.setFacts(facts, &activeTask)
+	}
+
 	onExitCmds := []execCmd{}
 	defer func() {
 		// run on-exit commands if any. it is executed after all commands of the task are done or on error
 		if len(onExitCmds) > 0 {
 			log.Printf("[INFO] run %d on-exit commands for %q on %s", len(onExitCmds), tsk.Name, hostAddr)
 			for _, ec := range onExitCmds {
-				if _, err := ec.Script(ctx); err != nil {
+				stCmd := time.Now()
+				resp, err := ec.Script(ctx)
+				cmdRep := resp.cmdReport(ec.cmd.Name, time.Since(stCmd), err)
+				cmdRep.Ignored = err != nil // failed on-exit command doesn't fail the task
+				rep.Commands = append(rep.Commands, cmdRep)
+				if err != nil {
 					report(ec.hostAddr, ec.hostName, "failed on-exit command %q (%v)", ec.cmd.Name, err)
 				}
 			}
 		}
 	}()
 
-	for _, cmd := range activeTask.Commands {
-		if !p.shouldRunCmd(cmd, hostName, hostAddr) {
-			continue
+	notified := map[string]bool{} // handlers notified by commands made changes on this host
+	inherited := p.inheritedVars(hostAddr)
+
+	// runCmd executes a single command with all its loop iterations
+	runCmd := func(c config.Cmd) error {
+		c = inheritVars(c, inherited)
+		// command with loop runs for each item, command without loop is a single iteration
+		iterations, iterErr := p.cmdIterations(c, hostAddr, hostName, &activeTask)
+		if iterErr != nil {
+			rep.Commands = append(rep.Commands, CmdReport{Name: c.Name, Status: StatusFailed, Error: iterErr.Error()})
+			return fmt.Errorf("failed command %q on host %s (%s): %w", c.Name, hostAddr, hostName, iterErr)
+		}
+		if len(iterations) == 0 {
+			rep.Commands = append(rep.Commands, CmdReport{Name: c.Name, Status: StatusSkipped})
+			report(hostAddr, hostName, "skip command %q, no loop items", c.Name)
+			return nil
 		}
 
-		log.Printf("[INFO] %s", p.infoMessage(cmd, hostAddr, hostName))
-		stCmd := time.Now()
+		for _, it := range iterations {
+			cmd, cmdName := it.cmd, it.name()
+			log.Printf("[INFO] %s", p.infoMessage(cmd, hostAddr, hostName))
+			stCmd := time.Now()
 
-		ec := execCmd{cmd: cmd, hostAddr: hostAddr, hostName: hostName, tsk: &activeTask, exec: remote,
-			verbose: p.Verbose, sshShell: p.SSHShell, onExit: cmd.OnExit}
-		ec = p.pickCmdExecutor(cmd, ec, hostAddr, hostName) // pick executor on dry run or local command
+			ec := execCmd{cmd: cmd, hostAddr: hostAddr, hostName: hostName, hostTags: host.Tags, item: it.item, tsk: &activeTask,
+				exec: remote, verbose: p.Verbose, sshShell: p.SSHShell, onExit: cmd.OnExit, sudoPass: p.BecomePassword}
+			ec = p.pickCmdExecutor(cmd, ec, hostAddr, hostName) // pick executor on dry run or local command
 
-		repHostAddr, repHostName := ec.hostAddr, ec.hostName
-		if cmd.Options.Local {
-			repHostAddr = "localhost"
-			repHostName = ""
-		}
+			repHostAddr, repHostName := ec.hostAddr, ec.hostName
+			if cmd.Options.Local {
+				repHostAddr = "localhost"
+				repHostName = ""
+			}
 
-		if ec.verbose {
-			report(repHostAddr, repHostName, "run command %q", cmd.Name)
-		}
+			if ec.verbose {
+				report(repHostAddr, repHostName, "run command %q", cmdName)
+			}
 
-		exResp, err := p.execCommand(ctx, ec)
-		if exResp.onExit.cmd.Name != "" { // we have on-exit command, save it for later execution
-			// this is intentionally before error check, we want to run on-exit command even if the main command failed
-			onExitCmds = append(onExitCmds, exResp.onExit)
-		}
-		if err != nil {
-			if !cmd.Options.IgnoreErrors {
-				return count, nil, fmt.Errorf("failed command %q on host %s (%s): %w", cmd.Name, ec.hostAddr, ec.hostName, err)
+			exResp, err := p.execCommand(tskCtx, ec)
+			cmdRep := exResp.cmdReport(cmdName, time.Since(stCmd), err)
+			cmdRep.Ignored = err != nil && cmd.Options.IgnoreErrors
+			rep.Commands = append(rep.Commands, cmdRep)
+			if exResp.onExit.cmd.Name != "" { // we have on-exit command, save it for later execution
+				// this is intentionally before error check, we want to run on-exit command even if the main command failed
+				onExitCmds = append(onExitCmds, exResp.onExit)
 			}
-			report(ec.hostAddr, ec.hostName, "failed command %q%s (%v)", cmd.Name, exResp.details, since(stCmd))
-			continue
-		}
+			if err != nil {
+				if !cmd.Options.IgnoreErrors {
+					return fmt.Errorf("failed command %q on host %s (%s): %w", cmdName, ec.hostAddr, ec.hostName, err)
+				}
+				report(ec.hostAddr, ec.hostName, "failed command %q%s (%v)", cmdName, exResp.details, since(stCmd))
+				continue
+			}
+
+			p.updateVars(exResp.vars, cmd, &activeTask) // set variables from command output to all commands env in task
 
-		p.updateVars(exResp.vars, cmd, &activeTask) // set variables from command output to all commands env in task
+			if exResp.verbose != "" && ec.verbose {
+				report(repHostAddr, repHostName, exResp.verbose)
+			}
 
-		if exResp.verbose != "" && ec.verbose {
-			report(repHostAddr, repHostName, exResp.verbose)
+			// we don't want to print multiline script name in logs
+			// from: completed command "test" {script: /bin/sh -c /tmp/.spot-7113416067113199616/spot-script2358478823} (17ms)
+			// we make: completed command "test" {script: /bin/sh -c [multiline script]} (17ms)
+			pattern := `(\{script: .+ -c ).+/spot-script.+}`
+			re := regexp.MustCompile(pattern)
+			details := re.ReplaceAllString(exResp.details, "${1}[multiline script]}")
+			if exResp.changed {
+				details += " [changed]"
+				for _, h := range cmd.Notify {
+					notified[h] = true
+				}
+			}
+			report(repHostAddr, repHostName, "completed command %q%s (%v)", cmdName, details, since(stCmd))
+
+			count++
+			for k, v := range exResp.vars {
+				tskVars[k] = v
+			}
 		}
+		return nil
+	}
 
-		// we don't want to print multiline script name in logs
-		// from: completed command "test" {script: /bin/sh -c /tmp/.spot-7113416067113199616/spot-script2358478823} (17ms)
-		// we make: completed command "test" {script: /bin/sh -c [multiline script]} (17ms)
-		pattern := `(\{script: .+ -c ).+/spot-script.+}`
-		re := regexp.MustCompile(pattern)
-		details := re.ReplaceAllString(exResp.details, "${1}[multiline script]}")
-		report(repHostAddr, repHostName, "completed command %q%s (%v)", cmd.Name, details, since(stCmd))
+	for _, c := range activeTask.Commands {
+		if !p.shouldRunCmd(c, hostName, hostAddr) {
+			rep.Commands = append(rep.Commands, CmdReport{Name: c.Name, Status: StatusSkipped})
+			continue
+		}
+		if err := runCmd(c); err != nil {
+			return count, nil, tskError(err)
+		}
+	}
 
-		count++
-		for k, v := range exResp.vars {
-			tskVars[k] = v
+	// run notified handlers once, in the order of definition, after all commands of the task completed
+	for _, h := range activeTask.Handlers {
+		if !notified[h.Name] || !p.isOnlyOnHost(h, hostName, hostAddr) {
+			rep.Commands = append(rep.Commands, CmdReport{Name: h.Name, Status: StatusSkipped})
+			continue
+		}
+		if err := runCmd(h); err != nil {
+			return count, nil, tskError(err)
 		}
 	}
 
@@ -259,9 +526,8 @@ func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr,
 	return count, tskVars, nil
 }
 
-// execCommand executes a single command on a target host.
-// It detects the command type based on the fields what are set.
-// Even if multiple fields for multiple commands are set, only one will be executed.
+// execCommand executes a single command on a target host, retrying it on failure if retry option is set.
+// The delay between attempts starts with retry delay and multiplied by backoff, if set, after each attempt.
 func (p *Process) execCommand(ctx context.Context, ec execCmd) (resp execCmdResp, err error) {
 
 	if ec.cmd.OnExit != "" {
@@ -277,6 +543,49 @@ func (p *Process) execCommand(ctx context.Context, ec execCmd) (resp execCmdResp
 		}()
 	}
 
+	retry := ec.cmd.Options.Retry
+	delay := retry.Delay
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			p.Logs.WithHost(ec.hostAddr, ec.hostName).Info.Printf("retry command %q, attempt %d of %d", ec.cmd.Name,
+				attempt, retry.Attempts)
+		}
+		resp, err = p.execCommandTimeout(ctx, ec)
+		if err == nil || attempt >= retry.Attempts {
+			return resp, err
+		}
+
+		p.Logs.WithHost(ec.hostAddr, ec.hostName).Info.Printf("failed command %q, attempt %d of %d (%v), retry in %v",
+			ec.cmd.Name, attempt, retry.Attempts, err, delay)
+		select {
+		case <-ctx.Done():
+			return resp, err // keep the command's error, canceled context is reported by the caller
+		case <-time.After(delay):
+		}
+		if retry.Backoff > 1 {
+			delay = time.Duration(float64(delay) * retry.Backoff)
+		}
+	}
+}
+
+// execCommandTimeout executes a single attempt of the command, stopped if it runs longer than the command's timeout.
+func (p *Process) execCommandTimeout(ctx context.Context, ec execCmd) (execCmdResp, error) {
+	if ec.cmd.Options.Timeout <= 0 {
+		return p.execCommandType(ctx, ec)
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, ec.cmd.Options.Timeout)
+	defer cancel()
+	resp, err := p.execCommandType(cmdCtx, ec)
+	if err != nil && cmdCtx.Err() != nil && ctx.Err() == nil { // stopped by the command's timeout, not by the caller
+		return resp, ec.errorFmt("command timeout %v exceeded: %w", ec.cmd.Options.Timeout, err)
+	}
+	return resp, err
+}
+
+// execCommandType executes a single command on a target host, a single attempt.
+// It detects the command type based on the fields what are set.
+// Even if multiple fields for multiple commands are set, only one will be executed.
+func (p *Process) execCommandType(ctx context.Context, ec execCmd) (resp execCmdResp, err error) {
 	switch {
 	case ec.cmd.Script != "":
 		log.Printf("[DEBUG] execute script %q on %s", ec.cmd.Name, ec.hostAddr)
@@ -299,6 +608,18 @@ func (p *Process) execCommand(ctx context.Context, ec execCmd) (resp execCmdResp
 	case len(ec.cmd.MDelete) > 0:
 		log.Printf("[DEBUG] delete multiple files on %s", ec.hostAddr)
 		return ec.MDelete(ctx)
+	case ec.cmd.Download.Source != "" && ec.cmd.Download.Dest != "":
+		log.Printf("[DEBUG] download files from %s", ec.hostAddr)
+		return ec.Download(ctx)
+	case len(ec.cmd.MDownload) > 0:
+		log.Printf("[DEBUG] download multiple files from %s", ec.hostAddr)
+		return ec.MDownload(ctx)
+	case ec.cmd.Template.Source != "" && ec.cmd.Template.Dest != "":
+		log.Printf("[DEBUG] upload template to %s", ec.hostAddr)
+		return ec.Template(ctx)
+	case len(ec.cmd.MTemplate) > 0:
+		log.Printf("[DEBUG] upload multiple templates to %s", ec.hostAddr)
+		return ec.MTemplate(ctx)
 	case ec.cmd.Wait.Command != "":
 		log.Printf("[DEBUG] wait for command on %s", ec.hostAddr)
 		return ec.Wait(ctx)
@@ -384,12 +705,33 @@ func (p *Process) onError(ctx context.Context, err error) {
 	}
 }
 
+// jumpHosts converts destination's jump hosts to executor's jump hosts.
+func (p *Process) jumpHosts(host config.Destination) []executor.JumpHost {
+	if len(host.ProxyJump) == 0 {
+		return nil
+	}
+	res := make([]executor.JumpHost, 0, len(host.ProxyJump))
+	for _, jh := range host.ProxyJump {
+		addr := jh.Host
+		if jh.Port != 0 {
+			addr = fmt.Sprintf("%s:%d", jh.Host, jh.Port)
+		}
+		res = append(res, executor.JumpHost{Addr: addr, Name: jh.Name, User: jh.User, Key: jh.SSHKey})
+	}
+	return res
+}
+
 func (p *Process) anyRemoteCommand(tsk *config.Task) bool {
 	for _, cmd := range tsk.Commands {
 		if !cmd.Options.Local {
 			return true
 		}
 	}
+	for _, h := range tsk.Handlers {
+		if !h.Options.Local {
+			return true
+		}
+	}
 	return false
 }
 
@@ -404,26 +746,160 @@ func (p *Process) infoMessage(cmd config.Cmd, hostAddr, hostName string) string
 	return infoMsg
 }
 
-// updateVars sets variables from command output to all commands environment in the same task.
+// updateVars sets variables from command output to all commands and handlers environment in the same task.
 func (p *Process) updateVars(vars map[string]string, cmd config.Cmd, tsk *config.Task) {
 	if len(vars) == 0 {
 		return
 	}
 
 	log.Printf("[DEBUG] set %d variables from command %q: %+v", len(vars), cmd.Name, vars)
-	for k, v := range vars {
-		for i, c := range tsk.Commands {
-			env := c.Environment
-			if env == nil {
-				env = make(map[string]string)
+	setEnv := func(cmds []config.Cmd) {
+		for k, v := range vars {
+			for i, c := range cmds {
+				env := c.Environment
+				if env == nil {
+					env = make(map[string]string)
+				}
+				if _, ok := env[k]; ok { // don't allow override variables
+					continue
+				}
+				env[k] = v
+				cmds[i].Environment = env
 			}
-			if _, ok := env[k]; ok { // don't allow override variables
-				continue
+		}
+	}
+	setEnv(tsk.Commands)
+	setEnv(tsk.Handlers)
+}
+
+// registerVars keeps variables registered on each host by the completed task, to be inherited by the next tasks
+func (p *Process) registerVars(reports []HostReport) {
+	p.registeredLock.Lock()
+	defer p.registeredLock.Unlock()
+	for _, r := range reports {
+		if len(r.Vars) == 0 {
+			continue
+		}
+		if p.registered == nil {
+			p.registered, p.registeredAll = map[string]vars{}, vars{}
+		}
+		if p.registered[r.Host] == nil {
+			p.registered[r.Host] = vars{}
+		}
+		prefix := hostVarsPrefix(r.Host, r.Name)
+		for k, v := range r.Vars {
+			p.registered[r.Host][k] = v
+			p.registeredAll[prefix+k] = v
+		}
+	}
+}
+
+// inheritedVars returns variables registered by the previous tasks for the host. Variables registered on the same host
+// are passed as is, variables registered on all hosts, including this one, are passed with the host prefix,
+// e.g. HOST_BUILD_VERSION for VERSION registered on host named "build".
+func (p *Process) inheritedVars(hostAddr string) vars {
+	p.registeredLock.Lock()
+	defer p.registeredLock.Unlock()
+	res := make(vars, len(p.registeredAll)+len(p.registered[hostAddr]))
+	for k, v := range p.registeredAll {
+		res[k] = v
+	}
+	for k, v := range p.registered[hostAddr] {
+		res[k] = v
+	}
+	return res
+}
+
+// hostVarsPrefix returns the prefix of variables registered on the host, made of the host name, or the host address
+// if the name is not set. All characters not allowed in variable names are replaced by underscores,
+// i.e. "HOST_WEB_1_" for "web-1" and "HOST_10_0_0_1_22_" for "10.0.0.1:22".
+func hostVarsPrefix(hostAddr, hostName string) string {
+	host := hostName
+	if host == "" {
+		host = hostAddr
+	}
+	return "HOST_" + strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(host)) + "_"
+}
+
+// inheritVars returns the command with variables registered by the previous tasks added to its environment.
+// Variables already set for the command by env, overrides, facts or registered by the task's commands are not changed.
+func inheritVars(c config.Cmd, inherited vars) config.Cmd {
+	if len(inherited) == 0 {
+		return c
+	}
+	env := make(map[string]string, len(c.Environment)+len(inherited))
+	for k, v := range inherited {
+		env[k] = v
+	}
+	for k, v := range c.Environment {
+		env[k] = v
+	}
+	c.Environment = env
+	return c
+}
+
+// cmdIteration is a single run of the command, with the loop item if the command has a loop
+type cmdIteration struct {
+	cmd  config.Cmd
+	item string
+}
+
+// name returns command name with the loop item, if any, used for reporting
+func (it cmdIteration) name() string {
+	if it.item == "" {
+		return it.cmd.Name
+	}
+	return fmt.Sprintf("%s [%s]", it.cmd.Name, it.item)
+}
+
+// loopVarRe matches loop item referring to a variable, i.e. $NAME, ${NAME} or {NAME}
+var loopVarRe = regexp.MustCompile(`^(?:\$\{(\w+)\}|\$(\w+)|\{(\w+)\})$`)
+
+// cmdIterations returns the list of command runs. Command without loop has a single iteration without item.
+// For command with loop, an item referring to a variable (i.e. $SERVICES) is expanded to the values of this variable,
+// split by commas and whitespaces. The variable is taken from the command's environment, which includes variables
+// registered by previous commands. Other items are used as is, after applying templates.
+// Each iteration has a copy of the command with SPOT_ITEM environment variable set to the item.
+func (p *Process) cmdIterations(cmd config.Cmd, hostAddr, hostName string, tsk *config.Task) ([]cmdIteration, error) {
+	if len(cmd.Loop) == 0 {
+		return []cmdIteration{{cmd: cmd}}, nil
+	}
+
+	tmpl := templater{hostAddr: hostAddr, hostName: hostName, task: tsk, command: cmd.Name, env: cmd.Environment}
+	items := []string{}
+	for _, item := range cmd.Loop {
+		m := loopVarRe.FindStringSubmatch(strings.TrimSpace(item))
+		if m == nil {
+			items = append(items, tmpl.apply(item))
+			continue
+		}
+		name := m[1] + m[2] + m[3]
+		val, ok := cmd.Environment[name]
+		if !ok {
+			if val = tmpl.apply(item); val == item { // not a predefined variable like SPOT_REMOTE_NAME either
+				return nil, fmt.Errorf("loop variable %q is not set", name)
 			}
-			env[k] = v
-			tsk.Commands[i].Environment = env
 		}
+		items = append(items, strings.FieldsFunc(val, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })...)
 	}
+
+	res := make([]cmdIteration, 0, len(items))
+	for _, item := range items {
+		c := cmd
+		c.Environment = make(map[string]string, len(cmd.Environment)+1)
+		for k, v := range cmd.Environment {
+			c.Environment[k] = v
+		}
+		c.Environment["SPOT_ITEM"] = item
+		res = append(res, cmdIteration{cmd: c, item: item})
+	}
+	log.Printf("[DEBUG] command %q has %d loop items: %v", cmd.Name, len(items), items)
+	return res, nil
 }
 
 // shouldRunCmd checks if the command should be executed on the host. If the command has no restrictions
@@ -448,6 +924,11 @@ func (p *Process) shouldRunCmd(cmd config.Cmd, hostName, hostAddr string) bool {
 		return false
 	}
 
+	return p.isOnlyOnHost(cmd, hostName, hostAddr)
+}
+
+// isOnlyOnHost checks if command should be executed on the host, based on the only_on option
+func (p *Process) isOnlyOnHost(cmd config.Cmd, hostName, hostAddr string) bool {
 	if len(cmd.Options.OnlyOn) == 0 {
 		return true
 	}
@@ -7,11 +7,14 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
@@ -638,6 +641,593 @@ func TestProcess_RunLocal(t *testing.T) {
 	assert.Contains(t, buf.String(), "run command \"show content\"")
 }
 
+func TestProcess_RunHandlers(t *testing.T) {
+	ctx := context.Background()
+	dst := t.TempDir()
+	conf, err := config.New("testdata/conf-handlers.yml", &config.Overrides{Environment: map[string]string{"DST": dst}}, nil)
+	require.NoError(t, err)
+
+	t.Run("notified handlers", func(t *testing.T) {
+		rep := &Report{}
+		stdout := captureStdOut(t, func() {
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil), Report: rep}
+			res, err := p.Run(ctx, "default", "localhost:22")
+			require.NoError(t, err)
+			assert.Equal(t, 5, res.Commands)
+		})
+		t.Log(stdout)
+		assert.Contains(t, stdout, `completed command "copy config" {copy: testdata/conf-handlers.yml -> `)
+		assert.Contains(t, stdout, `completed command "restart app" {script: `)
+		assert.NotContains(t, stdout, `completed command "reload app"`)
+
+		data, err := os.ReadFile(filepath.Join(dst, "handlers.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "restart 1.2.3\n", string(data), "restart app runs once, reload app skipped by only_on, cleanup not notified")
+
+		require.Len(t, rep.Tasks, 1)
+		require.Len(t, rep.Tasks[0].Hosts, 1)
+		statuses := map[string]Status{}
+		for _, c := range rep.Tasks[0].Hosts[0].Commands {
+			statuses[c.Name] = c.Status
+		}
+		assert.Equal(t, map[string]Status{"copy config": StatusChanged, "copy config again": StatusOk, "check updates": StatusOk,
+			"get version": StatusChanged, "restart app": StatusChanged, "reload app": StatusSkipped, "cleanup": StatusSkipped}, statuses)
+	})
+
+	t.Run("nothing changed", func(t *testing.T) {
+		p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, false, nil)}
+		res, err := p.Run(ctx, "default", "localhost:22")
+		require.NoError(t, err)
+		assert.Equal(t, 4, res.Commands, "no handlers executed")
+
+		data, err := os.ReadFile(filepath.Join(dst, "handlers.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "restart 1.2.3\n", string(data))
+	})
+
+	t.Run("identical sudo copy doesn't notify", func(t *testing.T) {
+		fakeSudo(t)
+		for i := 0; i < 2; i++ {
+			rep := &Report{}
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, false, nil), Report: rep}
+			_, err := p.Run(ctx, "sudo copy", "localhost:22")
+			require.NoError(t, err)
+			require.Len(t, rep.Tasks, 1)
+			expStatus := StatusChanged
+			if i > 0 {
+				expStatus = StatusOk
+			}
+			assert.Equal(t, expStatus, rep.Tasks[0].Hosts[0].Commands[0].Status, "run %d", i)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dst, "sudo-handlers.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "sudo restart\n", string(data), "handler notified by the first copy only")
+	})
+}
+
+func TestProcess_RunLoop(t *testing.T) {
+	ctx := context.Background()
+	dst := t.TempDir()
+	conf, err := config.New("testdata/conf-loop.yml", &config.Overrides{Environment: map[string]string{"DST": dst}}, nil)
+	require.NoError(t, err)
+
+	stdout := captureStdOut(t, func() {
+		p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+		res, err := p.Run(ctx, "default", "localhost:22")
+		require.NoError(t, err)
+		assert.Equal(t, 9, res.Commands)
+	})
+	t.Log(stdout)
+
+	data, err := os.ReadFile(filepath.Join(dst, "out.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "static a a\nstatic b b\nvar svc1\nvar svc2\ncond b\n", string(data))
+	assert.FileExists(t, filepath.Join(dst, "f1.yml"))
+	assert.FileExists(t, filepath.Join(dst, "f2.yml"))
+
+	assert.Contains(t, stdout, `completed command "static loop [a]"`)
+	assert.Contains(t, stdout, `completed command "static loop [b]"`)
+	assert.Contains(t, stdout, `completed command "var loop [svc2]"`)
+	assert.Contains(t, stdout, `completed command "cond loop [a]" {skip: cond loop} (`)
+	assert.Contains(t, stdout, fmt.Sprintf(`completed command "copy loop [f2]" {copy: testdata/conf-loop.yml -> %s/f2.yml} [changed]`, dst))
+}
+
+func TestProcess_RunReport(t *testing.T) {
+	conf, err := config.New("testdata/conf-report.yml", nil, nil)
+	require.NoError(t, err)
+
+	p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil), Report: &Report{}}
+	_, err = p.Run(context.Background(), "default", "localhost")
+	require.NoError(t, err)
+
+	require.Len(t, p.Report.Tasks, 1)
+	tsk := p.Report.Tasks[0]
+	assert.Equal(t, "default", tsk.Name)
+	assert.Equal(t, "localhost", tsk.Target)
+	assert.Equal(t, StatusChanged, tsk.Status)
+	assert.Empty(t, tsk.Error)
+	require.Len(t, tsk.Hosts, 1)
+
+	host := tsk.Hosts[0]
+	assert.Equal(t, "localhost:22", host.Host)
+	assert.Equal(t, StatusChanged, host.Status)
+	assert.Equal(t, map[string]string{"FOO": "bar"}, host.Vars)
+	assert.Positive(t, host.Duration)
+
+	type cmdRes struct {
+		name     string
+		status   Status
+		exitCode int
+		stdout   string
+		stderr   string
+	}
+	res := []cmdRes{}
+	for _, c := range host.Commands {
+		res = append(res, cmdRes{name: c.Name, status: c.Status, exitCode: c.ExitCode, stdout: c.Stdout, stderr: c.Stderr})
+	}
+	assert.Equal(t, []cmdRes{
+		{name: "register var", status: StatusChanged, stdout: "registering\n"},
+		{name: "skipped by cond", status: StatusSkipped},
+		{name: "skipped by filter", status: StatusSkipped},
+		{name: "ignored failure", status: StatusFailed, exitCode: 3, stderr: "oops\n"},
+		{name: "echo", status: StatusOk},
+	}, res)
+	assert.Equal(t, map[string]string{"FOO": "bar"}, host.Commands[0].Vars)
+	assert.Contains(t, host.Commands[3].Error, "exit status 3")
+	assert.True(t, host.Commands[3].Ignored)
+	assert.False(t, host.Commands[0].Ignored)
+}
+
+func TestProcess_RunBatches(t *testing.T) {
+	names := func(hosts []config.Destination) []string {
+		res := make([]string, 0, len(hosts))
+		for _, h := range hosts {
+			res = append(res, h.Name)
+		}
+		sort.Strings(res)
+		return res
+	}
+	batchNames := func(batches []BatchResp) (hosts, failed [][]string) {
+		for _, b := range batches {
+			hosts = append(hosts, names(b.Hosts))
+			failed = append(failed, names(b.Failed))
+		}
+		return hosts, failed
+	}
+	recorded := func(t *testing.T, dst string) []string {
+		data, err := os.ReadFile(filepath.Join(dst, "out.txt"))
+		require.NoError(t, err)
+		res := strings.Fields(string(data))
+		sort.Strings(res)
+		return res
+	}
+
+	tbl := []struct {
+		name, task, serial string
+		maxFail            int
+		err                string
+		hosts, failed      [][]string
+	}{
+		{name: "serial from task", task: "batch",
+			hosts:  [][]string{{"h1", "h2"}, {"h3", "h4"}, {"h5", "h6"}},
+			failed: [][]string{{}, {}, {}}},
+		{name: "serial from cli", task: "batch", serial: "3",
+			hosts:  [][]string{{"h1", "h2", "h3"}, {"h4", "h5", "h6"}},
+			failed: [][]string{{}, {}}},
+		{name: "percentage from cli", task: "batch", serial: "30%",
+			hosts:  [][]string{{"h1", "h2"}, {"h3", "h4"}, {"h5", "h6"}},
+			failed: [][]string{{}, {}, {}}},
+		{name: "threshold exceeded", task: "fail-threshold",
+			err: "failed 1 of 3 hosts, max fail percentage 20% exceeded: 1 error(s) occurred: " +
+				"[0] {failed command \"fail on h2\" on host h2:22 (h2): can't run script on h2:22: exit status 1}",
+			hosts:  [][]string{{"h1", "h2", "h3"}},
+			failed: [][]string{{"h2"}}},
+		{name: "threshold from cli", task: "fail-threshold", maxFail: 40,
+			hosts:  [][]string{{"h1", "h2", "h3"}, {"h4", "h5", "h6"}},
+			failed: [][]string{{"h2"}, {}}},
+		{name: "failures tolerated", task: "fail-tolerated",
+			hosts:  [][]string{{"h1", "h2"}, {"h3", "h4"}, {"h5", "h6"}},
+			failed: [][]string{{}, {"h4"}, {}}},
+		{name: "no threshold, stop on first failed batch", task: "fail-no-threshold",
+			err:    "1 error(s) occurred: [0] {failed command \"fail on h1\" on host h1:22 (h1): can't run script on h1:22: exit status 1}",
+			hosts:  [][]string{{"h1"}},
+			failed: [][]string{{"h1"}}},
+		{name: "invalid serial", task: "batch", serial: "0%",
+			err: "can't make batches for task batch: invalid serial \"0%\", percentage must be between 1% and 100%"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := t.TempDir()
+			conf, err := config.New("testdata/conf-batch.yml", &config.Overrides{Environment: map[string]string{"DST": dst}}, nil)
+			require.NoError(t, err)
+
+			p := Process{Concurrency: 2, Playbook: conf, Logs: executor.MakeLogs(false, true, nil),
+				Serial: tt.serial, MaxFailPercentage: tt.maxFail}
+			res, err := p.Run(context.Background(), tt.task, "six")
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+			} else {
+				require.NoError(t, err)
+			}
+			if tt.hosts == nil {
+				return
+			}
+
+			hosts, failed := batchNames(res.Batches)
+			assert.Equal(t, tt.hosts, hosts)
+			assert.Equal(t, tt.failed, failed)
+			var allHosts []string
+			for _, h := range hosts {
+				allHosts = append(allHosts, h...)
+			}
+			assert.Equal(t, len(allHosts), res.Hosts)
+			if tt.err == "" {
+				assert.Equal(t, 1, res.Commands)
+			}
+			assert.Equal(t, allHosts, recorded(t, dst), "only hosts of processed batches executed")
+		})
+	}
+}
+
+func TestProcess_RunKeepGoing(t *testing.T) {
+	readLines := func(t *testing.T, fname string) []string {
+		data, err := os.ReadFile(fname)
+		require.NoError(t, err)
+		res := strings.Fields(string(data))
+		sort.Strings(res)
+		return res
+	}
+	newProc := func(t *testing.T, dst string) *Process {
+		conf, err := config.New("testdata/conf-batch.yml", &config.Overrides{Environment: map[string]string{"DST": dst}}, nil)
+		require.NoError(t, err)
+		return &Process{Concurrency: 2, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+	}
+
+	t.Run("task keep_going runs all hosts, on_error per failed host", func(t *testing.T) {
+		dst := t.TempDir()
+		p := newProc(t, dst)
+		res, err := p.Run(context.Background(), "keep-going", "six")
+		require.Error(t, err)
+		var merr *multierror.Error
+		require.ErrorAs(t, err, &merr)
+		require.Len(t, merr.Errors, 2)
+		assert.Contains(t, merr.Errors[0].Error(), `failed command "fail on h2 and h5" on host h2:22 (h2)`)
+		assert.Contains(t, merr.Errors[1].Error(), `failed command "fail on h2 and h5" on host h5:22 (h5)`)
+		assert.Equal(t, 6, res.Hosts)
+		assert.Len(t, res.Batches, 3)
+		assert.Equal(t, []string{"h1", "h2", "h3", "h4", "h5", "h6"}, readLines(t, filepath.Join(dst, "out.txt")))
+		assert.Equal(t, []string{"h2", "h5"}, readLines(t, filepath.Join(dst, "errors.txt")))
+	})
+
+	t.Run("task keep_going skips failed hosts in the next tasks", func(t *testing.T) {
+		dst := t.TempDir()
+		p := newProc(t, dst)
+		_, err := p.Run(context.Background(), "keep-going", "six")
+		require.Error(t, err)
+
+		require.NoError(t, os.Remove(filepath.Join(dst, "out.txt")))
+		res, err := p.Run(context.Background(), "batch", "six")
+		require.NoError(t, err)
+		assert.Equal(t, 4, res.Hosts)
+		assert.Equal(t, []string{"h1", "h3", "h4", "h6"}, readLines(t, filepath.Join(dst, "out.txt")))
+	})
+
+	t.Run("keep-going flag skips failed hosts in the next tasks", func(t *testing.T) {
+		dst := t.TempDir()
+		p := newProc(t, dst)
+		p.KeepGoing = true
+		res, err := p.Run(context.Background(), "fail-no-threshold", "six")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "1 error occurred")
+		assert.Equal(t, 6, res.Hosts, "all batches executed")
+		assert.Len(t, res.Batches, 6)
+
+		require.NoError(t, os.Remove(filepath.Join(dst, "out.txt")))
+		res, err = p.Run(context.Background(), "batch", "six")
+		require.NoError(t, err)
+		assert.Equal(t, 5, res.Hosts)
+		assert.Equal(t, []string{"h2", "h3", "h4", "h5", "h6"}, readLines(t, filepath.Join(dst, "out.txt")))
+	})
+
+	t.Run("keep-going with max fail percentage", func(t *testing.T) {
+		dst := t.TempDir()
+		p := newProc(t, dst)
+		p.KeepGoing = true
+		res, err := p.Run(context.Background(), "fail-threshold", "six")
+		require.Error(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "failed 1 of 3 hosts, max fail percentage 20% exceeded: 1 error occurred"))
+		assert.Equal(t, 3, res.Hosts)
+	})
+
+	t.Run("failures within max fail percentage skip failed hosts in the next tasks", func(t *testing.T) {
+		dst := t.TempDir()
+		p := newProc(t, dst)
+		p.Report = &Report{}
+		res, err := p.Run(context.Background(), "fail-tolerated", "six")
+		require.NoError(t, err, "failure tolerated")
+		assert.Equal(t, 6, res.Hosts)
+		require.Len(t, p.Report.Tasks, 1)
+		assert.Equal(t, StatusFailed, p.Report.Tasks[0].Status, "task with tolerated failures reported as failed")
+		assert.Contains(t, p.Report.Tasks[0].Error, "failed 1 of 6 hosts, within max fail percentage")
+		assert.Contains(t, p.Report.Tasks[0].Error, "on host h4:22 (h4)")
+
+		require.NoError(t, os.Remove(filepath.Join(dst, "out.txt")))
+		res, err = p.Run(context.Background(), "batch", "six")
+		require.NoError(t, err)
+		assert.Equal(t, 5, res.Hosts)
+		assert.Equal(t, []string{"h1", "h2", "h3", "h5", "h6"}, readLines(t, filepath.Join(dst, "out.txt")))
+	})
+
+	t.Run("without keep-going the next batches are not executed", func(t *testing.T) {
+		dst := t.TempDir()
+		p := newProc(t, dst)
+		res, err := p.Run(context.Background(), "fail-no-threshold", "six")
+		require.Error(t, err)
+		assert.Equal(t, 1, res.Hosts)
+
+		res, err = p.Run(context.Background(), "batch", "six")
+		require.NoError(t, err)
+		assert.Equal(t, 6, res.Hosts, "failed hosts are not skipped")
+	})
+}
+
+func TestProcess_execCommandRetry(t *testing.T) {
+	// script fails until it runs the given number of times, counting runs in a file
+	flakyCmd := func(dir string, succeedOn int, retry config.RetryOptions) execCmd {
+		script := fmt.Sprintf("n=$(cat %s/count 2>/dev/null || echo 0); n=$((n+1)); echo $n > %s/count; test $n -ge %d",
+			dir, dir, succeedOn)
+		return execCmd{exec: executor.NewLocal(executor.MakeLogs(false, true, nil)), hostAddr: "localhost",
+			tsk: &config.Task{Name: "task1"}, cmd: config.Cmd{Name: "flaky", Script: script,
+				Options: config.CmdOptions{Local: true, Retry: retry}}}
+	}
+	count := func(t *testing.T, dir string) string {
+		data, err := os.ReadFile(filepath.Join(dir, "count"))
+		require.NoError(t, err)
+		return strings.TrimSpace(string(data))
+	}
+
+	t.Run("success after retries", func(t *testing.T) {
+		dir := t.TempDir()
+		var resp execCmdResp
+		st := time.Now()
+		stdout := captureStdOut(t, func() {
+			p := Process{Logs: executor.MakeLogs(false, true, nil)}
+			var err error
+			resp, err = p.execCommand(context.Background(), flakyCmd(dir, 3,
+				config.RetryOptions{Attempts: 5, Delay: 50 * time.Millisecond, Backoff: 2}))
+			require.NoError(t, err)
+		})
+		t.Log(stdout)
+		assert.Contains(t, resp.details, "{script: ")
+		assert.Equal(t, "3", count(t, dir))
+		assert.GreaterOrEqual(t, time.Since(st), 150*time.Millisecond, "50ms and 100ms delays")
+		assert.Contains(t, stdout, `failed command "flaky", attempt 1 of 5 (can't run script on localhost: exit status 1), retry in 50ms`)
+		assert.Contains(t, stdout, `retry command "flaky", attempt 2 of 5`)
+		assert.Contains(t, stdout, `failed command "flaky", attempt 2 of 5 (can't run script on localhost: exit status 1), retry in 100ms`)
+		assert.Contains(t, stdout, `retry command "flaky", attempt 3 of 5`)
+		assert.NotContains(t, stdout, `attempt 4 of 5`)
+	})
+
+	t.Run("failed all attempts", func(t *testing.T) {
+		dir := t.TempDir()
+		stdout := captureStdOut(t, func() {
+			p := Process{Logs: executor.MakeLogs(false, true, nil)}
+			_, err := p.execCommand(context.Background(), flakyCmd(dir, 10, config.RetryOptions{Attempts: 2}))
+			require.EqualError(t, err, "can't run script on localhost: exit status 1")
+			var execErr *execCmdErr
+			assert.ErrorAs(t, err, &execErr, "error of the last attempt is returned")
+		})
+		t.Log(stdout)
+		assert.Equal(t, "2", count(t, dir))
+		assert.Contains(t, stdout, `retry command "flaky", attempt 2 of 2`)
+	})
+
+	t.Run("no retry", func(t *testing.T) {
+		dir := t.TempDir()
+		p := Process{Logs: executor.MakeLogs(false, true, nil)}
+		_, err := p.execCommand(context.Background(), flakyCmd(dir, 2, config.RetryOptions{}))
+		require.Error(t, err)
+		assert.Equal(t, "1", count(t, dir))
+	})
+
+	t.Run("canceled context stops retries", func(t *testing.T) {
+		dir := t.TempDir()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		p := Process{Logs: executor.MakeLogs(false, true, nil)}
+		_, err := p.execCommand(ctx, flakyCmd(dir, 10, config.RetryOptions{Attempts: 5, Delay: time.Minute}))
+		require.EqualError(t, err, "can't run script on localhost: exit status 1")
+		assert.Equal(t, "1", count(t, dir))
+	})
+}
+
+func TestProcess_RunVarsFromPreviousTasks(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("vars registered on the same host", func(t *testing.T) {
+		conf, err := config.New("testdata/conf-vars.yml", nil, nil)
+		require.NoError(t, err)
+		stdout := captureStdOut(t, func() {
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+			_, err = p.Run(ctx, "build", "h1:22")
+			require.NoError(t, err)
+			res, err := p.Run(ctx, "deploy", "h1:22")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"VERSION": "v2"}, res.Vars, "only vars registered by the task")
+		})
+		t.Log(stdout)
+		assert.Contains(t, stdout, "version v-h1:22, build 42")
+		assert.Contains(t, stdout, "env build from-env")
+		assert.Contains(t, stdout, "new version v2", "registered by the task overrides inherited")
+	})
+
+	t.Run("overrides take precedence", func(t *testing.T) {
+		conf, err := config.New("testdata/conf-vars.yml", &config.Overrides{Environment: map[string]string{"BUILD": "from-cli"}}, nil)
+		require.NoError(t, err)
+		stdout := captureStdOut(t, func() {
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+			_, err = p.Run(ctx, "build", "h1:22")
+			require.NoError(t, err)
+			_, err = p.Run(ctx, "deploy", "h1:22")
+			require.NoError(t, err)
+		})
+		t.Log(stdout)
+		assert.Contains(t, stdout, "version v-h1:22, build from-cli")
+		assert.Contains(t, stdout, "env build from-cli")
+	})
+
+	t.Run("vars registered on different hosts", func(t *testing.T) {
+		conf, err := config.New("testdata/conf-vars.yml", nil, nil)
+		require.NoError(t, err)
+		stdout := captureStdOut(t, func() {
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+			_, err = p.Run(ctx, "build", "h1:22")
+			require.NoError(t, err)
+			_, err = p.Run(ctx, "build", "h2:22")
+			require.NoError(t, err)
+			_, err = p.Run(ctx, "deploy", "h1:22")
+			require.NoError(t, err)
+			_, err = p.Run(ctx, "deploy", "h2:22")
+			require.NoError(t, err)
+			_, err = p.Run(ctx, "deploy", "h3:22")
+			require.NoError(t, err)
+		})
+		t.Log(stdout)
+		assert.Contains(t, stdout, "[localhost] completed command \"show version\" {echo: version v-h1:22, build 42}",
+			"vars of h1")
+		assert.Contains(t, stdout, "[localhost] completed command \"show version\" {echo: version v-h2:22, build 42}",
+			"vars of h2")
+		assert.Equal(t, 1, strings.Count(stdout, "{echo: version v-h1:22,"), "unprefixed vars of h1 are not passed to other hosts")
+		assert.Equal(t, 1, strings.Count(stdout, "{echo: version v-h2:22,"), "unprefixed vars of h2 are not passed to other hosts")
+		assert.Contains(t, stdout, "[localhost] completed command \"show version\" {echo: version {VERSION}, build {BUILD}}",
+			"no vars registered on h3")
+		assert.Contains(t, stdout, "{echo: h1 version v-h1:22, h2 version v-h2:22}", "vars of all hosts with the host prefix")
+		assert.Contains(t, stdout, "{echo: h1 version v2, h2 version v-h2:22}", "h1 registered VERSION again on deploy")
+		assert.Contains(t, stdout, "{echo: h1 version v2, h2 version v2}", "h2 registered VERSION again on deploy")
+	})
+}
+
+func TestProcess_RunTimeout(t *testing.T) {
+	ctx := context.Background()
+	conf, err := config.New("testdata/conf-timeout.yml", nil, nil)
+	require.NoError(t, err)
+
+	t.Run("command timeout", func(t *testing.T) {
+		st := time.Now()
+		rep := &Report{}
+		stdout := captureStdOut(t, func() {
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil), Report: rep}
+			res, err := p.Run(ctx, "command timeout", "localhost:22")
+			require.NoError(t, err)
+			assert.Equal(t, 1, res.Commands)
+		})
+		t.Log(stdout)
+		assert.Less(t, time.Since(st), time.Second)
+		assert.Contains(t, stdout, `failed command "slow command"`)
+		assert.Contains(t, stdout, `completed command "fast command"`)
+		require.Len(t, rep.Tasks, 1)
+		require.Len(t, rep.Tasks[0].Hosts, 1)
+		require.Len(t, rep.Tasks[0].Hosts[0].Commands, 2)
+		assert.Equal(t, "command timeout 200ms exceeded: can't run script on localhost:22: timeout: context deadline exceeded",
+			rep.Tasks[0].Hosts[0].Commands[0].Error)
+	})
+
+	t.Run("task timeout", func(t *testing.T) {
+		st := time.Now()
+		stdout := captureStdOut(t, func() {
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+			_, err := p.Run(ctx, "task timeout", "localhost:22")
+			require.ErrorContains(t, err, `task "task timeout" timeout 300ms exceeded: failed command "slow command"`)
+			require.ErrorContains(t, err, "timeout: context deadline exceeded")
+		})
+		t.Log(stdout)
+		assert.Less(t, time.Since(st), time.Second)
+		assert.Contains(t, stdout, `completed command "fast command"`)
+		assert.NotContains(t, stdout, "never runs")
+	})
+}
+
+func TestProcess_execCommandTimeout(t *testing.T) {
+	ec := execCmd{exec: executor.NewLocal(executor.MakeLogs(false, false, nil)), hostAddr: "localhost",
+		tsk: &config.Task{Name: "task1"}, cmd: config.Cmd{Name: "slow", Script: "sleep 5",
+			Options: config.CmdOptions{Local: true, Timeout: 100 * time.Millisecond}}}
+	p := Process{Logs: executor.MakeLogs(false, false, nil)}
+
+	t.Run("timeout", func(t *testing.T) {
+		_, err := p.execCommand(context.Background(), ec)
+		require.EqualError(t, err, "command timeout 100ms exceeded: can't run script on localhost: timeout: context deadline exceeded")
+		var execErr *execCmdErr
+		assert.ErrorAs(t, err, &execErr)
+	})
+
+	t.Run("retried after timeout", func(t *testing.T) {
+		dir := t.TempDir()
+		ecRetry := ec
+		ecRetry.cmd.Script = fmt.Sprintf("echo x >> %s/count; if [ $(wc -l < %s/count) -lt 2 ]; then sleep 5; fi", dir, dir)
+		ecRetry.cmd.Options.Retry = config.RetryOptions{Attempts: 2}
+		_, err := p.execCommand(context.Background(), ecRetry)
+		require.NoError(t, err, "second attempt is fast")
+	})
+
+	t.Run("canceled by caller", func(t *testing.T) {
+		ecLong := ec
+		ecLong.cmd.Options.Timeout = time.Minute
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := p.execCommand(ctx, ecLong)
+		require.EqualError(t, err, "can't run script on localhost: timeout: context deadline exceeded", "not command's timeout")
+	})
+}
+
+func TestProcess_cmdIterations(t *testing.T) {
+	p := Process{}
+	tsk := &config.Task{Name: "task1"}
+	tbl := []struct {
+		name     string
+		cmd      config.Cmd
+		expected []string
+		err      string
+	}{
+		{"no loop", config.Cmd{Name: "c1"}, []string{""}, ""},
+		{"static items", config.Cmd{Name: "c1", Loop: config.LoopItems{"a", "b c"}}, []string{"a", "b c"}, ""},
+		{"templated items", config.Cmd{Name: "c1", Loop: config.LoopItems{"{SPOT_REMOTE_NAME}-a", "$FOO-b"},
+			Environment: map[string]string{"FOO": "foo"}}, []string{"h1-a", "foo-b"}, ""},
+		{"variable", config.Cmd{Name: "c1", Loop: config.LoopItems{"$FOO"},
+			Environment: map[string]string{"FOO": "a,b c\nd"}}, []string{"a", "b", "c", "d"}, ""},
+		{"variable with braces and static", config.Cmd{Name: "c1", Loop: config.LoopItems{"x", "${FOO}", "{BAR}"},
+			Environment: map[string]string{"FOO": "a b", "BAR": "c"}}, []string{"x", "a", "b", "c"}, ""},
+		{"predefined variable", config.Cmd{Name: "c1", Loop: config.LoopItems{"$SPOT_REMOTE_NAME"}}, []string{"h1"}, ""},
+		{"empty variable", config.Cmd{Name: "c1", Loop: config.LoopItems{"$FOO"},
+			Environment: map[string]string{"FOO": ""}}, []string{}, ""},
+		{"unknown variable", config.Cmd{Name: "c1", Loop: config.LoopItems{"$FOO"}}, nil, `loop variable "FOO" is not set`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := p.cmdIterations(tt.cmd, "h1.example.com:22", "h1", tsk)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			items := []string{}
+			for _, it := range res {
+				items = append(items, it.item)
+				if it.item == "" {
+					assert.Equal(t, tt.cmd, it.cmd, "command without loop is not changed")
+					continue
+				}
+				assert.Equal(t, it.item, it.cmd.Environment["SPOT_ITEM"])
+				assert.Equal(t, fmt.Sprintf("c1 [%s]", it.item), it.name())
+			}
+			assert.Equal(t, tt.expected, items)
+			assert.NotContains(t, tt.cmd.Environment, "SPOT_ITEM", "original env is not modified")
+		})
+	}
+}
+
 func TestProcess_RunFailed(t *testing.T) {
 	ctx := context.Background()
 	testingHostAndPort, teardown := startTestContainer(t)
@@ -818,6 +1408,21 @@ func TestProcess_RunTaskWithWait(t *testing.T) {
 	assert.Contains(t, buf.String(), "wait done")
 }
 
+func Test_hostVarsPrefix(t *testing.T) {
+	testCases := []struct {
+		hostAddr, hostName, expected string
+	}{
+		{hostAddr: "10.0.0.1:22", hostName: "build", expected: "HOST_BUILD_"},
+		{hostAddr: "10.0.0.1:22", hostName: "web-1.example.com", expected: "HOST_WEB_1_EXAMPLE_COM_"},
+		{hostAddr: "10.0.0.1:22", hostName: "", expected: "HOST_10_0_0_1_22_"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			assert.Equal(t, tc.expected, hostVarsPrefix(tc.hostAddr, tc.hostName))
+		})
+	}
+}
+
 func Test_shouldRunCmd(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -964,6 +1569,20 @@ func Test_shouldRunCmd(t *testing.T) {
 	}
 }
 
+func TestProcess_jumpHosts(t *testing.T) {
+	p := Process{}
+	assert.Nil(t, p.jumpHosts(config.Destination{Host: "h1", Port: 22}))
+
+	res := p.jumpHosts(config.Destination{Host: "h1", Port: 22, ProxyJump: []config.JumpHost{
+		{Host: "bastion1", Port: 2222, User: "user1", SSHKey: "key1"},
+		{Host: "bastion2.example.com", Name: "bastion2"},
+	}})
+	assert.Equal(t, []executor.JumpHost{
+		{Addr: "bastion1:2222", User: "user1", Key: "key1"},
+		{Addr: "bastion2.example.com", Name: "bastion2"},
+	}, res)
+}
+
 func TestGen(t *testing.T) {
 	mockPbook := &mocks.PlaybookMock{
 		TargetHostsFunc: func(string) ([]config.Destination, error) {
@@ -1012,7 +1631,7 @@ func TestGen(t *testing.T) {
 			tmplRdr := bytes.NewBufferString(tc.tmplInput)
 			respWr := &bytes.Buffer{}
 
-			err := p.Gen([]string{tc.target}, tmplRdr, respWr)
+			err := p.Gen(context.Background(), []string{tc.target}, tmplRdr, respWr)
 			if tc.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -1075,3 +1694,53 @@ func captureStdOut(t *testing.T, f func()) string {
 	io.Copy(&buf, r)
 	return buf.String()
 }
+
+func TestProcess_RunRegisterOutputAndRC(t *testing.T) {
+	ctx := context.Background()
+	conf, err := config.New("testdata/conf-register.yml", nil, nil)
+	require.NoError(t, err)
+
+	var res ProcResp
+	stdout := captureStdOut(t, func() {
+		p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+		res, err = p.Run(ctx, "register output and rc", "h1:22")
+		require.NoError(t, err)
+	})
+	t.Log(stdout)
+	assert.Equal(t, map[string]string{"GREETING": "hello world", "MULTI_OUT": "first\nsecond", "MULTI_RC": "3", "FAILED_RC": "1"},
+		res.Vars)
+	assert.Contains(t, stdout, "greeting [hello world], rc 3, failed rc 1")
+	assert.Contains(t, stdout, "multiline [first")
+	assert.Contains(t, stdout, "exited with 3")
+	assert.NotContains(t, stdout, "exited with 0")
+}
+
+func TestProcess_RunRegisterJSON(t *testing.T) {
+	ctx := context.Background()
+	conf, err := config.New("testdata/conf-register.yml", nil, nil)
+	require.NoError(t, err)
+
+	t.Run("json registered", func(t *testing.T) {
+		var res ProcResp
+		stdout := captureStdOut(t, func() {
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+			res, err = p.Run(ctx, "register json", "h1:22")
+			require.NoError(t, err)
+		})
+		t.Log(stdout)
+		assert.Equal(t, map[string]string{"HEALTH_status": "ok", "HEALTH_items_0_name": "web", "HEALTH_items_1_name": "db"}, res.Vars)
+		assert.Contains(t, stdout, `failed command "bad json ignored"`)
+		assert.Contains(t, stdout, "status ok, first web, second db")
+		assert.Contains(t, stdout, "service is up")
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		captureStdOut(t, func() {
+			p := Process{Concurrency: 1, Playbook: conf, Logs: executor.MakeLogs(false, true, nil)}
+			_, err = p.Run(ctx, "register bad json", "h1:22")
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `failed command "bad json"`)
+		assert.Contains(t, err.Error(), "can't register json output of script on h1:22: invalid json: invalid character 'b'")
+	})
+}